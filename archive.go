@@ -3,23 +3,31 @@
 
 import (
 	"archive/tar"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/containerd/log"
+	"github.com/klauspost/compress/zstd"
 	"github.com/moby/patternmatcher"
 	"github.com/moby/sys/sequential"
 	"github.com/moby/sys/user"
+	"github.com/pierrec/lz4/v4"
 
 	"github.com/moby/go-archive/compression"
 	"github.com/moby/go-archive/tarheader"
@@ -47,49 +55,478 @@
 	}
 
 	// TarOptions wraps the tar options.
+	//
+	// Fields that are not serialized to JSON, such as the callbacks, are not
+	// passed to the re-exec'd process used by the chrootarchive package on
+	// platforms other than Linux.
 	TarOptions struct {
 		// IncludeFiles lists archive-relative paths to include.
-		// Paths use POSIX ('/') separators.
+		// Paths use POSIX ('/') separators. Hardlinks are detected across
+		// all included paths: the first file of a set of hardlinks that is
+		// archived holds the content, and the others are written as
+		// hardlinks to its name in the archive.
 		IncludeFiles []string
 
 		// ExcludePatterns lists archive-relative exclude patterns.
-		// Patterns use POSIX ('/') separators, matching patternmatcher semantics.
+		// Patterns use POSIX ('/') separators, and are interpreted according
+		// to ExcludePatternSyntax.
 		ExcludePatterns []string
+		// ExcludePatternSyntax is the syntax of ExcludePatterns. It defaults
+		// to [PatternDefault], which uses patternmatcher semantics.
+		ExcludePatternSyntax PatternSyntax
+		// FileFilter, if set, is called by TarWithOptions for every file
+		// that is not excluded by ExcludePatterns, with its archive-relative
+		// path, using POSIX ('/') separators, and its file info. Files for
+		// which it returns false are skipped, and for directories, their
+		// content is skipped as well. Unlike ExcludePatterns, it also applies
+		// to the paths in IncludeFiles.
+		FileFilter func(path string, info os.FileInfo) bool `json:"-"`
+		// StripComponents makes Untar remove the given number of leading
+		// path components from the names of entries, like the
+		// --strip-components option of GNU tar. Entries with no more
+		// components than that are skipped. ExcludePatterns are matched
+		// against the names before stripping.
+		//
+		// The targets of hardlinks are stripped in the same way, and
+		// hardlinks to entries that are skipped are skipped. Relative
+		// symlink targets that resolve to a path within the archive are
+		// rewritten to point to the same entry after stripping. Other
+		// symlink targets are unchanged.
+		StripComponents int
 		Compression     compression.Compression
+		// CompressionLevel sets the level used by the compression algorithm
+		// when creating an archive. It is validated against the range accepted
+		// by Compression, and ignored if Compression is [compression.None].
+		// If nil, the default level of the compression algorithm is used.
+		CompressionLevel *int
+		// ParallelCompression makes TarWithOptions compress the archive in
+		// blocks that are compressed concurrently, which is faster for large
+		// archives on machines with multiple CPUs. The result is a single
+		// gzip stream, which is typically slightly larger than when compressed
+		// sequentially. It is only supported for [compression.Gzip], and
+		// ignored for other compression algorithms.
+		ParallelCompression bool
+		// CompressionConcurrency is the maximum number of blocks compressed
+		// concurrently if ParallelCompression is set. If zero, it defaults to
+		// GOMAXPROCS.
+		CompressionConcurrency int
+		// CompressionDict is a zstd dictionary, in the dictionary format
+		// produced by "zstd --train", which improves the compression of
+		// small archives with content similar to the dictionary. It is used
+		// by TarWithOptions if Compression is [compression.Zstd], and by
+		// Untar to decompress zstd archives compressed with it. Archives
+		// compressed without a dictionary can still be extracted.
+		CompressionDict []byte
 		// NoLchown disables applying ownership from the archive to extracted files
 		// and directories. Despite its historical name, it applies to all ownership
 		// changes, leaving extracted filesystem objects owned by the user performing
 		// the extraction.
-		NoLchown         bool
-		IDMap            user.IdentityMapping
-		ChownOpts        *ChownOpts
+		NoLchown  bool
+		IDMap     user.IdentityMapping
+		ChownOpts *ChownOpts
+		// ChownFunc, if set, returns the ownership of each entry, and takes
+		// precedence over ChownOpts. It is called by TarWithOptions to set
+		// the ownership in the header, and by Untar to set the ownership of
+		// the extracted file, unless NoLchown is set. In both cases, hdr has
+		// the ownership that would be used if ChownFunc and ChownOpts were
+		// not set, that is, after IDMap is applied. ChownFunc must not
+		// modify hdr.
+		ChownFunc func(hdr *tar.Header) (uid, gid int) `json:"-"`
+		// OwnerNames and GroupNames, if set, are used by TarWithOptions to
+		// set the user and group names of entries from their uid and gid,
+		// after ownership is determined with IDMap, ChownOpts, and
+		// ChownFunc. By default, and for ids that are not in the maps, the
+		// names are left empty, so that archives only record numeric
+		// ownership, which does not depend on the users and groups defined
+		// on the host extracting the archive. The names are also set when
+		// Deterministic is set, which otherwise clears them.
+		OwnerNames       map[int]string
+		GroupNames       map[int]string
 		IncludeSourceDir bool
 		// WhiteoutFormat is the expected on disk format for whiteout files.
 		// This format will be converted to the standard format on pack
-		// and from the standard format on unpack.
+		// and from the standard format on unpack. It is used by
+		// TarWithOptions, Untar, ExportChangesWithOptions, and
+		// ApplyUncompressedLayer.
 		WhiteoutFormat WhiteoutFormat
 		// When unpacking, specifies whether overwriting a directory with a
 		// non-directory is allowed and vice versa.
+		//
+		// This also applies to the parent directories of entries: if the
+		// parent of an entry exists as a non-directory, for example a file
+		// extracted from an earlier entry "a" followed by an entry "a/b",
+		// Untar fails with a "parent is not a directory" error if
+		// NoOverwriteDirNonDir is set, and otherwise replaces it with an
+		// implied directory. Archives created by TarWithOptions do not
+		// contain such entries, but archives concatenated from multiple
+		// sources, or crafted, may.
 		NoOverwriteDirNonDir bool
+		// SkipExisting makes Untar leave files that already exist in the
+		// destination untouched, if they are of the same type as the entry
+		// in the archive, for example to resume an interrupted extraction.
+		// Directories are still merged, and whiteouts are still applied.
+		SkipExisting bool
+		// SkipExistingMatchSizeAndModTime makes SkipExisting only skip
+		// regular files if their size and modification time also match
+		// the entry in the archive.
+		SkipExistingMatchSizeAndModTime bool
+		// DetectCaseCollisions makes Untar, UntarTo, and ValidateArchive
+		// fail with an error matching [ErrCaseCollision] if the names of two
+		// entries, or of their parent directories, differ only in case,
+		// such as "Foo" and "foo", which would overwrite each other on a
+		// case-insensitive filesystem, such as the default filesystems of
+		// macOS and Windows. Entries with the same name are not a collision.
+		DetectCaseCollisions bool
 		// For each include when creating an archive, the included name will be
 		// replaced with the matching name from this map.
 		RebaseNames map[string]string
 		InUserNS    bool
+		// ParentsFirst makes TarWithOptions write an entry for every parent
+		// directory before the entries within it, also for IncludeFiles and
+		// RebaseNames that select or rename entries within a directory.
+		// Parent directories that are not otherwise archived are archived
+		// from the source directory, or, for names that were rebased,
+		// written with [ImpliedDirectoryMode], owned by 0:0 unless ChownOpts
+		// or ChownFunc is set, and with the Unix epoch as modification time
+		// unless ModTimeOverride is set.
+		ParentsFirst bool
 		// Allow unpacking to succeed in spite of failures to set extended
 		// attributes on the unpacked files due to the destination filesystem
 		// not supporting them or a lack of permissions. Extended attributes
 		// were probably in the archive for a reason, so set this option at
 		// your own peril.
 		BestEffortXattrs bool
+		// PreserveACLs makes TarWithOptions store the POSIX ACLs of files
+		// ("system.posix_acl_access", and "system.posix_acl_default" for
+		// directories) as extended attributes in the archive. Like other
+		// extended attributes, ACLs in the archive are restored by Untar after
+		// setting ownership, as changing ownership can clear the ACL mask.
+		// The extended attributes of a directory, including its default ACL,
+		// are restored when its entry is extracted, and not deferred like its
+		// modification time, so that entries extracted into it afterward,
+		// including implied parent directories, inherit its default ACL.
+		// PreserveACLs is only supported on Linux, and ignored on other
+		// platforms.
+		PreserveACLs bool
+		// Xattrs makes TarWithOptions store all extended attributes of files
+		// that the process can read as "SCHILY.xattr." PAX records, instead
+		// of only "security.capability". Attributes that cannot be read,
+		// such as "trusted.*" attributes without CAP_SYS_ADMIN, are skipped.
+		// Xattrs is only supported on Linux, macOS, FreeBSD, and NetBSD, and
+		// ignored on other platforms.
+		Xattrs bool
+		// XattrAllow, if set, limits the extended attributes stored by
+		// TarWithOptions with Xattrs, and restored by Untar, to those with a
+		// name matching one of the patterns, using the syntax of
+		// [path.Match], for example "user.*".
+		XattrAllow []string
+		// XattrDeny excludes the extended attributes with a name matching
+		// one of the patterns from the ones stored by TarWithOptions with
+		// Xattrs, and restored by Untar. It takes precedence over XattrAllow.
+		XattrDeny []string
+		// XattrFilter, if set, is called by TarWithOptions and Untar with the
+		// name of each extended attribute to store or restore, including
+		// "security.capability" and ACLs, and the attribute is dropped if it
+		// returns false. It is applied in addition to XattrAllow and
+		// XattrDeny.
+		XattrFilter func(name string) bool `json:"-"`
+		// PreserveBirthTime makes TarWithOptions store the creation (birth)
+		// time of files in the "LIBARCHIVE.creationtime" PAX record used by
+		// bsdtar, and Untar restore it from that record. Creation times are
+		// read on Linux (if supported by the filesystem), macOS, and
+		// Windows, and restored on macOS and Windows. PreserveBirthTime is
+		// ignored on other platforms. The record is not stored if TarFormat
+		// is set to a format other than [tar.FormatPAX], or if Deterministic
+		// is set.
+		PreserveBirthTime bool
+		// PreserveSourceAtime makes TarWithOptions open the files it archives
+		// with O_NOATIME, so that reading their content does not update
+		// their access time. Files that the process is not permitted to open
+		// with O_NOATIME (files it does not own, without CAP_FOWNER) are
+		// opened normally. PreserveSourceAtime is only supported on Linux,
+		// and ignored on other platforms.
+		PreserveSourceAtime bool
+		// PreciseTimes makes TarWithOptions store the modification and
+		// access times of files with nanosecond precision in PAX records,
+		// instead of truncating the modification time to whole seconds and
+		// omitting the access time. Untar restores them at the precision
+		// supported by the platform. Access times are only stored on Linux.
+		// PreciseTimes is ignored if TarFormat is set to a format other than
+		// [tar.FormatPAX]; Deterministic and ModTimeOverride take precedence.
+		PreciseTimes bool
+		// PreserveFileFlags makes TarWithOptions store the file flags of
+		// regular files and directories that are set with chattr(1), such
+		// as the immutable, append-only, and nodump flags, in the
+		// "SCHILY.fflags" PAX record used by bsdtar, and Untar restore
+		// them once all entries are extracted. File flags are only
+		// supported on Linux, and ignored on filesystems that do not
+		// support them. Setting the immutable and append-only flags
+		// requires CAP_LINUX_IMMUTABLE; if it is not permitted, the flags
+		// are ignored and a warning is logged. The record is not stored if
+		// TarFormat is set to a format other than [tar.FormatPAX], or if
+		// Deterministic is set.
+		PreserveFileFlags bool
+		// FollowSymlinks makes TarWithOptions archive the files and
+		// directories that symlinks point to, instead of the symlinks
+		// themselves. Archiving fails with an error if a symlink loop is
+		// found, or if a symlink points outside of the source directory,
+		// unless FollowSymlinksOutsideSource is set.
+		FollowSymlinks bool
+		// FollowSymlinksOutsideSource allows FollowSymlinks to archive the
+		// targets of symlinks pointing outside of the source directory.
+		FollowSymlinksOutsideSource bool
+		// SkipSpecialFiles makes TarWithOptions skip block and character
+		// devices, named pipes, and sockets, and only archive regular files,
+		// directories, and symlinks, for example for archives to extract on
+		// Windows, or without the privileges to create devices.
+		SkipSpecialFiles bool
+		// OnSkippedFile, if set, is called by TarWithOptions for every file
+		// that is skipped because of its type: sockets, which cannot be
+		// stored in an archive and are always skipped, and the files skipped
+		// by SkipSpecialFiles. It is called with the archive-relative path
+		// of the file, using POSIX ('/') separators, and its file info.
+		OnSkippedFile func(path string, info os.FileInfo) `json:"-"`
+		// OnEntry, if set, is called by Untar after each entry is extracted,
+		// with the entry's header and the number of bytes of content written
+		// for it. It is not called for entries skipped by ExcludePatterns.
+		// Extraction is aborted if OnEntry returns an error.
+		OnEntry func(hdr *tar.Header, written int64) error `json:"-"`
+		// OnCheckpoint, if set, is called by Untar after each entry is
+		// extracted, after OnEntry, with a checkpoint from which extraction
+		// can be resumed with ResumeFrom if it is interrupted later.
+		// Extraction is aborted if OnCheckpoint returns an error.
+		OnCheckpoint func(Checkpoint) error `json:"-"`
+		// ResumeFrom, if set, makes Untar resume an extraction into the same
+		// destination from a checkpoint passed to OnCheckpoint. The archive
+		// must then be read from the checkpoint's HeaderOffset in the
+		// uncompressed archive, for example by seeking an uncompressed
+		// archive file to it, or by fetching the rest of it with an HTTP
+		// range request. It is read as an uncompressed archive, without
+		// detecting its compression: compressed archives cannot be resumed,
+		// as their content cannot be read from an offset in the uncompressed
+		// archive. The last entry extracted before the checkpoint is read
+		// first and skipped, and an error is returned if its name or size
+		// does not match the checkpoint.
+		//
+		// Other entries extracted before the checkpoint are not read again,
+		// so the modification times of directories extracted before it are not
+		// restored, and MaxEntries and MaxUncompressedSize only apply to the
+		// entries extracted after it.
+		ResumeFrom *Checkpoint
+		// OnOwnership, if set, makes Untar record the ownership of extracted
+		// files and directories instead of applying it, for example to apply
+		// it later from an id-shifting layer when extracting without the
+		// privileges to change ownership. It is called with the path of each
+		// entry, and of each parent directory created for it, relative to
+		// the destination and slash-separated, and the uid and gid that
+		// would be applied otherwise, that is, after IDMap, ChownOpts, and
+		// ChownFunc. Ownership is not applied when OnOwnership is set, and
+		// OnOwnership is called even if NoLchown is set.
+		OnOwnership func(path string, uid, gid int) `json:"-"`
+		// OnGlobalHeader, if set, is called by Untar with the PAX records of
+		// each PAX global extended header in the archive. Global headers are
+		// not extracted, and their records are not applied to other entries.
+		OnGlobalHeader func(records map[string]string) `json:"-"`
+		// MaxUncompressedSize limits the total number of bytes of file content
+		// extracted by Untar. Extraction is aborted with an error matching
+		// [ErrExtractionLimitExceeded] if the limit would be exceeded. Zero
+		// means no limit.
+		MaxUncompressedSize int64
+		// MaxEntries limits the number of entries (including directories and
+		// symlinks) extracted by Untar. Extraction is aborted with an error
+		// matching [ErrExtractionLimitExceeded] if the limit would be exceeded.
+		// Zero means no limit.
+		MaxEntries int
+		// MaxFileSize limits the size in bytes of each file extracted by
+		// Untar. Extraction is aborted with an error matching
+		// [ErrExtractionLimitExceeded] if the size of a file in its header
+		// exceeds the limit, or if more content than the limit is read for
+		// it. Zero means no limit.
+		MaxFileSize int64
+		// MaxPathDepth limits the number of path components of entries
+		// extracted by Untar, counted from the destination directory. For
+		// example, "a/b/c" has a depth of 3. Extraction is aborted with an
+		// error matching [ErrExtractionLimitExceeded] if an entry exceeds the
+		// limit. Zero means no limit.
+		MaxPathDepth int
+		// MaxPathLength limits the length in bytes of the on-disk path of
+		// entries extracted by Untar, including the destination directory.
+		// Extraction is aborted with an error matching
+		// [ErrExtractionLimitExceeded] if an entry exceeds the limit. Zero
+		// means no limit.
+		//
+		// When extracting using the chrootarchive package, the length is that
+		// of the path within the chroot.
+		MaxPathLength int
+		// Deterministic makes TarWithOptions produce identical output for
+		// identical directory content. When set, IncludeFiles are archived in
+		// sorted order, and for every entry the modification time is set to
+		// the Unix epoch, the access and change times and the user and group
+		// names are cleared, and PAX records other than extended attributes
+		// are removed. OwnerNames and GroupNames take precedence over
+		// clearing the user and group names.
+		Deterministic bool
+		// ModTimeOverride, if set, is used as modification time for all
+		// entries created by TarWithOptions, instead of the modification
+		// time of the files. It takes precedence over Deterministic.
+		ModTimeOverride *time.Time
+		// ForceMode, if set, is used by TarWithOptions as the mode of all
+		// regular files, instead of the mode of the files, for example to
+		// produce the same archive on Windows, where the mode is synthesized,
+		// and on other platforms. Only its permission bits are used; the
+		// setuid, setgid, and sticky bits are cleared.
+		ForceMode *os.FileMode
+		// ForceDirMode is ForceMode for directories, including the parent
+		// directories written for IncludeFiles.
+		ForceDirMode *os.FileMode
+		// Stats, if set, is populated by TarWithOptions with statistics about
+		// the entries written to the archive. The archive is produced
+		// asynchronously, so Stats is only complete once the archive returned
+		// by TarWithOptions has been read to the end.
+		Stats *TarStats `json:"-"`
+		// TarFormat, if set, is the format of all headers written by
+		// TarWithOptions. Entries that cannot be represented in this format,
+		// for example names that are too long for [tar.FormatUSTAR], or
+		// extended attributes with [tar.FormatGNU], are skipped and an error
+		// is logged, as for other files that cannot be archived. The default,
+		// [tar.FormatUnknown], uses PAX for headers that need it, and USTAR
+		// otherwise.
+		TarFormat tar.Format
+		// GNULongLinks makes TarWithOptions write entries with a name or
+		// link target longer than 100 bytes in [tar.FormatGNU], using
+		// "././@LongLink" entries, instead of in PAX, for consumers that do
+		// not support PAX. Entries that need PAX records, such as for
+		// extended attributes or sub-second timestamps, are still written
+		// in PAX. GNULongLinks is ignored if TarFormat is set.
+		GNULongLinks bool
+		// PAXLongNames makes TarWithOptions store names and link targets
+		// longer than 100 bytes in PAX "path" and "linkpath" records,
+		// instead of splitting names between the name and prefix fields of
+		// the USTAR format where they fit, for consumers that do not
+		// support the prefix field. PAXLongNames is ignored if TarFormat is
+		// set to a format other than [tar.FormatPAX], and takes precedence
+		// over GNULongLinks.
+		PAXLongNames bool
+		// DetectSparse makes TarWithOptions store regular files that contain
+		// holes as sparse files in the PAX format used by GNU tar, so that
+		// the holes are neither read nor stored. It is only supported on
+		// Linux, and ignored on other platforms, or if TarFormat is set to a
+		// format other than [tar.FormatPAX]. As the holes depend on how the
+		// filesystem allocates files, archives created with DetectSparse may
+		// not be reproducible, even with Deterministic.
+		//
+		// Untar always extracts sparse files by seeking over blocks of zeros
+		// instead of writing them.
+		DetectSparse bool
+		// Sparsify makes Untar seek over blocks of zeros in all regular
+		// files instead of writing them, so that they are stored as holes
+		// on filesystems that support sparse files. The content of the
+		// extracted files is not affected.
+		Sparsify bool
+		// ClearSpecialBits makes Untar clear the setuid, setgid, and sticky
+		// bits from the mode of extracted files and directories, for
+		// example to avoid creating setuid binaries when extracting
+		// untrusted archives. By default, the mode from the archive is
+		// applied as-is.
+		ClearSpecialBits bool
+		// ExtractUmask, if set, is applied by Untar to the permission bits
+		// of each extracted entry, and of the parent directories that are
+		// not in the archive, which are otherwise created with
+		// [ImpliedDirectoryMode] or ImpliedDirMode. For example, an ExtractUmask of 0o022
+		// extracts a file with mode 0o777 in the archive with mode 0o755.
+		// The umask of the process is applied in addition if NoLchown is
+		// set, as the mode of implied directories is then not re-applied.
+		ExtractUmask *os.FileMode
+		// ImpliedDirMode, if set, is the mode used by Untar for the parent
+		// directories of entries that are not in the archive, instead of
+		// [ImpliedDirectoryMode]. Only its permission bits are used. The mode
+		// of directories that are in the archive is not affected.
+		ImpliedDirMode *os.FileMode
+		// Retry, if set, makes Untar retry creating files and directories,
+		// and changing their ownership, if that fails with a transient
+		// error. By default, operations are not retried.
+		Retry *RetryPolicy
+		// OnDigest, if set, is called by TarWithOptions once the archive has
+		// been written, with the SHA-256 digest of the archive as returned by
+		// the reader (after compression, if any), and the SHA-256 digest of
+		// the uncompressed tar stream. It is called before the reader returns
+		// io.EOF, and not called if writing the archive failed.
+		OnDigest func(digest, uncompressedDigest [sha256.Size]byte) `json:"-"`
+		// StrictTypeflags makes Untar reject archives containing an entry
+		// with a type other than regular file, directory, symlink, hardlink,
+		// character or block device, FIFO, or PAX global header. The entry
+		// is rejected as soon as it is read, before the destination is
+		// modified for it, and even if it is excluded or stripped by other
+		// options. By default, such entries fail to extract only if they
+		// are not excluded.
+		StrictTypeflags bool
+		// CopyBufferSize, if set, is the size of the buffer used by
+		// TarWithOptions and Untar to copy the content of regular files,
+		// instead of the default of 32 KiB. Larger buffers reduce the number
+		// of system calls for large files. It is not used for sparse files.
+		CopyBufferSize int
+		// FlushPerEntry makes TarWithOptions flush the tar writer and the
+		// compressor after every entry, so that each entry can be read from
+		// the archive as soon as it is written, for example when streaming
+		// the archive to a consumer that processes entries as they arrive.
+		// By default, the compressor is only flushed when the archive is
+		// closed, as flushing it for every entry reduces the compression
+		// ratio, in particular for archives with many small files.
+		// FlushPerEntry is not supported with [compression.Bzip2], whose
+		// compressor cannot be flushed.
+		FlushPerEntry bool
+	}
+
+	// TarStats holds statistics about an archive created by TarWithOptions.
+	TarStats struct {
+		// RegularFiles is the number of regular files written with their
+		// content, excluding files written as hardlinks.
+		RegularFiles int
+		// Directories is the number of directories.
+		Directories int
+		// Symlinks is the number of symbolic links.
+		Symlinks int
+		// Hardlinks is the number of files written as a hardlink to a file
+		// earlier in the archive, instead of with their content.
+		Hardlinks int
+		// Bytes is the total size of the file content written.
+		Bytes int64
+		// PaddingBytes is the total size of the headers, including PAX and
+		// GNU extension headers, and of the padding of content to the tar
+		// block size. It excludes the end-of-archive marker.
+		PaddingBytes int64
 	}
 )
 
+// ErrExtractionLimitExceeded is returned when extracting an archive would
+// exceed the MaxUncompressedSize, MaxEntries, MaxFileSize, MaxPathDepth, or
+// MaxPathLength limits set in [TarOptions].
+var ErrExtractionLimitExceeded = errors.New("extraction limit exceeded")
+
+// ErrCaseCollision is returned when extracting an archive with
+// DetectCaseCollisions set in [TarOptions] finds entries whose names differ
+// only in case.
+var ErrCaseCollision = errors.New("entry names differ only in case")
+
 // Archiver implements the Archiver interface and allows the reuse of most utility functions of
 // this package with a pluggable Untar function. Also, to facilitate the passing of specific id
 // mappings for untar, an Archiver can be created with maps which will then be passed to Untar operations.
+//
+// An Archiver is safe for concurrent use by multiple goroutines if its Untar
+// function is, as [Untar] is, and its fields are not modified while it is in
+// use. Its methods do not share mutable state between calls.
 type Archiver struct {
 	Untar     func(io.Reader, string, *TarOptions) error
 	IDMapping user.IdentityMapping
+	// Retry, if set, is passed to Untar as [TarOptions.Retry].
+	Retry *RetryPolicy
+	// PreserveOwnership makes the copy and untar methods keep the numeric
+	// uid and gid of the source files, without remapping them with
+	// IDMapping. The destination directory created by CopyWithTar is owned
+	// by the owner of the source directory. Ownership set by the Untar
+	// function, such as with [TarOptions.ChownOpts], still takes
+	// precedence.
+	PreserveOwnership bool
 }
 
 // NewDefaultArchiver returns a new Archiver without any IdentityMapping
@@ -146,16 +583,87 @@ func IsArchivePath(filePath string) bool {
 	return err == nil
 }
 
+// IsArchive checks if the (possibly compressed) stream read from r starts
+// with a tar file header, like [IsArchivePath]. It reads only the data needed
+// to decompress the first header, and returns a reader that replays the data
+// read before reading the remainder of r.
+//
+// Streams compressed with xz, which is decompressed by an external command,
+// are only checked for the xz signature.
+func IsArchive(r io.Reader) (bool, io.Reader) {
+	var consumed bytes.Buffer
+	replay := func() io.Reader {
+		return io.MultiReader(&consumed, r)
+	}
+
+	// The decompressors are created here instead of using DecompressStream,
+	// which may read from r in the background, so that all data read is
+	// recorded when returning.
+	comp, rdr, err := compression.DetectReader(io.TeeReader(r, &consumed))
+	if err != nil {
+		return false, replay()
+	}
+	switch comp {
+	case compression.None:
+	case compression.Gzip:
+		gzr, err := gzip.NewReader(rdr)
+		if err != nil {
+			return false, replay()
+		}
+		rdr = gzr
+	case compression.Bzip2:
+		rdr = bzip2.NewReader(rdr)
+	case compression.Xz:
+		return true, replay()
+	case compression.Zstd:
+		zr, err := zstd.NewReader(rdr, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return false, replay()
+		}
+		defer zr.Close()
+		rdr = zr
+	case compression.Lz4:
+		rdr = lz4.NewReader(rdr)
+	default:
+		return false, replay()
+	}
+	_, err = tar.NewReader(rdr).Next()
+	return err == nil, replay()
+}
+
 // TarModifierFunc is a function that can be passed to ReplaceFileTarWrapper to
 // modify the contents or header of an entry in the archive. If the file already
 // exists in the archive the TarModifierFunc will be called with the Header and
 // a reader which will return the files content. If the file does not exist both
 // header and content will be nil.
+//
+// If the TarModifierFunc returns a nil header and no error, the entry is
+// removed from the archive, or not added if it does not exist.
 type TarModifierFunc func(path string, header *tar.Header, content io.Reader) (*tar.Header, []byte, error)
 
 // ReplaceFileTarWrapper converts inputTarStream to a new tar stream. Files in the
 // tar stream are modified if they match any of the keys in mods.
 func ReplaceFileTarWrapper(inputTarStream io.ReadCloser, mods map[string]TarModifierFunc) io.ReadCloser {
+	return replaceFileTarWrapper(inputTarStream, mods, false)
+}
+
+// RemoveFileTarWrapper converts inputTarStream to a new tar stream without the
+// entries matching any of paths. If removeDescendants is set, the contents of
+// removed directories are removed as well.
+func RemoveFileTarWrapper(inputTarStream io.ReadCloser, paths []string, removeDescendants bool) io.ReadCloser {
+	mods := make(map[string]TarModifierFunc, len(paths))
+	for _, p := range paths {
+		mods[p] = func(string, *tar.Header, io.Reader) (*tar.Header, []byte, error) {
+			return nil, nil, nil
+		}
+	}
+	return replaceFileTarWrapper(inputTarStream, mods, removeDescendants)
+}
+
+// replaceFileTarWrapper implements ReplaceFileTarWrapper. If removeDescendants
+// is set, and a modifier removes a directory, all entries within that
+// directory are removed as well.
+func replaceFileTarWrapper(inputTarStream io.ReadCloser, mods map[string]TarModifierFunc, removeDescendants bool) io.ReadCloser {
 	pipeReader, pipeWriter := io.Pipe()
 
 	go func() {
@@ -166,12 +674,19 @@ func ReplaceFileTarWrapper(inputTarStream io.ReadCloser, mods map[string]TarModi
 			_ = inputTarStream.Close()
 		}()
 
+		// removedDirs holds the directories removed by a modifier, with a
+		// trailing slash, if removeDescendants is set.
+		var removedDirs []string
+
 		modify := func(name string, original *tar.Header, modifier TarModifierFunc, tarReader io.Reader) error {
 			header, data, err := modifier(name, original, tarReader)
 			switch {
 			case err != nil:
 				return err
 			case header == nil:
+				if removeDescendants && original != nil && original.Typeflag == tar.TypeDir {
+					removedDirs = append(removedDirs, strings.TrimSuffix(name, "/")+"/")
+				}
 				return nil
 			}
 
@@ -202,6 +717,13 @@ func ReplaceFileTarWrapper(inputTarStream io.ReadCloser, mods map[string]TarModi
 				return
 			}
 
+			if slices.ContainsFunc(removedDirs, func(dir string) bool {
+				return strings.HasPrefix(originalHeader.Name, dir)
+			}) {
+				delete(mods, originalHeader.Name)
+				continue
+			}
+
 			modifier, ok := mods[originalHeader.Name]
 			if !ok {
 				// No modifiers for this file, copy the header and data
@@ -259,6 +781,10 @@ func FileInfoHeader(name string, fi os.FileInfo, link string) (*tar.Header, erro
 
 const paxSchilyXattr = "SCHILY.xattr."
 
+// paxFileFlags is the PAX record used by libarchive (bsdtar) and star to
+// store file flags, as a comma-separated list of flag names.
+const paxFileFlags = "SCHILY.fflags"
+
 // ReadSecurityXattrToTarHeader reads security.capability xattr from filesystem
 // to a tar header
 func ReadSecurityXattrToTarHeader(filePath string, hdr *tar.Header) error {
@@ -285,6 +811,81 @@ func ReadSecurityXattrToTarHeader(filePath string, hdr *tar.Header) error {
 	return nil
 }
 
+// readXattrsToTarHeader reads the extended attributes of the file at
+// filePath that are allowed by allow and deny, and stores them in hdr.
+// Attributes that the process is not permitted to read are skipped.
+// "security.capability" is left to [ReadSecurityXattrToTarHeader].
+func readXattrsToTarHeader(filePath string, hdr *tar.Header, allow, deny []string) error {
+	names, err := llistxattr(filePath)
+	if err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return nil
+		}
+		return err
+	}
+	for _, name := range names {
+		if name == "security.capability" || !xattrAllowed(name, allow, deny) {
+			continue
+		}
+		value, err := lgetxattr(filePath, name)
+		if err != nil {
+			if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.ENOTSUP) {
+				continue
+			}
+			return err
+		}
+		if value == nil {
+			continue
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxSchilyXattr+name] = string(value)
+	}
+	return nil
+}
+
+// xattrAllowed reports whether the extended attribute name matches one of
+// the allow patterns, if any, and none of the deny patterns.
+func xattrAllowed(name string, allow, deny []string) bool {
+	for _, pattern := range deny {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	for _, pattern := range allow {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filterXattrs removes the extended attributes for which filter returns
+// false from hdr.
+func filterXattrs(hdr *tar.Header, filter func(name string) bool) {
+	for key := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, paxSchilyXattr); ok && !filter(name) {
+			delete(hdr.PAXRecords, key)
+		}
+	}
+}
+
+// keepXattr reports whether the extended attribute name is to be restored
+// according to the XattrAllow, XattrDeny, and XattrFilter options.
+func keepXattr(options *TarOptions, name string) bool {
+	if options == nil {
+		return true
+	}
+	if !xattrAllowed(name, options.XattrAllow, options.XattrDeny) {
+		return false
+	}
+	return options.XattrFilter == nil || options.XattrFilter(name)
+}
+
 type tarWhiteoutConverter interface {
 	ConvertWrite(*tar.Header, string, os.FileInfo) (*tar.Header, error)
 	ConvertRead(*os.Root, *tar.Header, string) (bool, error)
@@ -293,6 +894,9 @@ type tarWhiteoutConverter interface {
 type tarAppender struct {
 	TarWriter *tar.Writer
 
+	// writer is the writer that TarWriter writes to.
+	writer *countingWriter
+
 	// for hardlink mapping
 	SeenFiles       map[uint64]string
 	IdentityMapping user.IdentityMapping
@@ -303,17 +907,110 @@ type tarAppender struct {
 	// by the AUFS standard are used as the tar whiteout
 	// standard.
 	WhiteoutConverter tarWhiteoutConverter
+
+	// Deterministic normalizes headers to produce reproducible archives.
+	Deterministic bool
+
+	// ModTimeOverride, if set, overrides the modification time of all entries.
+	ModTimeOverride *time.Time
+
+	// ForceMode and ForceDirMode, if set, override the mode of regular files
+	// and directories.
+	ForceMode    *os.FileMode
+	ForceDirMode *os.FileMode
+
+	// PreserveACLs stores POSIX ACLs as extended attributes.
+	PreserveACLs bool
+
+	// Xattrs stores all extended attributes allowed by XattrAllow and XattrDeny.
+	Xattrs     bool
+	XattrAllow []string
+	XattrDeny  []string
+
+	// XattrFilter, if set, drops the extended attributes it returns false for.
+	XattrFilter func(name string) bool
+
+	// PreserveBirthTime stores the creation time of files in a PAX record.
+	PreserveBirthTime bool
+
+	// PreserveSourceAtime opens files with O_NOATIME where permitted.
+	PreserveSourceAtime bool
+
+	// PreciseTimes stores modification and access times with nanosecond precision.
+	PreciseTimes bool
+
+	// PreserveFileFlags stores the file flags of files in a PAX record.
+	PreserveFileFlags bool
+
+	// FollowSymlinks archives the targets of symlinks instead of the symlinks.
+	FollowSymlinks bool
+
+	// SkipSpecialFiles skips devices, named pipes, and sockets.
+	SkipSpecialFiles bool
+
+	// OnSkippedFile, if set, is called for files skipped because of their
+	// type.
+	OnSkippedFile func(path string, info os.FileInfo)
+
+	// Stats, if set, is updated for every entry written.
+	Stats *TarStats
+
+	// Format, if set, is the format of all headers written.
+	Format tar.Format
+
+	// GNULongLinks writes headers with long names or link targets in GNU format.
+	GNULongLinks bool
+
+	// PAXLongNames writes long names and link targets in PAX records.
+	PAXLongNames bool
+
+	// CopyBufferSize, if set, is the size of the buffer used to copy content.
+	CopyBufferSize int
+
+	// FlushPerEntry flushes the tar writer and Flusher after every entry.
+	FlushPerEntry bool
+
+	// Flusher, if set, is the compressor to flush with FlushPerEntry.
+	Flusher interface{ Flush() error }
+
+	// ChownFunc, if set, overrides the ownership of all entries, including
+	// ChownOpts.
+	ChownFunc func(hdr *tar.Header) (uid, gid int)
+
+	// OwnerNames and GroupNames, if set, map ids to user and group names.
+	OwnerNames map[int]string
+	GroupNames map[int]string
+
+	// DetectSparse stores regular files with holes as sparse files.
+	DetectSparse bool
 }
 
 func newTarAppender(idMapping user.IdentityMapping, writer io.Writer, chownOpts *ChownOpts) *tarAppender {
+	cw := &countingWriter{Writer: writer}
 	return &tarAppender{
 		SeenFiles:       make(map[uint64]string),
-		TarWriter:       tar.NewWriter(writer),
+		TarWriter:       tar.NewWriter(cw),
+		writer:          cw,
 		IdentityMapping: idMapping,
 		ChownOpts:       chownOpts,
 	}
 }
 
+// normalizeHeader clears or normalizes all fields of hdr that may differ
+// between archives created from identical content.
+func normalizeHeader(hdr *tar.Header) {
+	hdr.ModTime = time.Unix(0, 0)
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.Uname = ""
+	hdr.Gname = ""
+	for key := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxSchilyXattr) {
+			delete(hdr.PAXRecords, key)
+		}
+	}
+}
+
 // canonicalTarName provides a platform-independent and consistent POSIX-style
 // path for files and directories to be archived regardless of the platform.
 func canonicalTarName(name string, isDir bool) string {
@@ -329,10 +1026,22 @@ func canonicalTarName(name string, isDir bool) string {
 // addTarFile adds to the tar archive a file from `srcPath` as `name`
 func (ta *tarAppender) addTarFile(srcPath, archivePath string) error {
 	archivePath = filepath.ToSlash(archivePath)
-	fi, err := os.Lstat(srcPath)
+	stat := os.Lstat
+	if ta.FollowSymlinks {
+		stat = os.Stat
+	}
+	fi, err := stat(srcPath)
 	if err != nil {
 		return err
 	}
+	if fi.Mode()&os.ModeSocket != 0 || ta.SkipSpecialFiles && isSpecialFile(fi) {
+		// Sockets are always skipped, as the tar format has no type for them.
+		log.G(context.TODO()).Debugf("Tar: skipping %s with mode %s", srcPath, fi.Mode().Type())
+		if ta.OnSkippedFile != nil {
+			ta.OnSkippedFile(archivePath, fi)
+		}
+		return nil
+	}
 
 	var link string
 	if fi.Mode()&os.ModeSymlink != 0 {
@@ -347,9 +1056,38 @@ func (ta *tarAppender) addTarFile(srcPath, archivePath string) error {
 	if err != nil {
 		return err
 	}
+	if ta.Xattrs {
+		if err := readXattrsToTarHeader(srcPath, hdr, ta.XattrAllow, ta.XattrDeny); err != nil {
+			return err
+		}
+	}
 	if err := ReadSecurityXattrToTarHeader(srcPath, hdr); err != nil {
 		return err
 	}
+	if ta.PreserveACLs {
+		if err := readACLXattrsToTarHeader(srcPath, hdr); err != nil {
+			return err
+		}
+	}
+	if ta.XattrFilter != nil {
+		filterXattrs(hdr, ta.XattrFilter)
+	}
+	if ta.PreciseTimes && (ta.Format == tar.FormatUnknown || ta.Format == tar.FormatPAX) {
+		hdr.ModTime = fi.ModTime()
+		if atime, ok := accessTime(fi); ok {
+			hdr.AccessTime = atime
+		}
+	}
+	if ta.PreserveBirthTime && (ta.Format == tar.FormatUnknown || ta.Format == tar.FormatPAX) {
+		if btime, ok := birthTime(srcPath, fi); ok {
+			setBirthTimeRecord(hdr, btime)
+		}
+	}
+	if ta.PreserveFileFlags && (ta.Format == tar.FormatUnknown || ta.Format == tar.FormatPAX) {
+		if err := readFileFlagsToTarHeader(srcPath, hdr); err != nil {
+			return err
+		}
+	}
 
 	// if it's not a directory and has more than 1 link,
 	// it's hard linked, so set the type flag accordingly
@@ -387,12 +1125,29 @@ func (ta *tarAppender) addTarFile(srcPath, archivePath string) error {
 		}
 	}
 
-	// explicitly override with ChownOpts
-	if ta.ChownOpts != nil {
+	// explicitly override with ChownOpts or ChownFunc
+	if ta.ChownFunc != nil {
+		hdr.Uid, hdr.Gid = ta.ChownFunc(hdr)
+	} else if ta.ChownOpts != nil {
 		hdr.Uid = ta.ChownOpts.UID
 		hdr.Gid = ta.ChownOpts.GID
 	}
 
+	if ta.ForceMode != nil && fi.Mode().IsRegular() {
+		hdr.Mode = int64(ta.ForceMode.Perm())
+	} else if ta.ForceDirMode != nil && fi.IsDir() {
+		hdr.Mode = int64(ta.ForceDirMode.Perm())
+	}
+
+	if ta.Deterministic {
+		normalizeHeader(hdr)
+	}
+	if ta.ModTimeOverride != nil {
+		hdr.ModTime = *ta.ModTimeOverride
+	}
+	hdr.Uname = ta.OwnerNames[hdr.Uid]
+	hdr.Gname = ta.GroupNames[hdr.Gid]
+
 	if ta.WhiteoutConverter != nil {
 		wo, err := ta.WhiteoutConverter.ConvertWrite(hdr, srcPath, fi)
 		if err != nil {
@@ -408,51 +1163,190 @@ func (ta *tarAppender) addTarFile(srcPath, archivePath string) error {
 			if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
 				return fmt.Errorf("tar: cannot use whiteout for non-empty file %q", hdr.Name)
 			}
-			if err := ta.TarWriter.WriteHeader(hdr); err != nil {
+			if err := ta.writeHeader(hdr); err != nil {
 				return err
 			}
 			hdr = wo
 		}
 	}
 
-	if err := ta.TarWriter.WriteHeader(hdr); err != nil {
+	if ta.DetectSparse && hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+		added, err := ta.addSparseFile(srcPath, hdr)
+		if err != nil {
+			return err
+		}
+		if added {
+			return ta.flushEntry()
+		}
+	}
+
+	if err := ta.writeHeader(hdr); err != nil {
 		return err
 	}
 
 	if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
-		// We use sequential file access to avoid depleting the standby list on
-		// Windows. On Linux, this equates to a regular os.Open.
-		file, err := sequential.Open(srcPath)
+		file, err := ta.openSource(srcPath)
 		if err != nil {
 			return err
 		}
 
-		err = copyWithBuffer(ta.TarWriter, file)
+		err = copyWithBufferSize(ta.TarWriter, file, ta.CopyBufferSize)
 		_ = file.Close()
 		if err != nil {
 			return err
 		}
 	}
 
+	return ta.flushEntry()
+}
+
+// flushEntry flushes the tar writer, completing the padding of the entry
+// written last, and ta.Flusher, if FlushPerEntry is set.
+func (ta *tarAppender) flushEntry() error {
+	if !ta.FlushPerEntry {
+		return nil
+	}
+	if err := ta.TarWriter.Flush(); err != nil {
+		return err
+	}
+	if ta.Flusher != nil {
+		return ta.Flusher.Flush()
+	}
+	return nil
+}
+
+// openSource opens the file at srcPath for reading its content.
+func (ta *tarAppender) openSource(srcPath string) (*os.File, error) {
+	if ta.PreserveSourceAtime {
+		return openNoAtime(srcPath)
+	}
+	// We use sequential file access to avoid depleting the standby list on
+	// Windows. On Linux, this equates to a regular os.Open.
+	return sequential.Open(srcPath)
+}
+
+// needsGNULongLink reports whether hdr has a name or link target that does not
+// fit in a USTAR header, and can be written in GNU format instead of PAX.
+func needsGNULongLink(hdr *tar.Header) bool {
+	const nameSize = 100 // size of the name and linkname fields in the header
+	if len(hdr.Name) <= nameSize && len(hdr.Linkname) <= nameSize {
+		return false
+	}
+	return len(hdr.PAXRecords) == 0 && hdr.ModTime.Nanosecond() == 0 && hdr.AccessTime.IsZero() && hdr.ChangeTime.IsZero()
+}
+
+// setPAXLongNames stores the name and link target of hdr in PAX records if
+// they are longer than the fields of the USTAR header, so that they are not
+// split between the name and prefix fields.
+func setPAXLongNames(hdr *tar.Header) {
+	const nameSize = 100 // size of the name and linkname fields in the header
+	for key, value := range map[string]string{"path": hdr.Name, "linkpath": hdr.Linkname} {
+		if len(value) <= nameSize {
+			continue
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[key] = value
+	}
+}
+
+// addImpliedDir writes an entry for a directory with the given name that is
+// not in the source, with the mode that Untar uses for directories that are
+// not in an archive.
+func (ta *tarAppender) addImpliedDir(name string) error {
+	hdr := &tar.Header{
+		Name:     canonicalTarName(name, true),
+		Typeflag: tar.TypeDir,
+		Mode:     chmodTarEntry(ImpliedDirectoryMode),
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	}
+	if ta.ForceDirMode != nil {
+		hdr.Mode = int64(ta.ForceDirMode.Perm())
+	}
+	if ta.ChownFunc != nil {
+		hdr.Uid, hdr.Gid = ta.ChownFunc(hdr)
+	} else if ta.ChownOpts != nil {
+		hdr.Uid = ta.ChownOpts.UID
+		hdr.Gid = ta.ChownOpts.GID
+	}
+	if ta.ModTimeOverride != nil {
+		hdr.ModTime = *ta.ModTimeOverride
+	}
+	return ta.writeHeader(hdr)
+}
+
+// writeHeader writes hdr in ta.Format, if set, and records it in ta.Stats.
+func (ta *tarAppender) writeHeader(hdr *tar.Header) error {
+	if ta.Format != tar.FormatUnknown {
+		hdr.Format = ta.Format
+	} else if ta.GNULongLinks && !ta.PAXLongNames && needsGNULongLink(hdr) {
+		hdr.Format = tar.FormatGNU
+	}
+	if ta.PAXLongNames && (hdr.Format == tar.FormatUnknown || hdr.Format == tar.FormatPAX) {
+		setPAXLongNames(hdr)
+	}
+	if ta.Stats != nil {
+		// Complete the padding of the previous entry, so that only the
+		// header blocks of hdr are counted.
+		if err := ta.TarWriter.Flush(); err != nil {
+			return err
+		}
+	}
+	start := ta.writer.n
+	if err := ta.TarWriter.WriteHeader(hdr); err != nil {
+		return err
+	}
+	ta.updateStats(hdr, ta.writer.n-start+(-hdr.Size&(blockSize-1)))
 	return nil
 }
 
+// updateStats records hdr in ta.Stats, if set, with padding, the size of its
+// headers and of the padding of its content. Content is always written in
+// full after the header, so hdr.Size is counted as written.
+func (ta *tarAppender) updateStats(hdr *tar.Header, padding int64) {
+	if ta.Stats == nil {
+		return
+	}
+	ta.Stats.PaddingBytes += padding
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		ta.Stats.RegularFiles++
+		ta.Stats.Bytes += hdr.Size
+	case tar.TypeDir:
+		ta.Stats.Directories++
+	case tar.TypeSymlink:
+		ta.Stats.Symlinks++
+	case tar.TypeLink:
+		ta.Stats.Hardlinks++
+	}
+}
+
+// specialModeBits are the setuid, setgid, and sticky bits in the mode of a
+// tar header.
+const specialModeBits = 0o7000
+
 // createTarFile extracts a single tar entry into the given root. dstPath is the
 // root-relative path of the entry being extracted, in native (host-separator)
-// form so it can be passed directly to os.Root methods and fsRootPath.
+// form.
 func createTarFile(root *os.Root, dstPath string, hdr *tar.Header, reader io.Reader, opts *TarOptions) error {
-	var (
-		Lchown                     = true
-		inUserns, bestEffortXattrs bool
-		chownOpts                  *ChownOpts
-	)
-
 	// TODO(thaJeztah): make opts a required argument.
-	if opts != nil {
-		Lchown = !opts.NoLchown
-		inUserns = opts.InUserNS // TODO(thaJeztah): consider deprecating opts.InUserNS and detect locally.
-		chownOpts = opts.ChownOpts
-		bestEffortXattrs = opts.BestEffortXattrs
+	if opts == nil {
+		opts = &TarOptions{}
+	}
+	return extractEntry(&OSTarget{root: root}, filepath.ToSlash(dstPath), hdr, reader, opts)
+}
+
+// extractEntry extracts a single tar entry to t. name is the target-relative
+// name of the entry, which must not exist.
+func extractEntry(t Target, name string, hdr *tar.Header, reader io.Reader, opts *TarOptions) error {
+	dt, _ := t.(diskTarget)
+	if opts.ClearSpecialBits {
+		hdr.Mode &^= specialModeBits
+	}
+	if opts.ExtractUmask != nil {
+		hdr.Mode &^= int64(*opts.ExtractUmask & os.ModePerm)
 	}
 
 	// hdr.Mode is in linux format, which we can use for sycalls,
@@ -463,46 +1357,53 @@ func createTarFile(root *os.Root, dstPath string, hdr *tar.Header, reader io.Rea
 	switch hdr.Typeflag {
 	case tar.TypeDir:
 		// Create directory unless it already exists as one; merge in that case.
-		// os.Root.Mkdir only accepts the nine least-significant permission
-		// bits; special bits (setuid, setgid, sticky) are applied afterward
-		// by handleLChmod via root.Chmod.
-		if fi, err := root.Lstat(dstPath); err != nil || !fi.IsDir() {
-			if err := root.Mkdir(dstPath, hdrInfo.Mode()&0o777); err != nil {
+		// Special bits (setuid, setgid, sticky) are applied afterward by Chmod.
+		if fi, err := t.Lstat(name); err != nil || !fi.IsDir() {
+			if err := opts.Retry.do(func() error {
+				return t.Mkdir(name, hdrInfo.Mode())
+			}); err != nil {
 				return err
 			}
 		}
 
 	case tar.TypeReg:
-		// Source is a regular file. Use os.Root.OpenFile so that all
-		// path resolution is bounded within root using openat(2) semantics.
-		// os.Root.OpenFile only accepts the nine least-significant permission
-		// bits; special bits are applied afterward by handleLChmod.
-		// We use sequential file access to avoid depleting the standby list
-		// on Windows (go1.26). On Linux, this equates to a regular os.OpenFile.
-		file, err := root.OpenFile(dstPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|windows_O_FILE_FLAG_SEQUENTIAL_SCAN, hdrInfo.Mode()&0o777)
-		if err != nil {
-			return err
+		// Never copy more than hdr.Size bytes, and verify that exactly that
+		// many bytes were provided, so that the size limits checked against
+		// the header hold, whatever reader is used.
+		content := &countingReader{Reader: io.LimitReader(reader, hdr.Size)}
+		var err error
+		if dt != nil {
+			err = dt.writeFile(name, content, hdrInfo.Mode(), hdr.Size, opts.Sparsify || isSparseHeader(hdr), opts)
+		} else {
+			err = t.WriteFile(name, content, hdrInfo.Mode())
 		}
-		if err := copyWithBuffer(file, reader); err != nil {
-			_ = file.Close()
+		if err == nil {
+			err = checkContentSize(hdr, content.n, reader)
+		}
+		if err != nil {
 			return err
 		}
-		_ = file.Close()
 
 	case tar.TypeBlock, tar.TypeChar:
-		if inUserns { // cannot create devices in a userns
-			log.G(context.TODO()).WithFields(log.Fields{"path": dstPath, "type": hdr.Typeflag}).Debug("skipping device nodes in a userns")
+		if opts.InUserNS { // cannot create devices in a userns
+			log.G(context.TODO()).WithFields(log.Fields{"path": name, "type": hdr.Typeflag}).Debug("skipping device nodes in a userns")
 			return nil
 		}
-		if err := handleTarTypeBlockCharFifo(root, hdr, dstPath); err != nil {
+		if dt == nil {
+			return fmt.Errorf("%s entries are not supported by the target", typeflagName(hdr.Typeflag))
+		}
+		if err := dt.mknod(name, hdr); err != nil {
 			return err
 		}
 
 	case tar.TypeFifo:
-		if err := handleTarTypeBlockCharFifo(root, hdr, dstPath); err != nil {
-			if inUserns && errors.Is(err, syscall.EPERM) {
+		if dt == nil {
+			return fmt.Errorf("%s entries are not supported by the target", typeflagName(hdr.Typeflag))
+		}
+		if err := dt.mknod(name, hdr); err != nil {
+			if opts.InUserNS && errors.Is(err, syscall.EPERM) {
 				// In most cases, cannot create a fifo if running in user namespace
-				log.G(context.TODO()).WithFields(log.Fields{"error": err, "path": dstPath, "type": hdr.Typeflag}).Debug("creating fifo node in a userns")
+				log.G(context.TODO()).WithFields(log.Fields{"error": err, "path": name, "type": hdr.Typeflag}).Debug("creating fifo node in a userns")
 				return nil
 			}
 			return err
@@ -512,26 +1413,17 @@ func createTarFile(root *os.Root, dstPath string, hdr *tar.Header, reader io.Rea
 		// Defence in depth: root.Link's containment is limited when
 		// dest is a volume root.
 		linkname := path.Clean(hdr.Linkname)
-		if linkname == "." || !filepath.IsLocal(linkname) {
+		if linkname == "." || !filepath.IsLocal(linkname) || isWindowsAbs(linkname) {
 			return breakoutError(fmt.Errorf("invalid hardlink target %q", hdr.Linkname))
 		}
-		if err := root.Link(filepath.FromSlash(linkname), dstPath); err != nil {
+		if err := t.Link(linkname, name); err != nil {
 			return err
 		}
 
 	case tar.TypeSymlink:
 		// Symlink targets are archive data, not filesystem paths. Preserve the
 		// target verbatim rather than cleaning or converting it (filepath.FromSlash).
-		linkTarget := hdr.Linkname
-
-		// os.Root.Symlink contains the symlink's location (newname) within
-		// root but stores the target (oldname) verbatim, so absolute targets
-		// such as /usr/lib -- common and legitimate in container images -- are
-		// preserved rather than rejected. The symlink node is therefore always
-		// created within root via openat(2) semantics, without resolving to an
-		// absolute path; containment applies when the symlink is followed, not
-		// at creation.
-		if err := root.Symlink(linkTarget, dstPath); err != nil {
+		if err := t.Symlink(hdr.Linkname, name); err != nil {
 			return err
 		}
 
@@ -540,40 +1432,38 @@ func createTarFile(root *os.Root, dstPath string, hdr *tar.Header, reader io.Rea
 		return nil
 
 	default:
-		return fmt.Errorf("unhandled tar header type %d", hdr.Typeflag)
+		return unsupportedTypeflagError(hdr)
 	}
 
-	// Lchown is not supported on Windows.
-	if Lchown && runtime.GOOS != "windows" {
-		if chownOpts == nil {
-			chownOpts = &ChownOpts{UID: hdr.Uid, GID: hdr.Gid}
+	// Lchown is a no-op for an OSTarget on Windows.
+	if !opts.NoLchown || opts.OnOwnership != nil {
+		uid, gid := hdr.Uid, hdr.Gid
+		if opts.ChownFunc != nil {
+			uid, gid = opts.ChownFunc(hdr)
+		} else if opts.ChownOpts != nil {
+			uid, gid = opts.ChownOpts.UID, opts.ChownOpts.GID
 		}
-		if err := root.Lchown(dstPath, chownOpts.UID, chownOpts.GID); err != nil {
+		if opts.OnOwnership != nil {
+			opts.OnOwnership(name, uid, gid)
+		} else if err := opts.Retry.do(func() error {
+			return t.Lchown(name, uid, gid)
+		}); err != nil {
 			var msg string
-			if inUserns && errors.Is(err, syscall.EINVAL) {
+			if opts.InUserNS && errors.Is(err, syscall.EINVAL) {
 				msg = " (try increasing the number of subordinate IDs in /etc/subuid and /etc/subgid)"
 			}
-			return fmt.Errorf("failed to Lchown %q for UID %d, GID %d%s: %w", dstPath, hdr.Uid, hdr.Gid, msg, err)
+			return fmt.Errorf("failed to Lchown %q for UID %d, GID %d%s: %w", name, uid, gid, msg, err)
 		}
 	}
 
 	var xattrErrs []string
-	absPath := sync.OnceValues(func() (string, error) {
-		return fsRootPath(root.Name(), dstPath)
-	})
 	for key, value := range hdr.PAXRecords {
 		xattr, ok := strings.CutPrefix(key, paxSchilyXattr)
-		if !ok {
+		if !ok || !keepXattr(opts, xattr) {
 			continue
 		}
-		// os.Root has no xattr support; use the absolute path derived from
-		// the root so the path remains bounded.
-		ap, err := absPath()
-		if err != nil {
-			return err
-		}
-		if err := lsetxattr(ap, xattr, []byte(value), 0); err != nil {
-			if bestEffortXattrs && errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EPERM) {
+		if err := t.Setxattr(name, xattr, []byte(value)); err != nil {
+			if opts.BestEffortXattrs && errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EPERM) {
 				// EPERM occurs if modifying xattrs is not allowed. This can
 				// happen when running in userns with restrictions (ChromeOS).
 				xattrErrs = append(xattrErrs, err.Error())
@@ -589,34 +1479,44 @@ func createTarFile(root *os.Root, dstPath string, hdr *tar.Header, reader io.Rea
 		}).Warn("ignored xattrs in archive: underlying filesystem doesn't support them")
 	}
 
-	// There is no LChmod, so ignore mode for symlink. Also, this
+	// A hardlink to a symlink is a symlink itself.
+	isSymlink := hdr.Typeflag == tar.TypeSymlink
+	if hdr.Typeflag == tar.TypeLink {
+		fi, err := t.Lstat(name)
+		if err != nil {
+			return err
+		}
+		isSymlink = fi.Mode()&os.ModeSymlink != 0
+	}
+
+	// There is no lchmod, so ignore mode for symlinks. Also, this
 	// must happen after chown, as that can modify the file mode
-	if err := handleLChmod(root, dstPath, hdr, hdrInfo); err != nil {
-		return err
+	if !isSymlink {
+		if err := t.Chmod(name, hdrInfo.Mode()); err != nil {
+			return err
+		}
 	}
 
 	aTime := boundTime(latestTime(hdr.AccessTime, hdr.ModTime))
 	mTime := boundTime(hdr.ModTime)
 
-	switch hdr.Typeflag {
-	case tar.TypeSymlink:
+	switch {
+	case hdr.Typeflag == tar.TypeSymlink:
 		// Apply timestamps to the symlink itself (AT_SYMLINK_NOFOLLOW).
-		if err := lchtimes(root, dstPath, aTime, mTime); err != nil {
-			return err
-		}
-	case tar.TypeLink:
-		// Follow the hardlink only when its target is not itself a symlink.
-		fi, err := root.Lstat(filepath.FromSlash(path.Clean(hdr.Linkname)))
-		if err == nil && fi.Mode()&os.ModeSymlink == 0 {
-			if err := root.Chtimes(dstPath, aTime, mTime); err != nil {
+		return t.Lchtimes(name, aTime, mTime)
+	case isSymlink:
+		// Leave the timestamps of hardlinks to symlinks as they are.
+		return nil
+	}
+	if err := t.Chtimes(name, aTime, mTime); err != nil {
+		return err
+	}
+	if opts.PreserveBirthTime && dt != nil && hdr.Typeflag != tar.TypeLink {
+		if btime, ok := birthTimeRecord(hdr); ok {
+			if err := dt.setBirthTime(name, btime); err != nil {
 				return err
 			}
 		}
-	default:
-		// All other file types follow symlinks.
-		if err := root.Chtimes(dstPath, aTime, mTime); err != nil {
-			return err
-		}
 	}
 	return nil
 }
@@ -648,19 +1548,38 @@ type Tarballer struct {
 	pipeWriter        *io.PipeWriter
 	compressWriter    io.WriteCloser
 	whiteoutConverter tarWhiteoutConverter
+
+	// manifest, if set, holds the entries to archive instead of srcPath,
+	// for TarFromManifest.
+	manifest []ManifestEntry
+
+	// digest and uncompressedDigest hash the compressed and uncompressed
+	// archive if options.OnDigest is set.
+	digest             hash.Hash
+	uncompressedDigest hash.Hash
 }
 
 // NewTarballer constructs a new tarballer. The arguments are the same as for
 // TarWithOptions.
 func NewTarballer(srcPath string, options *TarOptions) (*Tarballer, error) {
-	pm, err := patternmatcher.New(options.ExcludePatterns)
+	pm, err := newExcludeMatcher(options)
 	if err != nil {
 		return nil, err
 	}
+	if options.FlushPerEntry && options.Compression == compression.Bzip2 {
+		return nil, fmt.Errorf("FlushPerEntry is not supported with %s compression", options.Compression.Extension())
+	}
 
 	pipeReader, pipeWriter := io.Pipe()
 
-	compressWriter, err := compression.CompressStream(pipeWriter, options.Compression)
+	var dest io.Writer = pipeWriter
+	var digest, uncompressedDigest hash.Hash
+	if options.OnDigest != nil {
+		digest, uncompressedDigest = sha256.New(), sha256.New()
+		dest = io.MultiWriter(pipeWriter, digest)
+	}
+
+	compressWriter, err := compressStream(dest, options)
 	if err != nil {
 		return nil, err
 	}
@@ -668,16 +1587,37 @@ func NewTarballer(srcPath string, options *TarOptions) (*Tarballer, error) {
 	return &Tarballer{
 		// Fix the source path to work with long path names. This is a no-op
 		// on platforms other than Windows.
-		srcPath:           addLongPathPrefix(srcPath),
-		options:           options,
-		pm:                pm,
-		pipeReader:        pipeReader,
-		pipeWriter:        pipeWriter,
-		compressWriter:    compressWriter,
-		whiteoutConverter: getWhiteoutConverter(options.WhiteoutFormat),
+		srcPath:            addLongPathPrefix(srcPath),
+		options:            options,
+		pm:                 pm,
+		pipeReader:         pipeReader,
+		pipeWriter:         pipeWriter,
+		compressWriter:     compressWriter,
+		whiteoutConverter:  getWhiteoutConverter(options.WhiteoutFormat),
+		digest:             digest,
+		uncompressedDigest: uncompressedDigest,
 	}, nil
 }
 
+// compressStream wraps dest with the compression algorithm and level
+// configured in options.
+func compressStream(dest io.Writer, options *TarOptions) (io.WriteCloser, error) {
+	if options.ParallelCompression && options.Compression == compression.Gzip {
+		level := gzip.DefaultCompression
+		if options.CompressionLevel != nil {
+			level = *options.CompressionLevel
+		}
+		return compression.NewParallelGzipWriter(dest, level, options.CompressionConcurrency)
+	}
+	if options.CompressionDict != nil && options.Compression == compression.Zstd {
+		return compression.CompressStreamZstdDict(dest, options.CompressionLevel, options.CompressionDict)
+	}
+	if options.CompressionLevel != nil {
+		return compression.CompressStreamLevel(dest, options.Compression, *options.CompressionLevel)
+	}
+	return compression.CompressStream(dest, options.Compression)
+}
+
 // Reader returns the reader for the created archive.
 func (t *Tarballer) Reader() io.ReadCloser {
 	return t.pipeReader
@@ -687,20 +1627,59 @@ func (t *Tarballer) Reader() io.ReadCloser {
 // can be read from t.Reader(). Do should only be called once on each Tarballer
 // instance.
 func (t *Tarballer) Do() {
+	var tarWriter io.Writer = t.compressWriter
+	if t.uncompressedDigest != nil {
+		tarWriter = io.MultiWriter(t.compressWriter, t.uncompressedDigest)
+	}
 	ta := newTarAppender(
 		t.options.IDMap,
-		t.compressWriter,
+		tarWriter,
 		t.options.ChownOpts,
 	)
 	ta.WhiteoutConverter = t.whiteoutConverter
+	ta.Deterministic = t.options.Deterministic
+	ta.ModTimeOverride = t.options.ModTimeOverride
+	ta.ForceMode = t.options.ForceMode
+	ta.ForceDirMode = t.options.ForceDirMode
+	ta.PreserveACLs = t.options.PreserveACLs
+	ta.Xattrs = t.options.Xattrs
+	ta.XattrAllow = t.options.XattrAllow
+	ta.XattrDeny = t.options.XattrDeny
+	ta.XattrFilter = t.options.XattrFilter
+	ta.PreserveBirthTime = t.options.PreserveBirthTime
+	ta.PreserveSourceAtime = t.options.PreserveSourceAtime
+	ta.PreciseTimes = t.options.PreciseTimes
+	ta.PreserveFileFlags = t.options.PreserveFileFlags
+	ta.FollowSymlinks = t.options.FollowSymlinks
+	ta.SkipSpecialFiles = t.options.SkipSpecialFiles
+	ta.OnSkippedFile = t.options.OnSkippedFile
+	ta.Stats = t.options.Stats
+	ta.Format = t.options.TarFormat
+	ta.GNULongLinks = t.options.GNULongLinks
+	ta.PAXLongNames = t.options.PAXLongNames
+	ta.CopyBufferSize = t.options.CopyBufferSize
+	ta.FlushPerEntry = t.options.FlushPerEntry
+	if f, ok := t.compressWriter.(interface{ Flush() error }); ok {
+		ta.Flusher = f
+	}
+	ta.DetectSparse = t.options.DetectSparse
+	ta.ChownFunc = t.options.ChownFunc
+	ta.OwnerNames = t.options.OwnerNames
+	ta.GroupNames = t.options.GroupNames
 
 	defer func() {
 		// Make sure to check the error on Close.
+		var closeErr bool
 		if err := ta.TarWriter.Close(); err != nil {
 			log.G(context.TODO()).Errorf("Can't close tar writer: %s", err)
+			closeErr = true
 		}
 		if err := t.compressWriter.Close(); err != nil {
 			log.G(context.TODO()).Errorf("Can't close compress writer: %s", err)
+			closeErr = true
+		}
+		if t.options.OnDigest != nil && !closeErr {
+			t.options.OnDigest([sha256.Size]byte(t.digest.Sum(nil)), [sha256.Size]byte(t.uncompressedDigest.Sum(nil)))
 		}
 		if err := t.pipeWriter.Close(); err != nil {
 			log.G(context.TODO()).Errorf("Can't close pipe writer: %s", err)
@@ -712,12 +1691,26 @@ func (t *Tarballer) Do() {
 	// mutating the filesystem and we can see transient errors
 	// from this
 
-	stat, err := os.Lstat(t.srcPath)
+	if t.manifest != nil {
+		t.addManifest(ta)
+		return
+	}
+
+	walk := filepath.WalkDir
+	stat := os.Lstat
+	if t.options.FollowSymlinks {
+		walk = func(root string, fn fs.WalkDirFunc) error {
+			return walkFollowSymlinks(root, t.srcPath, t.options.FollowSymlinksOutsideSource, fn)
+		}
+		stat = os.Stat
+	}
+
+	srcInfo, err := stat(t.srcPath)
 	if err != nil {
 		return
 	}
 
-	if !stat.IsDir() {
+	if !srcInfo.IsDir() {
 		// We can't later join a non-dir with any includes because the
 		// 'walk' will error if "file/." is stat-ed and "file" is not a
 		// directory. So, we must split the source path and use the
@@ -735,19 +1728,23 @@ func (t *Tarballer) Do() {
 		t.options.IncludeFiles = []string{"."}
 	}
 
+	includes := t.options.IncludeFiles
+	if t.options.Deterministic {
+		includes = slices.Sorted(slices.Values(includes))
+	}
+
 	seen := make(map[string]bool)
 
-	for _, include := range t.options.IncludeFiles {
+	// dirs holds the names of the directories written, for ParentsFirst.
+	dirs := make(map[string]bool)
+
+	for _, include := range includes {
 		rebaseName := t.options.RebaseNames[include]
 
-		var (
-			parentMatchInfo []patternmatcher.MatchInfo
-			parentDirs      []string
-		)
+		ew := &excludeWalker{pm: t.pm, include: include, sep: string(filepath.Separator)}
 
 		walkRoot := getWalkRoot(t.srcPath, include)
-		// TODO(thaJeztah): should this error be handled?
-		_ = filepath.WalkDir(walkRoot, func(filePath string, f os.DirEntry, err error) error {
+		err := walk(walkRoot, func(filePath string, f os.DirEntry, err error) error {
 			if err != nil {
 				log.G(context.TODO()).Errorf("Tar: Can't stat file %s to tar: %s", t.srcPath, err)
 				return nil
@@ -764,70 +1761,22 @@ func (t *Tarballer) Do() {
 				relFilePath = strings.Join([]string{".", relFilePath}, string(filepath.Separator))
 			}
 
-			skip := false
-
-			// If "include" is an exact match for the current file
-			// then even if there's an "excludePatterns" pattern that
-			// matches it, don't skip it. IOW, assume an explicit 'include'
-			// is asking for that file no matter what - which is true
-			// for some files, like .dockerignore and Dockerfile (sometimes)
-			if include != relFilePath {
-				for len(parentDirs) != 0 {
-					lastParentDir := parentDirs[len(parentDirs)-1]
-					if strings.HasPrefix(relFilePath, lastParentDir+string(os.PathSeparator)) {
-						break
-					}
-					parentDirs = parentDirs[:len(parentDirs)-1]
-					parentMatchInfo = parentMatchInfo[:len(parentMatchInfo)-1]
-				}
+			if skip, err := ew.excluded(relFilePath, f.IsDir()); err != nil || skip {
+				return err
+			}
 
-				var matchInfo patternmatcher.MatchInfo
-				if len(parentMatchInfo) != 0 {
-					skip, matchInfo, err = t.pm.MatchesUsingParentResults(relFilePath, parentMatchInfo[len(parentMatchInfo)-1])
-				} else {
-					skip, matchInfo, err = t.pm.MatchesUsingParentResults(relFilePath, patternmatcher.MatchInfo{})
-				}
+			if t.options.FileFilter != nil {
+				fi, err := f.Info()
 				if err != nil {
-					log.G(context.TODO()).Errorf("Error matching %s: %v", relFilePath, err)
-					return err
-				}
-
-				if f.IsDir() {
-					parentDirs = append(parentDirs, relFilePath)
-					parentMatchInfo = append(parentMatchInfo, matchInfo)
-				}
-			}
-
-			if skip {
-				// If we want to skip this file and its a directory
-				// then we should first check to see if there's an
-				// excludes pattern (e.g. !dir/file) that starts with this
-				// dir. If so then we can't skip this dir.
-
-				// Its not a dir then so we can just return/skip.
-				if !f.IsDir() {
+					log.G(context.TODO()).Errorf("Tar: Can't stat file %s to tar: %s", filePath, err)
 					return nil
 				}
-
-				// No exceptions (!...) in patterns so just skip dir
-				if !t.pm.Exclusions() {
-					return filepath.SkipDir
-				}
-
-				dirSlash := relFilePath + string(filepath.Separator)
-
-				for _, pat := range t.pm.Patterns() {
-					if !pat.Exclusion() {
-						continue
-					}
-					if strings.HasPrefix(pat.String()+string(filepath.Separator), dirSlash) {
-						// found a match - so can't skip this dir
-						return nil
+				if !t.options.FileFilter(filepath.ToSlash(relFilePath), fi) {
+					if f.IsDir() {
+						return filepath.SkipDir
 					}
+					return nil
 				}
-
-				// No matching exclusion dir so just skip dir
-				return filepath.SkipDir
 			}
 
 			if seen[relFilePath] {
@@ -836,16 +1785,19 @@ func (t *Tarballer) Do() {
 			seen[relFilePath] = true
 
 			// Rename the base resource.
-			if rebaseName != "" {
-				var replacement string
-				if rebaseName != string(filepath.Separator) {
-					// Special case the root directory to replace with an
-					// empty string instead so that we don't end up with
-					// double slashes in the paths.
-					replacement = rebaseName
+			relFilePath = rebaseEntryName(relFilePath, include, rebaseName, string(filepath.Separator))
+
+			if t.options.ParentsFirst {
+				if err := t.addParentDirs(ta, relFilePath, rebaseName != "", dirs, seen); err != nil {
+					log.G(context.TODO()).Errorf("Can't add parent directories of %s to tar: %s", filePath, err)
+					// if pipe is broken, stop writing tar stream to it
+					if errors.Is(err, io.ErrClosedPipe) {
+						return err
+					}
+				}
+				if f.IsDir() {
+					dirs[filepath.Clean(relFilePath)] = true
 				}
-
-				relFilePath = strings.Replace(relFilePath, include, replacement, 1)
 			}
 
 			if err := ta.addTarFile(filePath, relFilePath); err != nil {
@@ -857,7 +1809,38 @@ func (t *Tarballer) Do() {
 			}
 			return nil
 		})
+		if errors.Is(err, errSymlinkLoop) || errors.Is(err, errSymlinkOutsideRoot) {
+			log.G(context.TODO()).Errorf("Tar: Can't archive %s: %s", t.srcPath, err)
+			_ = t.pipeWriter.CloseWithError(err)
+			return
+		}
+		// TODO(thaJeztah): should other errors be handled?
+	}
+}
+
+// addParentDirs writes the parent directories of the entry with the given
+// name that were not written yet, for ParentsFirst. They are archived from
+// the source directory, or written as implied directories if the name was
+// rebased.
+func (t *Tarballer) addParentDirs(ta *tarAppender, name string, rebased bool, dirs, seen map[string]bool) error {
+	var parents []string
+	for dir := filepath.Dir(filepath.Clean(name)); dir != "." && dir != string(filepath.Separator) && !dirs[dir]; dir = filepath.Dir(dir) {
+		parents = append(parents, dir)
 	}
+	for _, dir := range slices.Backward(parents) {
+		dirs[dir] = true
+		if rebased {
+			if err := ta.addImpliedDir(dir); err != nil {
+				return err
+			}
+			continue
+		}
+		seen[dir] = true
+		if err := ta.addTarFile(filepath.Join(t.srcPath, dir), dir); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // unpackedDir records a directory whose mtime must be restored after all
@@ -868,26 +1851,51 @@ type unpackedDir struct {
 	name string // root-relative entry name
 }
 
+// unpackedFileFlags records the file flags to restore on an entry after all
+// entries are extracted, with PreserveFileFlags.
+type unpackedFileFlags struct {
+	name  string // root-relative entry name
+	flags string // value of the "SCHILY.fflags" PAX record
+}
+
 // Unpack unpacks the decompressedArchive to dest with options.
 func Unpack(decompressedArchive io.Reader, dest string, options *TarOptions) error {
 	if options == nil {
 		options = &TarOptions{}
 	}
-	root, err := os.OpenRoot(dest)
+	root, err := openDestRoot(dest)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = root.Close() }()
 
-	tr := tar.NewReader(decompressedArchive)
+	xr, err := newExtractReader(decompressedArchive, dest, options)
+	if err != nil {
+		return err
+	}
+	return extractEntries(xr, &OSTarget{root: root}, options)
+}
+
+// extractEntries extracts the entries read by xr to t with options. It is
+// the implementation of Unpack and UntarTo.
+func extractEntries(xr *extractReader, t Target, options *TarOptions) error {
+	dt, _ := t.(diskTarget)
+	var (
+		dirs []*tar.Header
 
-	var dirs []unpackedDir
+		// fileFlags are restored last, as the immutable and append-only
+		// flags prevent further changes to the entries, such as creating
+		// files in directories, hardlinks, or restoring modification times.
+		fileFlags []unpackedFileFlags
+	)
 	whiteoutConverter := getWhiteoutConverter(options.WhiteoutFormat)
+	if whiteoutConverter != nil && dt == nil {
+		return errors.New("WhiteoutFormat is not supported by the target")
+	}
 
 	// Iterate through the files in the archive.
-loop:
 	for {
-		hdr, err := tr.Next()
+		hdr, err := xr.next()
 		if errors.Is(err, io.EOF) {
 			// end of tar archive
 			break
@@ -896,56 +1904,25 @@ func Unpack(decompressedArchive io.Reader, dest string, options *TarOptions) err
 			return err
 		}
 
-		// ignore XGlobalHeader early to avoid creating parent directories for them
-		if hdr.Typeflag == tar.TypeXGlobalHeader {
-			log.G(context.TODO()).Debugf("PAX Global Extended Headers found for %s and ignored", hdr.Name)
-			continue
-		}
-
-		// Strip a leading "/" so absolute entries stay root-relative, and
-		// normalize the POSIX tar path. Skip entries referring to the extraction
-		// root and reject paths that escape it.
-		name := path.Clean(strings.TrimLeft(hdr.Name, "/"))
-		if name == "." {
-			continue
-		}
-		if !filepath.IsLocal(name) {
-			return breakoutError(fmt.Errorf("invalid entry name %q", hdr.Name))
-		}
-		for _, exclude := range options.ExcludePatterns {
-			if strings.HasPrefix(name, exclude) {
-				continue loop
+		// If the entry exists we almost always just want to remove and
+		// replace it. The only exception is when it is a directory *and*
+		// the file from the layer is also a directory. Then we want to
+		// merge them (i.e. just apply the metadata from the layer).
+		if fi, err := t.Lstat(hdr.Name); err == nil {
+			if options.SkipExisting && canSkipExisting(fi, hdr, options.SkipExistingMatchSizeAndModTime) {
+				continue
 			}
-		}
 
-		hdr.Name = name
-
-		// Skip entries whose name (or hardlink target) Windows cannot represent.
-		if err := unrepresentableOnWindows(hdr); err != nil {
-			log.G(context.TODO()).Warnf("Windows: ignoring entry: %v", err)
-			continue loop
-		}
-
-		// dstPath is the native (host-separator) form of the entry name,
-		// used at all filesystem boundaries (os.Root methods, fsRootPath).
-		// hdr.Name stays POSIX (forward-slash) for logical string checks.
-		dstPath := filepath.FromSlash(hdr.Name)
-
-		// If dstPath exists we almost always just want to remove and replace it.
-		// The only exception is when it is a directory *and* the file from
-		// the layer is also a directory. Then we want to merge them (i.e.
-		// just apply the metadata from the layer).
-		if fi, err := root.Lstat(dstPath); err == nil {
 			if options.NoOverwriteDirNonDir && fi.IsDir() && hdr.Typeflag != tar.TypeDir {
 				// If NoOverwriteDirNonDir is true then we cannot replace
 				// an existing directory with a non-directory from the archive.
-				return fmt.Errorf("cannot overwrite directory %q with non-directory %q", hdr.Name, dest)
+				return fmt.Errorf("cannot overwrite directory %q with non-directory %q", hdr.Name, xr.dest)
 			}
 
 			if options.NoOverwriteDirNonDir && !fi.IsDir() && hdr.Typeflag == tar.TypeDir {
 				// If NoOverwriteDirNonDir is true then we cannot replace
 				// an existing non-directory with a directory from the archive.
-				return fmt.Errorf("cannot overwrite non-directory %q with directory %q", hdr.Name, dest)
+				return fmt.Errorf("cannot overwrite non-directory %q with directory %q", hdr.Name, xr.dest)
 			}
 
 			if fi.IsDir() && hdr.Name == "." {
@@ -953,54 +1930,533 @@ func Unpack(decompressedArchive io.Reader, dest string, options *TarOptions) err
 			}
 
 			if !fi.IsDir() || hdr.Typeflag != tar.TypeDir {
-				if err := root.RemoveAll(dstPath); err != nil {
-					return err
+				if err := t.RemoveAll(hdr.Name); err != nil {
+					return entryError(hdr, err)
 				}
 			}
 		}
 
 		if err := remapIDs(options.IDMap, hdr); err != nil {
-			return err
+			return entryError(hdr, err)
 		}
 
 		// Ensure that the parent directory exists.
 		//
 		// This must be done before whiteoutConverter.ConvertRead, which
 		// may set xattrs on the directory or create whiteout files.
-		if err := createImpliedDirectories(root, hdr, options); err != nil {
-			return err
+		if err := createImpliedDirectories(t, hdr, options); err != nil {
+			return entryError(hdr, err)
 		}
 
 		if whiteoutConverter != nil {
-			writeFile, err := whiteoutConverter.ConvertRead(root, hdr, dstPath)
+			writeFile, err := whiteoutConverter.ConvertRead(dt.osRoot(), hdr, filepath.FromSlash(hdr.Name))
 			if err != nil {
-				return err
+				return entryError(hdr, err)
 			}
 			if !writeFile {
 				continue
 			}
 		}
 
-		if err := createTarFile(root, dstPath, hdr, tr, options); err != nil {
+		cr := &countingReader{Reader: limitFileSize(xr.tr, hdr, options)}
+		if err := extractEntry(t, hdr.Name, hdr, cr, options); err != nil {
+			return entryError(hdr, err)
+		}
+		xr.written += cr.n
+
+		if options.OnEntry != nil {
+			if err := options.OnEntry(hdr, cr.n); err != nil {
+				return err
+			}
+		}
+		if err := xr.checkpoint(); err != nil {
 			return err
 		}
 
 		// Directory mtimes must be handled at the end to avoid further
 		// file creation in them to modify the directory mtime
 		if hdr.Typeflag == tar.TypeDir {
-			dirs = append(dirs, unpackedDir{hdr: hdr, name: dstPath})
+			dirs = append(dirs, hdr)
+		}
+		if options.PreserveFileFlags && dt != nil && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeDir) {
+			if flags, ok := hdr.PAXRecords[paxFileFlags]; ok {
+				fileFlags = append(fileFlags, unpackedFileFlags{name: hdr.Name, flags: flags})
+			}
 		}
 	}
 
-	for _, d := range dirs {
-		aTime := boundTime(latestTime(d.hdr.AccessTime, d.hdr.ModTime))
-		if err := root.Chtimes(d.name, aTime, boundTime(d.hdr.ModTime)); err != nil {
+	for _, hdr := range dirs {
+		aTime := boundTime(latestTime(hdr.AccessTime, hdr.ModTime))
+		if err := t.Chtimes(hdr.Name, aTime, boundTime(hdr.ModTime)); err != nil {
+			return err
+		}
+	}
+	for _, f := range fileFlags {
+		if err := dt.setFileFlags(f.name, f.flags); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// extractReader reads the entries of an archive to extract. It applies the
+// checks and options shared by Unpack, UntarTo, and ValidateArchive, so that
+// they accept and skip the same entries.
+type extractReader struct {
+	tr      *tar.Reader
+	options *TarOptions
+	pm      *patternmatcher.PatternMatcher
+
+	// dest is the destination directory, to check MaxPathLength against,
+	// or empty if there is none.
+	dest string
+
+	// onGlobalHeader is called with the records of PAX global headers.
+	onGlobalHeader func(map[string]string)
+
+	// src tracks the offset in the archive, for OnCheckpoint and
+	// ResumeFrom. It is only used if needed, as it hides the io.Seeker
+	// implementation of the archive from the tar reader.
+	src *countingReader
+
+	// headerStart, dataStart, and name are the offsets of the headers and
+	// of the content, and the name as stored in the archive of the entry
+	// last returned by next.
+	headerStart int64
+	dataStart   int64
+	name        string
+
+	// entries and written track the number of entries and bytes of
+	// content extracted, to enforce MaxEntries and MaxUncompressedSize.
+	// Callers add the content they extract to written.
+	entries int
+	written int64
+
+	// names is set to detect case collisions, for DetectCaseCollisions.
+	names caseCollisions
+}
+
+// newExtractReader returns an extractReader for the uncompressed archive r, to
+// extract to dest with options.
+func newExtractReader(r io.Reader, dest string, options *TarOptions) (*extractReader, error) {
+	xr := &extractReader{
+		options:        options,
+		dest:           dest,
+		onGlobalHeader: options.OnGlobalHeader,
+	}
+	if options.OnCheckpoint != nil || options.ResumeFrom != nil {
+		xr.src = &countingReader{Reader: r}
+		r = xr.src
+	}
+	xr.tr = tar.NewReader(r)
+	if options.ResumeFrom != nil {
+		if err := xr.resume(*options.ResumeFrom); err != nil {
+			return nil, err
+		}
+	}
+	if options.DetectCaseCollisions {
+		xr.names = make(caseCollisions)
+	}
+	if options.ExcludePatternSyntax == PatternGitignore {
+		pm, err := newExcludeMatcher(options)
+		if err != nil {
+			return nil, err
+		}
+		xr.pm = pm
+	}
+	return xr, nil
+}
+
+// next returns the header of the next entry to extract, with its name
+// cleaned, and stripped as set in options. Entries that are excluded or
+// cannot be extracted on this platform are skipped. It returns an error if
+// the entry must not be extracted, and io.EOF at the end of the archive.
+func (xr *extractReader) next() (*tar.Header, error) {
+	for {
+		if xr.src != nil {
+			// Read the rest of the previous entry, so that its padding is
+			// all that precedes the headers of the next one.
+			if _, err := io.Copy(io.Discard, xr.tr); err != nil {
+				return nil, err
+			}
+			xr.headerStart = xr.src.n + (-xr.src.n & (blockSize - 1))
+		}
+		hdr, err := xr.tr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if xr.src != nil {
+			xr.dataStart = xr.src.n
+		}
+		xr.name = hdr.Name
+		if err := checkTypeflag(hdr, xr.options); err != nil {
+			return nil, err
+		}
+
+		// ignore XGlobalHeader early to avoid creating parent directories for them
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			if xr.onGlobalHeader != nil {
+				xr.onGlobalHeader(hdr.PAXRecords)
+			} else {
+				log.G(context.TODO()).Debugf("PAX Global Extended Headers found for %s and ignored", hdr.Name)
+			}
+			continue
+		}
+
+		// Strip a leading "/" so absolute entries stay root-relative, and
+		// normalize the POSIX tar path. Skip entries referring to the extraction
+		// root and reject paths that escape it.
+		name, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "." {
+			continue
+		}
+		if skip, err := isExcluded(xr.pm, xr.options, name); err != nil {
+			return nil, err
+		} else if skip {
+			continue
+		}
+
+		hdr.Name = name
+		if xr.options.StripComponents > 0 && !stripEntryComponents(hdr, xr.options.StripComponents) {
+			continue
+		}
+
+		// Skip entries whose name (or hardlink target) Windows cannot represent.
+		if err := unrepresentableOnWindows(hdr); err != nil {
+			log.G(context.TODO()).Warnf("Windows: ignoring entry: %v", err)
+			continue
+		}
+
+		if xr.names != nil {
+			if err := xr.names.check(hdr.Name); err != nil {
+				return nil, err
+			}
+		}
+
+		xr.entries++
+		if err := checkExtractionLimits(hdr, xr.dest, xr.options, xr.entries, xr.written); err != nil {
+			return nil, err
+		}
+		return hdr, nil
+	}
+}
+
+// checkpoint calls OnCheckpoint, if set, with the checkpoint after the entry
+// last returned by next.
+func (xr *extractReader) checkpoint() error {
+	if xr.options.OnCheckpoint == nil {
+		return nil
+	}
+	cp, err := entryCheckpoint(xr.tr, xr.src, xr.headerStart, xr.dataStart, xr.name)
+	if err != nil {
+		return err
+	}
+	return xr.options.OnCheckpoint(cp)
+}
+
+// cleanEntryName returns the normalized, root-relative form of the POSIX
+// entry name, with any leading "/" stripped. It returns "." for entries
+// referring to the extraction root, and an error for names that escape it,
+// including Windows absolute and UNC paths on all platforms.
+func cleanEntryName(name string) (string, error) {
+	trimmed := strings.TrimLeft(name, "/")
+	cleaned := path.Clean(trimmed)
+	if isWindowsAbs(trimmed) || cleaned != "." && !filepath.IsLocal(cleaned) {
+		return "", breakoutError(fmt.Errorf("invalid entry name %q", name))
+	}
+	return cleaned, nil
+}
+
+// isWindowsAbs reports whether name is a Windows path that is absolute or
+// relative to a drive or to the root of the current drive, such as `C:oo`,
+// `C:foo`, `oo`, or `\host\shareoo`. Archives are cross-platform, so
+// such names are rejected regardless of the platform extracting them.
+func isWindowsAbs(name string) bool {
+	if strings.HasPrefix(name, `\`) {
+		return true
+	}
+	if len(name) < 2 || name[1] != ':' {
+		return false
+	}
+	c := name[0] | 0x20 // lower-case
+	return 'a' <= c && c <= 'z'
+}
+
+// stripEntryComponents removes the first n components from the cleaned name
+// of hdr, and from its hardlink target or relative symlink target as
+// described for [TarOptions.StripComponents]. It returns false if the entry
+// must be skipped.
+func stripEntryComponents(hdr *tar.Header, n int) bool {
+	oldDir := path.Dir(hdr.Name)
+	name, ok := stripComponents(hdr.Name, n)
+	if !ok {
+		return false
+	}
+	hdr.Name = name
+
+	switch hdr.Typeflag {
+	case tar.TypeLink:
+		linkname, ok := stripComponents(path.Clean(strings.TrimLeft(hdr.Linkname, "/")), n)
+		if !ok {
+			return false
+		}
+		hdr.Linkname = linkname
+	case tar.TypeSymlink:
+		if path.IsAbs(hdr.Linkname) {
+			break
+		}
+		target := path.Join(oldDir, hdr.Linkname)
+		if !filepath.IsLocal(target) {
+			break
+		}
+		stripped, ok := stripComponents(target, n)
+		if !ok {
+			break
+		}
+		rel, err := filepath.Rel(filepath.FromSlash(path.Dir(name)), filepath.FromSlash(stripped))
+		if err == nil {
+			hdr.Linkname = filepath.ToSlash(rel)
+		}
+	}
+	return true
+}
+
+// stripComponents removes the first n components from the cleaned POSIX path
+// p. It returns false if p has no more than n components.
+func stripComponents(p string, n int) (string, bool) {
+	parts := strings.SplitN(p, "/", n+1)
+	if len(parts) <= n {
+		return "", false
+	}
+	return parts[n], true
+}
+
+// isExcluded reports whether the entry with the cleaned name is excluded by
+// options.ExcludePatterns. pm must be set if options.ExcludePatternSyntax is
+// [PatternGitignore].
+func isExcluded(pm *patternmatcher.PatternMatcher, options *TarOptions, name string) (bool, error) {
+	if pm != nil {
+		return pm.MatchesOrParentMatches(name)
+	}
+	for _, exclude := range options.ExcludePatterns {
+		if strings.HasPrefix(name, exclude) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkTypeflag returns an error if StrictTypeflags is set in options, and
+// hdr has a type that Untar does not support.
+func checkTypeflag(hdr *tar.Header, options *TarOptions) error {
+	if !options.StrictTypeflags {
+		return nil
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeLink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo, tar.TypeXGlobalHeader:
+		return nil
+	default:
+		return unsupportedTypeflagError(hdr)
+	}
+}
+
+// unsupportedTypeflagError returns the error for an entry with a type that
+// Untar does not support.
+func unsupportedTypeflagError(hdr *tar.Header) error {
+	return fmt.Errorf("unsupported tar header type %d for %q", hdr.Typeflag, hdr.Name)
+}
+
+// checkExtractionLimits checks hdr against the extraction limits set in
+// options, given the number of entries (including hdr) and the number of
+// bytes of content extracted before it.
+func checkExtractionLimits(hdr *tar.Header, dest string, options *TarOptions, entries int, written int64) error {
+	if options.MaxEntries > 0 && entries > options.MaxEntries {
+		return fmt.Errorf("archive contains more than %d entries: %w", options.MaxEntries, ErrExtractionLimitExceeded)
+	}
+	if options.MaxUncompressedSize > 0 && written+hdr.Size > options.MaxUncompressedSize {
+		return fmt.Errorf("extracting %q exceeds the maximum uncompressed size of %d bytes: %w", hdr.Name, options.MaxUncompressedSize, ErrExtractionLimitExceeded)
+	}
+	if options.MaxFileSize > 0 && hdr.Size > options.MaxFileSize {
+		return fmt.Errorf("%q has a size of %d bytes, which exceeds the maximum file size of %d bytes: %w", hdr.Name, hdr.Size, options.MaxFileSize, ErrExtractionLimitExceeded)
+	}
+	if options.MaxPathDepth > 0 {
+		if depth := strings.Count(hdr.Name, "/") + 1; depth > options.MaxPathDepth {
+			return fmt.Errorf("path of %q has a depth of %d, which exceeds the maximum of %d: %w", hdr.Name, depth, options.MaxPathDepth, ErrExtractionLimitExceeded)
+		}
+	}
+	if options.MaxPathLength > 0 {
+		if l := len(filepath.Join(dest, filepath.FromSlash(hdr.Name))); l > options.MaxPathLength {
+			return fmt.Errorf("path of %q has a length of %d, which exceeds the maximum of %d: %w", hdr.Name, l, options.MaxPathLength, ErrExtractionLimitExceeded)
+		}
+	}
+	return nil
+}
+
+// caseCollisions records the names of extracted entries and of their parent
+// directories by their lower-case form, for DetectCaseCollisions.
+type caseCollisions map[string]string
+
+// check records name and its parent directories, and returns an error if one
+// of them differs only in case from a name recorded earlier.
+func (c caseCollisions) check(name string) error {
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		folded := strings.ToLower(p)
+		prev, ok := c[folded]
+		if !ok {
+			c[folded] = p
+			continue
+		}
+		if prev != p {
+			return fmt.Errorf("%w: %q and %q", ErrCaseCollision, prev, p)
+		}
+		// The parent directories were recorded with p.
+		return nil
+	}
+	return nil
+}
+
+// isSpecialFile reports whether fi describes a block or character device, a
+// named pipe, or a socket.
+func isSpecialFile(fi os.FileInfo) bool {
+	return fi.Mode()&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe|os.ModeSocket) != 0
+}
+
+// canSkipExisting reports whether the existing file described by fi can be
+// kept instead of extracting hdr over it, because it is of the same type
+// (and, if matchSizeAndModTime is set, for regular files also of the same
+// size and modification time). Directories and whiteouts are never skipped.
+func canSkipExisting(fi os.FileInfo, hdr *tar.Header, matchSizeAndModTime bool) bool {
+	if strings.HasPrefix(path.Base(hdr.Name), WhiteoutPrefix) {
+		return false
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeLink:
+		if !fi.Mode().IsRegular() {
+			return false
+		}
+		if matchSizeAndModTime && hdr.Typeflag == tar.TypeReg {
+			return fi.Size() == hdr.Size && fi.ModTime().Equal(boundTime(hdr.ModTime))
+		}
+		return true
+	case tar.TypeSymlink:
+		return fi.Mode().Type() == os.ModeSymlink
+	case tar.TypeChar:
+		return fi.Mode().Type() == os.ModeDevice|os.ModeCharDevice
+	case tar.TypeBlock:
+		return fi.Mode().Type() == os.ModeDevice
+	case tar.TypeFifo:
+		return fi.Mode().Type() == os.ModeNamedPipe
+	default:
+		return false
+	}
+}
+
+// entryError annotates err, which occurred while extracting hdr, with the
+// name and type of the entry.
+func entryError(hdr *tar.Header, err error) error {
+	return fmt.Errorf("failed to create entry %q (%s): %w", hdr.Name, typeflagName(hdr.Typeflag), err)
+}
+
+// typeflagName returns a human-readable name for the tar entry type.
+func typeflagName(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeChar:
+		return "character device"
+	case tar.TypeBlock:
+		return "block device"
+	case tar.TypeDir:
+		return "directory"
+	case tar.TypeFifo:
+		return "fifo"
+	default:
+		return fmt.Sprintf("type %q", typeflag)
+	}
+}
+
+// countingReader counts the number of bytes read from the wrapped reader.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the number of bytes written to the wrapped writer.
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// checkContentSize returns an error if the content read for hdr was not
+// exactly hdr.Size bytes: if n, the number of bytes read, is less, or if r
+// has more content.
+func checkContentSize(hdr *tar.Header, n int64, r io.Reader) error {
+	if n < hdr.Size {
+		return fmt.Errorf("content of %q is shorter than its size of %d bytes: %w", hdr.Name, hdr.Size, io.ErrUnexpectedEOF)
+	}
+	if m, _ := r.Read(make([]byte, 1)); m > 0 {
+		return fmt.Errorf("content of %q is longer than its size of %d bytes", hdr.Name, hdr.Size)
+	}
+	return nil
+}
+
+// limitFileSize returns r wrapped to fail if more than MaxFileSize bytes are
+// read for hdr, or r if options has no MaxFileSize.
+func limitFileSize(r io.Reader, hdr *tar.Header, options *TarOptions) io.Reader {
+	if options.MaxFileSize <= 0 {
+		return r
+	}
+	return &fileSizeLimitReader{r: r, name: hdr.Name, max: options.MaxFileSize}
+}
+
+// fileSizeLimitReader reads from r, and returns an error matching
+// [ErrExtractionLimitExceeded] once more than max bytes are read.
+type fileSizeLimitReader struct {
+	r    io.Reader
+	name string
+	max  int64
+	n    int64
+}
+
+func (l *fileSizeLimitReader) Read(p []byte) (int, error) {
+	if l.n > l.max {
+		return 0, l.err()
+	}
+	// Read at most one byte past the limit to detect exceeding it.
+	if remaining := l.max - l.n + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		return n - int(l.n-l.max), l.err()
+	}
+	return n, err
+}
+
+func (l *fileSizeLimitReader) err() error {
+	return fmt.Errorf("content of %q exceeds the maximum file size of %d bytes: %w", l.name, l.max, ErrExtractionLimitExceeded)
+}
+
 // unrepresentableOnWindows returns an error describing why a tar entry cannot
 // be faithfully created on Windows, or nil if it can (always on non-Windows).
 // On Windows ":" is illegal in a filename and "\" is a path separator, so a tar
@@ -1028,85 +2484,102 @@ func unrepresentableOnWindows(hdr *tar.Header) error {
 // we most both create them and choose metadata like permissions.
 //
 // The caller must have normalized hdr.Name (no leading ".." components).
-// All directory creation is performed via root so it is bounded within the
-// destination at the OS level (openat(2) semantics), preventing escape via
-// symlinks in the destination tree.
-func createImpliedDirectories(root *os.Root, hdr *tar.Header, options *TarOptions) error {
-	// For non-directory entries, ensure that the parent directory exists.
-	if hdr.Typeflag != tar.TypeDir {
-		parent := filepath.FromSlash(path.Dir(strings.TrimSuffix(hdr.Name, "/")))
-		// Skip when the parent is the root itself; nothing to create.
-		if parent == "." || parent == "" {
-			return nil
+func createImpliedDirectories(t Target, hdr *tar.Header, options *TarOptions) error {
+	// Ensure that the parent directory exists, for directory entries as
+	// well, as their parents may have been extracted as non-directories.
+	parent := path.Dir(strings.TrimSuffix(hdr.Name, "/"))
+	// Skip when the parent is the root itself; nothing to create.
+	if parent == "." || parent == "" {
+		return nil
+	}
+	if fi, err := t.Stat(parent); err == nil && fi.IsDir() {
+		return nil
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+		return err
+	}
+	// RootPair() is confined inside this loop as most cases will not require a call, so we can spend some
+	// unneeded function calls in the uncommon case to encapsulate logic -- implied directories are a niche
+	// usage that reduces the portability of an image.
+	uid, gid := options.IDMap.RootPair()
+	mode := impliedDirectoryMode(options)
+
+	// Similar to [user.MkdirAllAndChown]
+	//
+	// [user.MkdirAllAndChown]: https://pkg.go.dev/github.com/moby/sys/user#MkdirAllAndChown
+	var cur string
+	for c := range strings.SplitSeq(parent, "/") {
+		if c == "" {
+			continue
 		}
-		if _, err := root.Lstat(parent); err == nil {
-			return nil
-		} else if !os.IsNotExist(err) {
+		cur = path.Join(cur, c)
+		fi, err := t.Stat(cur)
+		if err == nil && fi.IsDir() {
+			continue
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
 			return err
 		}
-		// RootPair() is confined inside this loop as most cases will not require a call, so we can spend some
-		// unneeded function calls in the uncommon case to encapsulate logic -- implied directories are a niche
-		// usage that reduces the portability of an image.
-		uid, gid := options.IDMap.RootPair()
-
-		// Similar to [user.MkdirAllAndChown]
-		//
-		// [user.MkdirAllAndChown]: https://pkg.go.dev/github.com/moby/sys/user#MkdirAllAndChown
-		var cur string
-		for c := range strings.SplitSeq(parent, string(os.PathSeparator)) {
-			if c == "" {
-				continue
-			}
-			cur = filepath.Join(cur, c)
-			if err := root.Mkdir(cur, ImpliedDirectoryMode); err != nil {
-				if !errors.Is(err, os.ErrExist) {
-					return err
-				}
-
-				fi, err := root.Stat(cur)
-				if err != nil {
-					return err
-				}
-				if fi.IsDir() {
-					continue
-				}
-				return &os.PathError{Op: "mkdir", Path: cur, Err: syscall.ENOTDIR}
-			}
-			if options.NoLchown {
-				continue
+		if _, err := t.Lstat(cur); err == nil {
+			// cur is a file, or a symlink that does not point to a
+			// directory, extracted earlier. Replace it, as for an
+			// explicit directory entry with the same name.
+			if options.NoOverwriteDirNonDir {
+				return fmt.Errorf("cannot create %q: parent %q is not a directory", hdr.Name, cur)
 			}
-			// Only the successful Mkdir case is newly-created.
-			dir, err := root.Open(cur)
-			if err != nil {
+			if err := t.RemoveAll(cur); err != nil {
 				return err
 			}
-			if uid != 0 || gid != 0 {
-				if err := dir.Chown(uid, gid); err != nil {
-					_ = dir.Close()
-					return err
-				}
-			}
-			// root.Mkdir applies the mode subject to the process umask, so
-			// re-apply it with Chmod to guarantee ImpliedDirectoryMode
-			// independent of umask, matching the previous MkdirAllAndChown
-			// behavior.
-			if err := dir.Chmod(ImpliedDirectoryMode); err != nil {
-				_ = dir.Close()
-				return err
-			}
-			if err := dir.Close(); err != nil {
+		}
+		if err := options.Retry.do(func() error {
+			return t.Mkdir(cur, mode)
+		}); err != nil {
+			return err
+		}
+		if options.OnOwnership != nil {
+			options.OnOwnership(cur, uid, gid)
+		}
+		if options.NoLchown {
+			continue
+		}
+		if options.OnOwnership == nil && (uid != 0 || gid != 0) {
+			if err := t.Lchown(cur, uid, gid); err != nil {
 				return err
 			}
 		}
+		// Mkdir applies the mode subject to the process umask, so
+		// re-apply it with Chmod to guarantee ImpliedDirectoryMode
+		// independent of umask, matching the previous MkdirAllAndChown
+		// behavior.
+		if err := t.Chmod(cur, mode); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// impliedDirectoryMode returns the mode of parent directories that are not in
+// the archive, which is options.ImpliedDirMode, or [ImpliedDirectoryMode] if
+// not set, with options.ExtractUmask applied.
+func impliedDirectoryMode(options *TarOptions) os.FileMode {
+	mode := os.FileMode(ImpliedDirectoryMode)
+	if options.ImpliedDirMode != nil {
+		mode = *options.ImpliedDirMode & os.ModePerm
+	}
+	if options.ExtractUmask != nil {
+		mode &^= *options.ExtractUmask & os.ModePerm
+	}
+	return mode
+}
+
 // Untar reads a stream of bytes from `archive`, parses it as a tar archive,
 // and unpacks it into the directory at `dest`.
 // The archive may be compressed with one of the following algorithms:
-// identity (uncompressed), gzip, bzip2, xz.
+// identity (uncompressed), gzip, bzip2, xz, zstd, lz4.
+//
+// The mode, ownership, and timestamps of directories that already exist,
+// including dest itself, are only updated if the archive has an entry for
+// that directory. Entries for dest itself ("." or "/") are ignored.
 //
 // FIXME: specify behavior when target path exists vs. doesn't exist.
 func Untar(tarArchive io.Reader, dest string, options *TarOptions) error {
@@ -1120,6 +2593,36 @@ func UntarUncompressed(tarArchive io.Reader, dest string, options *TarOptions) e
 	return untarHandler(tarArchive, dest, options, false)
 }
 
+// UntarWithCompression is like [Untar], but decompresses the archive with the
+// given compression algorithm instead of detecting it. It returns an error if
+// the archive is not compressed with that algorithm.
+func UntarWithCompression(tarArchive io.Reader, dest string, comp compression.Compression, options *TarOptions) error {
+	if tarArchive == nil {
+		return errors.New("empty archive")
+	}
+	if options == nil {
+		options = &TarOptions{}
+	}
+	if options.ResumeFrom != nil && comp != compression.None {
+		return fmt.Errorf("cannot resume extracting a %s archive", comp.Extension())
+	}
+	decompressedArchive, err := compression.DecompressStreamAs(tarArchive, comp, compressionDicts(options)...)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = decompressedArchive.Close() }()
+	return untarHandler(decompressedArchive, dest, options, false)
+}
+
+// compressionDicts returns the dictionaries to decompress archives with, as
+// set in options.
+func compressionDicts(options *TarOptions) [][]byte {
+	if options.CompressionDict == nil {
+		return nil
+	}
+	return [][]byte{options.CompressionDict}
+}
+
 // Handler for teasing out the automatic decompression
 func untarHandler(tarArchive io.Reader, dest string, options *TarOptions, decompress bool) error {
 	if tarArchive == nil {
@@ -1131,8 +2634,8 @@ func untarHandler(tarArchive io.Reader, dest string, options *TarOptions, decomp
 	}
 
 	r := tarArchive
-	if decompress {
-		decompressedArchive, err := compression.DecompressStream(tarArchive)
+	if decompress && options.ResumeFrom == nil {
+		decompressedArchive, err := compression.DecompressStreamWithDicts(tarArchive, compressionDicts(options)...)
 		if err != nil {
 			return err
 		}
@@ -1146,25 +2649,41 @@ func untarHandler(tarArchive io.Reader, dest string, options *TarOptions, decomp
 // TarUntar is a convenience function which calls Tar and Untar, with the output of one piped into the other.
 // If either Tar or Untar fails, TarUntar aborts and returns the error.
 func (archiver *Archiver) TarUntar(src, dst string) error {
+	return archiver.tarUntar(context.Background(), src, dst)
+}
+
+func (archiver *Archiver) tarUntar(ctx context.Context, src, dst string) error {
 	archive, err := Tar(src, compression.None)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = archive.Close() }()
-	return archiver.Untar(archive, dst, &TarOptions{
-		IDMap: archiver.IDMapping,
+	return archiver.Untar(newContextReader(ctx, archive), dst, &TarOptions{
+		IDMap: archiver.untarIDMapping(),
+		Retry: archiver.Retry,
 	})
 }
 
 // UntarPath untar a file from path to a destination, src is the source tar file path.
 func (archiver *Archiver) UntarPath(src, dst string) error {
+	return archiver.UntarPathCtx(context.Background(), src, dst)
+}
+
+// UntarPathCtx is like [Archiver.UntarPath], but stops extracting and returns
+// the context's error when ctx is cancelled. Cancellation is checked between
+// reads of the archive, so at the latest before the next entry is extracted.
+func (archiver *Archiver) UntarPathCtx(ctx context.Context, src, dst string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	archive, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = archive.Close() }()
-	return archiver.Untar(archive, dst, &TarOptions{
-		IDMap: archiver.IDMapping,
+	return archiver.Untar(newContextReader(ctx, archive), dst, &TarOptions{
+		IDMap: archiver.untarIDMapping(),
+		Retry: archiver.Retry,
 	})
 }
 
@@ -1173,29 +2692,54 @@ func (archiver *Archiver) UntarPath(src, dst string) error {
 // The archive is streamed directly with fixed buffering and no
 // intermediary disk IO.
 func (archiver *Archiver) CopyWithTar(src, dst string) error {
+	return archiver.CopyWithTarCtx(context.Background(), src, dst)
+}
+
+// CopyWithTarCtx is like [Archiver.CopyWithTar], but stops copying and
+// returns the context's error when ctx is cancelled. Files that were already
+// copied are not removed.
+func (archiver *Archiver) CopyWithTarCtx(ctx context.Context, src, dst string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	srcSt, err := os.Stat(src)
 	if err != nil {
 		return err
 	}
 	if !srcSt.IsDir() {
-		return archiver.CopyFileWithTar(src, dst)
+		return archiver.CopyFileWithTarCtx(ctx, src, dst)
 	}
 
 	// if this Archiver is set up with ID mapping we need to create
 	// the new destination directory with the remapped root UID/GID pair
 	// as owner
 	uid, gid := archiver.IDMapping.RootPair()
+	if archiver.PreserveOwnership {
+		uid, gid, err = getFileUIDGID(srcSt.Sys())
+		if err != nil {
+			return err
+		}
+	}
 	// Create dst, copy src's content into it
 	if err := user.MkdirAllAndChown(dst, 0o755, uid, gid, user.WithOnlyNew); err != nil {
 		return err
 	}
-	return archiver.TarUntar(src, dst)
+	return archiver.tarUntar(ctx, src, dst)
 }
 
 // CopyFileWithTar emulates the behavior of the 'cp' command-line
 // for a single file. It copies a regular file from path `src` to
 // path `dst`, and preserves all its metadata.
-func (archiver *Archiver) CopyFileWithTar(src, dst string) (err error) {
+func (archiver *Archiver) CopyFileWithTar(src, dst string) error {
+	return archiver.CopyFileWithTarCtx(context.Background(), src, dst)
+}
+
+// CopyFileWithTarCtx is like [Archiver.CopyFileWithTar], but stops copying
+// and returns the context's error when ctx is cancelled.
+func (archiver *Archiver) CopyFileWithTarCtx(ctx context.Context, src, dst string) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	srcSt, err := os.Stat(src)
 	if err != nil {
 		return err
@@ -1241,8 +2785,10 @@ func (archiver *Archiver) CopyFileWithTar(src, dst string) (err error) {
 			hdr.Name = filepath.Base(dst)
 			hdr.Mode = chmodTarEntry(hdr.Mode)
 
-			if err := remapIDs(archiver.IDMapping, hdr); err != nil {
-				return err
+			if !archiver.PreserveOwnership {
+				if err := remapIDs(archiver.IDMapping, hdr); err != nil {
+					return err
+				}
 			}
 
 			tw := tar.NewWriter(w)
@@ -1262,18 +2808,52 @@ func (archiver *Archiver) CopyFileWithTar(src, dst string) (err error) {
 		}
 	}()
 
-	err = archiver.Untar(r, filepath.Dir(dst), nil)
+	err = archiver.Untar(newContextReader(ctx, r), filepath.Dir(dst), &TarOptions{
+		Retry: archiver.Retry,
+	})
 	if err != nil {
 		_ = r.CloseWithError(err)
 	}
 	return err
 }
 
+// contextReader is an [io.Reader] that fails with the context's error once
+// the context is cancelled. Wrapping the archive passed to [Archiver.Untar]
+// with it aborts extraction, regardless of the Untar implementation used.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func newContextReader(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		// Context can't be cancelled.
+		return r
+	}
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
 // IdentityMapping returns the IdentityMapping of the archiver.
 func (archiver *Archiver) IdentityMapping() user.IdentityMapping {
 	return archiver.IDMapping
 }
 
+// untarIDMapping returns the IdentityMapping to pass to Untar, which is empty
+// if PreserveOwnership is set.
+func (archiver *Archiver) untarIDMapping() user.IdentityMapping {
+	if archiver.PreserveOwnership {
+		return user.IdentityMapping{}
+	}
+	return archiver.IDMapping
+}
+
 func remapIDs(idMapping user.IdentityMapping, hdr *tar.Header) error {
 	uid, gid, err := idMapping.ToHost(hdr.Uid, hdr.Gid)
 	hdr.Uid, hdr.Gid = uid, gid
@@ -2,11 +2,15 @@
 
 import (
 	"archive/tar"
+	"errors"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/moby/sys/userns"
 	"golang.org/x/sys/unix"
@@ -19,6 +23,78 @@ func getWhiteoutConverter(format WhiteoutFormat) tarWhiteoutConverter {
 	return nil
 }
 
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+)
+
+// readACLXattrsToTarHeader reads the POSIX ACLs of the file at filePath, and
+// stores them as extended attributes in hdr. The default ACL is only read for
+// directories. Filesystems that do not support ACLs are ignored.
+func readACLXattrsToTarHeader(filePath string, hdr *tar.Header) error {
+	var xattrs []string
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		// ACLs are not supported on symlinks.
+		return nil
+	case tar.TypeDir:
+		xattrs = []string{aclAccessXattr, aclDefaultXattr}
+	default:
+		xattrs = []string{aclAccessXattr}
+	}
+	for _, xattr := range xattrs {
+		acl, err := lgetxattr(filePath, xattr)
+		if err != nil {
+			if errors.Is(err, unix.ENOTSUP) {
+				return nil
+			}
+			return err
+		}
+		if acl == nil {
+			continue
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxSchilyXattr+xattr] = string(acl)
+	}
+	return nil
+}
+
+// setxattrInRoot sets the extended attribute attr of the file at name within
+// root, without following a final symlink. The file is opened through root,
+// and the attribute is set through its file descriptor in /proc/self/fd, so
+// that a parent directory that is concurrently replaced with a symlink cannot
+// redirect it outside of root. If /proc is not mounted, the attribute is set
+// on the path of the file resolved within root instead.
+func setxattrInRoot(root *os.Root, name, attr string, data []byte) error {
+	f, err := root.OpenFile(name, unix.O_PATH|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var setErr error
+	if err := rc.Control(func(fd uintptr) {
+		// Setxattr follows the magic link to the file opened, which is the
+		// symlink itself if name is a symlink.
+		setErr = unix.Setxattr("/proc/self/fd/"+strconv.Itoa(int(fd)), attr, data, 0)
+	}); err != nil {
+		return err
+	}
+	if errors.Is(setErr, unix.ENOENT) {
+		p, err := fsRootPath(root.Name(), name)
+		if err != nil {
+			return err
+		}
+		return lsetxattr(p, attr, data, 0)
+	}
+	return wrapPathError("lsetxattr", filepath.Join(root.Name(), name), attr, setErr)
+}
+
 type overlayWhiteoutConverter struct {
 	opaqueXattr string
 }
@@ -140,3 +216,22 @@ func (c overlayWhiteoutConverter) ConvertRead(root *os.Root, hdr *tar.Header, fi
 		return false, nil
 	}
 }
+
+// openNoAtime opens the file at path for reading with O_NOATIME, or without
+// it if the process is not permitted to use it for the file.
+func openNoAtime(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOATIME, 0)
+	if errors.Is(err, unix.EPERM) {
+		return os.Open(path)
+	}
+	return file, err
+}
+
+// accessTime returns the access time recorded in fi, if available.
+func accessTime(fi os.FileInfo) (time.Time, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Atim.Unix()), true
+}
@@ -3,12 +3,15 @@
 import (
 	"archive/tar"
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/moby/sys/userns"
 	"golang.org/x/sys/unix"
@@ -222,3 +225,571 @@ func TestOverlayTarAUFSUntar(t *testing.T) {
 	checkFileMode(t, filepath.Join(dst, "d2", "f1"), 0o660)
 	checkFileMode(t, filepath.Join(dst, "d3", WhiteoutPrefix+"f1"), 0o600)
 }
+
+func TestOverlayUnpackLayerUpperDir(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	skip.If(t, userns.RunningInUserNS(), "skipping test that requires initial userns")
+
+	layer := buildTestArchive(t, []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "dir/" + WhiteoutOpaqueDir, Typeflag: tar.TypeReg, Mode: 0o600},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: WhiteoutPrefix + "foo", Typeflag: tar.TypeReg, Mode: 0o600},
+		{Name: "implied/" + WhiteoutPrefix + "bar", Typeflag: tar.TypeReg, Mode: 0o600},
+	}, map[string]string{"dir/file": "hello"})
+
+	dst := t.TempDir()
+	_, err := UnpackLayer(dst, layer, &TarOptions{WhiteoutFormat: OverlayWhiteoutFormat})
+	assert.NilError(t, err)
+
+	checkFileMode(t, filepath.Join(dst, "foo"), os.ModeCharDevice|os.ModeDevice)
+	checkOverlayWhiteout(t, filepath.Join(dst, "foo"))
+	checkFileMode(t, filepath.Join(dst, "implied", "bar"), os.ModeCharDevice|os.ModeDevice)
+	checkOverlayWhiteout(t, filepath.Join(dst, "implied", "bar"))
+	checkOpaqueness(t, filepath.Join(dst, "dir"), "y")
+	checkOpaqueness(t, filepath.Join(dst, "implied"), "")
+
+	content, err := os.ReadFile(filepath.Join(dst, "dir", "file"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(content), "hello"))
+	for _, name := range []string{WhiteoutPrefix + "foo", filepath.Join("dir", WhiteoutOpaqueDir), filepath.Join("implied", WhiteoutPrefix+"bar")} {
+		_, err := os.Lstat(filepath.Join(dst, name))
+		assert.Check(t, os.IsNotExist(err), "expected whiteout %s to not be extracted", name)
+	}
+}
+
+func TestOverlayExportChangesApplyLayer(t *testing.T) {
+	restore := overrideUmask(0)
+	defer restore()
+
+	src := t.TempDir()
+	setupOverlayTestDir(t, src)
+
+	layer, err := ExportChangesWithOptions(src, []Change{
+		{Path: "/d1", Kind: ChangeAdd},
+		{Path: "/d1/f1", Kind: ChangeAdd},
+		{Path: "/d2", Kind: ChangeAdd},
+		{Path: "/d2/f1", Kind: ChangeAdd},
+		{Path: "/d3", Kind: ChangeModify},
+		{Path: "/d3/f1", Kind: ChangeAdd},
+		{Path: "/d3/f2", Kind: ChangeDelete},
+	}, &TarOptions{WhiteoutFormat: OverlayWhiteoutFormat})
+	assert.NilError(t, err)
+	defer layer.Close()
+
+	dst := t.TempDir()
+	assert.NilError(t, os.Mkdir(filepath.Join(dst, "d1"), 0o700))
+	assert.NilError(t, os.WriteFile(filepath.Join(dst, "d1", "old"), nil, 0o600))
+	assert.NilError(t, os.Mkdir(filepath.Join(dst, "d3"), 0o700))
+	assert.NilError(t, os.WriteFile(filepath.Join(dst, "d3", "f2"), nil, 0o600))
+
+	_, err = ApplyUncompressedLayer(dst, layer, &TarOptions{WhiteoutFormat: OverlayWhiteoutFormat})
+	assert.NilError(t, err)
+
+	checkFileMode(t, filepath.Join(dst, "d1", "f1"), 0o600)
+	checkFileMode(t, filepath.Join(dst, "d2", "f1"), 0o660)
+	checkOpaqueness(t, filepath.Join(dst, "d1"), "y")
+	checkOpaqueness(t, filepath.Join(dst, "d2"), "y")
+	checkOpaqueness(t, filepath.Join(dst, "d3"), "")
+	checkOverlayWhiteout(t, filepath.Join(dst, "d3", "f1"))
+	checkOverlayWhiteout(t, filepath.Join(dst, "d3", "f2"))
+
+	_, err = os.Lstat(filepath.Join(dst, "d1", "old"))
+	assert.Check(t, os.IsNotExist(err), "expected opaque directory content to be removed")
+	_, err = os.Lstat(filepath.Join(dst, "d1", WhiteoutOpaqueDir))
+	assert.Check(t, os.IsNotExist(err), "expected AUFS opaque marker to not be extracted")
+}
+
+// posixACL returns a POSIX ACL in the format of the "system.posix_acl_access"
+// extended attribute, granting read access to user 1000.
+func posixACL() []byte {
+	const undefinedID = 0xffffffff
+	entries := []struct {
+		tag, perm uint16
+		id        uint32
+	}{
+		{tag: 0x01, perm: 6, id: undefinedID}, // ACL_USER_OBJ
+		{tag: 0x02, perm: 4, id: 1000},        // ACL_USER
+		{tag: 0x04, perm: 4, id: undefinedID}, // ACL_GROUP_OBJ
+		{tag: 0x10, perm: 4, id: undefinedID}, // ACL_MASK
+		{tag: 0x20, perm: 4, id: undefinedID}, // ACL_OTHER
+	}
+	acl := binary.LittleEndian.AppendUint32(nil, 2) // POSIX_ACL_XATTR_VERSION
+	for _, e := range entries {
+		acl = binary.LittleEndian.AppendUint16(acl, e.tag)
+		acl = binary.LittleEndian.AppendUint16(acl, e.perm)
+		acl = binary.LittleEndian.AppendUint32(acl, e.id)
+	}
+	return acl
+}
+
+func TestTarUntarPreserveACLs(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+
+	origin := t.TempDir()
+	dir := filepath.Join(origin, "dir")
+	file := filepath.Join(origin, "dir", "file")
+	assert.NilError(t, os.Mkdir(dir, 0o755))
+	assert.NilError(t, os.WriteFile(file, []byte("hello"), 0o644))
+
+	acl := posixACL()
+	if err := unix.Lsetxattr(file, aclAccessXattr, acl, 0); err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			t.Skip("filesystem does not support POSIX ACLs")
+		}
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, unix.Lsetxattr(dir, aclDefaultXattr, acl, 0))
+
+	for _, preserve := range []bool{false, true} {
+		rdr, err := TarWithOptions(origin, &TarOptions{PreserveACLs: preserve})
+		assert.NilError(t, err)
+		dest := t.TempDir()
+		err = Untar(rdr, dest, nil)
+		assert.NilError(t, rdr.Close())
+		assert.NilError(t, err)
+
+		for _, tc := range []struct{ path, xattr string }{
+			{path: filepath.Join(dest, "dir"), xattr: aclDefaultXattr},
+			{path: filepath.Join(dest, "dir", "file"), xattr: aclAccessXattr},
+		} {
+			actual, err := lgetxattr(tc.path, tc.xattr)
+			assert.NilError(t, err)
+			if preserve {
+				assert.Check(t, is.DeepEqual(actual, acl), "%s: %s", tc.path, tc.xattr)
+			} else {
+				assert.Check(t, is.Nil(actual), "%s: %s", tc.path, tc.xattr)
+			}
+		}
+	}
+}
+
+func TestUntarDefaultACLInheritance(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+
+	acl := posixACL()
+	if err := unix.Lsetxattr(t.TempDir(), aclDefaultXattr, acl, 0); err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			t.Skip("filesystem does not support POSIX ACLs")
+		}
+		assert.NilError(t, err)
+	}
+
+	// The extended attributes of a directory are applied when its entry is
+	// extracted, so entries extracted into it afterward, including implied
+	// parent directories, inherit its default ACL.
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755, PAXRecords: map[string]string{paxSchilyXattr + aclDefaultXattr: string(acl)}},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "dir/sub/file", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"dir/file": "hello", "dir/sub/file": "hello"})
+	dest := t.TempDir()
+	assert.NilError(t, Untar(archive, dest, nil))
+
+	for _, tc := range []struct{ path, xattr string }{
+		{path: "dir", xattr: aclDefaultXattr},
+		{path: "dir/file", xattr: aclAccessXattr},
+		{path: "dir/sub", xattr: aclDefaultXattr},
+		{path: "dir/sub/file", xattr: aclAccessXattr},
+	} {
+		actual, err := lgetxattr(filepath.Join(dest, tc.path), tc.xattr)
+		assert.NilError(t, err)
+		assert.Check(t, is.DeepEqual(actual, acl), "%s: %s", tc.path, tc.xattr)
+	}
+}
+
+func TestTarUntarDetectSparse(t *testing.T) {
+	const size = 8 << 20
+	origin := t.TempDir()
+	f, err := os.Create(filepath.Join(origin, "sparse"))
+	assert.NilError(t, err)
+	assert.NilError(t, f.Truncate(size))
+	_, err = f.WriteAt([]byte("hello"), size/2)
+	assert.NilError(t, err)
+	assert.NilError(t, f.Close())
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "file"), []byte("world"), 0o644))
+
+	allocated := func(p string) int64 {
+		t.Helper()
+		var st unix.Stat_t
+		assert.NilError(t, unix.Stat(p, &st))
+		return st.Blocks * 512
+	}
+	skip.If(t, allocated(filepath.Join(origin, "sparse")) >= size, "filesystem does not support sparse files")
+
+	rdr, err := TarWithOptions(origin, &TarOptions{DetectSparse: true})
+	assert.NilError(t, err)
+	archive, err := io.ReadAll(rdr)
+	assert.NilError(t, err)
+	assert.NilError(t, rdr.Close())
+	assert.Check(t, len(archive) < 1<<20, "archive is %d bytes", len(archive))
+
+	tr := tar.NewReader(bytes.NewReader(archive))
+	contents := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		assert.NilError(t, err)
+		b, err := io.ReadAll(tr)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(hdr.Size, int64(len(b))))
+		contents[hdr.Name] = b
+	}
+	expected := make([]byte, size)
+	copy(expected[size/2:], "hello")
+	assert.Check(t, is.Len(contents, 2))
+	assert.Check(t, bytes.Equal(contents["sparse"], expected), "unexpected content of sparse file")
+	assert.Check(t, is.Equal(string(contents["file"]), "world"))
+
+	dest := t.TempDir()
+	assert.NilError(t, Untar(bytes.NewReader(archive), dest, &TarOptions{NoLchown: true}))
+	actual, err := os.ReadFile(filepath.Join(dest, "sparse"))
+	assert.NilError(t, err)
+	assert.Check(t, bytes.Equal(actual, expected), "unexpected content of extracted sparse file")
+	assert.Check(t, allocated(filepath.Join(dest, "sparse")) < 1<<20, "extracted sparse file is not sparse")
+
+	changes, err := ChangesDirs(dest, origin)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(changes, 0), "unexpected changes: %v", changes)
+}
+
+func TestUntarSparsify(t *testing.T) {
+	const size = 8 << 20
+	content := make([]byte, size)
+	copy(content[size/2:], "hello")
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"file": string(content)})
+
+	allocated := func(p string) int64 {
+		t.Helper()
+		var st unix.Stat_t
+		assert.NilError(t, unix.Stat(p, &st))
+		return st.Blocks * 512
+	}
+
+	for _, sparsify := range []bool{false, true} {
+		dest := t.TempDir()
+		err := Untar(bytes.NewReader(archive.Bytes()), dest, &TarOptions{NoLchown: true, Sparsify: sparsify})
+		assert.NilError(t, err)
+		actual, err := os.ReadFile(filepath.Join(dest, "file"))
+		assert.NilError(t, err)
+		assert.Check(t, bytes.Equal(actual, content), "unexpected content with Sparsify=%v", sparsify)
+
+		if !sparsify {
+			skip.If(t, allocated(filepath.Join(dest, "file")) < size, "filesystem does not allocate blocks of zeros")
+			continue
+		}
+		assert.Check(t, allocated(filepath.Join(dest, "file")) < 1<<20, "extracted file is not sparse")
+	}
+}
+
+func TestTarWithOptionsPreserveSourceAtime(t *testing.T) {
+	src := t.TempDir()
+	p := filepath.Join(src, "file")
+	assert.NilError(t, os.WriteFile(p, []byte("content"), 0o644))
+	// With relatime, reading the file updates the atime if it is older
+	// than the mtime.
+	atime := time.Unix(1000000000, 0)
+	assert.NilError(t, os.Chtimes(p, atime, time.Now()))
+
+	rdr, err := TarWithOptions(src, &TarOptions{PreserveSourceAtime: true})
+	assert.NilError(t, err)
+	_, err = io.Copy(io.Discard, rdr)
+	assert.NilError(t, err)
+	assert.NilError(t, rdr.Close())
+
+	var st unix.Stat_t
+	assert.NilError(t, unix.Stat(p, &st))
+	assert.Check(t, is.Equal(time.Unix(st.Atim.Unix()), atime))
+}
+
+func TestTarUntarPreciseTimes(t *testing.T) {
+	src := t.TempDir()
+	p := filepath.Join(src, "file")
+	assert.NilError(t, os.WriteFile(p, []byte("content"), 0o644))
+	atime := time.Unix(1700000100, 987654321)
+	mtime := time.Unix(1700000000, 123456789)
+	assert.NilError(t, os.Chtimes(p, atime, mtime))
+
+	rdr, err := TarWithOptions(src, &TarOptions{PreciseTimes: true})
+	assert.NilError(t, err)
+	defer rdr.Close()
+
+	dest := t.TempDir()
+	assert.NilError(t, Untar(rdr, dest, nil))
+
+	var st unix.Stat_t
+	assert.NilError(t, unix.Stat(filepath.Join(dest, "file"), &st))
+	assert.Check(t, is.Equal(time.Unix(st.Mtim.Unix()), mtime))
+	assert.Check(t, is.Equal(time.Unix(st.Atim.Unix()), atime))
+}
+
+func TestTarUntarXattrs(t *testing.T) {
+	origin := t.TempDir()
+	file := filepath.Join(origin, "file")
+	assert.NilError(t, os.WriteFile(file, []byte("hello"), 0o644))
+	if err := unix.Lsetxattr(file, "user.foo", []byte("bar"), 0); err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			t.Skip("filesystem does not support user xattrs")
+		}
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, unix.Lsetxattr(file, "user.secret", []byte("baz"), 0))
+
+	tests := []struct {
+		doc      string
+		options  *TarOptions
+		expected map[string][]byte
+	}{
+		{
+			doc:      "default",
+			options:  &TarOptions{},
+			expected: map[string][]byte{"user.foo": nil, "user.secret": nil},
+		},
+		{
+			doc:      "xattrs",
+			options:  &TarOptions{Xattrs: true},
+			expected: map[string][]byte{"user.foo": []byte("bar"), "user.secret": []byte("baz")},
+		},
+		{
+			doc:      "allow",
+			options:  &TarOptions{Xattrs: true, XattrAllow: []string{"user.f*"}},
+			expected: map[string][]byte{"user.foo": []byte("bar"), "user.secret": nil},
+		},
+		{
+			doc:      "deny",
+			options:  &TarOptions{Xattrs: true, XattrAllow: []string{"user.*"}, XattrDeny: []string{"user.secret"}},
+			expected: map[string][]byte{"user.foo": []byte("bar"), "user.secret": nil},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.doc, func(t *testing.T) {
+			rdr, err := TarWithOptions(origin, tc.options)
+			assert.NilError(t, err)
+			dest := t.TempDir()
+			err = Untar(rdr, dest, nil)
+			assert.NilError(t, rdr.Close())
+			assert.NilError(t, err)
+
+			for xattr, expected := range tc.expected {
+				actual, err := lgetxattr(filepath.Join(dest, "file"), xattr)
+				assert.NilError(t, err)
+				assert.Check(t, is.DeepEqual(actual, expected), xattr)
+			}
+		})
+	}
+}
+
+func TestTarUntarXattrFilter(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+
+	// VFS_CAP_REVISION_2 with CAP_NET_BIND_SERVICE permitted and effective.
+	capability := []byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	noSecurity := func(name string) bool {
+		return !strings.HasPrefix(name, "security.")
+	}
+
+	t.Run("create", func(t *testing.T) {
+		origin := t.TempDir()
+		file := filepath.Join(origin, "file")
+		assert.NilError(t, os.WriteFile(file, []byte("hello"), 0o644))
+		if err := unix.Lsetxattr(file, "user.foo", []byte("bar"), 0); err != nil {
+			if errors.Is(err, unix.ENOTSUP) {
+				t.Skip("filesystem does not support user xattrs")
+			}
+			assert.NilError(t, err)
+		}
+		assert.NilError(t, unix.Lsetxattr(file, "security.capability", capability, 0))
+
+		rdr, err := TarWithOptions(origin, &TarOptions{Xattrs: true, XattrFilter: noSecurity})
+		assert.NilError(t, err)
+		defer rdr.Close()
+
+		tr := tar.NewReader(rdr)
+		hdr, err := tr.Next()
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(hdr.Name, "file"))
+		assert.Check(t, is.Equal(hdr.PAXRecords["SCHILY.xattr.user.foo"], "bar"))
+		_, ok := hdr.PAXRecords["SCHILY.xattr.security.capability"]
+		assert.Check(t, !ok, "security.capability should have been filtered")
+	})
+
+	t.Run("extract", func(t *testing.T) {
+		buf := buildTestArchive(t, []*tar.Header{{
+			Name:     "file",
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Format:   tar.FormatPAX,
+			PAXRecords: map[string]string{
+				"SCHILY.xattr.user.foo":            "bar",
+				"SCHILY.xattr.security.capability": string(capability),
+			},
+		}}, map[string]string{"file": "hello"})
+
+		dest := t.TempDir()
+		err := Untar(buf, dest, &TarOptions{XattrFilter: noSecurity})
+		if errors.Is(err, unix.ENOTSUP) {
+			t.Skip("filesystem does not support user xattrs")
+		}
+		assert.NilError(t, err)
+
+		value, err := lgetxattr(filepath.Join(dest, "file"), "user.foo")
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(string(value), "bar"))
+		value, err = lgetxattr(filepath.Join(dest, "file"), "security.capability")
+		assert.NilError(t, err)
+		assert.Check(t, is.Nil(value))
+	})
+}
+
+func TestTarUntarFileFlags(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+
+	fileFlags := func(t *testing.T, p string) uint32 {
+		t.Helper()
+		fd, err := unix.Open(p, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		assert.NilError(t, err)
+		defer unix.Close(fd)
+		flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+		assert.NilError(t, err)
+		return flags
+	}
+	setFlags := func(p string, flags uint32) error {
+		fd, err := unix.Open(p, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(fd)
+		return unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(flags))
+	}
+	// clearAppendOnly removes the append-only flag from p, so that the
+	// temporary directory can be removed.
+	clearAppendOnly := func(t *testing.T, p string) {
+		t.Cleanup(func() {
+			fd, err := unix.Open(p, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+			if err != nil {
+				return
+			}
+			defer unix.Close(fd)
+			if flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS); err == nil {
+				_ = unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(flags&^fsAppendFl))
+			}
+		})
+	}
+
+	origin := t.TempDir()
+	assert.NilError(t, os.Mkdir(filepath.Join(origin, "dir"), 0o755))
+	file := filepath.Join(origin, "dir", "file")
+	assert.NilError(t, os.WriteFile(file, []byte("hello"), 0o644))
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NilError(t, os.Chtimes(file, mtime, mtime))
+
+	clearAppendOnly(t, file)
+	if err := setFlags(file, fileFlags(t, file)|fsAppendFl); err != nil {
+		if isFileFlagsUnsupported(err) {
+			t.Skip("filesystem does not support file flags")
+		}
+		assert.NilError(t, err)
+	}
+
+	archive, err := TarWithOptions(origin, &TarOptions{PreserveFileFlags: true})
+	assert.NilError(t, err)
+	buf, err := io.ReadAll(archive)
+	assert.NilError(t, err)
+	assert.NilError(t, archive.Close())
+
+	var records []string
+	err = Walk(bytes.NewReader(buf), func(hdr *tar.Header, _ io.Reader) error {
+		if v, ok := hdr.PAXRecords["SCHILY.fflags"]; ok {
+			records = append(records, hdr.Name+"="+v)
+		}
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(records, []string{"dir/file=sappnd"}))
+
+	t.Run("restored", func(t *testing.T) {
+		dest := t.TempDir()
+		clearAppendOnly(t, filepath.Join(dest, "dir", "file"))
+		assert.NilError(t, Untar(bytes.NewReader(buf), dest, &TarOptions{PreserveFileFlags: true}))
+
+		extracted := filepath.Join(dest, "dir", "file")
+		assert.Check(t, fileFlags(t, extracted)&fsAppendFl != 0)
+		content, err := os.ReadFile(extracted)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(string(content), "hello"))
+		fi, err := os.Stat(extracted)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(fi.ModTime().UTC(), mtime))
+		assert.Check(t, fileFlags(t, filepath.Join(dest, "dir"))&fsAppendFl == 0)
+	})
+
+	t.Run("not restored", func(t *testing.T) {
+		dest := t.TempDir()
+		clearAppendOnly(t, filepath.Join(dest, "dir", "file"))
+		assert.NilError(t, Untar(bytes.NewReader(buf), dest, nil))
+		assert.Check(t, fileFlags(t, filepath.Join(dest, "dir", "file"))&fsAppendFl == 0)
+	})
+}
+
+func TestSetxattrInRoot(t *testing.T) {
+	dest := t.TempDir()
+	outside := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(dest, "file"), nil, 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(outside, "file"), nil, 0o644))
+	assert.NilError(t, os.Symlink(outside, filepath.Join(dest, "escape")))
+
+	root, err := os.OpenRoot(dest)
+	assert.NilError(t, err)
+	defer root.Close()
+
+	if err := setxattrInRoot(root, "file", "user.foo", []byte("bar")); errors.Is(err, unix.ENOTSUP) {
+		t.Skip("filesystem does not support user xattrs")
+	} else {
+		assert.NilError(t, err)
+	}
+	value, err := lgetxattr(filepath.Join(dest, "file"), "user.foo")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(value), "bar"))
+
+	err = setxattrInRoot(root, filepath.Join("escape", "file"), "user.foo", []byte("bar"))
+	assert.Check(t, err != nil, "expected an error setting an xattr through a symlink outside of root")
+	value, err = lgetxattr(filepath.Join(outside, "file"), "user.foo")
+	assert.NilError(t, err)
+	assert.Check(t, is.Nil(value))
+
+	t.Run("symlink race", func(t *testing.T) {
+		// Repeatedly replace a directory with a symlink pointing outside of
+		// root while setting xattrs on a file in it.
+		dir := filepath.Join(dest, "dir")
+		assert.NilError(t, os.Mkdir(dir, 0o755))
+		assert.NilError(t, os.WriteFile(filepath.Join(dir, "file"), nil, 0o644))
+		assert.NilError(t, os.Symlink(outside, filepath.Join(dest, "swap")))
+
+		stop := make(chan struct{})
+		swapped := make(chan struct{})
+		go func() {
+			defer close(swapped)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_ = unix.Renameat2(unix.AT_FDCWD, dir, unix.AT_FDCWD, filepath.Join(dest, "swap"), unix.RENAME_EXCHANGE)
+			}
+		}()
+		for range 20000 {
+			_ = setxattrInRoot(root, filepath.Join("dir", "file"), "user.race", []byte("x"))
+		}
+		close(stop)
+		<-swapped
+
+		value, err := lgetxattr(filepath.Join(outside, "file"), "user.race")
+		assert.NilError(t, err)
+		assert.Check(t, is.Nil(value), "xattr was set outside of root")
+	})
+}
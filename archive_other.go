@@ -2,6 +2,40 @@
 
 package archive
 
+import (
+	"archive/tar"
+	"os"
+	"time"
+
+	"github.com/moby/sys/sequential"
+)
+
 func getWhiteoutConverter(format WhiteoutFormat) tarWhiteoutConverter {
 	return nil
 }
+
+func readACLXattrsToTarHeader(string, *tar.Header) error {
+	return nil
+}
+
+// openNoAtime opens the file at path for reading. O_NOATIME is only
+// supported on Linux.
+func openNoAtime(path string) (*os.File, error) {
+	return sequential.Open(path)
+}
+
+// accessTime returns false; access times are only archived on Linux.
+func accessTime(os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// setxattrInRoot sets the extended attribute attr of the file at name within
+// root, without following a final symlink. os.Root has no xattr support; the
+// attribute is set on the path of the file resolved within root.
+func setxattrInRoot(root *os.Root, name, attr string, data []byte) error {
+	p, err := fsRootPath(root.Name(), name)
+	if err != nil {
+		return err
+	}
+	return lsetxattr(p, attr, data, 0)
+}
@@ -4,15 +4,21 @@
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/moby/sys/user"
 	"github.com/moby/sys/userns"
 	"gotest.tools/v3/assert"
@@ -103,6 +109,44 @@ func TestIsArchivePathInvalidFile(t *testing.T) {
 	assert.Check(t, !IsArchivePath(archiveGz), "incorrectly recognised invalid compressed tar path as archive")
 }
 
+func TestIsArchive(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"file": strings.Repeat("content", 10000)})
+
+	for _, c := range []compression.Compression{compression.None, compression.Bzip2, compression.Gzip, compression.Zstd, compression.Lz4} {
+		t.Run(c.Extension(), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := compression.CompressStream(&buf, c)
+			assert.NilError(t, err)
+			_, err = w.Write(archive.Bytes())
+			assert.NilError(t, err)
+			assert.NilError(t, w.Close())
+			expected := bytes.Clone(buf.Bytes())
+
+			ok, r := IsArchive(&buf)
+			assert.Check(t, ok)
+			actual, err := io.ReadAll(r)
+			assert.NilError(t, err)
+			assert.Check(t, bytes.Equal(actual, expected), "replayed stream does not match")
+
+			var invalid bytes.Buffer
+			w, err = compression.CompressStream(&invalid, c)
+			assert.NilError(t, err)
+			_, err = w.Write(bytes.Repeat([]byte("x"), 1024))
+			assert.NilError(t, err)
+			assert.NilError(t, w.Close())
+			expected = bytes.Clone(invalid.Bytes())
+
+			ok, r = IsArchive(&invalid)
+			assert.Check(t, !ok)
+			actual, err = io.ReadAll(r)
+			assert.NilError(t, err)
+			assert.Check(t, bytes.Equal(actual, expected), "replayed stream does not match")
+		})
+	}
+}
+
 func TestIsArchivePathTar(t *testing.T) {
 	tmp := t.TempDir()
 	srcFile := filepath.Join(tmp, "archivedata")
@@ -128,8 +172,24 @@ func TestIsArchivePathTar(t *testing.T) {
 	assert.NilError(t, gw.Close())
 	assert.NilError(t, out.Close())
 
+	lz4File := tarFile + ".lz4"
+	_, err = in.Seek(0, io.SeekStart)
+	assert.NilError(t, err)
+
+	out, err = os.Create(lz4File)
+	assert.NilError(t, err)
+
+	lw, err := compression.CompressStream(out, compression.Lz4)
+	assert.NilError(t, err)
+
+	_, err = io.Copy(lw, in)
+	assert.NilError(t, err)
+	assert.NilError(t, lw.Close())
+	assert.NilError(t, out.Close())
+
 	assert.Check(t, IsArchivePath(tarFile), "did not recognise valid tar path as archive")
 	assert.Check(t, IsArchivePath(gzFile), "did not recognise valid compressed tar path as archive")
+	assert.Check(t, IsArchivePath(lz4File), "did not recognise valid lz4 compressed tar path as archive")
 }
 
 func TestUntarPathWithInvalidDest(t *testing.T) {
@@ -383,6 +443,40 @@ func TestCopyFileWithTarSrcFile(t *testing.T) {
 	}
 }
 
+func TestArchiverContextCancelled(t *testing.T) {
+	folder := t.TempDir()
+	src := filepath.Join(folder, "src")
+	assert.NilError(t, os.MkdirAll(filepath.Join(src, "dir"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "dir", "file"), []byte("content"), 0o644))
+	tarFile := filepath.Join(folder, "src.tar")
+	createTarFromFiles(t, tarFile, src)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancel the context once extraction has started, to verify that
+	// cancellation is observed while reading the archive.
+	archiver := &Archiver{
+		Untar: func(r io.Reader, dst string, options *TarOptions) error {
+			cancel()
+			return Untar(r, dst, options)
+		},
+	}
+
+	dest := filepath.Join(folder, "dest")
+	assert.NilError(t, os.MkdirAll(dest, 0o755))
+	err := archiver.UntarPathCtx(ctx, tarFile, dest)
+	assert.Check(t, is.ErrorIs(err, context.Canceled))
+
+	err = archiver.CopyWithTarCtx(ctx, src, filepath.Join(folder, "copy"))
+	assert.Check(t, is.ErrorIs(err, context.Canceled))
+
+	err = archiver.CopyFileWithTarCtx(ctx, filepath.Join(src, "dir", "file"), filepath.Join(folder, "copy-file"))
+	assert.Check(t, is.ErrorIs(err, context.Canceled))
+	_, err = os.Stat(filepath.Join(folder, "copy-file"))
+	assert.Check(t, is.ErrorIs(err, os.ErrNotExist))
+}
+
 func TestTarFiles(t *testing.T) {
 	// try without hardlinks
 	if err := checkNoChanges(t, 1000, false); err != nil {
@@ -469,7 +563,10 @@ func TestTarUntar(t *testing.T) {
 
 	for _, c := range []compression.Compression{
 		compression.None,
+		compression.Bzip2,
 		compression.Gzip,
+		compression.Zstd,
+		compression.Lz4,
 	} {
 		changes, err := tarUntar(t, origin, &TarOptions{
 			Compression:     c,
@@ -503,6 +600,8 @@ func TestTarWithOptionsChownOptsAlwaysOverridesIdPair(t *testing.T) {
 		},
 	}
 
+	chownFunc := func(*tar.Header) (int, int) { return 2000, 3000 }
+
 	tests := []struct {
 		opts        *TarOptions
 		expectedUID int
@@ -513,6 +612,9 @@ func TestTarWithOptionsChownOptsAlwaysOverridesIdPair(t *testing.T) {
 		{&TarOptions{ChownOpts: &ChownOpts{UID: 0, GID: 0}, NoLchown: false}, 0, 0},
 		{&TarOptions{ChownOpts: &ChownOpts{UID: 1, GID: 1}, NoLchown: true}, 1, 1},
 		{&TarOptions{ChownOpts: &ChownOpts{UID: 1000, GID: 1000}, NoLchown: true}, 1000, 1000},
+		{&TarOptions{ChownFunc: chownFunc}, 2000, 3000},
+		{&TarOptions{ChownFunc: chownFunc, ChownOpts: &ChownOpts{UID: 1337, GID: 42}}, 2000, 3000},
+		{&TarOptions{ChownFunc: chownFunc, IDMap: user.IdentityMapping{UIDMaps: idMaps, GIDMaps: idMaps}}, 2000, 3000},
 	}
 	for _, tc := range tests {
 		t.Run("", func(t *testing.T) {
@@ -585,6 +687,43 @@ func TestTypeXGlobalHeaderDoesNotFail(t *testing.T) {
 	}
 }
 
+// TestCreateTarFileContentSize verifies that the content of regular files is
+// bounded by the size in the header, and that content that is longer or
+// shorter than the size is rejected.
+func TestCreateTarFileContentSize(t *testing.T) {
+	for _, tc := range []struct {
+		doc         string
+		content     string
+		sparsify    bool
+		expectedErr string
+	}{
+		{doc: "exact", content: "hello"},
+		{doc: "exact sparsify", content: "hello", sparsify: true},
+		{doc: "longer", content: "hello world", expectedErr: `content of "file" is longer than its size of 5 bytes`},
+		{doc: "longer sparsify", content: "hello world", sparsify: true, expectedErr: `content of "file" is longer than its size of 5 bytes`},
+		{doc: "shorter", content: "hell", expectedErr: `content of "file" is shorter than its size of 5 bytes: unexpected EOF`},
+		{doc: "shorter sparsify", content: "hell", sparsify: true, expectedErr: "unexpected EOF"},
+	} {
+		t.Run(tc.doc, func(t *testing.T) {
+			dest := t.TempDir()
+			root, err := os.OpenRoot(dest)
+			assert.NilError(t, err)
+			defer root.Close()
+
+			hdr := &tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644, Size: 5}
+			err = createTarFile(root, hdr.Name, hdr, strings.NewReader(tc.content), &TarOptions{NoLchown: true, Sparsify: tc.sparsify})
+			if tc.expectedErr != "" {
+				assert.Check(t, is.ErrorContains(err, tc.expectedErr))
+				return
+			}
+			assert.NilError(t, err)
+			content, err := os.ReadFile(filepath.Join(dest, "file"))
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(string(content), tc.content))
+		})
+	}
+}
+
 // TestCreateTarFileSymlinkPreservesLinkname verifies that symlink targets are
 // treated as opaque values and are preserved verbatim rather than converted to
 // platform-native path syntax during extraction.
@@ -745,6 +884,214 @@ func BenchmarkTarUntarWithLinks(b *testing.B) {
 	}
 }
 
+func BenchmarkTarCompressionLevel(b *testing.B) {
+	origin, err := os.MkdirTemp(b.TempDir(), "docker-test-untar-origin")
+	if err != nil {
+		b.Fatal(err)
+	}
+	n, err := prepareUntarSourceDirectory(100, origin, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, level := range []int{1, 9} {
+		b.Run(fmt.Sprintf("level=%d", level), func(b *testing.B) {
+			b.SetBytes(int64(n))
+			var size int64
+			for b.Loop() {
+				rdr, err := TarWithOptions(origin, &TarOptions{
+					Compression:      compression.Gzip,
+					CompressionLevel: &level,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				size, err = io.Copy(io.Discard, rdr)
+				_ = rdr.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(size), "compressed-bytes")
+		})
+	}
+}
+
+func BenchmarkTarUntarCopyBufferSize(b *testing.B) {
+	origin := b.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 8<<20/16)
+	for i := range 4 {
+		if err := os.WriteFile(filepath.Join(origin, fmt.Sprintf("file-%d", i)), data, 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, size := range []int{0, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(4 * len(data)))
+			target := filepath.Join(b.TempDir(), "dest")
+			for b.Loop() {
+				rdr, err := TarWithOptions(origin, &TarOptions{CopyBufferSize: size})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := os.Mkdir(target, 0o755); err != nil {
+					b.Fatal(err)
+				}
+				err = Untar(rdr, target, &TarOptions{CopyBufferSize: size})
+				_ = rdr.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := os.RemoveAll(target); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUntarSmallFiles(b *testing.B) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for i := range 10000 {
+		hdr := &tar.Header{Name: fmt.Sprintf("dir-%d/file-%d", i%100, i), Typeflag: tar.TypeReg, Mode: 0o644, Size: 4}
+		if err := tw.WriteHeader(hdr); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := tw.Write([]byte("fooo")); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	b.ReportAllocs()
+	target := filepath.Join(b.TempDir(), "dest")
+	for b.Loop() {
+		if err := os.Mkdir(target, 0o755); err != nil {
+			b.Fatal(err)
+		}
+		if err := Untar(bytes.NewReader(archive), target, &TarOptions{NoLchown: true}); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.RemoveAll(target); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestTarUntarCopyBufferSize(t *testing.T) {
+	origin := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "file"), data, 0o644))
+
+	// A buffer size that does not divide the size of the file.
+	options := &TarOptions{CopyBufferSize: 333}
+	rdr, err := TarWithOptions(origin, options)
+	assert.NilError(t, err)
+	defer rdr.Close()
+
+	dest := t.TempDir()
+	assert.NilError(t, Untar(rdr, dest, options))
+	content, err := os.ReadFile(filepath.Join(dest, "file"))
+	assert.NilError(t, err)
+	assert.Check(t, bytes.Equal(content, data))
+}
+
+func BenchmarkTarFlushPerEntry(b *testing.B) {
+	origin := b.TempDir()
+	for i := range 10000 {
+		dir := filepath.Join(origin, fmt.Sprintf("dir-%d", i%100))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%d", i)), []byte("fooo"), 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, flush := range []bool{false, true} {
+		b.Run(fmt.Sprintf("flush=%t", flush), func(b *testing.B) {
+			var size int64
+			for b.Loop() {
+				rdr, err := TarWithOptions(origin, &TarOptions{
+					Compression:   compression.Gzip,
+					FlushPerEntry: flush,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				size, err = io.Copy(io.Discard, rdr)
+				_ = rdr.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(size), "compressed-bytes")
+		})
+	}
+}
+
+func TestTarFlushPerEntry(t *testing.T) {
+	origin := t.TempDir()
+	for i := range 10 {
+		assert.NilError(t, os.WriteFile(filepath.Join(origin, fmt.Sprintf("file-%d", i)), []byte("fooo"), 0o644))
+	}
+
+	tarSize := func(flush, parallel bool) int64 {
+		t.Helper()
+		var stats TarStats
+		rdr, err := TarWithOptions(origin, &TarOptions{Compression: compression.Gzip, ParallelCompression: parallel, FlushPerEntry: flush, Stats: &stats})
+		assert.NilError(t, err)
+		defer rdr.Close()
+		data, err := io.ReadAll(rdr)
+		assert.NilError(t, err)
+
+		// Every file has a header block, and its content is padded to a
+		// block.
+		assert.Check(t, is.Equal(stats.PaddingBytes, int64(10*(blockSize+blockSize-len("fooo")))))
+
+		dest := t.TempDir()
+		assert.NilError(t, Untar(bytes.NewReader(data), dest, nil))
+		assert.Check(t, is.Len(dirNames(t, dest), 10))
+		return int64(len(data))
+	}
+
+	// Flushing the compressor for every entry adds a sync marker per entry,
+	// so the archive is larger.
+	assert.Check(t, tarSize(true, false) > tarSize(false, false))
+	assert.Check(t, tarSize(true, true) > tarSize(false, true))
+
+	_, err := TarWithOptions(origin, &TarOptions{Compression: compression.Bzip2, FlushPerEntry: true})
+	assert.Check(t, is.Error(err, "FlushPerEntry is not supported with tar.bz2 compression"))
+}
+
+func TestTarWithOptionsInvalidCompressionLevel(t *testing.T) {
+	level := 42
+	_, err := TarWithOptions(t.TempDir(), &TarOptions{
+		Compression:      compression.Gzip,
+		CompressionLevel: &level,
+	})
+	assert.Check(t, is.ErrorContains(err, "invalid compression level 42"))
+}
+
+func TestTarUntarParallelCompression(t *testing.T) {
+	origin := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "small"), []byte("hello world"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "large"), bytes.Repeat([]byte("0123456789abcdef"), 256*1024), 0o644))
+
+	changes, err := tarUntar(t, origin, &TarOptions{
+		Compression:            compression.Gzip,
+		ParallelCompression:    true,
+		CompressionConcurrency: 2,
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(changes, 0))
+}
+
 func TestUntarInvalidFilenames(t *testing.T) {
 	for i, headers := range [][]*tar.Header{
 		{
@@ -762,6 +1109,27 @@ func TestUntarInvalidFilenames(t *testing.T) {
 				Mode:     0o644,
 			},
 		},
+		{
+			{
+				Name:     `C:\victim`,
+				Typeflag: tar.TypeReg,
+				Mode:     0o644,
+			},
+		},
+		{
+			{
+				Name:     `\\host\share\x`,
+				Typeflag: tar.TypeReg,
+				Mode:     0o644,
+			},
+		},
+		{
+			{
+				Name:     `\..\x`,
+				Typeflag: tar.TypeReg,
+				Mode:     0o644,
+			},
+		},
 	} {
 		if err := testBreakout("untar", "docker-TestUntarInvalidFilenames", headers); err != nil {
 			t.Fatalf("i=%d. %v", i, err)
@@ -769,6 +1137,102 @@ func TestUntarInvalidFilenames(t *testing.T) {
 	}
 }
 
+// TestUntarWindowsAbsolutePaths verifies that Windows absolute, drive-relative,
+// rooted, and UNC entry names are rejected on all platforms.
+func TestUntarWindowsAbsolutePaths(t *testing.T) {
+	for _, name := range []string{
+		`C:\victim`,
+		`c:/victim`,
+		`C:victim`,
+		`/C:\victim`,
+		`\\host\share\x`,
+		`\..\x`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			headers := []*tar.Header{{Name: name, Typeflag: tar.TypeReg, Mode: 0o644}}
+
+			err := Untar(buildTestArchive(t, headers, nil), t.TempDir(), &TarOptions{NoLchown: true})
+			assert.Check(t, is.ErrorType(err, &breakoutErr{}))
+
+			_, err = UnpackLayer(t.TempDir(), buildTestArchive(t, headers, nil), nil)
+			assert.Check(t, is.ErrorType(err, &breakoutErr{}))
+
+			err = ValidateArchive(buildTestArchive(t, headers, nil), nil)
+			assert.Check(t, is.ErrorContains(err, "invalid entry name"))
+		})
+	}
+
+	t.Run("hardlink target", func(t *testing.T) {
+		headers := []*tar.Header{{Name: "link", Typeflag: tar.TypeLink, Linkname: `C:\victim`}}
+		err := Untar(buildTestArchive(t, headers, nil), t.TempDir(), &TarOptions{NoLchown: true})
+		assert.Check(t, is.ErrorContains(err, "invalid hardlink target"))
+	})
+
+	t.Run("valid names", func(t *testing.T) {
+		skip.If(t, runtime.GOOS == "windows", "colons are not valid in paths on Windows")
+		for _, name := range []string{"C", "dir/C:x", "ab:c"} {
+			cleaned, err := cleanEntryName(name)
+			assert.Check(t, err, name)
+			assert.Check(t, is.Equal(cleaned, name))
+		}
+	})
+}
+
+func TestUntarStrictTypeflags(t *testing.T) {
+	headers := func() []*tar.Header {
+		return []*tar.Header{
+			{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "contiguous", Typeflag: tar.TypeCont, Mode: 0o644},
+		}
+	}
+	contents := map[string]string{"file": "new"}
+
+	t.Run("strict", func(t *testing.T) {
+		dest := t.TempDir()
+		assert.NilError(t, os.WriteFile(filepath.Join(dest, "contiguous"), []byte("existing"), 0o644))
+
+		options := &TarOptions{NoLchown: true, StrictTypeflags: true, ExcludePatterns: []string{"contiguous"}}
+		err := Untar(buildTestArchive(t, headers(), contents), dest, options)
+		assert.Check(t, is.Error(err, `unsupported tar header type 55 for "contiguous"`))
+
+		content, err := os.ReadFile(filepath.Join(dest, "contiguous"))
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(string(content), "existing"))
+
+		err = ValidateArchive(buildTestArchive(t, headers(), contents), options)
+		assert.Check(t, is.Error(err, `unsupported tar header type 55 for "contiguous"`))
+	})
+
+	t.Run("excluded", func(t *testing.T) {
+		dest := t.TempDir()
+		options := &TarOptions{NoLchown: true, ExcludePatterns: []string{"contiguous"}}
+		err := Untar(buildTestArchive(t, headers(), contents), dest, options)
+		assert.NilError(t, err)
+
+		content, err := os.ReadFile(filepath.Join(dest, "file"))
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(string(content), "new"))
+
+		_, err = os.Lstat(filepath.Join(dest, "contiguous"))
+		assert.Check(t, os.IsNotExist(err))
+	})
+
+	t.Run("default", func(t *testing.T) {
+		// Without StrictTypeflags, entries before the unsupported one are
+		// extracted, and the unsupported entry fails to extract.
+		dest := t.TempDir()
+		err := Untar(buildTestArchive(t, headers(), contents), dest, &TarOptions{NoLchown: true})
+		assert.Check(t, is.Error(err, `failed to create entry "contiguous" (type '7'): unsupported tar header type 55 for "contiguous"`))
+
+		content, err := os.ReadFile(filepath.Join(dest, "file"))
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(string(content), "new"))
+
+		_, err = os.Lstat(filepath.Join(dest, "contiguous"))
+		assert.Check(t, os.IsNotExist(err))
+	})
+}
+
 // TestUntarParentTraversalContained verifies that entries whose names traverse
 // above the destination (including a bare "..") are rejected and never write
 // into the destination's parent. Regression test for the "write to the parent
@@ -1131,42 +1595,810 @@ func TestXGlobalNoParent(t *testing.T) {
 	assert.Check(t, is.ErrorIs(err, os.ErrNotExist))
 }
 
-func TestReplaceFileTarWrapper(t *testing.T) {
-	filesInArchive := 20
+func TestUntarOnGlobalHeader(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "foo/pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "hello"}},
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"schema": "2"}},
+	}, map[string]string{"file": "content"})
+
+	var records []map[string]string
+	tmpDir := t.TempDir()
+	err := Untar(archive, tmpDir, &TarOptions{
+		OnGlobalHeader: func(r map[string]string) {
+			records = append(records, r)
+		},
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(records, []map[string]string{
+		{"comment": "hello"},
+		{"schema": "2"},
+	}))
+
+	entries, err := os.ReadDir(tmpDir)
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(entries, 1))
+	assert.Check(t, is.Equal(entries[0].Name(), "file"))
+}
+
+// buildTestArchive returns an uncompressed archive with the given headers.
+// Regular files get the content from the contents map, keyed by header name.
+func buildTestArchive(t *testing.T, headers []*tar.Header, contents map[string]string) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range headers {
+		content := contents[hdr.Name]
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(content))
+		}
+		assert.NilError(t, tw.WriteHeader(hdr))
+		if content != "" {
+			_, err := tw.Write([]byte(content))
+			assert.NilError(t, err)
+		}
+	}
+	assert.NilError(t, tw.Close())
+	return buf
+}
+
+func TestUntarOnEntry(t *testing.T) {
+	headers := []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "excluded/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file"},
+	}
+	contents := map[string]string{
+		"dir/file":      "hello world",
+		"excluded/file": "excluded",
+	}
+
+	type entry struct {
+		Name    string
+		Written int64
+	}
+	var entries []entry
+	err := Untar(buildTestArchive(t, headers, contents), t.TempDir(), &TarOptions{
+		NoLchown:        true,
+		ExcludePatterns: []string{"excluded"},
+		OnEntry: func(hdr *tar.Header, written int64) error {
+			entries = append(entries, entry{Name: hdr.Name, Written: written})
+			return nil
+		},
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(entries, []entry{
+		{Name: "dir", Written: 0},
+		{Name: "dir/file", Written: 11},
+		{Name: "dir/link", Written: 0},
+	}))
+
+	errAbort := errors.New("abort")
+	var calls int
+	err = Untar(buildTestArchive(t, headers, contents), t.TempDir(), &TarOptions{
+		NoLchown: true,
+		OnEntry: func(*tar.Header, int64) error {
+			calls++
+			return errAbort
+		},
+	})
+	assert.Check(t, is.ErrorIs(err, errAbort))
+	assert.Check(t, is.Equal(calls, 1))
+}
+
+func TestUntarExtractionLimits(t *testing.T) {
+	headers := func() []*tar.Header {
+		return []*tar.Header{
+			{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "dir/file1", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file1"},
+			{Name: "dir/file2", Typeflag: tar.TypeReg, Mode: 0o644},
+		}
+	}
+	contents := map[string]string{
+		"dir/file1": "hello",
+		"dir/file2": "world!",
+	}
+
 	tests := []struct {
-		doc       string
-		filename  string
-		modifier  TarModifierFunc
-		expected  string
-		fileCount int
+		doc         string
+		opts        *TarOptions
+		expectedErr string
 	}{
 		{
-			doc:       "Modifier creates a new file",
-			filename:  "newfile",
-			modifier:  createModifier(t),
-			expected:  "the new content",
-			fileCount: filesInArchive + 1,
+			doc:  "no limits",
+			opts: &TarOptions{},
 		},
 		{
-			doc:       "Modifier replaces a file",
-			filename:  "file-2",
-			modifier:  createOrReplaceModifier,
-			expected:  "the new content",
-			fileCount: filesInArchive,
+			doc:  "within limits",
+			opts: &TarOptions{MaxEntries: 4, MaxUncompressedSize: 11},
 		},
 		{
-			doc:       "Modifier replaces the last file",
-			filename:  fmt.Sprintf("file-%d", filesInArchive-1),
-			modifier:  createOrReplaceModifier,
-			expected:  "the new content",
-			fileCount: filesInArchive,
+			doc:         "too many entries",
+			opts:        &TarOptions{MaxEntries: 3},
+			expectedErr: "archive contains more than 3 entries: extraction limit exceeded",
 		},
 		{
-			doc:       "Modifier appends to a file",
-			filename:  "file-3",
-			modifier:  appendModifier,
-			expected:  "fooo\nnext line",
-			fileCount: filesInArchive,
+			doc:         "too large",
+			opts:        &TarOptions{MaxUncompressedSize: 10},
+			expectedErr: `extracting "dir/file2" exceeds the maximum uncompressed size of 10 bytes: extraction limit exceeded`,
+		},
+		{
+			doc:  "files within limit",
+			opts: &TarOptions{MaxFileSize: 6},
+		},
+		{
+			doc:         "file too large",
+			opts:        &TarOptions{MaxFileSize: 5},
+			expectedErr: `"dir/file2" has a size of 6 bytes, which exceeds the maximum file size of 5 bytes: extraction limit exceeded`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.doc, func(t *testing.T) {
+			tc.opts.NoLchown = true
+			dest := t.TempDir()
+			err := Untar(buildTestArchive(t, headers(), contents), dest, tc.opts)
+			if tc.expectedErr == "" {
+				assert.NilError(t, err)
+				return
+			}
+			assert.Check(t, is.ErrorIs(err, ErrExtractionLimitExceeded))
+			assert.Check(t, is.Error(err, tc.expectedErr))
+			_, err = os.Lstat(filepath.Join(dest, "dir", "file2"))
+			assert.Check(t, is.ErrorIs(err, os.ErrNotExist))
+		})
+	}
+}
+
+func TestFileSizeLimitReader(t *testing.T) {
+	for _, tc := range []struct {
+		content     string
+		expectedErr string
+	}{
+		{content: ""},
+		{content: "hello"},
+		{content: "hello!", expectedErr: `content of "file" exceeds the maximum file size of 5 bytes: extraction limit exceeded`},
+		{content: strings.Repeat("a", 100), expectedErr: `content of "file" exceeds the maximum file size of 5 bytes: extraction limit exceeded`},
+	} {
+		r := limitFileSize(strings.NewReader(tc.content), &tar.Header{Name: "file"}, &TarOptions{MaxFileSize: 5})
+		var buf bytes.Buffer
+		_, err := io.Copy(&buf, iotest.OneByteReader(r))
+		if tc.expectedErr == "" {
+			assert.Check(t, err)
+			assert.Check(t, is.Equal(buf.String(), tc.content))
+			continue
+		}
+		assert.Check(t, is.ErrorIs(err, ErrExtractionLimitExceeded))
+		assert.Check(t, is.Error(err, tc.expectedErr))
+		assert.Check(t, is.Equal(buf.String(), tc.content[:5]))
+	}
+}
+
+func TestUntarEntryError(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "dir/link", Typeflag: tar.TypeLink, Linkname: "dir/missing"},
+	}, nil)
+	err := Untar(archive, t.TempDir(), &TarOptions{NoLchown: true})
+	assert.Check(t, is.ErrorContains(err, `failed to create entry "dir/link" (hardlink): `))
+	assert.Check(t, is.ErrorIs(err, os.ErrNotExist))
+
+	// Entries with ids that are not mapped are reported by name.
+	idMap := []user.IDMap{{ID: 0, ParentID: 100000, Count: 1000}}
+	archive = buildTestArchive(t, []*tar.Header{
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 5000, Gid: 5000},
+	}, nil)
+	err = Untar(archive, t.TempDir(), &TarOptions{NoLchown: true, IDMap: user.IdentityMapping{UIDMaps: idMap, GIDMaps: idMap}})
+	assert.Check(t, is.ErrorContains(err, `failed to create entry "file" (file): `))
+}
+
+func TestUntarDetectCaseCollisions(t *testing.T) {
+	tests := []struct {
+		doc         string
+		headers     []*tar.Header
+		expectedErr string
+	}{
+		{
+			doc: "files",
+			headers: []*tar.Header{
+				{Name: "Foo", Typeflag: tar.TypeReg, Mode: 0o644},
+				{Name: "foo", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+			expectedErr: `entry names differ only in case: "Foo" and "foo"`,
+		},
+		{
+			doc: "parent directories",
+			headers: []*tar.Header{
+				{Name: "Dir/a", Typeflag: tar.TypeReg, Mode: 0o644},
+				{Name: "dir/b", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+			expectedErr: `entry names differ only in case: "Dir" and "dir"`,
+		},
+		{
+			doc: "same name",
+			headers: []*tar.Header{
+				{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+				{Name: "dir/foo", Typeflag: tar.TypeReg, Mode: 0o644},
+				{Name: "dir/foo", Typeflag: tar.TypeReg, Mode: 0o644},
+				{Name: "dir/Bar", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.doc, func(t *testing.T) {
+			options := &TarOptions{DetectCaseCollisions: true}
+			err := Untar(buildTestArchive(t, tc.headers, nil), t.TempDir(), options)
+			if tc.expectedErr == "" {
+				assert.NilError(t, err)
+				assert.NilError(t, ValidateArchive(buildTestArchive(t, tc.headers, nil), options))
+				assert.NilError(t, UntarTo(buildTestArchive(t, tc.headers, nil), memTarget{}, options))
+				return
+			}
+			assert.Check(t, is.ErrorIs(err, ErrCaseCollision))
+			assert.Check(t, is.Error(err, tc.expectedErr))
+
+			// ValidateArchive and UntarTo detect the same collisions.
+			err = ValidateArchive(buildTestArchive(t, tc.headers, nil), options)
+			assert.Check(t, is.Error(err, tc.expectedErr))
+			err = UntarTo(buildTestArchive(t, tc.headers, nil), memTarget{}, options)
+			assert.Check(t, is.Error(err, tc.expectedErr))
+
+			// Collisions are not detected by default.
+			assert.NilError(t, Untar(buildTestArchive(t, tc.headers, nil), t.TempDir(), nil))
+		})
+	}
+}
+
+func TestUntarParentIsNotADirectory(t *testing.T) {
+	headers := func() []*tar.Header {
+		return []*tar.Header{
+			{Name: "a", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "a/b", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "c", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "c/d/e", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "f", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "f/g/", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "h", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "h/i/j/", Typeflag: tar.TypeDir, Mode: 0o755},
+		}
+	}
+	contents := map[string]string{"a": "a", "a/b": "b", "c": "c", "c/d/e": "e", "f": "f", "h": "h"}
+
+	t.Run("replace", func(t *testing.T) {
+		dest := t.TempDir()
+		assert.NilError(t, Untar(buildTestArchive(t, headers(), contents), dest, nil))
+		for _, name := range []string{"a/b", "c/d/e"} {
+			content, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(string(content), contents[name]))
+		}
+		for _, name := range []string{"f/g", "h/i/j"} {
+			fi, err := os.Lstat(filepath.Join(dest, filepath.FromSlash(name)))
+			assert.NilError(t, err)
+			assert.Check(t, fi.IsDir())
+		}
+	})
+
+	t.Run("NoOverwriteDirNonDir", func(t *testing.T) {
+		dest := t.TempDir()
+		err := Untar(buildTestArchive(t, headers(), contents), dest, &TarOptions{NoOverwriteDirNonDir: true})
+		assert.Check(t, is.ErrorContains(err, `cannot create "a/b": parent "a" is not a directory`))
+		content, err := os.ReadFile(filepath.Join(dest, "a"))
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(string(content), "a"))
+
+		dest = t.TempDir()
+		err = Untar(buildTestArchive(t, headers()[4:], contents), dest, &TarOptions{NoOverwriteDirNonDir: true})
+		assert.Check(t, is.ErrorContains(err, `cannot create "f/g": parent "f" is not a directory`))
+	})
+}
+
+func TestUntarSkipExisting(t *testing.T) {
+	mtime := time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC)
+	headers := func() []*tar.Header {
+		return []*tar.Header{
+			{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: mtime},
+			{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: mtime},
+			{Name: "dir/other", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: mtime},
+			{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file", ModTime: mtime},
+			{Name: "replaced", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: mtime},
+		}
+	}
+	contents := map[string]string{"dir/file": "archived", "dir/other": "other", "replaced": "archived"}
+
+	readFile := func(t *testing.T, name string) string {
+		t.Helper()
+		b, err := os.ReadFile(name)
+		assert.NilError(t, err)
+		return string(b)
+	}
+
+	setup := func(t *testing.T) string {
+		t.Helper()
+		dest := t.TempDir()
+		assert.NilError(t, os.Mkdir(filepath.Join(dest, "dir"), 0o755))
+		// Same size and modification time as in the archive.
+		assert.NilError(t, os.WriteFile(filepath.Join(dest, "dir", "file"), []byte("existing"), 0o644))
+		assert.NilError(t, os.Chtimes(filepath.Join(dest, "dir", "file"), mtime, mtime))
+		// Different size.
+		assert.NilError(t, os.WriteFile(filepath.Join(dest, "dir", "other"), []byte("existing"), 0o644))
+		assert.NilError(t, os.Symlink("other", filepath.Join(dest, "dir", "link")))
+		// Different type.
+		assert.NilError(t, os.Mkdir(filepath.Join(dest, "replaced"), 0o755))
+		return dest
+	}
+
+	t.Run("skip existing", func(t *testing.T) {
+		dest := setup(t)
+		err := Untar(buildTestArchive(t, headers(), contents), dest, &TarOptions{NoLchown: true, SkipExisting: true})
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(readFile(t, filepath.Join(dest, "dir", "file")), "existing"))
+		assert.Check(t, is.Equal(readFile(t, filepath.Join(dest, "dir", "other")), "existing"))
+		link, err := os.Readlink(filepath.Join(dest, "dir", "link"))
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(link, "other"))
+		assert.Check(t, is.Equal(readFile(t, filepath.Join(dest, "replaced")), "archived"))
+	})
+
+	t.Run("match size and modification time", func(t *testing.T) {
+		dest := setup(t)
+		err := Untar(buildTestArchive(t, headers(), contents), dest, &TarOptions{
+			NoLchown:                        true,
+			SkipExisting:                    true,
+			SkipExistingMatchSizeAndModTime: true,
+		})
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(readFile(t, filepath.Join(dest, "dir", "file")), "existing"))
+		assert.Check(t, is.Equal(readFile(t, filepath.Join(dest, "dir", "other")), "other"))
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		dest := setup(t)
+		err := Untar(buildTestArchive(t, headers(), contents), dest, &TarOptions{NoLchown: true})
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(readFile(t, filepath.Join(dest, "dir", "file")), "archived"))
+		assert.Check(t, is.Equal(readFile(t, filepath.Join(dest, "dir", "other")), "other"))
+		link, err := os.Readlink(filepath.Join(dest, "dir", "link"))
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(link, "file"))
+	})
+}
+
+func TestUntarPathLimits(t *testing.T) {
+	headers := func() []*tar.Header {
+		return []*tar.Header{
+			{Name: "a/", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "a/b/", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "a/b/c", Typeflag: tar.TypeReg, Mode: 0o644},
+		}
+	}
+
+	t.Run("depth", func(t *testing.T) {
+		dest := t.TempDir()
+		err := Untar(buildTestArchive(t, headers(), nil), dest, &TarOptions{MaxPathDepth: 3})
+		assert.NilError(t, err)
+
+		dest = t.TempDir()
+		err = Untar(buildTestArchive(t, headers(), nil), dest, &TarOptions{MaxPathDepth: 2})
+		assert.Check(t, is.ErrorIs(err, ErrExtractionLimitExceeded))
+		assert.Check(t, is.Error(err, `path of "a/b/c" has a depth of 3, which exceeds the maximum of 2: extraction limit exceeded`))
+		_, err = os.Lstat(filepath.Join(dest, "a", "b", "c"))
+		assert.Check(t, is.ErrorIs(err, os.ErrNotExist))
+	})
+
+	t.Run("length", func(t *testing.T) {
+		dest := t.TempDir()
+		maxLen := len(filepath.Join(dest, "a", "b", "c"))
+		err := Untar(buildTestArchive(t, headers(), nil), dest, &TarOptions{MaxPathLength: maxLen})
+		assert.NilError(t, err)
+
+		dest = t.TempDir()
+		maxLen = len(filepath.Join(dest, "a", "b"))
+		err = Untar(buildTestArchive(t, headers(), nil), dest, &TarOptions{MaxPathLength: maxLen})
+		assert.Check(t, is.ErrorIs(err, ErrExtractionLimitExceeded))
+		assert.Check(t, is.ErrorContains(err, `path of "a/b/c" has a length of`))
+		_, err = os.Lstat(filepath.Join(dest, "a", "b", "c"))
+		assert.Check(t, is.ErrorIs(err, os.ErrNotExist))
+	})
+}
+
+func TestTarWithOptionsDeterministic(t *testing.T) {
+	createDir := func(names []string, mtime time.Time) string {
+		dir := t.TempDir()
+		assert.NilError(t, os.Mkdir(filepath.Join(dir, "sub"), 0o755))
+		for _, name := range names {
+			p := filepath.Join(dir, name)
+			assert.NilError(t, os.WriteFile(p, []byte("content of "+name), 0o644))
+			assert.NilError(t, os.Chtimes(p, mtime, mtime))
+		}
+		assert.NilError(t, os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "sub", "link")))
+		assert.NilError(t, os.Chtimes(filepath.Join(dir, "sub"), mtime, mtime))
+		return dir
+	}
+	digest := func(dir string, includes ...string) [sha256.Size]byte {
+		rdr, err := TarWithOptions(dir, &TarOptions{
+			Deterministic: true,
+			IncludeFiles:  includes,
+		})
+		assert.NilError(t, err)
+		defer rdr.Close()
+		b, err := io.ReadAll(rdr)
+		assert.NilError(t, err)
+		return sha256.Sum256(b)
+	}
+
+	dir1 := createDir([]string{"a", "b", "sub/c"}, time.Now())
+	dir2 := createDir([]string{"sub/c", "b", "a"}, time.Now().Add(-time.Hour))
+
+	assert.Check(t, is.Equal(digest(dir1), digest(dir2)))
+	assert.Check(t, is.Equal(digest(dir1, "b", "a", "sub"), digest(dir2, "sub", "a", "b")))
+
+	rdr, err := TarWithOptions(dir1, &TarOptions{Deterministic: true})
+	assert.NilError(t, err)
+	defer rdr.Close()
+	err = Walk(rdr, func(hdr *tar.Header, _ io.Reader) error {
+		assert.Check(t, hdr.ModTime.Equal(time.Unix(0, 0)), "unexpected mtime for %s: %s", hdr.Name, hdr.ModTime)
+		assert.Check(t, is.Equal(hdr.Uname, ""))
+		assert.Check(t, is.Equal(hdr.Gname, ""))
+		return nil
+	})
+	assert.NilError(t, err)
+}
+
+func TestTarWithOptionsModTimeOverride(t *testing.T) {
+	origin := t.TempDir()
+	assert.NilError(t, os.Mkdir(filepath.Join(origin, "dir"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "file"), []byte("hello"), 0o644))
+	assert.NilError(t, os.Symlink("file", filepath.Join(origin, "dir", "link")))
+
+	modTime := time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC)
+	rdr, err := TarWithOptions(origin, &TarOptions{ModTimeOverride: &modTime})
+	assert.NilError(t, err)
+	defer rdr.Close()
+
+	var names []string
+	err = Walk(rdr, func(hdr *tar.Header, _ io.Reader) error {
+		names = append(names, hdr.Name)
+		assert.Check(t, hdr.ModTime.Equal(modTime), "unexpected mtime for %s: %s", hdr.Name, hdr.ModTime)
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(names, []string{"dir/", "dir/file", "dir/link"}))
+}
+
+func TestTarWithOptionsForceMode(t *testing.T) {
+	origin := t.TempDir()
+	assert.NilError(t, os.MkdirAll(filepath.Join(origin, "dir", "sub"), 0o700))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "sub", "file"), []byte("hello"), 0o600))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "exec"), []byte("hello"), 0o700))
+
+	// Directory modes are synthesized on Windows.
+	fi, err := os.Stat(filepath.Join(origin, "dir"))
+	assert.NilError(t, err)
+	origDirMode := chmodTarEntry(int64(fi.Mode().Perm()))
+
+	fileMode, dirMode := os.FileMode(0o644), os.FileMode(0o755)
+	for _, tc := range []struct {
+		doc      string
+		options  *TarOptions
+		expected map[string]int64
+	}{
+		{
+			doc:     "forced",
+			options: &TarOptions{ForceMode: &fileMode, ForceDirMode: &dirMode},
+			expected: map[string]int64{
+				"dir/":         0o755,
+				"dir/exec":     0o644,
+				"dir/sub/":     0o755,
+				"dir/sub/file": 0o644,
+			},
+		},
+		{
+			doc:     "files only",
+			options: &TarOptions{ForceMode: &fileMode},
+			expected: map[string]int64{
+				"dir/":         origDirMode,
+				"dir/exec":     0o644,
+				"dir/sub/":     origDirMode,
+				"dir/sub/file": 0o644,
+			},
+		},
+		{
+			doc:     "implied directories",
+			options: &TarOptions{IncludeFiles: []string{filepath.FromSlash("dir/sub/file")}, ParentsFirst: true, ForceMode: &fileMode, ForceDirMode: &dirMode},
+			expected: map[string]int64{
+				"dir/":         0o755,
+				"dir/sub/":     0o755,
+				"dir/sub/file": 0o644,
+			},
+		},
+	} {
+		t.Run(tc.doc, func(t *testing.T) {
+			rdr, err := TarWithOptions(origin, tc.options)
+			assert.NilError(t, err)
+			defer rdr.Close()
+
+			modes := make(map[string]int64)
+			err = Walk(rdr, func(hdr *tar.Header, _ io.Reader) error {
+				modes[hdr.Name] = hdr.Mode
+				return nil
+			})
+			assert.NilError(t, err)
+			assert.Check(t, is.DeepEqual(modes, tc.expected))
+		})
+	}
+}
+
+func TestTarWithOptionsFileFilter(t *testing.T) {
+	origin := t.TempDir()
+	assert.NilError(t, os.MkdirAll(filepath.Join(origin, "dir", "sub"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "small"), []byte("a"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "large"), bytes.Repeat([]byte("a"), 100), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "sub", "old"), []byte("a"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "sub", "new"), []byte("a"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "excluded"), []byte("a"), 0o644))
+
+	threshold := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	oldTime := threshold.Add(-time.Hour)
+	assert.NilError(t, os.Chtimes(filepath.Join(origin, "dir", "sub", "old"), oldTime, oldTime))
+	assert.NilError(t, os.Chtimes(filepath.Join(origin, "dir", "small"), oldTime, oldTime))
+
+	tarNames := func(options *TarOptions) []string {
+		t.Helper()
+		rdr, err := TarWithOptions(origin, options)
+		assert.NilError(t, err)
+		defer rdr.Close()
+
+		var names []string
+		err = Walk(rdr, func(hdr *tar.Header, _ io.Reader) error {
+			names = append(names, hdr.Name)
+			return nil
+		})
+		assert.NilError(t, err)
+		return names
+	}
+
+	t.Run("size", func(t *testing.T) {
+		names := tarNames(&TarOptions{
+			ExcludePatterns: []string{"excluded"},
+			FileFilter: func(_ string, info os.FileInfo) bool {
+				return info.IsDir() || info.Size() < 10
+			},
+		})
+		assert.Check(t, is.DeepEqual(names, []string{"dir/", "dir/small", "dir/sub/", "dir/sub/new", "dir/sub/old"}))
+	})
+
+	t.Run("mtime", func(t *testing.T) {
+		names := tarNames(&TarOptions{
+			IncludeFiles: []string{"dir/sub"},
+			FileFilter: func(_ string, info os.FileInfo) bool {
+				return info.IsDir() || info.ModTime().After(threshold)
+			},
+		})
+		assert.Check(t, is.DeepEqual(names, []string{"dir/sub/", "dir/sub/new"}))
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		var paths []string
+		names := tarNames(&TarOptions{
+			FileFilter: func(p string, _ os.FileInfo) bool {
+				paths = append(paths, p)
+				return p != "dir/sub"
+			},
+		})
+		assert.Check(t, is.DeepEqual(names, []string{"dir/", "dir/large", "dir/small", "excluded"}))
+		assert.Check(t, is.DeepEqual(paths, []string{"dir", "dir/large", "dir/small", "dir/sub", "excluded"}))
+	})
+}
+
+func TestTarWithOptionsOwnerNames(t *testing.T) {
+	origin := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "file"), []byte("hello"), 0o644))
+
+	tarOwners := func(options *TarOptions) [][2]string {
+		t.Helper()
+		rdr, err := TarWithOptions(origin, options)
+		assert.NilError(t, err)
+		defer rdr.Close()
+
+		var owners [][2]string
+		err = Walk(rdr, func(hdr *tar.Header, _ io.Reader) error {
+			owners = append(owners, [2]string{hdr.Uname, hdr.Gname})
+			return nil
+		})
+		assert.NilError(t, err)
+		return owners
+	}
+
+	// Only numeric ownership is recorded by default.
+	assert.Check(t, is.DeepEqual(tarOwners(&TarOptions{}), [][2]string{{"", ""}}))
+
+	chownOpts := &ChownOpts{UID: 1000, GID: 1001}
+	assert.Check(t, is.DeepEqual(tarOwners(&TarOptions{
+		ChownOpts:  chownOpts,
+		OwnerNames: map[int]string{1000: "user"},
+		GroupNames: map[int]string{1001: "group"},
+	}), [][2]string{{"user", "group"}}))
+	assert.Check(t, is.DeepEqual(tarOwners(&TarOptions{
+		ChownOpts:     chownOpts,
+		OwnerNames:    map[int]string{0: "root"},
+		GroupNames:    map[int]string{1001: "group"},
+		Deterministic: true,
+	}), [][2]string{{"", "group"}}))
+}
+
+func TestTarWithOptionsStats(t *testing.T) {
+	origin := t.TempDir()
+	assert.NilError(t, os.Mkdir(filepath.Join(origin, "dir"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "file"), []byte("hello"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "other"), []byte("world!"), 0o644))
+	assert.NilError(t, os.Link(filepath.Join(origin, "dir", "file"), filepath.Join(origin, "hardlink")))
+	assert.NilError(t, os.Symlink("other", filepath.Join(origin, "symlink")))
+
+	tarBytes := func(opts *TarOptions) []byte {
+		t.Helper()
+		rdr, err := TarWithOptions(origin, opts)
+		assert.NilError(t, err)
+		defer rdr.Close()
+		b, err := io.ReadAll(rdr)
+		assert.NilError(t, err)
+		return b
+	}
+
+	var stats TarStats
+	withStats := tarBytes(&TarOptions{Deterministic: true, Stats: &stats})
+	assert.Check(t, is.DeepEqual(stats, TarStats{
+		RegularFiles: 2,
+		Directories:  1,
+		Symlinks:     1,
+		Hardlinks:    1,
+		Bytes:        int64(len("hello") + len("world!")),
+		// Everything but the content and the end-of-archive marker.
+		PaddingBytes: int64(len(withStats)-len("hello")-len("world!")) - 2*blockSize,
+	}))
+
+	withoutStats := tarBytes(&TarOptions{Deterministic: true})
+	assert.Check(t, bytes.Equal(withStats, withoutStats), "collecting stats must not change the archive")
+}
+
+func TestTarWithOptionsTarFormat(t *testing.T) {
+	longName := strings.Repeat("a", 120)
+	origin := t.TempDir()
+	assert.NilError(t, os.Mkdir(filepath.Join(origin, "dir"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "file"), []byte("hello"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, longName), []byte("world"), 0o644))
+
+	tests := []struct {
+		format   tar.Format
+		expected map[string]tar.Format
+	}{
+		{
+			format: tar.FormatUnknown,
+			expected: map[string]tar.Format{
+				"dir/":     tar.FormatUSTAR,
+				"dir/file": tar.FormatUSTAR,
+				longName:   tar.FormatPAX,
+			},
+		},
+		{
+			// USTAR headers are valid PAX headers, and are reported as
+			// USTAR when reading them back.
+			format: tar.FormatPAX,
+			expected: map[string]tar.Format{
+				"dir/":     tar.FormatUSTAR,
+				"dir/file": tar.FormatUSTAR,
+				longName:   tar.FormatPAX,
+			},
+		},
+		{
+			format: tar.FormatGNU,
+			expected: map[string]tar.Format{
+				"dir/":     tar.FormatGNU,
+				"dir/file": tar.FormatGNU,
+				longName:   tar.FormatGNU,
+			},
+		},
+		{
+			// The long name cannot be represented in USTAR, and is skipped.
+			format: tar.FormatUSTAR,
+			expected: map[string]tar.Format{
+				"dir/":     tar.FormatUSTAR,
+				"dir/file": tar.FormatUSTAR,
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.format.String(), func(t *testing.T) {
+			rdr, err := TarWithOptions(origin, &TarOptions{TarFormat: tc.format})
+			assert.NilError(t, err)
+			defer rdr.Close()
+
+			actual := map[string]tar.Format{}
+			tr := tar.NewReader(rdr)
+			for {
+				hdr, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				assert.NilError(t, err)
+				actual[hdr.Name] = hdr.Format
+			}
+			assert.Check(t, is.DeepEqual(actual, tc.expected))
+		})
+	}
+}
+
+func TestTarWithOptionsOnDigest(t *testing.T) {
+	origin := t.TempDir()
+	assert.NilError(t, os.Mkdir(filepath.Join(origin, "dir"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "file"), bytes.Repeat([]byte("hello"), 1000), 0o644))
+
+	for _, c := range []compression.Compression{compression.None, compression.Gzip, compression.Zstd} {
+		t.Run(c.Extension(), func(t *testing.T) {
+			var digest, uncompressedDigest [sha256.Size]byte
+			var called int
+			rdr, err := TarWithOptions(origin, &TarOptions{
+				Compression: c,
+				OnDigest: func(d, ud [sha256.Size]byte) {
+					called++
+					digest, uncompressedDigest = d, ud
+				},
+			})
+			assert.NilError(t, err)
+			defer rdr.Close()
+
+			out, err := io.ReadAll(rdr)
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(called, 1))
+			assert.Check(t, is.Equal(digest, sha256.Sum256(out)))
+
+			dr, err := compression.DecompressStream(bytes.NewReader(out))
+			assert.NilError(t, err)
+			defer dr.Close()
+			uncompressed, err := io.ReadAll(dr)
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(uncompressedDigest, sha256.Sum256(uncompressed)))
+		})
+	}
+}
+
+func TestReplaceFileTarWrapper(t *testing.T) {
+	filesInArchive := 20
+	tests := []struct {
+		doc       string
+		filename  string
+		modifier  TarModifierFunc
+		expected  string
+		fileCount int
+	}{
+		{
+			doc:       "Modifier creates a new file",
+			filename:  "newfile",
+			modifier:  createModifier(t),
+			expected:  "the new content",
+			fileCount: filesInArchive + 1,
+		},
+		{
+			doc:       "Modifier replaces a file",
+			filename:  "file-2",
+			modifier:  createOrReplaceModifier,
+			expected:  "the new content",
+			fileCount: filesInArchive,
+		},
+		{
+			doc:       "Modifier replaces the last file",
+			filename:  fmt.Sprintf("file-%d", filesInArchive-1),
+			modifier:  createOrReplaceModifier,
+			expected:  "the new content",
+			fileCount: filesInArchive,
+		},
+		{
+			doc:       "Modifier appends to a file",
+			filename:  "file-3",
+			modifier:  appendModifier,
+			expected:  "fooo\nnext line",
+			fileCount: filesInArchive,
 		},
 	}
 
@@ -1183,6 +2415,52 @@ func TestReplaceFileTarWrapper(t *testing.T) {
 	}
 }
 
+func TestRemoveFileTarWrapper(t *testing.T) {
+	headers := []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "dir/sub/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "dir/sub/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "dir-file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "secret", Typeflag: tar.TypeReg, Mode: 0o600},
+	}
+	contents := map[string]string{"dir/file": "a", "dir/sub/file": "b", "dir-file": "c", "secret": "d"}
+
+	list := func(t *testing.T, rdr io.ReadCloser) []string {
+		t.Helper()
+		defer rdr.Close()
+		hdrs, err := ListArchive(rdr)
+		assert.NilError(t, err)
+		var names []string
+		for _, hdr := range hdrs {
+			names = append(names, hdr.Name)
+		}
+		return names
+	}
+
+	t.Run("modifier returning nil header", func(t *testing.T) {
+		src := io.NopCloser(buildTestArchive(t, headers, contents))
+		names := list(t, ReplaceFileTarWrapper(src, map[string]TarModifierFunc{
+			"secret": func(string, *tar.Header, io.Reader) (*tar.Header, []byte, error) {
+				return nil, nil, nil
+			},
+		}))
+		assert.Check(t, is.DeepEqual(names, []string{"dir", "dir/file", "dir/sub", "dir/sub/file", "dir-file"}))
+	})
+
+	t.Run("keep descendants", func(t *testing.T) {
+		src := io.NopCloser(buildTestArchive(t, headers, contents))
+		names := list(t, RemoveFileTarWrapper(src, []string{"dir/", "secret"}, false))
+		assert.Check(t, is.DeepEqual(names, []string{"dir/file", "dir/sub", "dir/sub/file", "dir-file"}))
+	})
+
+	t.Run("remove descendants", func(t *testing.T) {
+		src := io.NopCloser(buildTestArchive(t, headers, contents))
+		names := list(t, RemoveFileTarWrapper(src, []string{"dir/", "secret"}, true))
+		assert.Check(t, is.DeepEqual(names, []string{"dir-file"}))
+	})
+}
+
 // TestPrefixHeaderReadable tests that files that could be created with the
 // version of this package that was built with <=go17 are still readable.
 func TestPrefixHeaderReadable(t *testing.T) {
@@ -1253,3 +2531,228 @@ func readFileFromArchive(t *testing.T, archive io.ReadCloser, name string, expec
 	assert.Check(t, err)
 	return string(content)
 }
+
+func TestUntarStripComponents(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "README", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "pkg-1.0/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "pkg-1.0/bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "pkg-1.0/bin/tool", Typeflag: tar.TypeReg, Mode: 0o755},
+		{Name: "pkg-1.0/lib/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "pkg-1.0/lib/tool", Typeflag: tar.TypeSymlink, Linkname: "../../pkg-1.0/bin/tool"},
+		{Name: "pkg-1.0/lib/relative", Typeflag: tar.TypeSymlink, Linkname: "../bin/tool"},
+		{Name: "pkg-1.0/lib/absolute", Typeflag: tar.TypeSymlink, Linkname: "/usr/bin/tool"},
+		{Name: "pkg-1.0/lib/outside", Typeflag: tar.TypeSymlink, Linkname: "../../../tool"},
+		{Name: "pkg-1.0/hardlink", Typeflag: tar.TypeLink, Linkname: "pkg-1.0/bin/tool"},
+		{Name: "pkg-1.0/skipped", Typeflag: tar.TypeLink, Linkname: "README"},
+		{Name: "pkg-1.0/excluded", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{
+		"README":           "readme",
+		"pkg-1.0/bin/tool": "tool",
+		"pkg-1.0/excluded": "excluded",
+	})
+
+	type entry struct {
+		Name, Linkname string
+	}
+	var entries []entry
+	tmpDir := t.TempDir()
+	err := Untar(archive, tmpDir, &TarOptions{
+		NoLchown:        true,
+		StripComponents: 1,
+		ExcludePatterns: []string{"pkg-1.0/excluded"},
+		OnEntry: func(hdr *tar.Header, _ int64) error {
+			entries = append(entries, entry{Name: hdr.Name, Linkname: hdr.Linkname})
+			return nil
+		},
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(entries, []entry{
+		{Name: "bin"},
+		{Name: "bin/tool"},
+		{Name: "lib"},
+		{Name: "lib/tool", Linkname: "../bin/tool"},
+		{Name: "lib/relative", Linkname: "../bin/tool"},
+		{Name: "lib/absolute", Linkname: "/usr/bin/tool"},
+		{Name: "lib/outside", Linkname: "../../../tool"},
+		{Name: "hardlink", Linkname: "bin/tool"},
+	}))
+
+	for _, name := range []string{"lib/tool", "hardlink"} {
+		content, err := os.ReadFile(filepath.Join(tmpDir, name))
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(string(content), "tool"), name)
+	}
+	_, err = os.Lstat(filepath.Join(tmpDir, "README"))
+	assert.Check(t, is.ErrorIs(err, os.ErrNotExist))
+}
+
+func TestUntarWithCompression(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"file": "content"})
+	var compressed bytes.Buffer
+	w, err := compression.CompressStream(&compressed, compression.Gzip)
+	assert.NilError(t, err)
+	_, err = io.Copy(w, archive)
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+
+	tmpDir := t.TempDir()
+	err = UntarWithCompression(bytes.NewReader(compressed.Bytes()), tmpDir, compression.Gzip, &TarOptions{NoLchown: true})
+	assert.NilError(t, err)
+	content, err := os.ReadFile(filepath.Join(tmpDir, "file"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(content), "content"))
+
+	err = UntarWithCompression(bytes.NewReader(compressed.Bytes()), t.TempDir(), compression.Zstd, &TarOptions{NoLchown: true})
+	assert.Check(t, is.ErrorContains(err, "failed to decompress archive as tar.zst"))
+
+	// The archive is not decompressed if no compression is specified.
+	err = UntarWithCompression(bytes.NewReader(compressed.Bytes()), t.TempDir(), compression.None, &TarOptions{NoLchown: true})
+	assert.Check(t, err != nil)
+}
+
+func TestTarUntarCompressionDict(t *testing.T) {
+	// Build a dictionary from archives of directories similar to the one
+	// that is compressed.
+	createDir := func(version int) string {
+		dir := t.TempDir()
+		config := fmt.Sprintf(`{"architecture":"amd64","os":"linux","config":{"Env":["PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"],"Cmd":["/bin/sh"],"Labels":{"version":"%d"}}}`, version)
+		assert.NilError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0o644))
+		assert.NilError(t, os.WriteFile(filepath.Join(dir, "VERSION"), []byte(strconv.Itoa(version)), 0o644))
+		return dir
+	}
+	archive := func(dir string, opts *TarOptions) []byte {
+		rdr, err := TarWithOptions(dir, opts)
+		assert.NilError(t, err)
+		defer rdr.Close()
+		b, err := io.ReadAll(rdr)
+		assert.NilError(t, err)
+		return b
+	}
+
+	var samples [][]byte
+	for version := range 10 {
+		samples = append(samples, archive(createDir(version), &TarOptions{Deterministic: true}))
+	}
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       1,
+		Contents: samples,
+		History:  samples[0],
+		Offsets:  [3]int{1, 4, 8},
+	})
+	assert.NilError(t, err)
+
+	// The level is validated the same way with and without dictionary.
+	level := 0
+	for _, d := range [][]byte{nil, dict} {
+		_, err := TarWithOptions(t.TempDir(), &TarOptions{Compression: compression.Zstd, CompressionLevel: &level, CompressionDict: d})
+		assert.Check(t, is.ErrorContains(err, "invalid compression level 0 for tar.zst"))
+	}
+
+	src := createDir(100)
+	withDict := archive(src, &TarOptions{Deterministic: true, Compression: compression.Zstd, CompressionDict: dict})
+	withoutDict := archive(src, &TarOptions{Deterministic: true, Compression: compression.Zstd})
+	assert.Check(t, len(withDict) < len(withoutDict), "compressed size with dictionary %d, without %d", len(withDict), len(withoutDict))
+
+	dst := t.TempDir()
+	assert.NilError(t, Untar(bytes.NewReader(withDict), dst, &TarOptions{NoLchown: true, CompressionDict: dict}))
+	content, err := os.ReadFile(filepath.Join(dst, "VERSION"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(content), "100"))
+
+	// Archives compressed without the dictionary can still be extracted.
+	assert.NilError(t, Untar(bytes.NewReader(withoutDict), t.TempDir(), &TarOptions{NoLchown: true, CompressionDict: dict}))
+
+	err = Untar(bytes.NewReader(withDict), t.TempDir(), &TarOptions{NoLchown: true})
+	assert.Check(t, err != nil, "expected error extracting without dictionary")
+
+	// UntarTo and ValidateArchive use the dictionary in the same way.
+	target := memTarget{}
+	assert.NilError(t, UntarTo(bytes.NewReader(withDict), target, &TarOptions{CompressionDict: dict}))
+	assert.Check(t, is.Equal(target["VERSION"].Content, "100"))
+	assert.Check(t, UntarTo(bytes.NewReader(withDict), memTarget{}, nil) != nil, "expected error extracting without dictionary")
+
+	assert.Check(t, ValidateArchive(bytes.NewReader(withDict), &TarOptions{CompressionDict: dict}))
+	assert.Check(t, ValidateArchive(bytes.NewReader(withDict), nil) != nil, "expected error validating without dictionary")
+}
+
+func TestTarWithOptionsParentsFirst(t *testing.T) {
+	src := t.TempDir()
+	assert.NilError(t, os.MkdirAll(filepath.Join(src, "a", "b"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "a", "b", "c"), []byte("c"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "a", "d"), []byte("d"), 0o644))
+
+	tests := []struct {
+		doc      string
+		options  *TarOptions
+		expected []string
+	}{
+		{
+			doc:      "include without ParentsFirst",
+			options:  &TarOptions{IncludeFiles: []string{filepath.FromSlash("a/b/c")}},
+			expected: []string{filepath.FromSlash("a/b/c")},
+		},
+		{
+			doc:      "include",
+			options:  &TarOptions{IncludeFiles: []string{filepath.FromSlash("a/b/c")}, ParentsFirst: true},
+			expected: []string{"a", "a/b", "a/b/c"},
+		},
+		{
+			doc:      "include parent after child",
+			options:  &TarOptions{IncludeFiles: []string{filepath.FromSlash("a/b/c"), "a"}, ParentsFirst: true},
+			expected: []string{"a", "a/b", "a/b/c", "a/d"},
+		},
+		{
+			doc:      "rebase",
+			options:  &TarOptions{IncludeFiles: []string{filepath.FromSlash("a/b/c")}, RebaseNames: map[string]string{filepath.FromSlash("a/b/c"): filepath.FromSlash("x/y/c")}, ParentsFirst: true},
+			expected: []string{"x", "x/y", "x/y/c"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.doc, func(t *testing.T) {
+			rdr, err := TarWithOptions(src, tc.options)
+			assert.NilError(t, err)
+			defer rdr.Close()
+
+			headers, err := ListArchive(rdr)
+			assert.NilError(t, err)
+			var names []string
+			for _, hdr := range headers {
+				names = append(names, hdr.Name)
+				if hdr.Name == "x" || hdr.Name == "x/y" {
+					assert.Check(t, is.Equal(hdr.Typeflag, byte(tar.TypeDir)))
+					assert.Check(t, is.Equal(hdr.Mode, chmodTarEntry(ImpliedDirectoryMode)))
+				}
+			}
+			assert.Check(t, is.DeepEqual(names, tc.expected))
+		})
+	}
+}
+
+func TestUntarConcatenatedGzipMembers(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "file1", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "dir/file2", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"file1": "hello", "dir/file2": "world"}).Bytes()
+
+	// Split the tar stream in the middle of an entry, and compress both
+	// parts as separate gzip members.
+	var compressed bytes.Buffer
+	for _, part := range [][]byte{archive[:700], archive[700:]} {
+		w := gzip.NewWriter(&compressed)
+		_, err := w.Write(part)
+		assert.NilError(t, err)
+		assert.NilError(t, w.Close())
+	}
+
+	dest := t.TempDir()
+	assert.NilError(t, Untar(&compressed, dest, &TarOptions{NoLchown: true}))
+	for name, expected := range map[string]string{"file1": "hello", "dir/file2": "world"} {
+		content, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(string(content), expected))
+	}
+}
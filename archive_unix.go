@@ -8,7 +8,6 @@
 	"fmt"
 	"math"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 	"syscall"
@@ -24,6 +23,11 @@ func addLongPathPrefix(srcPath string) string {
 	return srcPath
 }
 
+// openDestRoot opens dest as the root to extract into.
+func openDestRoot(dest string) (*os.Root, error) {
+	return os.OpenRoot(dest)
+}
+
 // getWalkRoot calculates the root path when performing a TarWithOptions.
 // We use a separate function as this is platform specific. On Linux, we
 // can't use filepath.Join(srcPath,include) because this will clean away
@@ -85,28 +89,6 @@ func handleTarTypeBlockCharFifo(root *os.Root, hdr *tar.Header, dstPath string)
 	return mknodInRoot(root, dstPath, mode, unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
 }
 
-// handleLChmod applies the mode from hdrInfo to dstPath within root, skipping
-// symlinks (there is no lchmod). For hardlinks, the mode is applied only when
-// the link target is itself not a symlink.
-func handleLChmod(root *os.Root, dstPath string, hdr *tar.Header, hdrInfo os.FileInfo) error {
-	switch hdr.Typeflag {
-	case tar.TypeSymlink:
-		return nil
-
-	case tar.TypeLink:
-		// If the target is a symlink, there is no way to chmod the hardlink
-		// without following it.
-		fi, err := root.Lstat(filepath.FromSlash(path.Clean(hdr.Linkname)))
-		if err != nil || fi.Mode()&os.ModeSymlink != 0 {
-			return nil
-		}
-		return chmodNoSymlink(root, dstPath, hdrInfo.Mode())
-
-	default:
-		return chmodNoSymlink(root, dstPath, hdrInfo.Mode())
-	}
-}
-
 // chmodNoSymlink applies mode to a non-symlink entry.
 //
 // Callers must have already excluded symlink entries.
@@ -10,13 +10,18 @@
 	"io"
 	"io/fs"
 	"math"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/moby/sys/user"
 	"github.com/moby/sys/userns"
 	"golang.org/x/sys/unix"
 	"gotest.tools/v3/assert"
@@ -126,6 +131,33 @@ func TestImpliedDirectoryPermissions(t *testing.T) {
 			assertMode("explicit/permissions/umask/file", 0o666)
 		})
 	}
+
+	t.Run("ImpliedDirMode", func(t *testing.T) {
+		restore := overrideUmask(0o022)
+		defer restore()
+
+		tmpDir := t.TempDir()
+		mode := os.FileMode(0o700)
+		err := Untar(bytes.NewReader(buf.Bytes()), tmpDir, &TarOptions{ImpliedDirMode: &mode})
+		assert.NilError(t, err)
+
+		assertMode := func(path string, expected fs.FileMode) {
+			t.Helper()
+			stat, err := os.Lstat(filepath.Join(tmpDir, path))
+			assert.Check(t, err)
+			assert.Check(t, is.Equal(stat.Mode().Perm(), expected))
+		}
+
+		assertMode("deeply", 0o700)
+		assertMode("deeply/nested", 0o700)
+		assertMode("deeply/nested/and", 0o700)
+
+		assertMode("explicit", 0o644)
+		assertMode("explicit/permissions", 0o600)
+		assertMode("explicit/permissions/specified", 0o400)
+		assertMode("explicit/permissions/umask", 0o777)
+		assertMode("explicit/permissions/umask/file", 0o666)
+	})
 }
 
 func TestUnpackLayerCreatesImpliedDirectoriesThroughLowerLayerSymlink(t *testing.T) {
@@ -269,6 +301,82 @@ func TestTarWithHardLinkAndRebase(t *testing.T) {
 	assert.Check(t, is.Equal(i1, i2))
 }
 
+func TestTarWithHardLinkIncludeFiles(t *testing.T) {
+	origin := t.TempDir()
+	for _, dir := range []string{"a", "b", "c"} {
+		assert.NilError(t, os.Mkdir(filepath.Join(origin, dir), 0o755))
+	}
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "a", "1"), []byte("hello world"), 0o644))
+	assert.NilError(t, os.Link(filepath.Join(origin, "a", "1"), filepath.Join(origin, "b", "2")))
+	assert.NilError(t, os.Link(filepath.Join(origin, "a", "1"), filepath.Join(origin, "c", "3")))
+
+	// sanity check that we can hardlink
+	if n, err := getNlink(filepath.Join(origin, "a", "1")); err != nil || n != 3 {
+		t.Skipf("skipping since hardlinks don't work here; expected 3 links, got %d (%v)", n, err)
+	}
+
+	tests := []struct {
+		doc     string
+		opts    *TarOptions
+		regular string
+		link    string
+	}{
+		{
+			doc:     "first not included",
+			opts:    &TarOptions{IncludeFiles: []string{"b", "c"}},
+			regular: "b/2",
+			link:    "c/3",
+		},
+		{
+			doc:     "first excluded",
+			opts:    &TarOptions{ExcludePatterns: []string{"a"}},
+			regular: "b/2",
+			link:    "c/3",
+		},
+		{
+			doc:     "rebased",
+			opts:    &TarOptions{IncludeFiles: []string{"c", "b"}, RebaseNames: map[string]string{"b": "x", "c": "y"}},
+			regular: "y/3",
+			link:    "x/2",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.doc, func(t *testing.T) {
+			rdr, err := TarWithOptions(origin, tc.opts)
+			assert.NilError(t, err)
+			archive, err := io.ReadAll(rdr)
+			assert.NilError(t, err)
+			assert.NilError(t, rdr.Close())
+
+			var files []string
+			tr := tar.NewReader(bytes.NewReader(archive))
+			for {
+				hdr, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				assert.NilError(t, err)
+				switch hdr.Typeflag {
+				case tar.TypeReg:
+					files = append(files, "reg:"+hdr.Name)
+					assert.Check(t, is.Equal(hdr.Size, int64(len("hello world"))))
+				case tar.TypeLink:
+					files = append(files, "link:"+hdr.Name+"->"+hdr.Linkname)
+				}
+			}
+			assert.Check(t, is.DeepEqual(files, []string{"reg:" + tc.regular, "link:" + tc.link + "->" + tc.regular}))
+
+			dest := t.TempDir()
+			assert.NilError(t, Untar(bytes.NewReader(archive), dest, &TarOptions{NoLchown: true}))
+			i1, err := getInode(filepath.Join(dest, tc.regular))
+			assert.NilError(t, err)
+			i2, err := getInode(filepath.Join(dest, tc.link))
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(i1, i2))
+		})
+	}
+}
+
 // TestUntarParentPathPermissions is a regression test to check that missing
 // parent directories are created with the expected permissions
 func TestUntarParentPathPermissions(t *testing.T) {
@@ -286,6 +394,189 @@ func TestUntarParentPathPermissions(t *testing.T) {
 	assert.Equal(t, fi.Mode(), 0o755|os.ModeDir)
 }
 
+func TestUntarChownFunc(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+
+	idMaps := []user.IDMap{{ID: 0, ParentID: 100000, Count: 65536}}
+	chownFunc := func(hdr *tar.Header) (int, int) {
+		// Collapse all ids to the first one.
+		return hdr.Uid - hdr.Uid%1000, hdr.Gid - hdr.Gid%1000
+	}
+	tests := []struct {
+		doc         string
+		opts        *TarOptions
+		expectedUID int
+		expectedGID int
+	}{
+		{doc: "none", opts: &TarOptions{}, expectedUID: 1234, expectedGID: 5678},
+		{doc: "ChownOpts", opts: &TarOptions{ChownOpts: &ChownOpts{UID: 1, GID: 2}}, expectedUID: 1, expectedGID: 2},
+		{doc: "ChownFunc", opts: &TarOptions{ChownFunc: chownFunc}, expectedUID: 1000, expectedGID: 5000},
+		{doc: "ChownFunc and ChownOpts", opts: &TarOptions{ChownFunc: chownFunc, ChownOpts: &ChownOpts{UID: 1, GID: 2}}, expectedUID: 1000, expectedGID: 5000},
+		{doc: "ChownFunc and IDMap", opts: &TarOptions{ChownFunc: chownFunc, IDMap: user.IdentityMapping{UIDMaps: idMaps, GIDMaps: idMaps}}, expectedUID: 101000, expectedGID: 105000},
+	}
+	for _, tc := range tests {
+		t.Run(tc.doc, func(t *testing.T) {
+			archive := buildTestArchive(t, []*tar.Header{
+				{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 1234, Gid: 5678},
+			}, nil)
+			tmpDir := t.TempDir()
+			assert.NilError(t, Untar(archive, tmpDir, tc.opts))
+
+			fi, err := os.Lstat(filepath.Join(tmpDir, "file"))
+			assert.NilError(t, err)
+			st := fi.Sys().(*syscall.Stat_t)
+			assert.Check(t, is.Equal(int(st.Uid), tc.expectedUID))
+			assert.Check(t, is.Equal(int(st.Gid), tc.expectedGID))
+		})
+	}
+}
+
+func TestUntarOnOwnership(t *testing.T) {
+	type ownership [2]int // uid, gid
+	idMaps := []user.IDMap{{ID: 0, ParentID: 100000, Count: 65536}}
+	tests := []struct {
+		doc      string
+		opts     *TarOptions
+		expected map[string]ownership
+	}{
+		{
+			doc:  "archive ownership",
+			opts: &TarOptions{},
+			expected: map[string]ownership{
+				"implied":      {0, 0},
+				"implied/file": {1234, 5678},
+				"dir":          {1, 2},
+				"dir/link":     {1234, 5678},
+			},
+		},
+		{
+			doc:  "IDMap",
+			opts: &TarOptions{IDMap: user.IdentityMapping{UIDMaps: idMaps, GIDMaps: idMaps}},
+			expected: map[string]ownership{
+				"implied":      {100000, 100000},
+				"implied/file": {101234, 105678},
+				"dir":          {100001, 100002},
+				"dir/link":     {101234, 105678},
+			},
+		},
+		{
+			doc:  "NoLchown and ChownOpts",
+			opts: &TarOptions{NoLchown: true, ChownOpts: &ChownOpts{UID: 7, GID: 8}},
+			expected: map[string]ownership{
+				"implied":      {0, 0},
+				"implied/file": {7, 8},
+				"dir":          {7, 8},
+				"dir/link":     {7, 8},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.doc, func(t *testing.T) {
+			archive := buildTestArchive(t, []*tar.Header{
+				{Name: "implied/file", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 1234, Gid: 5678},
+				{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755, Uid: 1, Gid: 2},
+				{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "../implied/file", Uid: 1234, Gid: 5678},
+			}, map[string]string{"implied/file": "hello"})
+			tmpDir := t.TempDir()
+
+			recorded := make(map[string]ownership)
+			tc.opts.OnOwnership = func(path string, uid, gid int) {
+				recorded[path] = ownership{uid, gid}
+			}
+			assert.NilError(t, Untar(archive, tmpDir, tc.opts))
+			assert.Check(t, is.DeepEqual(recorded, tc.expected))
+
+			// Ownership is not applied.
+			for p := range tc.expected {
+				fi, err := os.Lstat(filepath.Join(tmpDir, p))
+				assert.NilError(t, err)
+				st := fi.Sys().(*syscall.Stat_t)
+				assert.Check(t, is.Equal(int(st.Uid), os.Getuid()), p)
+				assert.Check(t, is.Equal(int(st.Gid), os.Getgid()), p)
+			}
+		})
+	}
+}
+
+func TestUntarClearSpecialBits(t *testing.T) {
+	tests := []struct {
+		doc              string
+		clearSpecialBits bool
+		expectedFile     os.FileMode
+		expectedDir      os.FileMode
+	}{
+		{doc: "preserve", expectedFile: 0o755 | os.ModeSetuid, expectedDir: 0o755 | os.ModeDir | os.ModeSticky},
+		{doc: "clear", clearSpecialBits: true, expectedFile: 0o755, expectedDir: 0o755 | os.ModeDir},
+	}
+	for _, tc := range tests {
+		t.Run(tc.doc, func(t *testing.T) {
+			archive := buildTestArchive(t, []*tar.Header{
+				{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o1755},
+				{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o4755},
+				{Name: "dir/hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file", Mode: 0o4755},
+			}, map[string]string{"dir/file": "content"})
+			tmpDir := t.TempDir()
+			assert.NilError(t, Untar(archive, tmpDir, &TarOptions{
+				NoLchown:         true,
+				ClearSpecialBits: tc.clearSpecialBits,
+			}))
+
+			fi, err := os.Lstat(filepath.Join(tmpDir, "dir", "file"))
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(fi.Mode(), tc.expectedFile))
+
+			fi, err = os.Lstat(filepath.Join(tmpDir, "dir"))
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(fi.Mode(), tc.expectedDir))
+		})
+	}
+}
+
+func TestUntarExtractUmask(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+
+	tests := []struct {
+		umask    os.FileMode
+		expected map[string]os.FileMode
+	}{
+		{
+			umask: 0o022,
+			expected: map[string]os.FileMode{
+				"dir":          0o755 | os.ModeDir,
+				"dir/file":     0o755,
+				"implied":      0o755 | os.ModeDir,
+				"implied/file": 0o644 | os.ModeSetuid,
+			},
+		},
+		{
+			umask: 0o027,
+			expected: map[string]os.FileMode{
+				"dir":          0o750 | os.ModeDir,
+				"dir/file":     0o750,
+				"implied":      0o750 | os.ModeDir,
+				"implied/file": 0o640 | os.ModeSetuid,
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%#o", tc.umask), func(t *testing.T) {
+			archive := buildTestArchive(t, []*tar.Header{
+				{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o777},
+				{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o777},
+				{Name: "implied/file", Typeflag: tar.TypeReg, Mode: 0o4666},
+			}, nil)
+			tmpDir := t.TempDir()
+			assert.NilError(t, Untar(archive, tmpDir, &TarOptions{ExtractUmask: &tc.umask}))
+
+			for name, expected := range tc.expected {
+				fi, err := os.Lstat(filepath.Join(tmpDir, name))
+				assert.NilError(t, err)
+				assert.Check(t, is.Equal(fi.Mode(), expected), name)
+			}
+		})
+	}
+}
+
 func getNlink(path string) (uint64, error) {
 	stat, err := os.Stat(path)
 	if err != nil {
@@ -352,6 +643,58 @@ func TestTarWithBlockCharFifo(t *testing.T) {
 	}
 }
 
+func TestTarWithOptionsSkipSpecialFiles(t *testing.T) {
+	origin := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "file"), []byte("hello world"), 0o644))
+	assert.NilError(t, os.Symlink("file", filepath.Join(origin, "link")))
+	assert.NilError(t, unix.Mkfifo(filepath.Join(origin, "fifo"), 0o644))
+
+	for _, skipSpecial := range []bool{false, true} {
+		rdr, err := TarWithOptions(origin, &TarOptions{SkipSpecialFiles: skipSpecial})
+		assert.NilError(t, err)
+
+		var names []string
+		err = Walk(rdr, func(hdr *tar.Header, _ io.Reader) error {
+			names = append(names, hdr.Name)
+			return nil
+		})
+		assert.NilError(t, rdr.Close())
+		assert.NilError(t, err)
+		if skipSpecial {
+			assert.Check(t, is.DeepEqual(names, []string{"file", "link"}))
+		} else {
+			assert.Check(t, is.DeepEqual(names, []string{"fifo", "file", "link"}))
+		}
+	}
+}
+
+func TestTarWithOptionsSocket(t *testing.T) {
+	origin := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "file"), []byte("hello world"), 0o644))
+	l, err := net.Listen("unix", filepath.Join(origin, "socket"))
+	assert.NilError(t, err)
+	defer l.Close()
+
+	var skipped []string
+	rdr, err := TarWithOptions(origin, &TarOptions{
+		OnSkippedFile: func(path string, info os.FileInfo) {
+			assert.Check(t, info.Mode()&os.ModeSocket != 0)
+			skipped = append(skipped, path)
+		},
+	})
+	assert.NilError(t, err)
+	defer rdr.Close()
+
+	var names []string
+	err = Walk(rdr, func(hdr *tar.Header, _ io.Reader) error {
+		names = append(names, hdr.Name)
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(names, []string{"file"}))
+	assert.Check(t, is.DeepEqual(skipped, []string{"socket"}))
+}
+
 // TestTarUntarWithXattr is Unix as Lsetxattr is not supported on Windows
 func TestTarUntarWithXattr(t *testing.T) {
 	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
@@ -474,6 +817,59 @@ type FileTestData struct {
 	}
 }
 
+func TestCopyInfoDestinationPathSymlinkChain(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := tmpDir + "/"
+
+	provisionSampleDir(t, tmpDir, []FileData{
+		{filetype: Regular, path: "file", permissions: 0o600},
+		{filetype: Dir, path: "dir", permissions: 0o740},
+		{filetype: Dir, path: "dir/sub", permissions: 0o740},
+
+		// Two hops: twoHop -> oneHop -> file
+		{filetype: Symlink, path: "oneHop", contents: "file"},
+		{filetype: Symlink, path: "twoHop", contents: "oneHop"},
+
+		// Three hops through different directories:
+		// threeHop -> dir/sub/hop2 -> ../hop1 (dir/hop1) -> dir/sub
+		{filetype: Symlink, path: "dir/hop1", contents: root + "dir/sub"},
+		{filetype: Symlink, path: "dir/sub/hop2", contents: "../hop1"},
+		{filetype: Symlink, path: "threeHop", contents: "dir/sub/hop2"},
+
+		// A chain ending in a target that does not exist.
+		{filetype: Symlink, path: "dangling1", contents: "noSuchTarget"},
+		{filetype: Symlink, path: "dangling2", contents: "dangling1"},
+
+		// Loops.
+		{filetype: Symlink, path: "self", contents: "self"},
+		{filetype: Symlink, path: "loop1", contents: "loop2"},
+		{filetype: Symlink, path: "loop2", contents: "loop1"},
+	})
+
+	tests := []struct {
+		path        string
+		expected    CopyInfo
+		expectedErr string
+	}{
+		{path: "twoHop", expected: CopyInfo{Path: root + "file", Exists: true}},
+		{path: "threeHop", expected: CopyInfo{Path: root + "dir/sub", Exists: true, IsDir: true}},
+		{path: "dangling2", expected: CopyInfo{Path: root + "noSuchTarget"}},
+		{path: "self", expectedErr: "symlink loop in " + root + "self"},
+		{path: "loop1", expectedErr: "symlink loop in " + root + "loop1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			ci, err := CopyInfoDestinationPath(filepath.Join(tmpDir, tc.path))
+			if tc.expectedErr != "" {
+				assert.Check(t, is.Error(err, tc.expectedErr))
+				return
+			}
+			assert.Check(t, err)
+			assert.Check(t, is.DeepEqual(ci, tc.expected))
+		})
+	}
+}
+
 func TestHandleTarTypeBlockCharFifoDeviceRange(t *testing.T) {
 	for _, tc := range []struct {
 		name     string
@@ -502,3 +898,275 @@ func TestHandleTarTypeBlockCharFifoDeviceRange(t *testing.T) {
 		})
 	}
 }
+
+func TestRetryPolicy(t *testing.T) {
+	policy := &RetryPolicy{MaxRetries: 3, Backoff: time.Millisecond}
+
+	t.Run("transient", func(t *testing.T) {
+		var calls int
+		err := policy.do(func() error {
+			calls++
+			if calls < 3 {
+				return &os.PathError{Op: "mkdir", Path: "dir", Err: syscall.ESTALE}
+			}
+			return nil
+		})
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(calls, 3))
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		var calls int
+		err := policy.do(func() error {
+			calls++
+			return &os.PathError{Op: "mkdir", Path: "dir", Err: syscall.EINTR}
+		})
+		assert.Check(t, is.ErrorIs(err, syscall.EINTR))
+		assert.Check(t, is.Equal(calls, 4))
+	})
+
+	t.Run("non-transient", func(t *testing.T) {
+		var calls int
+		err := policy.do(func() error {
+			calls++
+			return &os.PathError{Op: "mkdir", Path: "dir", Err: syscall.EACCES}
+		})
+		assert.Check(t, is.ErrorIs(err, syscall.EACCES))
+		assert.Check(t, is.Equal(calls, 1))
+	})
+
+	t.Run("no policy", func(t *testing.T) {
+		var calls int
+		var nilPolicy *RetryPolicy
+		err := nilPolicy.do(func() error {
+			calls++
+			return syscall.ESTALE
+		})
+		assert.Check(t, is.ErrorIs(err, syscall.ESTALE))
+		assert.Check(t, is.Equal(calls, 1))
+	})
+}
+
+func TestUntarExistingDirectoryMode(t *testing.T) {
+	restore := overrideUmask(0o022)
+	defer restore()
+
+	dest := t.TempDir()
+	assert.NilError(t, os.Chmod(dest, 0o700))
+	assert.NilError(t, os.Mkdir(filepath.Join(dest, "existing"), 0o700))
+	assert.NilError(t, os.Mkdir(filepath.Join(dest, "explicit"), 0o700))
+
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "existing/nested/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "explicit/", Typeflag: tar.TypeDir, Mode: 0o750},
+	}, nil)
+	assert.NilError(t, Untar(archive, dest, &TarOptions{NoLchown: true}))
+
+	for _, tc := range []struct {
+		path     string
+		expected os.FileMode
+	}{
+		{path: ".", expected: 0o700},
+		{path: "existing", expected: 0o700},
+		{path: "existing/nested", expected: ImpliedDirectoryMode},
+		{path: "explicit", expected: 0o750},
+	} {
+		fi, err := os.Lstat(filepath.Join(dest, tc.path))
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(fi.Mode().Perm(), tc.expected), tc.path)
+	}
+}
+
+func TestCopyWithTarPreserveOwnership(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+
+	src := filepath.Join(t.TempDir(), "src")
+	assert.NilError(t, os.Mkdir(src, 0o755))
+	assert.NilError(t, os.Lchown(src, 3456, 7890))
+	assert.NilError(t, os.Mkdir(filepath.Join(src, "dir"), 0o755))
+	assert.NilError(t, os.Lchown(filepath.Join(src, "dir"), 1234, 5678))
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "dir", "file"), []byte("content"), 0o644))
+	assert.NilError(t, os.Lchown(filepath.Join(src, "dir", "file"), 2345, 6789))
+
+	owner := func(t *testing.T, p string) [2]int {
+		t.Helper()
+		fi, err := os.Lstat(p)
+		assert.NilError(t, err)
+		st := fi.Sys().(*syscall.Stat_t)
+		return [2]int{int(st.Uid), int(st.Gid)}
+	}
+
+	idMaps := []user.IDMap{{ID: 0, ParentID: 100000, Count: 65536}}
+	chownUntar := func(r io.Reader, dst string, options *TarOptions) error {
+		options.ChownOpts = &ChownOpts{UID: 42, GID: 43}
+		return Untar(r, dst, options)
+	}
+	tests := []struct {
+		doc      string
+		archiver *Archiver
+		expected map[string][2]int
+	}{
+		{
+			doc:      "IDMapping",
+			archiver: &Archiver{Untar: Untar, IDMapping: user.IdentityMapping{UIDMaps: idMaps, GIDMaps: idMaps}},
+			expected: map[string][2]int{".": {100000, 100000}, "dir": {101234, 105678}, "dir/file": {102345, 106789}},
+		},
+		{
+			doc:      "PreserveOwnership",
+			archiver: &Archiver{Untar: Untar, IDMapping: user.IdentityMapping{UIDMaps: idMaps, GIDMaps: idMaps}, PreserveOwnership: true},
+			expected: map[string][2]int{".": {3456, 7890}, "dir": {1234, 5678}, "dir/file": {2345, 6789}},
+		},
+		{
+			doc:      "PreserveOwnership and ChownOpts",
+			archiver: &Archiver{Untar: chownUntar, PreserveOwnership: true},
+			expected: map[string][2]int{".": {3456, 7890}, "dir": {42, 43}, "dir/file": {42, 43}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.doc, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "dst")
+			assert.NilError(t, tc.archiver.CopyWithTar(src, dst))
+			for p, expected := range tc.expected {
+				assert.Check(t, is.Equal(owner(t, filepath.Join(dst, p)), expected), p)
+			}
+		})
+	}
+
+	t.Run("CopyFileWithTar", func(t *testing.T) {
+		archiver := &Archiver{Untar: Untar, IDMapping: user.IdentityMapping{UIDMaps: idMaps, GIDMaps: idMaps}, PreserveOwnership: true}
+		dst := filepath.Join(t.TempDir(), "file")
+		assert.NilError(t, archiver.CopyFileWithTar(filepath.Join(src, "dir", "file"), dst))
+		assert.Check(t, is.Equal(owner(t, dst), [2]int{2345, 6789}))
+	})
+}
+
+func TestTarUntarGNULongLinks(t *testing.T) {
+	src := t.TempDir()
+	target := strings.Repeat("t", 200)
+	longName := strings.Repeat("f", 150)
+	assert.NilError(t, os.Symlink(target, filepath.Join(src, "symlink")))
+	assert.NilError(t, os.WriteFile(filepath.Join(src, longName), []byte("content"), 0o644))
+	assert.NilError(t, os.Link(filepath.Join(src, longName), filepath.Join(src, "hardlink")))
+
+	rdr, err := TarWithOptions(src, &TarOptions{GNULongLinks: true})
+	assert.NilError(t, err)
+	archive, err := io.ReadAll(rdr)
+	assert.NilError(t, err)
+	assert.NilError(t, rdr.Close())
+
+	assert.Check(t, bytes.Contains(archive, []byte("././@LongLink")))
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		assert.NilError(t, err)
+		switch hdr.Name {
+		case "symlink":
+			assert.Check(t, is.Equal(hdr.Format, tar.FormatGNU))
+			assert.Check(t, is.Equal(hdr.Linkname, target))
+		case longName:
+			assert.Check(t, is.Equal(hdr.Format, tar.FormatGNU))
+		case "hardlink":
+			assert.Check(t, is.Equal(hdr.Format, tar.FormatGNU))
+			assert.Check(t, is.Equal(hdr.Linkname, longName))
+		}
+	}
+
+	dest := t.TempDir()
+	assert.NilError(t, Untar(bytes.NewReader(archive), dest, &TarOptions{NoLchown: true}))
+	link, err := os.Readlink(filepath.Join(dest, "symlink"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(link, target))
+
+	fi1, err := os.Stat(filepath.Join(dest, longName))
+	assert.NilError(t, err)
+	fi2, err := os.Stat(filepath.Join(dest, "hardlink"))
+	assert.NilError(t, err)
+	assert.Check(t, os.SameFile(fi1, fi2))
+}
+
+func TestTarUntarPAXLongNames(t *testing.T) {
+	src := t.TempDir()
+	dir := strings.Repeat("d", 100)
+	longName := dir + "/" + strings.Repeat("f", 49)
+	assert.Assert(t, is.Len(longName, 150))
+	assert.NilError(t, os.Mkdir(filepath.Join(src, dir), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(src, longName), []byte("content"), 0o644))
+
+	for _, tc := range []struct {
+		doc          string
+		paxLongNames bool
+	}{
+		{doc: "ustar prefix"},
+		{doc: "pax path", paxLongNames: true},
+	} {
+		t.Run(tc.doc, func(t *testing.T) {
+			rdr, err := TarWithOptions(src, &TarOptions{PAXLongNames: tc.paxLongNames})
+			assert.NilError(t, err)
+			archive, err := io.ReadAll(rdr)
+			assert.NilError(t, err)
+			assert.NilError(t, rdr.Close())
+
+			var found bool
+			tr := tar.NewReader(bytes.NewReader(archive))
+			for {
+				hdr, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				assert.NilError(t, err)
+				if hdr.Name != longName {
+					continue
+				}
+				found = true
+				path, ok := hdr.PAXRecords["path"]
+				if tc.paxLongNames {
+					assert.Check(t, is.Equal(hdr.Format, tar.FormatPAX))
+					assert.Check(t, is.Equal(path, longName))
+				} else {
+					assert.Check(t, is.Equal(hdr.Format, tar.FormatUSTAR))
+					assert.Check(t, !ok, "unexpected PAX path record")
+				}
+			}
+			assert.Check(t, found, "entry %q not found", longName)
+
+			dest := t.TempDir()
+			assert.NilError(t, Untar(bytes.NewReader(archive), dest, &TarOptions{NoLchown: true}))
+			content, err := os.ReadFile(filepath.Join(dest, longName))
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(string(content), "content"))
+		})
+	}
+}
+
+func TestArchiverConcurrentCopyWithTar(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	assert.NilError(t, os.Mkdir(src, 0o755))
+	createSampleDir(t, src)
+
+	const copies = 16
+	archiver := NewDefaultArchiver()
+	dest := t.TempDir()
+	errs := make(chan error, copies)
+	var wg sync.WaitGroup
+	for i := range copies {
+		wg.Go(func() {
+			errs <- archiver.CopyWithTar(src, filepath.Join(dest, strconv.Itoa(i)))
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Check(t, err)
+	}
+
+	for i := range copies {
+		changes, err := ChangesDirs(filepath.Join(dest, strconv.Itoa(i)), src)
+		assert.NilError(t, err)
+		assert.Check(t, is.Len(changes, 0), "copy %d", i)
+	}
+}
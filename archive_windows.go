@@ -25,6 +25,17 @@ func addLongPathPrefix(srcPath string) string {
 	return longPathPrefix + srcPath
 }
 
+// openDestRoot opens dest as the root to extract into. dest is made absolute
+// and given the long path prefix, so that paths derived from root.Name(),
+// such as with fsRootPath, are not limited to MAX_PATH.
+func openDestRoot(dest string) (*os.Root, error) {
+	abs, err := filepath.Abs(dest)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenRoot(addLongPathPrefix(abs))
+}
+
 // getWalkRoot calculates the root path when performing a TarWithOptions.
 // We use a separate function as this is platform specific.
 func getWalkRoot(srcPath string, include string) string {
@@ -52,8 +63,8 @@ func handleTarTypeBlockCharFifo(root *os.Root, hdr *tar.Header, path string) err
 	return nil
 }
 
-// handleLChmod is a no-op on Windows because chmod is not supported.
-func handleLChmod(root *os.Root, path string, hdr *tar.Header, hdrInfo os.FileInfo) error {
+// chmodNoSymlink is a no-op on Windows because chmod is not supported.
+func chmodNoSymlink(root *os.Root, name string, mode os.FileMode) error {
 	return nil
 }
 
@@ -3,9 +3,16 @@
 package archive
 
 import (
+	"archive/tar"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
 )
 
 func TestCopyFileWithInvalidDest(t *testing.T) {
@@ -67,3 +74,37 @@ func TestChmodTarEntry(t *testing.T) {
 		}
 	}
 }
+
+func TestUntarLongPath(t *testing.T) {
+	// Nest directories so that the extracted paths exceed MAX_PATH (260).
+	var dirs []string
+	for i := 0; i < 6; i++ {
+		dirs = append(dirs, strings.Repeat(string(rune('a'+i)), 50))
+	}
+	dir := path.Join(dirs...)
+	name := path.Join(dir, "file")
+
+	btime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{
+			Name: name, Typeflag: tar.TypeReg, Mode: 0o644,
+			PAXRecords: map[string]string{paxBirthTime: formatPAXTime(btime)},
+		},
+	}, map[string]string{name: "hello"})
+
+	dest := t.TempDir()
+	assert.NilError(t, Untar(archive, dest, &TarOptions{PreserveBirthTime: true}))
+
+	p := filepath.Join(dest, filepath.FromSlash(name))
+	assert.Assert(t, len(p) > 260)
+	content, err := os.ReadFile(p)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(content), "hello"))
+
+	fi, err := os.Stat(p)
+	assert.NilError(t, err)
+	got, ok := birthTime(p, fi)
+	assert.Assert(t, ok)
+	assert.Check(t, got.Equal(btime), "got %v, want %v", got, btime)
+}
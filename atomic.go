@@ -0,0 +1,90 @@
+package archive
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// UntarAtomic is Untar, but extracts the archive into a temporary directory
+// next to dest, named "<dest>.tmp-*", and renames it to dest once extraction
+// succeeded, so that dest is never seen partially extracted. If extraction
+// fails, the temporary directory is removed and dest is left untouched.
+//
+// If dest exists, it must be a directory, and its content is replaced by the
+// content of the archive: the temporary directory is created with the
+// permissions of dest, and swapped with it, after which the previous content
+// of dest is removed. On Linux, the directories are swapped atomically; on
+// other platforms, dest is briefly absent between moving it aside and
+// renaming the temporary directory to dest. If dest does not exist, it is
+// created with mode 0o755, and its parent directory must exist.
+func UntarAtomic(tarArchive io.Reader, dest string, options *TarOptions) error {
+	dest = filepath.Clean(dest)
+
+	mode := os.FileMode(0o755)
+	fi, err := os.Lstat(dest)
+	exists := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if exists {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "untar", Path: dest, Err: syscall.ENOTDIR}
+		}
+		mode = fi.Mode().Perm()
+	}
+
+	staging, err := os.MkdirTemp(filepath.Dir(dest), filepath.Base(dest)+".tmp-")
+	if err != nil {
+		return err
+	}
+	// remove holds the directory to remove on return: the temporary
+	// directory until it is renamed to dest, and the previous content of
+	// dest afterwards.
+	remove := staging
+	defer func() {
+		if remove != "" {
+			_ = os.RemoveAll(remove)
+		}
+	}()
+
+	if err := os.Chmod(staging, mode); err != nil {
+		return err
+	}
+	if err := Untar(tarArchive, staging, options); err != nil {
+		return err
+	}
+
+	if !exists {
+		if err := os.Rename(staging, dest); err != nil {
+			return err
+		}
+		remove = ""
+		return nil
+	}
+
+	swapped, err := exchangeDirs(staging, dest)
+	if err != nil {
+		return err
+	}
+	if swapped {
+		// staging now holds the previous content of dest.
+		return nil
+	}
+
+	old := staging + ".old"
+	if err := os.Rename(dest, old); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, dest); err != nil {
+		if rerr := os.Rename(old, dest); rerr != nil {
+			return errors.Join(err, rerr)
+		}
+		return err
+	}
+	remove = old
+	return nil
+}
@@ -0,0 +1,22 @@
+package archive
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// exchangeDirs atomically swaps the directories a and b with
+// renameat2(RENAME_EXCHANGE). It returns false if the filesystem or kernel
+// does not support exchanging them.
+func exchangeDirs(a, b string) (bool, error) {
+	err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+	if err != nil {
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) {
+			return false, nil
+		}
+		return false, &os.LinkError{Op: "renameat2", Old: a, New: b, Err: err}
+	}
+	return true, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package archive
+
+// exchangeDirs is not supported on platforms other than Linux, and always
+// returns false.
+func exchangeDirs(string, string) (bool, error) {
+	return false, nil
+}
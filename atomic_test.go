@@ -0,0 +1,93 @@
+package archive
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+// dirNames returns the names of the entries in dir.
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	assert.NilError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestUntarAtomic(t *testing.T) {
+	headers := func() []*tar.Header {
+		return []*tar.Header{
+			{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		}
+	}
+	contents := map[string]string{"dir/file": "hello"}
+
+	t.Run("new destination", func(t *testing.T) {
+		parent := t.TempDir()
+		dest := filepath.Join(parent, "dest")
+		assert.NilError(t, UntarAtomic(buildTestArchive(t, headers(), contents), dest, nil))
+
+		content, err := os.ReadFile(filepath.Join(dest, "dir", "file"))
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(string(content), "hello"))
+		assert.Check(t, is.DeepEqual(dirNames(t, parent), []string{"dest"}))
+	})
+
+	t.Run("existing destination", func(t *testing.T) {
+		parent := t.TempDir()
+		dest := filepath.Join(parent, "dest")
+		assert.NilError(t, os.MkdirAll(filepath.Join(dest, "old"), 0o750))
+		assert.NilError(t, os.WriteFile(filepath.Join(dest, "old", "file"), []byte("old"), 0o644))
+		assert.NilError(t, os.Chmod(dest, 0o750))
+
+		assert.NilError(t, UntarAtomic(buildTestArchive(t, headers(), contents), dest, nil))
+
+		assert.Check(t, is.DeepEqual(dirNames(t, dest), []string{"dir"}))
+		content, err := os.ReadFile(filepath.Join(dest, "dir", "file"))
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(string(content), "hello"))
+		assert.Check(t, is.DeepEqual(dirNames(t, parent), []string{"dest"}))
+		if runtime.GOOS != "windows" {
+			fi, err := os.Stat(dest)
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(fi.Mode().Perm(), os.FileMode(0o750)))
+		}
+	})
+
+	t.Run("failed extraction", func(t *testing.T) {
+		parent := t.TempDir()
+		dest := filepath.Join(parent, "dest")
+		assert.NilError(t, os.Mkdir(dest, 0o755))
+		assert.NilError(t, os.WriteFile(filepath.Join(dest, "file"), []byte("old"), 0o644))
+
+		archive := buildTestArchive(t, []*tar.Header{
+			{Name: "new", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0o644},
+		}, map[string]string{"new": "new", "../escape": "escape"})
+		err := UntarAtomic(archive, dest, nil)
+		assert.Check(t, err != nil)
+
+		assert.Check(t, is.DeepEqual(dirNames(t, dest), []string{"file"}))
+		assert.Check(t, is.DeepEqual(dirNames(t, parent), []string{"dest"}))
+	})
+
+	t.Run("destination is a file", func(t *testing.T) {
+		parent := t.TempDir()
+		dest := filepath.Join(parent, "dest")
+		assert.NilError(t, os.WriteFile(dest, []byte("file"), 0o644))
+
+		err := UntarAtomic(buildTestArchive(t, headers(), contents), dest, nil)
+		assert.Check(t, is.ErrorContains(err, "not a directory"))
+		assert.Check(t, is.DeepEqual(dirNames(t, parent), []string{"dest"}))
+	})
+}
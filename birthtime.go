@@ -0,0 +1,64 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// paxBirthTime is the PAX record used by libarchive (bsdtar) to store the
+// creation time of files.
+const paxBirthTime = "LIBARCHIVE.creationtime"
+
+// setBirthTimeRecord stores btime in the PAX records of hdr. Times before
+// the Unix epoch are not stored.
+func setBirthTimeRecord(hdr *tar.Header, btime time.Time) {
+	if btime.Before(minTime) {
+		return
+	}
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = make(map[string]string)
+	}
+	hdr.PAXRecords[paxBirthTime] = formatPAXTime(btime)
+}
+
+// birthTimeRecord returns the creation time stored in the PAX records of hdr.
+func birthTimeRecord(hdr *tar.Header) (time.Time, bool) {
+	v, ok := hdr.PAXRecords[paxBirthTime]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := parsePAXTime(v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// formatPAXTime formats t as a PAX time, which is a number of seconds since
+// the Unix epoch with an optional fractional part.
+func formatPAXTime(t time.Time) string {
+	sec, nsec := t.Unix(), t.Nanosecond()
+	if nsec == 0 {
+		return strconv.FormatInt(sec, 10)
+	}
+	return strings.TrimRight(fmt.Sprintf("%d.%09d", sec, nsec), "0")
+}
+
+// parsePAXTime parses a non-negative PAX time as formatted by formatPAXTime.
+func parsePAXTime(s string) (time.Time, error) {
+	ss, sn, _ := strings.Cut(s, ".")
+	sec, err := strconv.ParseInt(ss, 10, 64)
+	if err != nil || sec < 0 {
+		return time.Time{}, fmt.Errorf("invalid PAX time %q", s)
+	}
+	// Truncate or pad the fraction to nanoseconds.
+	sn = (sn + "000000000")[:9]
+	nsec, err := strconv.ParseUint(sn, 10, 32)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid PAX time %q", s)
+	}
+	return time.Unix(sec, int64(nsec)), nil
+}
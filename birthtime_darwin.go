@@ -0,0 +1,40 @@
+package archive
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// birthTime returns the creation time of the file with file info fi.
+func birthTime(_ string, fi os.FileInfo) (time.Time, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Birthtimespec.Unix()), true
+}
+
+// setBirthTime sets the creation time of name within root, without following
+// symlinks.
+func setBirthTime(root *os.Root, name string, btime time.Time) error {
+	// os.Root has no setattrlist support; use the absolute path derived
+	// from the root so the path remains bounded.
+	p, err := fsRootPath(root.Name(), name)
+	if err != nil {
+		return err
+	}
+	attrs := unix.Attrlist{
+		Bitmapcount: unix.ATTR_BIT_MAP_COUNT,
+		Commonattr:  unix.ATTR_CMN_CRTIME,
+	}
+	ts := unix.NsecToTimespec(btime.UnixNano())
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(&ts)), unsafe.Sizeof(ts))
+	if err := unix.Setattrlist(p, &attrs, buf, unix.FSOPT_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "setattrlist", Path: name, Err: err}
+	}
+	return nil
+}
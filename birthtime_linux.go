@@ -0,0 +1,28 @@
+package archive
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// birthTime returns the creation time of the file at path with file info fi,
+// if the filesystem records it.
+func birthTime(path string, fi os.FileInfo) (time.Time, bool) {
+	flags := 0
+	if fi.Mode()&os.ModeSymlink != 0 {
+		flags = unix.AT_SYMLINK_NOFOLLOW
+	}
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, flags, unix.STATX_BTIME, &stx); err != nil || stx.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec)), true
+}
+
+// setBirthTime is a no-op on Linux, which has no way to set the creation
+// time of files.
+func setBirthTime(*os.Root, string, time.Time) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !windows
+
+package archive
+
+import (
+	"os"
+	"time"
+)
+
+// birthTime is not supported on this platform.
+func birthTime(string, os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// setBirthTime is not supported on this platform.
+func setBirthTime(*os.Root, string, time.Time) error {
+	return nil
+}
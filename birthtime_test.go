@@ -0,0 +1,102 @@
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+	"gotest.tools/v3/skip"
+)
+
+func TestPAXTime(t *testing.T) {
+	tests := []struct {
+		time      time.Time
+		formatted string
+	}{
+		{time: time.Unix(0, 0), formatted: "0"},
+		{time: time.Unix(1700000000, 0), formatted: "1700000000"},
+		{time: time.Unix(1700000000, 500000000), formatted: "1700000000.5"},
+		{time: time.Unix(1700000000, 123456789), formatted: "1700000000.123456789"},
+	}
+	for _, tc := range tests {
+		assert.Check(t, is.Equal(formatPAXTime(tc.time), tc.formatted))
+		parsed, err := parsePAXTime(tc.formatted)
+		assert.Check(t, err)
+		assert.Check(t, parsed.Equal(tc.time), "parsed %q as %v", tc.formatted, parsed)
+	}
+
+	// Fractions are truncated to nanoseconds.
+	parsed, err := parsePAXTime("1.1234567891")
+	assert.NilError(t, err)
+	assert.Check(t, parsed.Equal(time.Unix(1, 123456789)))
+
+	for _, s := range []string{"", "-1", "1.x", "x"} {
+		_, err := parsePAXTime(s)
+		assert.Check(t, err != nil, "expected error for %q", s)
+	}
+}
+
+func TestTarUntarPreserveBirthTime(t *testing.T) {
+	src := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "file"), []byte("content"), 0o644))
+	fi, err := os.Lstat(filepath.Join(src, "file"))
+	assert.NilError(t, err)
+	btime, ok := birthTime(filepath.Join(src, "file"), fi)
+	skip.If(t, !ok, "creation time is not supported on this platform or filesystem")
+
+	for _, tc := range []struct {
+		doc      string
+		opts     *TarOptions
+		expected bool
+	}{
+		{doc: "default", opts: &TarOptions{}},
+		{doc: "PreserveBirthTime", opts: &TarOptions{PreserveBirthTime: true}, expected: true},
+		{doc: "Deterministic", opts: &TarOptions{PreserveBirthTime: true, Deterministic: true}},
+		{doc: "GNU format", opts: &TarOptions{PreserveBirthTime: true, TarFormat: tar.FormatGNU}},
+	} {
+		t.Run(tc.doc, func(t *testing.T) {
+			rdr, err := TarWithOptions(src, tc.opts)
+			assert.NilError(t, err)
+			defer rdr.Close()
+
+			tr := tar.NewReader(rdr)
+			for {
+				hdr, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				assert.NilError(t, err)
+				if hdr.Name != "file" {
+					continue
+				}
+				recorded, ok := birthTimeRecord(hdr)
+				assert.Check(t, is.Equal(ok, tc.expected))
+				if ok {
+					assert.Check(t, recorded.Equal(btime), "recorded %v, expected %v", recorded, btime)
+				}
+			}
+		})
+	}
+
+	rdr, err := TarWithOptions(src, &TarOptions{PreserveBirthTime: true})
+	assert.NilError(t, err)
+	defer rdr.Close()
+	dst := t.TempDir()
+	assert.NilError(t, Untar(rdr, dst, &TarOptions{PreserveBirthTime: true}))
+	if runtime.GOOS != "darwin" && runtime.GOOS != "windows" {
+		// Creation times can only be restored on macOS and Windows.
+		return
+	}
+	fi, err = os.Lstat(filepath.Join(dst, "file"))
+	assert.NilError(t, err)
+	extracted, ok := birthTime(filepath.Join(dst, "file"), fi)
+	assert.Assert(t, ok)
+	assert.Check(t, extracted.Equal(btime), "extracted %v, expected %v", extracted, btime)
+}
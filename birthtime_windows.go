@@ -0,0 +1,41 @@
+package archive
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// birthTime returns the creation time of the file with file info fi.
+func birthTime(_ string, fi os.FileInfo) (time.Time, bool) {
+	attrs, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, attrs.CreationTime.Nanoseconds()), true
+}
+
+// setBirthTime sets the creation time of name within root.
+func setBirthTime(root *os.Root, name string, btime time.Time) error {
+	// os.Root provides no handle to set the creation time; use the absolute
+	// path derived from the root so the path remains bounded.
+	p, err := fsRootPath(root.Name(), name)
+	if err != nil {
+		return err
+	}
+	pathp, err := windows.UTF16PtrFromString(p)
+	if err != nil {
+		return err
+	}
+	h, err := windows.CreateFile(pathp,
+		windows.FILE_WRITE_ATTRIBUTES, windows.FILE_SHARE_WRITE, nil,
+		windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return err
+	}
+	defer windows.Close(h)
+	c := windows.NsecToFiletime(btime.UnixNano())
+	return windows.SetFileTime(h, &c, nil, nil)
+}
@@ -4,11 +4,13 @@
 	"archive/tar"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"maps"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -16,6 +18,8 @@
 
 	"github.com/containerd/log"
 	"github.com/moby/sys/user"
+
+	"github.com/moby/go-archive/compression"
 )
 
 // ChangeType represents the change type.
@@ -333,6 +337,16 @@ func newRootFileInfo() *FileInfo {
 // ChangesDirs compares two directories and generates an array of Change objects describing the changes.
 // If oldDir is "", then all files in newDir will be Add-Changes.
 func ChangesDirs(newDir, oldDir string) ([]Change, error) {
+	return ChangesDirsContext(context.Background(), newDir, oldDir)
+}
+
+// ChangesDirsContext is like [ChangesDirs], but stops walking the directories
+// and returns the context's error if ctx is cancelled. The directories are
+// walked concurrently.
+func ChangesDirsContext(ctx context.Context, newDir, oldDir string) ([]Change, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	var oldRoot, newRoot *FileInfo
 	if oldDir == "" {
 		emptyDir, err := os.MkdirTemp("", "empty")
@@ -342,7 +356,7 @@ func ChangesDirs(newDir, oldDir string) ([]Change, error) {
 		defer os.Remove(emptyDir)
 		oldDir = emptyDir
 	}
-	oldRoot, newRoot, err := collectFileInfoForChanges(oldDir, newDir)
+	oldRoot, newRoot, err := collectFileInfoForChanges(ctx, oldDir, newDir)
 	if err != nil {
 		return nil, err
 	}
@@ -350,6 +364,99 @@ func ChangesDirs(newDir, oldDir string) ([]Change, error) {
 	return newRoot.Changes(oldRoot), nil
 }
 
+// ChangesFromIndex compares the directory dir with the files described by
+// index, for example as returned by [ListArchive] for an archive of a previous
+// version of the directory, and generates an array of Change objects
+// describing the changes. The changes are determined as by [ChangesDirs],
+// comparing the type, mode, ownership, and device numbers of files, the size
+// and modification time of files other than directories, and the
+// "security.capability" extended attribute stored in the headers.
+//
+// Parent directories that are not in index are assumed to have
+// [ImpliedDirectoryMode], and be owned by root. If index has multiple
+// headers with the same name, the last one is used, as when extracting.
+func ChangesFromIndex(dir string, index []tar.Header) ([]Change, error) {
+	oldRoot, err := fileInfoFromIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	emptyDir, err := os.MkdirTemp("", "empty")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(emptyDir)
+	_, newRoot, err := collectFileInfoForChanges(context.Background(), emptyDir, dir)
+	if err != nil {
+		return nil, err
+	}
+	return newRoot.Changes(oldRoot), nil
+}
+
+// fileInfoFromIndex returns the tree of files described by the headers in
+// index, with stats returned by [tar.Header.FileInfo].
+func fileInfoFromIndex(index []tar.Header) (*FileInfo, error) {
+	root := newRootFileInfo()
+	headers := make(map[string]*tar.Header, len(index))
+	for _, hdr := range index {
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "." {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			// The size of a symlink is the length of its target.
+			hdr.Size = int64(len(hdr.Linkname))
+		case tar.TypeLink:
+			// Hardlinks share the metadata of their target.
+			if target, ok := headers[path.Clean(hdr.Linkname)]; ok {
+				hdr = *target
+			}
+		}
+		headers[name] = &hdr
+
+		parent := root
+		elems := strings.Split(name, "/")
+		for _, elem := range elems[:len(elems)-1] {
+			child := parent.children[elem]
+			if child == nil {
+				implied := &tar.Header{Name: elem, Typeflag: tar.TypeDir, Mode: ImpliedDirectoryMode}
+				child = &FileInfo{
+					parent:   parent,
+					name:     elem,
+					stat:     implied.FileInfo(),
+					children: make(map[string]*FileInfo),
+				}
+				parent.children[elem] = child
+			}
+			parent = child
+		}
+
+		base := elems[len(elems)-1]
+		info := parent.children[base]
+		if info == nil {
+			info = &FileInfo{
+				parent:   parent,
+				name:     base,
+				children: make(map[string]*FileInfo),
+			}
+			parent.children[base] = info
+		}
+		info.stat = headers[name].FileInfo()
+		info.capability = nil
+		if capability, ok := hdr.PAXRecords[paxSchilyXattr+"security.capability"]; ok {
+			info.capability = []byte(capability)
+		}
+	}
+	return root, nil
+}
+
 // ChangesSize calculates the size in bytes of the provided changes, based on newDir.
 func ChangesSize(newDir string, changes []Change) int64 {
 	var (
@@ -381,11 +488,138 @@ func ChangesSize(newDir string, changes []Change) int64 {
 	return size
 }
 
+// MergeChanges composes the changes in base with the changes in overlay,
+// which were made after base, into the net changes, sorted by path. The
+// result can be passed to [ExportChanges] with the directory that has both
+// sets of changes applied.
+//
+// For paths changed in both, the kind of the net change is determined by
+// whether the path existed before base, and whether it exists after overlay:
+// an Add followed by a Delete cancels out, a Delete followed by an Add
+// becomes a Modify, and a Modify followed by a Delete becomes a Delete.
+// Changes in base below a path deleted by overlay are removed.
+//
+// As the contents of a directory that is deleted and added again must not
+// show through, an Add of its [WhiteoutOpaqueDir] marker is included for
+// each path deleted by base and added by overlay. ExportChanges writes it as
+// an opaque directory marker if the path is a directory, and skips it
+// otherwise.
+func MergeChanges(base, overlay []Change) []Change {
+	merged := make(map[string]ChangeType, len(base)+len(overlay))
+	for _, c := range base {
+		merged[c.Path] = c.Kind
+	}
+
+	var (
+		fromOverlay = make(map[string]struct{}, len(overlay))
+		deleted     = make(map[string]struct{})
+		// replaced holds the paths deleted by base and added by overlay.
+		replaced = make(map[string]struct{})
+	)
+	for _, c := range overlay {
+		fromOverlay[c.Path] = struct{}{}
+		if c.Kind == ChangeDelete {
+			deleted[c.Path] = struct{}{}
+		}
+		prev, ok := merged[c.Path]
+		if !ok {
+			merged[c.Path] = c.Kind
+			continue
+		}
+		if prev == ChangeDelete && c.Kind == ChangeAdd {
+			replaced[c.Path] = struct{}{}
+		}
+		if kind, ok := mergeChangeKind(prev, c.Kind); ok {
+			merged[c.Path] = kind
+		} else {
+			delete(merged, c.Path)
+		}
+	}
+
+	changes := make([]Change, 0, len(merged)+len(replaced))
+	for p, kind := range merged {
+		if _, ok := fromOverlay[p]; !ok && len(deleted) > 0 && hasDeletedParent(p, deleted) {
+			continue
+		}
+		changes = append(changes, Change{Path: p, Kind: kind})
+		if _, ok := replaced[p]; ok {
+			changes = append(changes, Change{Path: filepath.Join(p, WhiteoutOpaqueDir), Kind: ChangeAdd})
+		}
+	}
+	sort.Sort(changesByPath(changes))
+	return changes
+}
+
+// mergeChangeKind returns the kind of the net change to a path changed with
+// prev, and then with next, as described for [MergeChanges]. It returns false
+// if the changes cancel out.
+func mergeChangeKind(prev, next ChangeType) (ChangeType, bool) {
+	existedBefore, existsAfter := prev != ChangeAdd, next != ChangeDelete
+	switch {
+	case !existedBefore && !existsAfter:
+		return 0, false
+	case !existedBefore:
+		return ChangeAdd, true
+	case !existsAfter:
+		return ChangeDelete, true
+	default:
+		return ChangeModify, true
+	}
+}
+
+// hasDeletedParent reports whether any of the parent directories of p is in
+// deleted.
+func hasDeletedParent(p string, deleted map[string]struct{}) bool {
+	for {
+		parent := filepath.Dir(p)
+		if parent == p {
+			return false
+		}
+		if _, ok := deleted[parent]; ok {
+			return true
+		}
+		p = parent
+	}
+}
+
 // ExportChanges produces an Archive from the provided changes, relative to dir.
 func ExportChanges(dir string, changes []Change, idMap user.IdentityMapping) (io.ReadCloser, error) {
+	return ExportChangesWithOptions(dir, changes, &TarOptions{IDMap: idMap})
+}
+
+// ExportChangesWithCompression is like [ExportChanges], but compresses the
+// archive with the given compression algorithm.
+func ExportChangesWithCompression(dir string, changes []Change, idMap user.IdentityMapping, comp compression.Compression) (io.ReadCloser, error) {
+	return ExportChangesWithOptions(dir, changes, &TarOptions{IDMap: idMap, Compression: comp})
+}
+
+// ExportChangesWithOptions produces an Archive from the provided changes,
+// relative to dir. The IDMap, WhiteoutFormat, and compression options
+// (Compression, CompressionLevel, ParallelCompression, and
+// CompressionConcurrency) are used; other options are ignored.
+//
+// Deletions and opaque directories are always represented in the archive
+// using AUFS whiteouts. If WhiteoutFormat is [OverlayWhiteoutFormat], overlay
+// whiteouts (0/0 character devices) and opaque directories found in dir are
+// converted to AUFS whiteouts.
+//
+// The archive is produced as it is read, and not buffered in memory or on
+// disk. Closing the returned reader before reading it to the end stops
+// producing the archive, and waits for the files being read to be closed.
+func ExportChangesWithOptions(dir string, changes []Change, options *TarOptions) (io.ReadCloser, error) {
+	if options == nil {
+		options = &TarOptions{}
+	}
 	reader, writer := io.Pipe()
+	compressWriter, err := compressStream(writer, options)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
 	go func() {
-		ta := newTarAppender(idMap, writer, nil)
+		defer close(done)
+		ta := newTarAppender(options.IDMap, compressWriter, nil)
+		ta.WhiteoutConverter = getWhiteoutConverter(options.WhiteoutFormat)
 
 		sort.Sort(changesByPath(changes))
 
@@ -393,11 +627,25 @@ func ExportChanges(dir string, changes []Change, idMap user.IdentityMapping) (io
 		// during e.g. a diff operation the container can continue
 		// mutating the filesystem and we can see transient errors
 		// from this
+	loop:
 		for _, change := range changes {
-			if change.Kind == ChangeDelete {
+			var whiteOut string
+			switch {
+			case change.Kind == ChangeDelete:
 				whiteOutDir := filepath.Dir(change.Path)
 				whiteOutBase := filepath.Base(change.Path)
-				whiteOut := filepath.Join(whiteOutDir, WhiteoutPrefix+whiteOutBase)
+				whiteOut = filepath.Join(whiteOutDir, WhiteoutPrefix+whiteOutBase)
+			case filepath.Base(change.Path) == WhiteoutOpaqueDir:
+				// The opaque directory marker of a replaced directory, as
+				// added by MergeChanges. It is skipped if the path is not
+				// a directory in dir.
+				fi, err := os.Lstat(filepath.Join(dir, filepath.Dir(change.Path)))
+				if err != nil || !fi.IsDir() {
+					continue
+				}
+				whiteOut = change.Path
+			}
+			if whiteOut != "" {
 				timestamp := time.Now()
 				hdr := &tar.Header{
 					Name:       strings.TrimPrefix(filepath.ToSlash(whiteOut), "/"),
@@ -408,12 +656,20 @@ func ExportChanges(dir string, changes []Change, idMap user.IdentityMapping) (io
 				}
 				if err := ta.TarWriter.WriteHeader(hdr); err != nil {
 					log.G(context.TODO()).Debugf("Can't write whiteout header: %s", err)
+					// if pipe is broken, stop writing tar stream to it
+					if errors.Is(err, io.ErrClosedPipe) {
+						break loop
+					}
 				}
 			} else {
 				srcPath := filepath.Join(dir, change.Path)
 				archivePath := strings.TrimPrefix(filepath.ToSlash(change.Path), "/")
 				if err := ta.addTarFile(srcPath, archivePath); err != nil {
 					log.G(context.TODO()).Debugf("Can't add file %s to tar: %s", srcPath, err)
+					// if pipe is broken, stop writing tar stream to it
+					if errors.Is(err, io.ErrClosedPipe) {
+						break loop
+					}
 				}
 			}
 		}
@@ -421,10 +677,33 @@ func ExportChanges(dir string, changes []Change, idMap user.IdentityMapping) (io
 		// Make sure to check the error on Close.
 		if err := ta.TarWriter.Close(); err != nil {
 			log.G(context.TODO()).Debugf("Can't close layer: %s", err)
+			_ = compressWriter.Close()
+			_ = writer.CloseWithError(err)
+			return
+		}
+		if err := compressWriter.Close(); err != nil {
+			log.G(context.TODO()).Debugf("Can't close compressor: %s", err)
+			_ = writer.CloseWithError(err)
+			return
 		}
 		if err := writer.Close(); err != nil {
 			log.G(context.TODO()).Debugf("failed close Changes writer: %s", err)
 		}
 	}()
-	return reader, nil
+	return &producerReader{PipeReader: reader, done: done}, nil
+}
+
+// producerReader is the read end of a pipe that is written to by a
+// goroutine, which closes done when it exits.
+type producerReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// Close closes the pipe, so that writes to it fail, and waits for the
+// goroutine writing to it to exit.
+func (r *producerReader) Close() error {
+	err := r.PipeReader.Close()
+	<-r.done
+	return err
 }
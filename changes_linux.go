@@ -1,11 +1,13 @@
 package archive
 
 import (
-	"fmt"
+	"context"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"unsafe"
 
@@ -20,25 +22,47 @@
 // changes, can be used to prune subtrees without ever having to lstat(2) them
 // directly. Eliminating stat calls in this way can save up to seconds on large
 // images.
+//
+// Subdirectories are walked concurrently, by at most maxChangesWalkers
+// goroutines in addition to the caller's. Each directory is walked by a single
+// goroutine, which is the only one adding to the children of its FileInfo.
 type walker struct {
+	ctx   context.Context
 	dir1  string
 	dir2  string
 	root1 *FileInfo
 	root2 *FileInfo
+
+	// cancel stops the walk with the first error encountered.
+	cancel context.CancelCauseFunc
+	// sem limits the number of goroutines walking subdirectories.
+	sem chan struct{}
+	wg  sync.WaitGroup
 }
 
+// maxChangesWalkers is the maximum number of goroutines used to walk
+// subdirectories in collectFileInfoForChanges. Walking is mostly waiting for
+// the filesystem, so more goroutines than CPUs are used.
+var maxChangesWalkers = 4 * runtime.GOMAXPROCS(0)
+
 // collectFileInfoForChanges returns a complete representation of the trees
 // rooted at dir1 and dir2, with one important exception: any subtree or
 // leaf where the inode and device numbers are an exact match between dir1
 // and dir2 will be pruned from the results. This method is *only* to be used
 // to generating a list of changes between the two directories, as it does not
 // reflect the full contents.
-func collectFileInfoForChanges(dir1, dir2 string) (*FileInfo, *FileInfo, error) {
+func collectFileInfoForChanges(ctx context.Context, dir1, dir2 string) (*FileInfo, *FileInfo, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
 	w := &walker{
-		dir1:  dir1,
-		dir2:  dir2,
-		root1: newRootFileInfo(),
-		root2: newRootFileInfo(),
+		ctx:    ctx,
+		dir1:   dir1,
+		dir2:   dir2,
+		root1:  newRootFileInfo(),
+		root2:  newRootFileInfo(),
+		cancel: cancel,
+		sem:    make(chan struct{}, maxChangesWalkers),
 	}
 
 	i1, err := os.Lstat(w.dir1)
@@ -50,23 +74,23 @@ func collectFileInfoForChanges(dir1, dir2 string) (*FileInfo, *FileInfo, error)
 		return nil, nil, err
 	}
 
-	if err := w.walk("/", i1, i2); err != nil {
+	if err := w.walk("/", w.root1, w.root2, i1, i2); err != nil {
+		cancel(err)
+	}
+	w.wg.Wait()
+	if err := context.Cause(ctx); err != nil {
 		return nil, nil, err
 	}
 
 	return w.root1, w.root2, nil
 }
 
-// Given a FileInfo, its path info, and a reference to the root of the tree
-// being constructed, register this file with the tree.
-func walkchunk(path string, fi os.FileInfo, dir string, root *FileInfo) error {
+// Given a FileInfo, its path info, and the FileInfo of its parent directory
+// in the tree being constructed, register this file with the tree.
+func walkchunk(path string, fi os.FileInfo, dir string, parent *FileInfo) *FileInfo {
 	if fi == nil {
 		return nil
 	}
-	parent := root.LookUp(filepath.Dir(path))
-	if parent == nil {
-		return fmt.Errorf("walkchunk: Unexpectedly no parent for %s", path)
-	}
 	info := &FileInfo{
 		name:     filepath.Base(path),
 		children: make(map[string]*FileInfo),
@@ -76,21 +100,16 @@ func walkchunk(path string, fi os.FileInfo, dir string, root *FileInfo) error {
 	info.stat = fi
 	info.capability, _ = lgetxattr(cpath, "security.capability") // lgetxattr(2): fs access
 	parent.children[info.name] = info
-	return nil
+	return info
 }
 
 // Walk a subtree rooted at the same path in both trees being iterated. For
-// example, /docker/overlay/1234/a/b/c/d and /docker/overlay/8888/a/b/c/d
-func (w *walker) walk(path string, i1, i2 os.FileInfo) (err error) {
-	// Register these nodes with the return trees, unless we're still at the
-	// (already-created) roots:
-	if path != "/" {
-		if err := walkchunk(path, i1, w.dir1, w.root1); err != nil {
-			return err
-		}
-		if err := walkchunk(path, i2, w.dir2, w.root2); err != nil {
-			return err
-		}
+// example, /docker/overlay/1234/a/b/c/d and /docker/overlay/8888/a/b/c/d.
+// node1 and node2 are the already registered FileInfos of path in both trees,
+// and are nil if path does not exist in that tree.
+func (w *walker) walk(path string, node1, node2 *FileInfo, i1, i2 os.FileInfo) (err error) {
+	if w.ctx.Err() != nil {
+		return context.Cause(w.ctx)
 	}
 
 	is1Dir := i1 != nil && i1.IsDir()
@@ -163,29 +182,57 @@ func (w *walker) walk(path string, i1, i2 os.FileInfo) (err error) {
 	}
 
 	// For each of the names present in either or both of the directories being
-	// iterated, stat the name under each root, and recurse the pair of them:
+	// iterated, stat the name under each root, register it, and recurse the
+	// pair of them if either is a directory:
 	for _, name := range names {
 		fname := filepath.Join(path, name)
 		var cInfo1, cInfo2 os.FileInfo
+		var cNode1, cNode2 *FileInfo
 		if is1Dir {
 			cInfo1, err = os.Lstat(filepath.Join(w.dir1, fname)) // lstat(2): fs access
 			if err != nil && !os.IsNotExist(err) {
 				return err
 			}
+			cNode1 = walkchunk(fname, cInfo1, w.dir1, node1)
 		}
 		if is2Dir {
 			cInfo2, err = os.Lstat(filepath.Join(w.dir2, fname)) // lstat(2): fs access
 			if err != nil && !os.IsNotExist(err) {
 				return err
 			}
+			cNode2 = walkchunk(fname, cInfo2, w.dir2, node2)
+		}
+		if (cInfo1 == nil || !cInfo1.IsDir()) && (cInfo2 == nil || !cInfo2.IsDir()) {
+			continue
 		}
-		if err = w.walk(fname, cInfo1, cInfo2); err != nil {
+		if err = w.walkSubdir(fname, cNode1, cNode2, cInfo1, cInfo2); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// walkSubdir walks a subdirectory in a new goroutine if the limit of
+// goroutines is not reached, or in the current goroutine otherwise.
+func (w *walker) walkSubdir(path string, node1, node2 *FileInfo, i1, i2 os.FileInfo) error {
+	select {
+	case w.sem <- struct{}{}:
+	default:
+		return w.walk(path, node1, node2, i1, i2)
+	}
+	w.wg.Add(1)
+	go func() {
+		defer func() {
+			<-w.sem
+			w.wg.Done()
+		}()
+		if err := w.walk(path, node1, node2, i1, i2); err != nil {
+			w.cancel(err)
+		}
+	}()
+	return nil
+}
+
 // {name,inode} pairs used to support the early-pruning logic of the walker type
 type nameIno struct {
 	name string
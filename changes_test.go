@@ -1,7 +1,12 @@
 package archive
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
@@ -14,7 +19,10 @@
 
 	"github.com/moby/sys/user"
 	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
 	"gotest.tools/v3/skip"
+
+	"github.com/moby/go-archive/compression"
 )
 
 func maxInt(x, y int) int {
@@ -404,6 +412,59 @@ func TestChangesDirsMutated(t *testing.T) {
 	}
 }
 
+func TestChangesFromIndex(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: broken on Windows 1903 and up; see https://github.com/moby/moby/pull/39846")
+	}
+
+	src := t.TempDir()
+	createSampleDir(t, src)
+	assert.NilError(t, os.Link(filepath.Join(src, "file6"), filepath.Join(src, "hardlink")))
+	orig := filepath.Join(t.TempDir(), "orig")
+	assert.NilError(t, copyDir(src, orig))
+
+	rdr, err := TarWithOptions(src, &TarOptions{})
+	assert.NilError(t, err)
+	index, err := ListArchive(rdr)
+	assert.NilError(t, err)
+	assert.NilError(t, rdr.Close())
+
+	changes, err := ChangesFromIndex(src, index)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(changes, 0))
+
+	mutateSampleDir(t, src)
+	changes, err = ChangesFromIndex(src, index)
+	assert.NilError(t, err)
+	sort.Sort(changesByPath(changes))
+
+	expected, err := ChangesDirs(src, orig)
+	assert.NilError(t, err)
+	sort.Sort(changesByPath(expected))
+	assert.Check(t, is.DeepEqual(changes, expected))
+}
+
+func TestChangesFromIndexImpliedDirectories(t *testing.T) {
+	src := t.TempDir()
+	assert.NilError(t, os.MkdirAll(filepath.Join(src, "dir", "sub"), ImpliedDirectoryMode))
+	assert.NilError(t, os.Chmod(filepath.Join(src, "dir"), 0o700))
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "dir", "sub", "file"), []byte("content"), 0o644))
+	fi, err := os.Lstat(filepath.Join(src, "dir", "sub", "file"))
+	assert.NilError(t, err)
+	hdr, err := FileInfoHeader("dir/sub/file", fi, "")
+	assert.NilError(t, err)
+
+	changes, err := ChangesFromIndex(src, []tar.Header{*hdr})
+	assert.NilError(t, err)
+	if runtime.GOOS == "windows" {
+		// Windows does not support the mode of directories.
+		return
+	}
+	assert.Check(t, is.DeepEqual(changes, []Change{
+		{Path: filepath.FromSlash("/dir"), Kind: ChangeModify},
+	}))
+}
+
 func TestApplyLayer(t *testing.T) {
 	// TODO Windows. This is very close to working, but it fails with changes
 	// to \symlinknew and \symlink2. The destination has an updated
@@ -447,6 +508,83 @@ func TestApplyLayer(t *testing.T) {
 	}
 }
 
+func TestExportChangesWithCompression(t *testing.T) {
+	// See TestApplyLayer.
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		t.Skip("needs further investigation")
+	}
+	for _, comp := range []compression.Compression{compression.Gzip, compression.Zstd} {
+		t.Run(comp.Extension(), func(t *testing.T) {
+			src := filepath.Join(t.TempDir(), "src")
+			assert.NilError(t, os.Mkdir(src, 0o755))
+			createSampleDir(t, src)
+			dst := src + "-copy"
+			assert.NilError(t, copyDir(src, dst))
+			mutateSampleDir(t, dst)
+
+			changes, err := ChangesDirs(dst, src)
+			assert.NilError(t, err)
+
+			layer, err := ExportChangesWithCompression(dst, changes, user.IdentityMapping{}, comp)
+			assert.NilError(t, err)
+			defer layer.Close()
+			compressed, err := io.ReadAll(layer)
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(compression.Detect(compressed), comp))
+
+			decompressed, err := compression.DecompressStream(bytes.NewReader(compressed))
+			assert.NilError(t, err)
+			defer decompressed.Close()
+			_, err = ApplyLayer(src, decompressed)
+			assert.NilError(t, err)
+
+			changes, err = ChangesDirs(src, dst)
+			assert.NilError(t, err)
+			assert.Check(t, is.Len(changes, 0), "unexpected differences after reapplying mutation: %v", changes)
+		})
+	}
+}
+
+func TestExportChangesClose(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("a"), 64*1024)
+	var changes []Change
+	for i := range 100 {
+		name := fmt.Sprintf("file%03d", i)
+		assert.NilError(t, os.WriteFile(filepath.Join(dir, name), content, 0o644))
+		changes = append(changes, Change{Path: string(os.PathSeparator) + name, Kind: ChangeAdd})
+	}
+
+	for _, comp := range []compression.Compression{compression.None, compression.Gzip} {
+		t.Run(comp.Extension(), func(t *testing.T) {
+			layer, err := ExportChangesWithCompression(dir, changes, user.IdentityMapping{}, comp)
+			assert.NilError(t, err)
+
+			// Read only the start of the archive, which is produced on demand,
+			// so the remaining files are not read.
+			_, err = io.ReadFull(layer, make([]byte, 16))
+			assert.NilError(t, err)
+
+			closed := make(chan error, 1)
+			go func() { closed <- layer.Close() }()
+			select {
+			case err := <-closed:
+				assert.Check(t, err)
+			case <-time.After(10 * time.Second):
+				t.Fatal("timeout waiting for the archive to be closed")
+			}
+
+			select {
+			case <-layer.(*producerReader).done:
+			default:
+				t.Fatal("goroutine producing the archive is still running after Close")
+			}
+			_, err = layer.Read(make([]byte, 1))
+			assert.Check(t, is.ErrorIs(err, io.ErrClosedPipe))
+		})
+	}
+}
+
 func TestChangesSizeWithHardlinks(t *testing.T) {
 	// TODO Windows. Needs further investigation. Likely in ChangeSizes not
 	// coping correctly with hardlinks on Windows.
@@ -509,6 +647,191 @@ func TestChangesSize(t *testing.T) {
 	}
 }
 
+func TestMergeChanges(t *testing.T) {
+	// changes converts the paths to the platform's path separator, as used
+	// by ChangesDirs.
+	changes := func(cs ...Change) []Change {
+		for i := range cs {
+			cs[i].Path = filepath.FromSlash(cs[i].Path)
+		}
+		return cs
+	}
+	tests := []struct {
+		doc      string
+		base     []Change
+		overlay  []Change
+		expected []Change
+	}{
+		{
+			doc:      "add then delete",
+			base:     changes(Change{Path: "/a", Kind: ChangeAdd}),
+			overlay:  changes(Change{Path: "/a", Kind: ChangeDelete}),
+			expected: []Change{},
+		},
+		{
+			doc:      "delete then add",
+			base:     changes(Change{Path: "/a", Kind: ChangeDelete}),
+			overlay:  changes(Change{Path: "/a", Kind: ChangeAdd}),
+			expected: changes(Change{Path: "/a", Kind: ChangeModify}, Change{Path: "/a/" + WhiteoutOpaqueDir, Kind: ChangeAdd}),
+		},
+		{
+			doc:      "modify then delete",
+			base:     changes(Change{Path: "/a", Kind: ChangeModify}),
+			overlay:  changes(Change{Path: "/a", Kind: ChangeDelete}),
+			expected: changes(Change{Path: "/a", Kind: ChangeDelete}),
+		},
+		{
+			doc:      "add then modify",
+			base:     changes(Change{Path: "/a", Kind: ChangeAdd}),
+			overlay:  changes(Change{Path: "/a", Kind: ChangeModify}),
+			expected: changes(Change{Path: "/a", Kind: ChangeAdd}),
+		},
+		{
+			doc:      "modify then modify",
+			base:     changes(Change{Path: "/a", Kind: ChangeModify}),
+			overlay:  changes(Change{Path: "/a", Kind: ChangeModify}),
+			expected: changes(Change{Path: "/a", Kind: ChangeModify}),
+		},
+		{
+			doc: "delete parent directory",
+			base: changes(
+				Change{Path: "/dir", Kind: ChangeModify},
+				Change{Path: "/dir/added", Kind: ChangeAdd},
+				Change{Path: "/dir/sub/deleted", Kind: ChangeDelete},
+				Change{Path: "/dir2", Kind: ChangeAdd},
+			),
+			overlay:  changes(Change{Path: "/dir", Kind: ChangeDelete}),
+			expected: changes(Change{Path: "/dir", Kind: ChangeDelete}, Change{Path: "/dir2", Kind: ChangeAdd}),
+		},
+		{
+			doc:  "disjoint",
+			base: changes(Change{Path: "/c", Kind: ChangeAdd}, Change{Path: "/a", Kind: ChangeModify}),
+			overlay: changes(
+				Change{Path: "/d", Kind: ChangeDelete},
+				Change{Path: "/b", Kind: ChangeAdd},
+			),
+			expected: changes(
+				Change{Path: "/a", Kind: ChangeModify},
+				Change{Path: "/b", Kind: ChangeAdd},
+				Change{Path: "/c", Kind: ChangeAdd},
+				Change{Path: "/d", Kind: ChangeDelete},
+			),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.doc, func(t *testing.T) {
+			assert.Check(t, is.DeepEqual(MergeChanges(tc.base, tc.overlay), tc.expected))
+		})
+	}
+}
+
+func TestMergeChangesExport(t *testing.T) {
+	// lower has a directory that base deletes, and overlay adds again with
+	// other contents, a directory that overlay replaces with a file, and a
+	// file that overlay replaces with a directory.
+	lower, mid, upper := t.TempDir(), t.TempDir(), t.TempDir()
+	assert.NilError(t, os.Mkdir(filepath.Join(lower, "d"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(lower, "d", "old"), []byte("old"), 0o644))
+	assert.NilError(t, os.Mkdir(filepath.Join(lower, "d2"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(lower, "d2", "old"), []byte("old"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(lower, "f"), []byte("old"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(lower, "keep"), []byte("keep"), 0o644))
+	assert.NilError(t, NewDefaultArchiver().CopyWithTar(lower, mid))
+	for _, p := range []string{"d", "d2", "f"} {
+		assert.NilError(t, os.RemoveAll(filepath.Join(mid, p)))
+	}
+	assert.NilError(t, NewDefaultArchiver().CopyWithTar(mid, upper))
+	assert.NilError(t, os.Mkdir(filepath.Join(upper, "d"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(upper, "d", "new"), []byte("new"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(upper, "d2"), []byte("new"), 0o644))
+	assert.NilError(t, os.Mkdir(filepath.Join(upper, "f"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(upper, "f", "new"), []byte("new"), 0o644))
+
+	base, err := ChangesDirs(mid, lower)
+	assert.NilError(t, err)
+	overlay, err := ChangesDirs(upper, mid)
+	assert.NilError(t, err)
+	merged := MergeChanges(base, overlay)
+
+	layer, err := ExportChanges(upper, merged, user.IdentityMapping{})
+	assert.NilError(t, err)
+	assert.NilError(t, ValidateLayer(layer))
+	assert.NilError(t, layer.Close())
+
+	layer, err = ExportChanges(upper, merged, user.IdentityMapping{})
+	assert.NilError(t, err)
+	defer layer.Close()
+	_, err = ApplyLayer(lower, layer)
+	assert.NilError(t, err)
+
+	changes, err := ChangesDirs(lower, upper)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(changes, 0), "unexpected changes: %v", changes)
+}
+
+// createTree creates dirs directories, each with a nested directory, and
+// files files of size bytes in each of them, and returns the paths of the
+// files and directories created, and the total size of the files.
+func createTree(t testing.TB, root string, dirs, files, size int) ([]string, int64) {
+	var (
+		paths []string
+		total int64
+	)
+	content := make([]byte, size)
+	for i := range dirs {
+		for _, dir := range []string{fmt.Sprintf("dir%d", i), fmt.Sprintf("dir%d/sub", i)} {
+			assert.NilError(t, os.Mkdir(filepath.Join(root, dir), 0o755))
+			paths = append(paths, dir)
+			for j := range files {
+				p := filepath.Join(dir, fmt.Sprintf("file%d", j))
+				assert.NilError(t, os.WriteFile(filepath.Join(root, p), content, 0o644))
+				paths = append(paths, p)
+				total += int64(size)
+			}
+		}
+	}
+	return paths, total
+}
+
+func TestChangesDirsContext(t *testing.T) {
+	newDir := t.TempDir()
+	paths, size := createTree(t, newDir, 50, 10, 3)
+
+	changes, err := ChangesDirsContext(context.Background(), newDir, "")
+	assert.NilError(t, err)
+
+	var expected []Change
+	for _, p := range paths {
+		expected = append(expected, Change{Path: filepath.Join(string(os.PathSeparator), p), Kind: ChangeAdd})
+	}
+	sort.Sort(changesByPath(expected))
+	sort.Sort(changesByPath(changes))
+	assert.DeepEqual(t, changes, expected)
+	assert.Equal(t, ChangesSize(newDir, changes), size)
+}
+
+func TestChangesDirsContextCancelled(t *testing.T) {
+	newDir := t.TempDir()
+	createTree(t, newDir, 5, 1, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := ChangesDirsContext(ctx, newDir, "")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func BenchmarkChangesDirs(b *testing.B) {
+	newDir := b.TempDir()
+	createTree(b, newDir, 50, 1000, 0)
+	oldDir := b.TempDir()
+
+	for b.Loop() {
+		if _, err := ChangesDirs(newDir, oldDir); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func checkChanges(expectedChanges, changes []Change, t *testing.T) {
 	skip.If(t, runtime.GOOS != "windows" && os.Getuid() != 0, "skipping test that requires root")
 	sort.Sort(changesByPath(expectedChanges))
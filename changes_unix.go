@@ -3,19 +3,22 @@
 package archive
 
 import (
+	"archive/tar"
 	"io/fs"
 	"os"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func statDifferent(oldStat fs.FileInfo, newStat fs.FileInfo) bool {
-	oldSys := oldStat.Sys().(*syscall.Stat_t)
-	newSys := newStat.Sys().(*syscall.Stat_t)
+	oldUID, oldGID, oldRdev := statIDs(oldStat)
+	newUID, newGID, newRdev := statIDs(newStat)
 	// Don't look at size for dirs, its not a good measure of change
 	if oldStat.Mode() != newStat.Mode() ||
-		oldSys.Uid != newSys.Uid ||
-		oldSys.Gid != newSys.Gid ||
-		oldSys.Rdev != newSys.Rdev ||
+		oldUID != newUID ||
+		oldGID != newGID ||
+		oldRdev != newRdev ||
 		// Don't look at size or modification time for dirs, its not a good
 		// measure of change. See https://github.com/moby/moby/issues/9874
 		// for a description of the issue with modification time, and
@@ -30,6 +33,21 @@ func statDifferent(oldStat fs.FileInfo, newStat fs.FileInfo) bool {
 	return false
 }
 
+// statIDs returns the owner and device number of the file described by fi,
+// which is either the result of a stat, or of [tar.Header.FileInfo] for
+// files described by the headers passed to [ChangesFromIndex].
+func statIDs(fi fs.FileInfo) (uid, gid uint32, rdev uint64) {
+	switch st := fi.Sys().(type) {
+	case *syscall.Stat_t:
+		return st.Uid, st.Gid, uint64(st.Rdev) // #nosec G115 -- Rdev is signed on some platforms.
+	case *tar.Header:
+		// #nosec G115 -- ignore integer overflow conversion for ids and device numbers in the header.
+		return uint32(st.Uid), uint32(st.Gid), unix.Mkdev(uint32(st.Devmajor), uint32(st.Devminor))
+	default:
+		return 0, 0, 0
+	}
+}
+
 func (info *FileInfo) isDir() bool {
 	return info.parent == nil || info.stat.Mode().IsDir()
 }
@@ -31,3 +31,9 @@ func getIno(fi os.FileInfo) (inode uint64) {
 func hasHardlinks(fi os.FileInfo) bool {
 	return false
 }
+
+// statIDs returns zero values, as the owner and device number of files are
+// not available on Windows.
+func statIDs(fs.FileInfo) (uid, gid uint32, rdev uint64) {
+	return 0, 0, 0
+}
@@ -23,7 +23,7 @@ func NewArchiver(idMapping user.IdentityMapping) *archive.Archiver {
 // Untar reads a stream of bytes from `archive`, parses it as a tar archive,
 // and unpacks it into the directory at `dest`.
 // The archive may be compressed with one of the following algorithms:
-// identity (uncompressed), gzip, bzip2, xz.
+// identity (uncompressed), gzip, bzip2, xz, zstd, lz4.
 func Untar(tarArchive io.Reader, dest string, options *archive.TarOptions) error {
 	return untarHandler(tarArchive, dest, options, true, dest)
 }
@@ -74,8 +74,12 @@ func untarHandler(tarArchive io.Reader, dest string, options *archive.TarOptions
 	}
 
 	r := io.NopCloser(tarArchive)
-	if decompress {
-		decompressedArchive, err := compression.DecompressStream(tarArchive)
+	if decompress && options.ResumeFrom == nil {
+		var dicts [][]byte
+		if options.CompressionDict != nil {
+			dicts = append(dicts, options.CompressionDict)
+		}
+		decompressedArchive, err := compression.DecompressStreamWithDicts(tarArchive, dicts...)
 		if err != nil {
 			return err
 		}
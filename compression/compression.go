@@ -15,7 +15,9 @@
 	"sync"
 
 	"github.com/containerd/log"
+	bzip2w "github.com/dsnet/compress/bzip2"
 	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
 )
 
 // Compression is the state represents if compressed or not.
@@ -27,6 +29,7 @@
 	Gzip  Compression = 2 // Gzip is gzip compression algorithm.
 	Xz    Compression = 3 // Xz is xz compression algorithm.
 	Zstd  Compression = 4 // Zstd is zstd compression algorithm.
+	Lz4   Compression = 5 // Lz4 is lz4 compression algorithm.
 )
 
 // Extension returns the extension of a file that uses the specified compression algorithm.
@@ -42,6 +45,8 @@ func (c *Compression) Extension() string {
 		return "tar.xz"
 	case Zstd:
 		return "tar.zst"
+	case Lz4:
+		return "tar.lz4"
 	default:
 		return ""
 	}
@@ -100,7 +105,37 @@ func (r *bufferedReader) Peek(n int) ([]byte, error) {
 }
 
 // DecompressStream decompresses the archive and returns a ReaderCloser with the decompressed archive.
+// Archives consisting of multiple concatenated gzip members, or xz or zstd
+// streams, are decompressed in full.
 func DecompressStream(archive io.Reader) (io.ReadCloser, error) {
+	rdr, _, err := DecompressStreamWithType(archive)
+	return rdr, err
+}
+
+// DecompressStreamWithDicts is like [DecompressStream], but zstd streams may
+// be compressed with one of the given dictionaries, as with
+// [CompressStreamZstdDict]. The dictionaries must be in the dictionary format
+// of zstd, as produced by "zstd --train". Streams compressed without a
+// dictionary, or with another algorithm, are decompressed as usual.
+func DecompressStreamWithDicts(archive io.Reader, dicts ...[]byte) (io.ReadCloser, error) {
+	rdr, _, err := decompressStream(archive, zstdDecoderOptions(dicts)...)
+	return rdr, err
+}
+
+// DecompressStreamWithType is like [DecompressStream], but also returns the
+// compression algorithm that was detected for the archive.
+func DecompressStreamWithType(archive io.Reader) (io.ReadCloser, Compression, error) {
+	return decompressStream(archive)
+}
+
+func zstdDecoderOptions(dicts [][]byte) []zstd.DOption {
+	if len(dicts) == 0 {
+		return nil
+	}
+	return []zstd.DOption{zstd.WithDecoderDicts(dicts...)}
+}
+
+func decompressStream(archive io.Reader, zstdOpts ...zstd.DOption) (io.ReadCloser, Compression, error) {
 	buf := newBufferedReader(archive)
 	bs, err := buf.Peek(10)
 	if err != nil && !errors.Is(err, io.EOF) {
@@ -110,10 +145,58 @@ func DecompressStream(archive io.Reader) (io.ReadCloser, error) {
 		// cases we'll just treat it as a non-compressed stream and
 		// that means just create an empty layer.
 		// See Issue 18170
-		return nil, err
+		return nil, None, err
 	}
 
-	switch compression := Detect(bs); compression {
+	compression := Detect(bs)
+	rdr, err := decompress(buf, compression, zstdOpts...)
+	if err != nil {
+		return nil, None, err
+	}
+	return rdr, compression, nil
+}
+
+// DecompressStreamAs is like [DecompressStream], but decompresses the archive
+// with the given compression algorithm instead of detecting it, for example
+// for algorithms that cannot be detected. Errors returned when reading the
+// decompressed archive, for example because it is not compressed with the
+// given algorithm, mention the algorithm. Zstd streams may be compressed with
+// one of the given dictionaries, as for [DecompressStreamWithDicts].
+func DecompressStreamAs(archive io.Reader, compression Compression, dicts ...[]byte) (io.ReadCloser, error) {
+	rdr, err := decompress(newBufferedReader(archive), compression, zstdDecoderOptions(dicts)...)
+	if err != nil {
+		return nil, decompressError(compression, err)
+	}
+	if compression == None {
+		return rdr, nil
+	}
+	return &readCloserWrapper{
+		Reader: &decompressErrorReader{Reader: rdr, compression: compression},
+		closer: rdr.Close,
+	}, nil
+}
+
+// decompressErrorReader annotates errors from the decompressing Reader with
+// the compression algorithm.
+type decompressErrorReader struct {
+	io.Reader
+	compression Compression
+}
+
+func (r *decompressErrorReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		err = decompressError(r.compression, err)
+	}
+	return n, err
+}
+
+func decompressError(compression Compression, err error) error {
+	return fmt.Errorf("failed to decompress archive as %s: %w", compression.Extension(), err)
+}
+
+func decompress(buf *bufferedReader, compression Compression, zstdOpts ...zstd.DOption) (io.ReadCloser, error) {
+	switch compression {
 	case None:
 		return &readCloserWrapper{
 			Reader: buf,
@@ -155,7 +238,7 @@ func DecompressStream(archive io.Reader) (io.ReadCloser, error) {
 			},
 		}, nil
 	case Zstd:
-		zstdReader, err := zstd.NewReader(buf)
+		zstdReader, err := zstd.NewReader(buf, zstdOpts...)
 		if err != nil {
 			return nil, err
 		}
@@ -166,6 +249,10 @@ func DecompressStream(archive io.Reader) (io.ReadCloser, error) {
 				return nil
 			},
 		}, nil
+	case Lz4:
+		return &readCloserWrapper{
+			Reader: lz4.NewReader(buf),
+		}, nil
 
 	default:
 		return nil, fmt.Errorf("unsupported compression format (%d)", compression)
@@ -180,17 +267,81 @@ func CompressStream(dest io.Writer, compression Compression) (io.WriteCloser, er
 	case Gzip:
 		return gzip.NewWriter(dest), nil
 	case Bzip2:
-		// archive/bzip2 does not support writing.
-		return nil, errors.New("unsupported compression format: tar.bz2")
+		// compress/bzip2 does not support writing.
+		return bzip2w.NewWriter(dest, nil)
 	case Xz:
-		// there is no xz support at all
-		// However, this is not a problem as docker only currently generates gzipped tars
+		// xz archives can only be decompressed, using the xz binary;
+		// there is no support for writing them.
 		return nil, errors.New("unsupported compression format: tar.xz")
+	case Zstd:
+		return zstd.NewWriter(dest)
+	case Lz4:
+		return lz4.NewWriter(dest), nil
 	default:
 		return nil, fmt.Errorf("unsupported compression format (%d)", compression)
 	}
 }
 
+// CompressStreamLevel compresses the dest with specified compression algorithm
+// and compression level. The level is validated against the range accepted by
+// the algorithm (gzip: -2 to 9, bzip2: 1 to 9, zstd: 1 to 22, lz4: 0 to 9,
+// where 0 is the fast mode used by default), and is ignored for [None].
+func CompressStreamLevel(dest io.Writer, compression Compression, level int) (io.WriteCloser, error) {
+	switch compression {
+	case None:
+		return nopWriteCloser{dest}, nil
+	case Gzip:
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return nil, invalidLevelError(compression, level, gzip.HuffmanOnly, gzip.BestCompression)
+		}
+		return gzip.NewWriterLevel(dest, level)
+	case Bzip2:
+		if level < bzip2w.BestSpeed || level > bzip2w.BestCompression {
+			return nil, invalidLevelError(compression, level, bzip2w.BestSpeed, bzip2w.BestCompression)
+		}
+		return bzip2w.NewWriter(dest, &bzip2w.WriterConfig{Level: level})
+	case Zstd:
+		const minLevel, maxLevel = 1, 22
+		if level < minLevel || level > maxLevel {
+			return nil, invalidLevelError(compression, level, minLevel, maxLevel)
+		}
+		return zstd.NewWriter(dest, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	case Lz4:
+		levels := []lz4.CompressionLevel{lz4.Fast, lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9}
+		if level < 0 || level >= len(levels) {
+			return nil, invalidLevelError(compression, level, 0, len(levels)-1)
+		}
+		w := lz4.NewWriter(dest)
+		if err := w.Apply(lz4.CompressionLevelOption(levels[level])); err != nil {
+			return nil, err
+		}
+		return w, nil
+	default:
+		return CompressStream(dest, compression)
+	}
+}
+
+// CompressStreamZstdDict compresses the dest with zstd, using the dictionary
+// dict, which must be in the dictionary format of zstd, as produced by
+// "zstd --train". The dictionary is needed to decompress the stream, see
+// [DecompressStreamWithDicts]. If level is nil, the default level is used;
+// otherwise, it is validated as for [CompressStreamLevel].
+func CompressStreamZstdDict(dest io.Writer, level *int, dict []byte) (io.WriteCloser, error) {
+	opts := []zstd.EOption{zstd.WithEncoderDict(dict)}
+	if level != nil {
+		const minLevel, maxLevel = 1, 22
+		if *level < minLevel || *level > maxLevel {
+			return nil, invalidLevelError(Zstd, *level, minLevel, maxLevel)
+		}
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(*level)))
+	}
+	return zstd.NewWriter(dest, opts...)
+}
+
+func invalidLevelError(compression Compression, level, minLevel, maxLevel int) error {
+	return fmt.Errorf("invalid compression level %d for %s: must be between %d and %d", level, compression.Extension(), minLevel, maxLevel)
+}
+
 func xzDecompress(ctx context.Context, archive io.Reader) (io.ReadCloser, error) {
 	args := []string{"xz", "-d", "-c", "-q"}
 
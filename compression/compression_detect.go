@@ -3,6 +3,8 @@
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 )
 
 const (
@@ -10,24 +12,34 @@
 	zstdMagicSkippableMask  = 0xFFFFFFF0
 )
 
+// detectLen is the number of bytes needed by [Detect] to detect any of the
+// supported compression algorithms; the longest signature is the 8 bytes
+// needed to detect zstd skippable frames.
+const detectLen = 8
+
 var (
 	bzip2Magic = []byte{0x42, 0x5A, 0x68}
 	gzipMagic  = []byte{0x1F, 0x8B, 0x08}
 	xzMagic    = []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}
 	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic   = []byte{0x04, 0x22, 0x4D, 0x18}
 )
 
 type matcher = func([]byte) bool
 
-// Detect detects the compression algorithm of the source.
+// Detect detects the compression algorithm of the source. Only a prefix of
+// the compressed data is needed, but source must be long enough to hold the
+// full signature of the algorithm; [None] is returned if source is shorter
+// than the signature, or does not match any of the supported algorithms.
 func Detect(source []byte) Compression {
 	compressionMap := map[Compression]matcher{
 		Bzip2: magicNumberMatcher(bzip2Magic),
 		Gzip:  magicNumberMatcher(gzipMagic),
 		Xz:    magicNumberMatcher(xzMagic),
 		Zstd:  zstdMatcher(),
+		Lz4:   magicNumberMatcher(lz4Magic),
 	}
-	for _, compression := range []Compression{Bzip2, Gzip, Xz, Zstd} {
+	for _, compression := range []Compression{Bzip2, Gzip, Xz, Zstd, Lz4} {
 		fn := compressionMap[compression]
 		if fn(source) {
 			return compression
@@ -63,3 +75,17 @@ func zstdMatcher() matcher {
 		return false
 	}
 }
+
+// DetectReader detects the compression algorithm of the data read from r. It
+// reads only the bytes needed for detection, and returns a reader that replays
+// those bytes before reading the remainder of r. Data shorter than any of
+// the signatures is detected as [None].
+func DetectReader(r io.Reader) (Compression, io.Reader, error) {
+	buf := make([]byte, detectLen)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return None, nil, err
+	}
+	buf = buf[:n]
+	return Detect(buf), io.MultiReader(bytes.NewReader(buf), r), nil
+}
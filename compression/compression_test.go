@@ -1,6 +1,7 @@
 package compression
 
 import (
+	"bytes"
 	"compress/gzip"
 	"fmt"
 	"io"
@@ -9,11 +10,14 @@
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
 )
 
 func TestExtension(t *testing.T) {
@@ -27,6 +31,7 @@ func TestExtension(t *testing.T) {
 		{compression: Gzip, extension: "tar.gz"},
 		{compression: Xz, extension: "tar.xz"},
 		{compression: Zstd, extension: "tar.zst"},
+		{compression: Lz4, extension: "tar.lz4"},
 	}
 	for _, tc := range tests {
 		if actual := tc.compression.Extension(); actual != tc.extension {
@@ -63,6 +68,60 @@ func TestDetectCompressionZstd(t *testing.T) {
 	}
 }
 
+func TestDetectCompressionLz4(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := CompressStream(&buf, Lz4)
+	assert.NilError(t, err)
+	_, err = w.Write([]byte("docker"))
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+
+	assert.Equal(t, Detect(buf.Bytes()), Lz4)
+	assert.Equal(t, Detect([]byte{0x04, 0x22, 0x4D, 0x18}), Lz4)
+}
+
+func TestDetectShortInput(t *testing.T) {
+	tests := []struct {
+		doc   string
+		input []byte
+	}{
+		{doc: "empty", input: []byte{}},
+		{doc: "1 byte", input: gzipMagic[:1]},
+		{doc: "3 bytes xz", input: xzMagic[:3]},
+		{doc: "3 bytes zstd", input: zstdMagic[:3]},
+		{doc: "4 bytes zstd skippable frame", input: []byte{0x50, 0x2a, 0x4d, 0x18}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.doc, func(t *testing.T) {
+			assert.Equal(t, Detect(tc.input), None)
+
+			c, r, err := DetectReader(bytes.NewReader(tc.input))
+			assert.NilError(t, err)
+			assert.Equal(t, c, None)
+			out, err := io.ReadAll(r)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, out, tc.input)
+		})
+	}
+}
+
+func TestDetectReader(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := CompressStream(&buf, Gzip)
+	assert.NilError(t, err)
+	_, err = w.Write([]byte("hello world"))
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+	expected := slices.Clone(buf.Bytes())
+
+	c, r, err := DetectReader(&buf)
+	assert.NilError(t, err)
+	assert.Equal(t, c, Gzip)
+	out, err := io.ReadAll(r)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, out, expected)
+}
+
 // toUnixPath converts the given path to a unix-path, using forward-slashes, and
 // with the drive-letter replaced (e.g. "C:\temp\file.txt" becomes "/c/temp/file.txt").
 // It is a no-op on non-Windows platforms.
@@ -151,16 +210,208 @@ func TestCompressStreamXzUnsupported(t *testing.T) {
 	}
 }
 
-func TestCompressStreamBzip2Unsupported(t *testing.T) {
-	dest, err := os.Create(filepath.Join(t.TempDir(), "dest"))
-	if err != nil {
-		t.Fatalf("Fail to create the destination file")
+func TestCompressStreamBzip2(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := CompressStream(&buf, Bzip2)
+	assert.NilError(t, err)
+	_, err = w.Write([]byte("hello world"))
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+
+	assert.Equal(t, Detect(buf.Bytes()), Bzip2)
+
+	r, err := DecompressStream(&buf)
+	assert.NilError(t, err)
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	assert.NilError(t, err)
+	assert.Equal(t, string(out), "hello world")
+}
+
+func TestCompressStreamZstd(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := CompressStream(&buf, Zstd)
+	assert.NilError(t, err)
+	_, err = w.Write([]byte("hello world"))
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+
+	assert.Equal(t, Detect(buf.Bytes()), Zstd)
+
+	r, err := DecompressStream(&buf)
+	assert.NilError(t, err)
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	assert.NilError(t, err)
+	assert.Equal(t, string(out), "hello world")
+}
+
+// testZstdDict returns a zstd dictionary built from samples similar to the
+// result of testZstdDictSample.
+func testZstdDict(t *testing.T) []byte {
+	t.Helper()
+	var samples [][]byte
+	for i := range 100 {
+		samples = append(samples, testZstdDictSample(i))
+	}
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       1,
+		Contents: samples,
+		History:  bytes.Join(samples[:10], nil),
+		Offsets:  [3]int{1, 4, 8},
+	})
+	assert.NilError(t, err)
+	return dict
+}
+
+func testZstdDictSample(i int) []byte {
+	return fmt.Appendf(nil, `{"architecture":"amd64","config":{"Env":["PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"],"Cmd":["/bin/sh"],"Labels":{"version":"%d"}},"os":"linux","rootfs":{"type":"layers","diff_ids":["sha256:%064d"]}}`, i, i)
+}
+
+func TestCompressStreamZstdDict(t *testing.T) {
+	dict := testZstdDict(t)
+	sample := testZstdDictSample(1000)
+
+	compress := func(dict []byte) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		var err error
+		if dict != nil {
+			w, err = CompressStreamZstdDict(&buf, nil, dict)
+		} else {
+			w, err = CompressStream(&buf, Zstd)
+		}
+		assert.NilError(t, err)
+		_, err = w.Write(sample)
+		assert.NilError(t, err)
+		assert.NilError(t, w.Close())
+		return buf.Bytes()
+	}
+	withDict, withoutDict := compress(dict), compress(nil)
+	assert.Check(t, len(withDict) < len(withoutDict), "compressed size with dictionary %d, without %d", len(withDict), len(withoutDict))
+	assert.Check(t, is.Equal(Detect(withDict), Zstd))
+
+	for _, compressed := range [][]byte{withDict, withoutDict} {
+		r, err := DecompressStreamWithDicts(bytes.NewReader(compressed), dict)
+		assert.NilError(t, err)
+		out, err := io.ReadAll(r)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(string(out), string(sample)))
+		assert.NilError(t, r.Close())
 	}
-	defer dest.Close()
 
-	_, err = CompressStream(dest, Bzip2)
-	if err == nil {
-		t.Fatalf("Should fail as bzip2 is unsupported for compression format.")
+	r, err := DecompressStream(bytes.NewReader(withDict))
+	assert.NilError(t, err)
+	defer r.Close()
+	_, err = io.ReadAll(r)
+	assert.Check(t, err != nil, "expected error decompressing without dictionary")
+
+	for _, level := range []int{0, 23} {
+		_, err = CompressStreamZstdDict(io.Discard, &level, dict)
+		assert.Check(t, is.ErrorContains(err, fmt.Sprintf("invalid compression level %d", level)))
+	}
+	_, err = CompressStreamZstdDict(io.Discard, nil, []byte("not a dictionary"))
+	assert.Check(t, err != nil)
+}
+
+func TestCompressStreamLevel(t *testing.T) {
+	tests := []struct {
+		compression Compression
+		level       int
+		expectedErr string
+	}{
+		{compression: None, level: 100},
+		{compression: Gzip, level: 1},
+		{compression: Gzip, level: 9},
+		{compression: Gzip, level: 10, expectedErr: "invalid compression level 10 for tar.gz: must be between -2 and 9"},
+		{compression: Bzip2, level: 1},
+		{compression: Bzip2, level: 9},
+		{compression: Bzip2, level: 0, expectedErr: "invalid compression level 0 for tar.bz2: must be between 1 and 9"},
+		{compression: Zstd, level: 1},
+		{compression: Zstd, level: 22},
+		{compression: Zstd, level: 0, expectedErr: "invalid compression level 0 for tar.zst: must be between 1 and 22"},
+		{compression: Lz4, level: 0},
+		{compression: Lz4, level: 9},
+		{compression: Lz4, level: 10, expectedErr: "invalid compression level 10 for tar.lz4: must be between 0 and 9"},
+		{compression: Xz, level: 1, expectedErr: "unsupported compression format: tar.xz"},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tc.compression.Extension(), tc.level), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := CompressStreamLevel(&buf, tc.compression, tc.level)
+			if tc.expectedErr != "" {
+				assert.Error(t, err, tc.expectedErr)
+				return
+			}
+			assert.NilError(t, err)
+			_, err = w.Write([]byte("hello world"))
+			assert.NilError(t, err)
+			assert.NilError(t, w.Close())
+			assert.Equal(t, Detect(buf.Bytes()), tc.compression)
+		})
+	}
+}
+
+func TestDecompressStreamWithType(t *testing.T) {
+	for _, c := range []Compression{None, Bzip2, Gzip, Zstd, Lz4} {
+		t.Run(c.Extension(), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := CompressStream(&buf, c)
+			assert.NilError(t, err)
+			_, err = w.Write([]byte("hello world"))
+			assert.NilError(t, err)
+			assert.NilError(t, w.Close())
+
+			r, detected, err := DecompressStreamWithType(&buf)
+			assert.NilError(t, err)
+			defer r.Close()
+			assert.Equal(t, detected, c)
+
+			out, err := io.ReadAll(r)
+			assert.NilError(t, err)
+			assert.Equal(t, string(out), "hello world")
+		})
+	}
+}
+
+func TestDecompressStreamAs(t *testing.T) {
+	for _, c := range []Compression{None, Bzip2, Gzip, Zstd, Lz4} {
+		t.Run(c.Extension(), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := CompressStream(&buf, c)
+			assert.NilError(t, err)
+			_, err = w.Write([]byte("hello world"))
+			assert.NilError(t, err)
+			assert.NilError(t, w.Close())
+
+			r, err := DecompressStreamAs(&buf, c)
+			assert.NilError(t, err)
+			defer r.Close()
+
+			out, err := io.ReadAll(r)
+			assert.NilError(t, err)
+			assert.Equal(t, string(out), "hello world")
+		})
+	}
+}
+
+func TestDecompressStreamAsMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := CompressStream(&buf, Zstd)
+	assert.NilError(t, err)
+	_, err = w.Write([]byte("hello world"))
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+
+	for _, c := range []Compression{Bzip2, Gzip, Lz4} {
+		t.Run(c.Extension(), func(t *testing.T) {
+			r, err := DecompressStreamAs(bytes.NewReader(buf.Bytes()), c)
+			if err == nil {
+				defer r.Close()
+				_, err = io.ReadAll(r)
+			}
+			assert.Check(t, is.ErrorContains(err, "failed to decompress archive as "+c.Extension()))
+		})
 	}
 }
 
@@ -262,3 +513,61 @@ func TestPigz(t *testing.T) {
 		assert.Equal(t, reflect.TypeOf(wrapper.Reader), reflect.TypeFor[*gzip.Reader]())
 	}
 }
+
+func TestDecompressStreamConcatenated(t *testing.T) {
+	compressors := map[string]func(t *testing.T, data []byte) []byte{
+		"gzip": func(t *testing.T, data []byte) []byte {
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			_, err := w.Write(data)
+			assert.NilError(t, err)
+			assert.NilError(t, w.Close())
+			return buf.Bytes()
+		},
+		"zstd": func(t *testing.T, data []byte) []byte {
+			var buf bytes.Buffer
+			w, err := zstd.NewWriter(&buf)
+			assert.NilError(t, err)
+			_, err = w.Write(data)
+			assert.NilError(t, err)
+			assert.NilError(t, w.Close())
+			return buf.Bytes()
+		},
+		"xz": func(t *testing.T, data []byte) []byte {
+			if _, err := exec.LookPath("xz"); err != nil {
+				t.Skip("xz not installed")
+			}
+			cmd := exec.Command("xz", "-c")
+			cmd.Stdin = bytes.NewReader(data)
+			out, err := cmd.Output()
+			assert.NilError(t, err)
+			return out
+		},
+	}
+	for name, compress := range compressors {
+		t.Run(name, func(t *testing.T) {
+			var concatenated []byte
+			concatenated = append(concatenated, compress(t, []byte("first member, "))...)
+			concatenated = append(concatenated, compress(t, []byte("second member"))...)
+
+			rdr, err := DecompressStream(bytes.NewReader(concatenated))
+			assert.NilError(t, err)
+			defer rdr.Close()
+			out, err := io.ReadAll(rdr)
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(string(out), "first member, second member"))
+		})
+	}
+
+	t.Run("gzip without pigz", func(t *testing.T) {
+		t.Setenv("MOBY_DISABLE_PIGZ", "true")
+		concatenated := append(compressors["gzip"](t, []byte("first member, ")), compressors["gzip"](t, []byte("second member"))...)
+
+		rdr, err := DecompressStream(bytes.NewReader(concatenated))
+		assert.NilError(t, err)
+		defer rdr.Close()
+		out, err := io.ReadAll(rdr)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(string(out), "first member, second member"))
+	})
+}
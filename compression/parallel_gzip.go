@@ -0,0 +1,220 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"slices"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+)
+
+const (
+	// parallelGzipBlockSize is the size of the blocks of uncompressed data
+	// that are compressed in parallel.
+	parallelGzipBlockSize = 1 << 20
+
+	// maxDictSize is the size of the deflate window. The tail of each block
+	// is used as dictionary for the next block, so that blocks can use back
+	// references into the previous block.
+	maxDictSize = 32 << 10
+)
+
+// gzipHeader is a gzip header without modification time, extra fields, or
+// name, and with an unknown OS, matching the header written by [gzip.Writer].
+var gzipHeader = []byte{0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff}
+
+var errWriterClosed = errors.New("write to closed writer")
+
+// NewParallelGzipWriter returns a writer that compresses data written to it
+// using gzip, and writes the result to dest. Data is split into blocks that
+// are compressed using up to concurrency goroutines. If concurrency is zero
+// or negative, it defaults to [runtime.GOMAXPROCS].
+//
+// The output is a single gzip stream that can be decompressed by any gzip
+// decoder, but is typically slightly larger than the output of [gzip.Writer]
+// for the same level. Level accepts the same values as
+// [gzip.NewWriterLevel]. The writer must be closed to flush all data to dest.
+// The returned writer also implements a Flush method, which writes all data
+// written so far to dest, at the cost of a smaller block.
+func NewParallelGzipWriter(dest io.Writer, level, concurrency int) (io.WriteCloser, error) {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, invalidLevelError(Gzip, level, gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	z := &parallelGzipWriter{
+		dest:   dest,
+		level:  level,
+		buf:    make([]byte, 0, parallelGzipBlockSize),
+		blocks: make(chan chan []byte, concurrency),
+		done:   make(chan struct{}),
+	}
+	// The header counts as pending until run has written it.
+	z.pending.Add(1)
+	go z.run()
+	return z, nil
+}
+
+// parallelGzipWriter compresses blocks of data in parallel. Each block is
+// compressed to a deflate stream that ends at a byte boundary, using the
+// tail of the previous block as dictionary. Concatenated, these streams form
+// a single deflate stream, which is written to the destination in order by
+// a single goroutine.
+type parallelGzipWriter struct {
+	dest   io.Writer
+	level  int
+	buf    []byte
+	dict   []byte
+	crc    uint32
+	size   uint32
+	closed bool
+
+	// blocks holds the compressed blocks in the order in which they must be
+	// written. Each block is sent on its channel once it is compressed.
+	blocks chan chan []byte
+	done   chan struct{}
+
+	// pending counts the header and the blocks that are queued and not
+	// written yet.
+	pending sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+func (z *parallelGzipWriter) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, errWriterClosed
+	}
+	if err := z.getErr(); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	z.crc = crc32.Update(z.crc, crc32.IEEETable, p)
+	z.size += uint32(n) // #nosec G115 -- ISIZE is the size of the input modulo 2^32.
+	for len(p) > 0 {
+		c := copy(z.buf[len(z.buf):cap(z.buf)], p)
+		z.buf = z.buf[:len(z.buf)+c]
+		p = p[c:]
+		if len(z.buf) == cap(z.buf) {
+			z.dispatch(false)
+		}
+	}
+	return n, nil
+}
+
+// Flush compresses any buffered data, and waits until all data written so
+// far is written to dest. The deflate stream is flushed to a byte boundary,
+// so that a decoder can decompress all of it without reading further.
+func (z *parallelGzipWriter) Flush() error {
+	if z.closed {
+		return errWriterClosed
+	}
+	if len(z.buf) > 0 {
+		z.dispatch(false)
+	}
+	z.pending.Wait()
+	return z.getErr()
+}
+
+// Close compresses any remaining data, and writes the gzip footer. It does
+// not close the underlying writer.
+func (z *parallelGzipWriter) Close() error {
+	if z.closed {
+		return nil
+	}
+	z.closed = true
+	z.dispatch(true)
+	close(z.blocks)
+	<-z.done
+	if err := z.getErr(); err != nil {
+		return err
+	}
+
+	var footer [8]byte
+	binary.LittleEndian.PutUint32(footer[:4], z.crc)
+	binary.LittleEndian.PutUint32(footer[4:], z.size)
+	_, err := z.dest.Write(footer[:])
+	return err
+}
+
+// dispatch starts compressing the current block, and queues it to be written.
+// It blocks if the maximum number of blocks are already being compressed.
+func (z *parallelGzipWriter) dispatch(final bool) {
+	block, dict, level := z.buf, z.dict, z.level
+	result := make(chan []byte, 1)
+	z.pending.Add(1)
+	z.blocks <- result
+	go func() {
+		result <- compressBlock(block, dict, level, final)
+	}()
+	if len(block) >= maxDictSize {
+		z.dict = block[len(block)-maxDictSize:]
+	} else {
+		// Blocks dispatched by Flush may be smaller than the window; keep
+		// the tail of the previous dictionary. The clipped capacity makes
+		// append copy, as the previous blocks are still being compressed.
+		z.dict = append(slices.Clip(z.dict[max(0, len(z.dict)+len(block)-maxDictSize):]), block...)
+	}
+	z.buf = make([]byte, 0, parallelGzipBlockSize)
+}
+
+// run writes the gzip header and the compressed blocks to dest in order.
+// After an error, remaining blocks are discarded.
+func (z *parallelGzipWriter) run() {
+	defer close(z.done)
+
+	_, err := z.dest.Write(gzipHeader)
+	if err != nil {
+		z.setErr(err)
+	}
+	z.pending.Done()
+	for result := range z.blocks {
+		block := <-result
+		if err == nil {
+			_, err = z.dest.Write(block)
+		}
+		if err != nil {
+			z.setErr(err)
+		}
+		z.pending.Done()
+	}
+}
+
+func (z *parallelGzipWriter) getErr() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.err
+}
+
+func (z *parallelGzipWriter) setErr(err error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.err == nil {
+		z.err = err
+	}
+}
+
+// compressBlock compresses block to a deflate stream using dict as
+// dictionary. Unless final is set, the stream is not terminated, but flushed
+// to a byte boundary, so that the next block can be appended to it.
+func compressBlock(block, dict []byte, level int, final bool) []byte {
+	var out bytes.Buffer
+	// Writing to a bytes.Buffer does not fail, and level is validated
+	// by NewParallelGzipWriter.
+	fw, _ := flate.NewWriterDict(&out, level, dict)
+	_, _ = fw.Write(block)
+	if final {
+		_ = fw.Close()
+	} else {
+		_ = fw.Flush()
+	}
+	return out.Bytes()
+}
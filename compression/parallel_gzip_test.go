@@ -0,0 +1,130 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"os/exec"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// testData returns size bytes of compressible pseudo-random data.
+func testData(size int) []byte {
+	r := rand.New(rand.NewSource(1)) // #nosec G404 -- Deterministic test data, not used for security.
+	words := []string{"hello", "world", "archive", "layer", "tar", "gzip", "\n"}
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		buf.WriteString(words[r.Intn(len(words))])
+	}
+	return buf.Bytes()[:size]
+}
+
+func TestParallelGzipWriter(t *testing.T) {
+	for _, size := range []int{0, 1, parallelGzipBlockSize, 3*parallelGzipBlockSize + 12345} {
+		for _, concurrency := range []int{0, 1, 4} {
+			t.Run(fmt.Sprintf("size=%d/concurrency=%d", size, concurrency), func(t *testing.T) {
+				data := testData(size)
+
+				var buf bytes.Buffer
+				w, err := NewParallelGzipWriter(&buf, gzip.DefaultCompression, concurrency)
+				assert.NilError(t, err)
+				// Write in chunks that don't align with the block size.
+				for p := data; len(p) > 0; {
+					n := min(len(p), 100_000)
+					_, err = w.Write(p[:n])
+					assert.NilError(t, err)
+					p = p[n:]
+				}
+				assert.NilError(t, w.Close())
+				compressed := buf.Bytes()
+
+				gr, err := gzip.NewReader(bytes.NewReader(compressed))
+				assert.NilError(t, err)
+				gr.Multistream(false)
+				out, err := io.ReadAll(gr)
+				assert.NilError(t, err)
+				assert.Check(t, bytes.Equal(out, data), "decompressed data does not match")
+
+				r, err := DecompressStream(bytes.NewReader(compressed))
+				assert.NilError(t, err)
+				out, err = io.ReadAll(r)
+				assert.NilError(t, err)
+				assert.NilError(t, r.Close())
+				assert.Check(t, bytes.Equal(out, data), "decompressed data does not match")
+
+				if _, err := exec.LookPath("gzip"); err == nil {
+					cmd := exec.Command("gzip", "-d", "-c")
+					cmd.Stdin = bytes.NewReader(compressed)
+					out, err = cmd.Output()
+					assert.NilError(t, err)
+					assert.Check(t, bytes.Equal(out, data), "decompressed data does not match")
+				}
+			})
+		}
+	}
+}
+
+func TestParallelGzipWriterFlush(t *testing.T) {
+	data := testData(parallelGzipBlockSize + 100_000)
+
+	var buf bytes.Buffer
+	w, err := NewParallelGzipWriter(&buf, gzip.DefaultCompression, 4)
+	assert.NilError(t, err)
+	flusher, ok := w.(interface{ Flush() error })
+	assert.Assert(t, ok, "writer does not implement Flush")
+
+	// After each flush, all data written so far can be decompressed from
+	// the output, without the end of the stream.
+	var written int
+	for _, n := range []int{0, 10, 50_000, parallelGzipBlockSize, 49_990} {
+		_, err = w.Write(data[written : written+n])
+		assert.NilError(t, err)
+		written += n
+		assert.NilError(t, flusher.Flush())
+
+		gr, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+		assert.NilError(t, err)
+		out := make([]byte, written)
+		_, err = io.ReadFull(gr, out)
+		assert.NilError(t, err)
+		assert.Check(t, bytes.Equal(out, data[:written]), "decompressed data does not match after flush")
+	}
+	assert.NilError(t, w.Close())
+	assert.Check(t, flusher.Flush() != nil, "expected an error flushing a closed writer")
+
+	gr, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	assert.NilError(t, err)
+	out, err := io.ReadAll(gr)
+	assert.NilError(t, err)
+	assert.Check(t, bytes.Equal(out, data), "decompressed data does not match")
+}
+
+func TestParallelGzipWriterInvalidLevel(t *testing.T) {
+	_, err := NewParallelGzipWriter(io.Discard, 10, 0)
+	assert.Error(t, err, "invalid compression level 10 for tar.gz: must be between -2 and 9")
+}
+
+func BenchmarkParallelGzipWriter(b *testing.B) {
+	data := testData(16 * parallelGzipBlockSize)
+	for _, concurrency := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				w, err := NewParallelGzipWriter(io.Discard, gzip.DefaultCompression, concurrency)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := w.Write(data); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/moby/go-archive/compression"
+)
+
+// overlayOpaqueXattrs are the extended attributes used by overlayfs to mark
+// a directory as opaque.
+var overlayOpaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
+// ConvertWhiteouts reads the (possibly compressed) layer from r, and returns
+// an uncompressed layer in which whiteouts are converted from format "from"
+// to format "to".
+//
+// With [AUFSWhiteoutFormat], deleted files are represented by empty regular
+// files with the [WhiteoutPrefix], and opaque directories by an empty
+// [WhiteoutOpaqueDir] file inside the directory. With [OverlayWhiteoutFormat],
+// deleted files are represented by 0/0 character devices, and opaque
+// directories by a "trusted.overlay.opaque" extended attribute set to "y".
+//
+// Only entries representing whiteouts are rewritten; all other entries,
+// including hardlinks and extended attributes, are copied unmodified and in
+// the same order.
+func ConvertWhiteouts(r io.Reader, from, to WhiteoutFormat) (io.ReadCloser, error) {
+	for _, f := range []WhiteoutFormat{from, to} {
+		if f != AUFSWhiteoutFormat && f != OverlayWhiteoutFormat {
+			return nil, fmt.Errorf("unknown whiteout format: %d", f)
+		}
+	}
+
+	decompressed, err := compression.DecompressStream(r)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		defer func() { _ = decompressed.Close() }()
+
+		tr := tar.NewReader(decompressed)
+		tw := tar.NewWriter(pipeWriter)
+
+		var err error
+		switch {
+		case from == to:
+			err = convertWhiteouts(tr, tw, nil)
+		case to == OverlayWhiteoutFormat:
+			err = aufsToOverlayWhiteouts(tr, tw)
+		default:
+			err = convertWhiteouts(tr, tw, overlayToAUFSWhiteout)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		_ = pipeWriter.CloseWithError(err)
+	}()
+	return pipeReader, nil
+}
+
+// convertWhiteouts copies all entries from tr to tw. If convert is non-nil,
+// it is called for each entry, and the headers it returns are written
+// instead of the original header.
+func convertWhiteouts(tr *tar.Reader, tw *tar.Writer, convert func(*tar.Header) []*tar.Header) error {
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		hdrs := []*tar.Header{hdr}
+		if convert != nil {
+			hdrs = convert(hdr)
+		}
+		for _, h := range hdrs {
+			if err := tw.WriteHeader(h); err != nil {
+				return err
+			}
+			if h == hdr {
+				if err := copyWithBuffer(tw, tr); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// overlayToAUFSWhiteout converts a 0/0 character device to an AUFS whiteout
+// file, and an opaque directory to a directory followed by an AUFS opaque
+// whiteout file. It returns hdr unmodified for other entries.
+func overlayToAUFSWhiteout(hdr *tar.Header) []*tar.Header {
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		if hdr.Devmajor != 0 || hdr.Devminor != 0 {
+			return []*tar.Header{hdr}
+		}
+		dir, base := path.Split(hdr.Name)
+		return []*tar.Header{whiteoutHeader(hdr, tar.TypeReg, dir+WhiteoutPrefix+base)}
+	case tar.TypeDir:
+		var opaque bool
+		for _, xattr := range overlayOpaqueXattrs {
+			if v, ok := hdr.PAXRecords[paxSchilyXattr+xattr]; ok {
+				opaque = opaque || v == "y"
+				delete(hdr.PAXRecords, paxSchilyXattr+xattr)
+				delete(hdr.Xattrs, xattr) //nolint:staticcheck // Xattrs is populated by tar.Reader, and merged into PAXRecords by tar.Writer.
+			}
+		}
+		if !opaque {
+			return []*tar.Header{hdr}
+		}
+		return []*tar.Header{hdr, whiteoutHeader(hdr, tar.TypeReg, path.Join(hdr.Name, WhiteoutOpaqueDir))}
+	default:
+		return []*tar.Header{hdr}
+	}
+}
+
+// aufsToOverlayWhiteouts copies all entries from tr to tw, converting AUFS
+// whiteout files to 0/0 character devices, and AUFS opaque whiteouts to an
+// extended attribute on the parent directory.
+//
+// As the opaque whiteout follows its parent directory in the archive, the
+// header of each directory is held back until the next entry is read. If an
+// opaque whiteout does not immediately follow its parent directory, a header
+// for the parent directory is added.
+func aufsToOverlayWhiteouts(tr *tar.Reader, tw *tar.Writer) error {
+	var pendingDir *tar.Header
+	flush := func() error {
+		if pendingDir == nil {
+			return nil
+		}
+		hdr := pendingDir
+		pendingDir = nil
+		return tw.WriteHeader(hdr)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		dir, base := path.Split(hdr.Name)
+		switch {
+		case base == WhiteoutOpaqueDir:
+			if pendingDir == nil || path.Clean(pendingDir.Name) != path.Clean(dir) {
+				if err := flush(); err != nil {
+					return err
+				}
+				if dir == "" {
+					dir = "./"
+				}
+				pendingDir = whiteoutHeader(hdr, tar.TypeDir, dir)
+			}
+			if pendingDir.PAXRecords == nil {
+				pendingDir.PAXRecords = make(map[string]string)
+			}
+			pendingDir.PAXRecords[paxSchilyXattr+overlayOpaqueXattrs[0]] = "y"
+			pendingDir.Format = tar.FormatPAX
+			if err := flush(); err != nil {
+				return err
+			}
+		case strings.HasPrefix(base, WhiteoutPrefix) && !strings.HasPrefix(base, WhiteoutMetaPrefix):
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := tw.WriteHeader(whiteoutHeader(hdr, tar.TypeChar, dir+strings.TrimPrefix(base, WhiteoutPrefix))); err != nil {
+				return err
+			}
+		default:
+			if err := flush(); err != nil {
+				return err
+			}
+			if hdr.Typeflag == tar.TypeDir {
+				pendingDir = hdr
+				continue
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if err := copyWithBuffer(tw, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// whiteoutHeader returns a header of type typeflag for name, inheriting the
+// permissions, ownership, and timestamps of hdr.
+func whiteoutHeader(hdr *tar.Header, typeflag byte, name string) *tar.Header {
+	return &tar.Header{
+		Typeflag:   typeflag,
+		Name:       name,
+		Mode:       hdr.Mode & int64(os.ModePerm),
+		Uid:        hdr.Uid,
+		Gid:        hdr.Gid,
+		Uname:      hdr.Uname,
+		Gname:      hdr.Gname,
+		ModTime:    hdr.ModTime,
+		AccessTime: hdr.AccessTime,
+		ChangeTime: hdr.ChangeTime,
+	}
+}
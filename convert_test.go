@@ -0,0 +1,87 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestConvertWhiteouts(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	aufsLayer := buildTestArchive(t, []*tar.Header{
+		{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0o750, ModTime: mtime},
+		{Name: "opaque/" + WhiteoutOpaqueDir, Typeflag: tar.TypeReg, Mode: 0o750, ModTime: mtime},
+		{Name: "opaque/file", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: mtime},
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: mtime},
+		{Name: "dir/" + WhiteoutPrefix + "deleted", Typeflag: tar.TypeReg, Mode: 0o600, ModTime: mtime},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: mtime},
+		{Name: "dir/hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file", ModTime: mtime},
+		{Name: "dir/xattr", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: mtime, PAXRecords: map[string]string{paxSchilyXattr + "user.test": "value"}},
+	}, map[string]string{
+		"opaque/file": "opaque",
+		"dir/file":    "hello world",
+		"dir/xattr":   "xattr",
+	})
+	aufsBytes := aufsLayer.Bytes()
+
+	overlayLayer, err := ConvertWhiteouts(bytes.NewReader(aufsBytes), AUFSWhiteoutFormat, OverlayWhiteoutFormat)
+	assert.NilError(t, err)
+	overlayBytes, err := io.ReadAll(overlayLayer)
+	assert.NilError(t, err)
+	assert.NilError(t, overlayLayer.Close())
+
+	type entry struct {
+		Name     string
+		Typeflag byte
+		Linkname string
+		Opaque   string
+		Xattr    string
+	}
+	var actual []entry
+	err = Walk(bytes.NewReader(overlayBytes), func(hdr *tar.Header, _ io.Reader) error {
+		actual = append(actual, entry{
+			Name:     hdr.Name,
+			Typeflag: hdr.Typeflag,
+			Linkname: hdr.Linkname,
+			Opaque:   hdr.PAXRecords[paxSchilyXattr+"trusted.overlay.opaque"],
+			Xattr:    hdr.PAXRecords[paxSchilyXattr+"user.test"],
+		})
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(actual, []entry{
+		{Name: "opaque/", Typeflag: tar.TypeDir, Opaque: "y"},
+		{Name: "opaque/file", Typeflag: tar.TypeReg},
+		{Name: "dir/", Typeflag: tar.TypeDir},
+		{Name: "dir/deleted", Typeflag: tar.TypeChar},
+		{Name: "dir/file", Typeflag: tar.TypeReg},
+		{Name: "dir/hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file"},
+		{Name: "dir/xattr", Typeflag: tar.TypeReg, Xattr: "value"},
+	}))
+
+	roundTripped, err := ConvertWhiteouts(bytes.NewReader(overlayBytes), OverlayWhiteoutFormat, AUFSWhiteoutFormat)
+	assert.NilError(t, err)
+	defer roundTripped.Close()
+
+	// Extended attributes are verified above; don't attempt to set them on
+	// extraction, as the filesystem used for tests may not support them.
+	opts := &TarOptions{BestEffortXattrs: true}
+	original := t.TempDir()
+	assert.NilError(t, Untar(bytes.NewReader(aufsBytes), original, opts))
+	converted := t.TempDir()
+	assert.NilError(t, Untar(roundTripped, converted, opts))
+
+	changes, err := ChangesDirs(converted, original)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(changes, 0), "unexpected changes: %v", changes)
+}
+
+func TestConvertWhiteoutsInvalidFormat(t *testing.T) {
+	_, err := ConvertWhiteouts(bytes.NewReader(nil), AUFSWhiteoutFormat, WhiteoutFormat(42))
+	assert.Check(t, is.Error(err, "unknown whiteout format: 42"))
+}
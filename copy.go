@@ -22,13 +22,55 @@
 )
 
 var copyPool = sync.Pool{
-	New: func() any { s := make([]byte, 32*1024); return &s },
+	New: func() any { return newCopyBuffer(32 * 1024) },
+}
+
+// copyBuffer is a buffer used to copy content, along with the wrappers
+// passed to io.CopyBuffer, so that they are not allocated for every copy.
+type copyBuffer struct {
+	buf []byte
+	dst struct{ io.Writer }
+	src struct{ io.Reader }
+}
+
+func newCopyBuffer(size int) *copyBuffer {
+	return &copyBuffer{buf: make([]byte, size)}
 }
 
 func copyWithBuffer(dst io.Writer, src io.Reader) error {
-	buf := copyPool.Get().(*[]byte)
-	_, err := io.CopyBuffer(dst, src, *buf)
-	copyPool.Put(buf)
+	return copyWithPool(&copyPool, dst, src)
+}
+
+// copyBufferPools holds the pools of buffers of sizes set with
+// TarOptions.CopyBufferSize, by size.
+var copyBufferPools sync.Map // map[int]*sync.Pool
+
+// copyWithBufferSize is copyWithBuffer, using a buffer of the given size if
+// size is positive.
+func copyWithBufferSize(dst io.Writer, src io.Reader, size int) error {
+	if size <= 0 {
+		return copyWithBuffer(dst, src)
+	}
+	p, ok := copyBufferPools.Load(size)
+	if !ok {
+		p, _ = copyBufferPools.LoadOrStore(size, &sync.Pool{
+			New: func() any { return newCopyBuffer(size) },
+		})
+	}
+	return copyWithPool(p.(*sync.Pool), dst, src)
+}
+
+// copyWithPool copies src to dst with a buffer from pool. The buffer is used
+// even if dst implements io.ReaderFrom, or src implements io.WriterTo, as
+// [os.File] does, which would otherwise allocate a buffer of their own for
+// every copy. The buffer does not need to be cleared before it is reused, as
+// only the bytes read from src in the same copy are written from it.
+func copyWithPool(pool *sync.Pool, dst io.Writer, src io.Reader) error {
+	b := pool.Get().(*copyBuffer)
+	b.dst.Writer, b.src.Reader = dst, src
+	_, err := io.CopyBuffer(&b.dst, &b.src, b.buf)
+	b.dst.Writer, b.src.Reader = nil, nil
+	pool.Put(b)
 	return err
 }
 
@@ -193,8 +235,14 @@ func CopyInfoDestinationPath(path string) (info CopyInfo, err error) {
 		}, nil
 	}
 
-	// While the path is a symlink.
+	// While the path is a symlink, follow the chain of symlinks to its final
+	// target, which is the destination of the copy.
+	visited := make(map[string]struct{})
 	for n := 0; err == nil && stat.Mode()&os.ModeSymlink != 0; n++ {
+		if _, ok := visited[path]; ok {
+			return CopyInfo{}, errors.New("symlink loop in " + originalPath)
+		}
+		visited[path] = struct{}{}
 		if n > maxSymlinkIter {
 			// Don't follow symlinks more than this arbitrary number of times.
 			return CopyInfo{}, errors.New("too many symlinks in " + originalPath)
@@ -317,7 +365,11 @@ func PrepareArchiveCopy(srcContent io.Reader, srcInfo, dstInfo CopyInfo) (dstDir
 }
 
 // RebaseArchiveEntries rewrites the given srcContent archive replacing
-// an occurrence of oldBase with newBase at the beginning of entry names.
+// oldBase with newBase at the beginning of entry names. Both may contain
+// multiple path segments. Only entries that are oldBase itself or are
+// contained in it are renamed; a trailing slash on a directory entry is
+// preserved. The targets of hardlinks under oldBase are renamed accordingly,
+// but symlink targets are left untouched.
 func RebaseArchiveEntries(srcContent io.Reader, oldBase, newBase string) io.ReadCloser {
 	oldBase = filepath.ToSlash(oldBase)
 	newBase = filepath.ToSlash(newBase)
@@ -327,6 +379,11 @@ func RebaseArchiveEntries(srcContent io.Reader, oldBase, newBase string) io.Read
 		// oldBase instead so that newBase doesn't replace the path separator
 		// that all paths will start with.
 		oldBase = ""
+	} else {
+		oldBase = strings.TrimSuffix(oldBase, "/")
+		if newBase != "/" {
+			newBase = strings.TrimSuffix(newBase, "/")
+		}
 	}
 
 	rebased, w := io.Pipe()
@@ -356,9 +413,9 @@ func RebaseArchiveEntries(srcContent io.Reader, oldBase, newBase string) io.Read
 			//
 			// To fix, set the format to PAX here. See docker/for-linux issue #484.
 			hdr.Format = tar.FormatPAX
-			hdr.Name = strings.Replace(hdr.Name, oldBase, newBase, 1)
+			hdr.Name = rebasePath(hdr.Name, oldBase, newBase)
 			if hdr.Typeflag == tar.TypeLink {
-				hdr.Linkname = strings.Replace(hdr.Linkname, oldBase, newBase, 1)
+				hdr.Linkname = rebasePath(hdr.Linkname, oldBase, newBase)
 			}
 
 			if err = rebasedTar.WriteHeader(hdr); err != nil {
@@ -386,6 +443,19 @@ func RebaseArchiveEntries(srcContent io.Reader, oldBase, newBase string) io.Read
 	return rebased
 }
 
+// rebasePath replaces oldBase with newBase in p if p is oldBase or a path
+// within it, and returns p unchanged otherwise.
+func rebasePath(p, oldBase, newBase string) string {
+	if oldBase == "" {
+		return newBase + p
+	}
+	rest, ok := strings.CutPrefix(p, oldBase)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return p
+	}
+	return newBase + rest
+}
+
 // CopyResource performs an archive copy from the given source path to the
 // given destination path. The source path MUST exist and the destination
 // path's parent directory must exist.
@@ -3,6 +3,8 @@
 import (
 	"archive/tar"
 	"bytes"
+	"errors"
+	"io"
 	"path/filepath"
 	"testing"
 
@@ -52,6 +54,13 @@ func TestRebaseArchiveEntriesPlatformPaths(t *testing.T) {
 			wantName:     "dest/target/link",
 			wantLinkName: "dest/target/file",
 		},
+		{
+			name:       "root",
+			oldBase:    "/",
+			newBase:    "dest/",
+			headerName: "file",
+			wantName:   "dest/file",
+		},
 	}
 
 	for _, tc := range cases {
@@ -90,3 +99,44 @@ func TestRebaseArchiveEntriesPlatformPaths(t *testing.T) {
 		})
 	}
 }
+
+func TestRebaseArchiveEntries(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "a/b/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "a/b/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "a/b/sub/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "a/b/sub/hardlink", Typeflag: tar.TypeLink, Linkname: "a/b/file"},
+		{Name: "a/b/symlink", Typeflag: tar.TypeSymlink, Linkname: "a/b/file"},
+		{Name: "a/b/abs-symlink", Typeflag: tar.TypeSymlink, Linkname: "/a/b/file"},
+		{Name: "a/bc/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "a/bc/hardlink", Typeflag: tar.TypeLink, Linkname: "a/bc/file"},
+		{Name: "x/a/b", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, nil)
+
+	rc := RebaseArchiveEntries(archive, "a/b/", "c/d")
+	defer rc.Close()
+
+	type entry struct{ Name, Linkname string }
+	var got []entry
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		assert.NilError(t, err)
+		got = append(got, entry{hdr.Name, hdr.Linkname})
+	}
+
+	assert.Check(t, is.DeepEqual(got, []entry{
+		{"c/d/", ""},
+		{"c/d/file", ""},
+		{"c/d/sub/", ""},
+		{"c/d/sub/hardlink", "c/d/file"},
+		{"c/d/symlink", "a/b/file"},
+		{"c/d/abs-symlink", "/a/b/file"},
+		{"a/bc/file", ""},
+		{"a/bc/hardlink", "a/bc/file"},
+		{"x/a/b", ""},
+	}))
+}
@@ -19,8 +19,23 @@
 // UnpackLayer unpack `layer` to a `dest`. The stream `layer` can be
 // compressed or uncompressed.
 // Returns the size in bytes of the contents of the layer.
+//
+// If options.WhiteoutFormat is [OverlayWhiteoutFormat], whiteouts in the
+// layer are not only applied to dest, but also written in the format used by
+// overlayfs: a whiteout for a file is written as a character device with
+// device number 0/0 in its place, and an opaque directory marker as the
+// "trusted.overlay.opaque" extended attribute ("user.overlay.opaque" in a
+// user namespace) on the directory. Unpacking a layer into an empty
+// directory in that format produces an overlayfs upper directory for the
+// layer.
 func UnpackLayer(dest string, layer io.Reader, options *TarOptions) (size int64, err error) {
-	root, err := os.OpenRoot(dest)
+	return unpackLayer(dest, layer, options, nil)
+}
+
+// unpackLayer is UnpackLayer, recording the changes made to dest in changes,
+// if set.
+func unpackLayer(dest string, layer io.Reader, options *TarOptions, changes *layerChanges) (size int64, err error) {
+	root, err := openDestRoot(dest)
 	if err != nil {
 		return 0, err
 	}
@@ -36,6 +51,7 @@ func UnpackLayer(dest string, layer io.Reader, options *TarOptions) (size int64,
 	if options == nil {
 		options = &TarOptions{}
 	}
+	whiteoutConverter := getWhiteoutConverter(options.WhiteoutFormat)
 
 	aufsTempdir := ""
 	aufsHardlinks := make(map[string]*tar.Header)
@@ -56,13 +72,13 @@ func UnpackLayer(dest string, layer io.Reader, options *TarOptions) (size int64,
 		// Strip a leading "/" so absolute entries stay root-relative, and
 		// normalize the POSIX tar path. Skip entries referring to the extraction
 		// root and reject paths that escape it.
-		name := path.Clean(strings.TrimLeft(hdr.Name, "/"))
+		name, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return 0, err
+		}
 		if name == "." {
 			continue
 		}
-		if !filepath.IsLocal(name) {
-			return 0, breakoutError(fmt.Errorf("invalid entry name %q", hdr.Name))
-		}
 		hdr.Name = name
 
 		// Skip entries whose name (or hardlink target) Windows cannot represent.
@@ -71,10 +87,16 @@ func UnpackLayer(dest string, layer io.Reader, options *TarOptions) (size int64,
 			continue
 		}
 
+		if !strings.HasPrefix(hdr.Name, WhiteoutMetaPrefix) {
+			if err := changes.recordParents(root, filepath.FromSlash(hdr.Name)); err != nil {
+				return 0, err
+			}
+		}
+
 		// Ensure that the parent directory exists.
-		err = createImpliedDirectories(root, hdr, options)
+		err = createImpliedDirectories(&OSTarget{root: root}, hdr, options)
 		if err != nil {
-			return 0, err
+			return 0, entryError(hdr, err)
 		}
 
 		// Skip AUFS metadata dirs
@@ -110,11 +132,10 @@ func UnpackLayer(dest string, layer io.Reader, options *TarOptions) (size int64,
 		// used at all filesystem boundaries (os.Root methods, fsRootPath).
 		// The tar-header name (hdr.Name) is POSIX, so convert it here.
 		dstPath := filepath.FromSlash(hdr.Name)
-		base := filepath.Base(dstPath)
 
-		if strings.HasPrefix(base, WhiteoutPrefix) {
+		if originalBase, opaque, ok := IsWhiteout(hdr.Name); ok {
 			dir := filepath.Dir(dstPath)
-			if base == WhiteoutOpaqueDir {
+			if opaque {
 				_, err := root.Lstat(dir)
 				if err != nil {
 					return 0, err
@@ -147,6 +168,7 @@ func UnpackLayer(dest string, layer io.Reader, options *TarOptions) (size int64,
 					// unpackedPaths is keyed by root-relative slash paths; convert
 					// filepath.WalkDir's native path before looking it up.
 					if _, exists := unpackedPaths[filepath.ToSlash(rel)]; !exists {
+						changes.record(rel, ChangeDelete)
 						return root.RemoveAll(rel)
 					}
 					return nil
@@ -155,23 +177,38 @@ func UnpackLayer(dest string, layer io.Reader, options *TarOptions) (size int64,
 					return 0, err
 				}
 			} else {
-				originalBase := base[len(WhiteoutPrefix):]
 				originalPath := filepath.Join(dir, originalBase)
+				if _, err := root.Lstat(originalPath); err == nil {
+					changes.record(originalPath, ChangeDelete)
+				}
 				if err := root.RemoveAll(originalPath); err != nil {
 					return 0, err
 				}
 			}
+
+			// Create the whiteout in the on-disk format, if it's not AUFS.
+			if whiteoutConverter != nil {
+				if err := remapIDs(options.IDMap, hdr); err != nil {
+					return 0, err
+				}
+				if _, err := whiteoutConverter.ConvertRead(root, hdr, dstPath); err != nil {
+					return 0, err
+				}
+			}
 		} else {
 			// If dstPath exists we almost always just want to remove and replace it.
 			// The only exception is when it is a directory *and* the file from
 			// the layer is also a directory. Then we want to merge them (i.e.
 			// just apply the metadata from the layer).
 			if fi, err := root.Lstat(dstPath); err == nil {
+				changes.record(dstPath, ChangeModify)
 				if !fi.IsDir() || hdr.Typeflag != tar.TypeDir {
 					if err := root.RemoveAll(dstPath); err != nil {
 						return 0, err
 					}
 				}
+			} else {
+				changes.record(dstPath, ChangeAdd)
 			}
 
 			srcData := io.Reader(tr)
@@ -198,7 +235,7 @@ func UnpackLayer(dest string, layer io.Reader, options *TarOptions) (size int64,
 			}
 
 			if err := createTarFile(root, dstPath, srcHdr, srcData, options); err != nil {
-				return 0, err
+				return 0, entryError(hdr, err)
 			}
 
 			// Directory mtimes must be handled at the end to avoid further
@@ -229,6 +266,55 @@ func ApplyLayer(dest string, layer io.Reader) (int64, error) {
 	return applyLayerHandler(dest, layer, &TarOptions{}, true)
 }
 
+// ApplyLayerWithChanges is ApplyLayer, and also returns the changes made to
+// dest by applying the layer, sorted by path. Paths are OS specific, and
+// relative to dest, as for [ChangesDirs]: entries of the layer are reported
+// as added or modified, depending on whether they existed before, and paths
+// removed by whiteouts are reported as deleted. As for ChangesDirs, the
+// parent directories of changed paths are reported as modified, or added if
+// they were created, and paths below a deleted directory are not reported.
+//
+// Entries are reported as modified if they existed, even if applying them
+// did not change them.
+func ApplyLayerWithChanges(dest string, layer io.Reader) (int64, []Change, error) {
+	dest = filepath.Clean(dest)
+
+	// We need to be able to set any perms
+	restore := overrideUmask(0)
+	defer restore()
+
+	changes := &layerChanges{}
+	size, err := applyLayer(dest, layer, &TarOptions{}, true, changes)
+	if err != nil {
+		return 0, nil, err
+	}
+	return size, changes.list(), nil
+}
+
+// ApplyLayers applies the layers in order to the directory dest, as if
+// ApplyLayer was called for each of them, so that whiteouts in a layer remove
+// files from the layers applied before it. Layers can be compressed or
+// uncompressed. Applying stops at the first layer that fails to apply.
+// Returns the total size in bytes of the contents of the layers that were
+// applied.
+func ApplyLayers(dest string, layers []io.Reader) (int64, error) {
+	dest = filepath.Clean(dest)
+
+	// We need to be able to set any perms
+	restore := overrideUmask(0)
+	defer restore()
+
+	var total int64
+	for i, layer := range layers {
+		size, err := applyLayer(dest, layer, &TarOptions{}, true, nil)
+		if err != nil {
+			return total, fmt.Errorf("failed to apply layer %d: %w", i, err)
+		}
+		total += size
+	}
+	return total, nil
+}
+
 // ApplyUncompressedLayer parses a diff in the standard layer format from
 // `layer`, and applies it to the directory `dest`. The stream `layer`
 // can only be uncompressed.
@@ -264,6 +350,13 @@ func applyLayerHandler(dest string, layer io.Reader, options *TarOptions, decomp
 	restore := overrideUmask(0)
 	defer restore()
 
+	return applyLayer(dest, layer, options, decompress, nil)
+}
+
+// applyLayer unpacks layer to dest, which must be a clean path, recording the
+// changes made in changes, if set. The umask must already be cleared by the
+// caller.
+func applyLayer(dest string, layer io.Reader, options *TarOptions, decompress bool, changes *layerChanges) (int64, error) {
 	if decompress {
 		decompLayer, err := compression.DecompressStream(layer)
 		if err != nil {
@@ -272,5 +365,5 @@ func applyLayerHandler(dest string, layer io.Reader, options *TarOptions, decomp
 		defer decompLayer.Close()
 		layer = decompLayer
 	}
-	return UnpackLayer(dest, layer, options)
+	return unpackLayer(dest, layer, options, changes)
 }
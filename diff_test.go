@@ -2,11 +2,17 @@
 
 import (
 	"archive/tar"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
 
 	"github.com/moby/go-archive/compression"
 )
@@ -306,6 +312,64 @@ type tcase struct {
 	}
 }
 
+func TestApplyLayers(t *testing.T) {
+	layers := [][]string{
+		{
+			"bar/",
+			"bar/bax",
+			"baz",
+			"foo/",
+			"foo/abc",
+			"foo/bcd",
+		},
+		{
+			".wh.baz",
+			"foo/",
+			"foo/.wh.abc",
+			"foo/cde",
+			"qux",
+		},
+		{
+			".wh.bar",
+			"bar/",
+			"bar/bay",
+			"foo/",
+			"foo/.wh..wh..opq",
+			"foo/def",
+		},
+	}
+
+	var readers []io.Reader
+	for _, paths := range layers {
+		l, err := makeTestLayer(t, paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		readers = append(readers, l)
+	}
+
+	wd := t.TempDir()
+	if _, err := ApplyLayers(wd, readers); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := readDirContents(wd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"bar/",
+		"bar/bay",
+		"foo/",
+		"foo/def",
+		"qux",
+	}
+	if !reflect.DeepEqual(expected, paths) {
+		t.Fatalf("invalid files: expected %q, got %q", expected, paths)
+	}
+}
+
 func makeTestLayer(t *testing.T, paths []string) (_ io.ReadCloser, retErr error) {
 	t.Helper()
 	tmpDir := t.TempDir()
@@ -350,3 +414,88 @@ func readDirContents(root string) ([]string, error) {
 	}
 	return files, nil
 }
+
+func TestApplyLayerWithChanges(t *testing.T) {
+	src := t.TempDir()
+	assert.NilError(t, os.Mkdir(filepath.Join(src, "dir"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "dir", "modified"), []byte("old"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "dir", "deleted"), []byte("old"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "unchanged"), []byte("old"), 0o644))
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, p := range []string{"dir/modified", "dir/deleted", "unchanged", "dir"} {
+		assert.NilError(t, os.Chtimes(filepath.Join(src, p), old, old))
+	}
+
+	// Keep a copy of the tree before applying the layer to compare with.
+	dest := t.TempDir()
+	before := t.TempDir()
+	assert.NilError(t, NewDefaultArchiver().CopyWithTar(src, dest))
+	assert.NilError(t, NewDefaultArchiver().CopyWithTar(src, before))
+
+	now := time.Now().Truncate(time.Second)
+	layer := buildTestArchive(t, []*tar.Header{
+		{Name: "added", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: now},
+		{Name: "dir/modified", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: now},
+		{Name: "dir/.wh.deleted", Typeflag: tar.TypeReg, Mode: 0o600, ModTime: now},
+		{Name: "dir/.wh.missing", Typeflag: tar.TypeReg, Mode: 0o600, ModTime: now},
+		{Name: "newdir/sub/file", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: now},
+		{Name: "newdir/sub/.wh.file", Typeflag: tar.TypeReg, Mode: 0o600, ModTime: now},
+		{Name: "newdir/other", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: now},
+	}, map[string]string{
+		"added":           "new",
+		"dir/modified":    "new content",
+		"newdir/sub/file": "new",
+		"newdir/other":    "new",
+	})
+
+	_, changes, err := ApplyLayerWithChanges(dest, layer)
+	assert.NilError(t, err)
+
+	sep := string(os.PathSeparator)
+	expected := []Change{
+		{Path: sep + "added", Kind: ChangeAdd},
+		{Path: sep + "dir", Kind: ChangeModify},
+		{Path: filepath.Join(sep, "dir", "deleted"), Kind: ChangeDelete},
+		{Path: filepath.Join(sep, "dir", "modified"), Kind: ChangeModify},
+		{Path: sep + "newdir", Kind: ChangeAdd},
+		{Path: filepath.Join(sep, "newdir", "other"), Kind: ChangeAdd},
+		{Path: filepath.Join(sep, "newdir", "sub"), Kind: ChangeAdd},
+	}
+	assert.Check(t, is.DeepEqual(changes, expected))
+
+	dirChanges, err := ChangesDirs(dest, before)
+	assert.NilError(t, err)
+	sort.Sort(changesByPath(dirChanges))
+	assert.Check(t, is.DeepEqual(changes, dirChanges))
+}
+
+func TestLayerChangesDelete(t *testing.T) {
+	// Deleting a directory drops the changes below it, without scanning
+	// all changes recorded, so that layers with many whiteouts are applied
+	// in linear time.
+	const n = 20_000
+	var c layerChanges
+	for i := range n {
+		c.record(fmt.Sprintf("dir%d", i), ChangeAdd)
+		c.record(fmt.Sprintf("dir%d/file", i), ChangeAdd)
+		c.record(fmt.Sprintf("old%d/file", i), ChangeModify)
+	}
+	for i := range n {
+		c.record(fmt.Sprintf("old%d", i), ChangeDelete)
+	}
+	changes := c.list()
+	assert.Assert(t, is.Len(changes, 3*n))
+
+	sep := string(os.PathSeparator)
+	c = layerChanges{}
+	c.record("a/b/c", ChangeModify)
+	c.record("a/b", ChangeModify)
+	c.record("a/x", ChangeAdd)
+	c.record("a/b", ChangeDelete)
+	c.record("a/x", ChangeDelete)
+	c.record("ab", ChangeAdd)
+	assert.Check(t, is.DeepEqual(c.list(), []Change{
+		{Path: filepath.Join(sep, "a", "b"), Kind: ChangeDelete},
+		{Path: sep + "ab", Kind: ChangeAdd},
+	}))
+}
@@ -0,0 +1,272 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/moby/go-archive/compression"
+)
+
+// diffEntry describes an entry of the older archive passed to DiffArchives.
+type diffEntry struct {
+	hdr  *tar.Header
+	hash [sha256.Size]byte
+}
+
+// DiffArchives produces a layer with the changes between the archives older
+// and newer, as [ChangesDirs] and [ExportChanges] do for directories, without
+// extracting the archives. Applying the layer with [ApplyLayer] to the tree
+// extracted from older produces the tree extracted from newer. Both archives
+// can be compressed or uncompressed; the layer is uncompressed.
+//
+// Entries of newer that are not in older, or that differ from the entry in
+// older, are included in the layer, in the order they appear in newer, and
+// entries of older that are not in newer are removed by whiteouts. As for
+// ChangesDirs, entries differ if their type, mode, ownership, device
+// numbers, link target, or extended attributes differ, and, for entries
+// other than directories, if their modification time or size differ.
+// Regular files with the same size are also compared by the SHA-256 digest
+// of their content. Hard links are included if the entry they link to is.
+//
+// Both archives are expected to contain complete trees, such as those
+// produced by [TarWithOptions]: whiteouts in them are not interpreted, and
+// the last entry for a name replaces earlier ones. PAX Global Extended
+// Headers are ignored in both archives. Older is read before newer; only the
+// headers and digests of its entries are kept in memory.
+//
+// The content of regular files of newer with the same size as in older is
+// spooled to a temporary file in the default directory for temporary files
+// (see [os.TempDir]) while it is compared, so DiffArchives uses as much disk
+// space there as the largest of these files.
+func DiffArchives(older, newer io.Reader) (io.ReadCloser, error) {
+	pipeReader, pipeWriter := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = pipeWriter.CloseWithError(diffArchives(older, newer, pipeWriter))
+	}()
+	return &producerReader{PipeReader: pipeReader, done: done}, nil
+}
+
+// diffArchives writes the changes between the archives older and newer to w,
+// as a tar archive.
+func diffArchives(older, newer io.Reader, w io.Writer) error {
+	olderEntries, err := readDiffEntries(older)
+	if err != nil {
+		return fmt.Errorf("failed to read older archive: %w", err)
+	}
+
+	decompressed, err := compression.DecompressStream(newer)
+	if err != nil {
+		return fmt.Errorf("failed to decompress newer archive: %w", err)
+	}
+	defer decompressed.Close()
+
+	// Regular files that may be unchanged are spooled to a temporary file,
+	// as their content must be compared before deciding whether to write
+	// their header.
+	var spool *os.File
+	defer func() {
+		if spool != nil {
+			_ = spool.Close()
+			_ = os.Remove(spool.Name())
+		}
+	}()
+
+	tw := tar.NewWriter(w)
+	tr := tar.NewReader(decompressed)
+	var (
+		// seen maps the names of the entries of newer to their type.
+		seen     = make(map[string]byte)
+		included = make(map[string]struct{})
+	)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read newer archive: %w", err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			continue
+		}
+		seen[name] = hdr.Typeflag
+
+		var content io.Reader = tr
+		old, ok := olderEntries[name]
+		switch {
+		case !ok, diffHeadersDiffer(old.hdr, hdr):
+		case hdr.Typeflag == tar.TypeLink:
+			target, err := cleanEntryName(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if _, ok := included[target]; !ok {
+				continue
+			}
+		case hdr.Typeflag == tar.TypeReg && hdr.Size > 0:
+			if spool == nil {
+				if spool, err = os.CreateTemp("", "diff-archives"); err != nil {
+					return err
+				}
+			}
+			if _, err := spool.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if err := spool.Truncate(0); err != nil {
+				return err
+			}
+			h := sha256.New()
+			if _, err := io.Copy(io.MultiWriter(spool, h), tr); err != nil {
+				return fmt.Errorf("failed to read newer archive: %w", err)
+			}
+			if bytes.Equal(h.Sum(nil), old.hash[:]) {
+				continue
+			}
+			if _, err := spool.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			content = spool
+		default:
+			continue
+		}
+
+		included[name] = struct{}{}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, content); err != nil {
+			return err
+		}
+	}
+
+	// Write whiteouts for the entries removed, omitting those in removed
+	// directories, in the order ChangesDirs reports them. A directory that
+	// is replaced by a non-directory is removed with its contents when the
+	// entry replacing it is applied, and no whiteouts may be written below
+	// it, as they would recreate it as a directory.
+	var deleted []string
+	for _, name := range slices.Sorted(maps.Keys(olderEntries)) {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		removedParent := false
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := olderEntries[dir]; !ok {
+				continue
+			}
+			if typeflag, ok := seen[dir]; !ok || typeflag != tar.TypeDir {
+				removedParent = true
+				break
+			}
+		}
+		if !removedParent {
+			deleted = append(deleted, name)
+		}
+	}
+	timestamp := time.Now()
+	for _, name := range deleted {
+		dir, base := path.Split(name)
+		hdr := &tar.Header{
+			Name:       dir + WhiteoutPrefix + base,
+			Typeflag:   tar.TypeReg,
+			ModTime:    timestamp,
+			AccessTime: timestamp,
+			ChangeTime: timestamp,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// readDiffEntries reads the headers of the entries in the archive r, and
+// the digests of the content of its regular files, by cleaned name.
+func readDiffEntries(r io.Reader) (map[string]diffEntry, error) {
+	decompressed, err := compression.DecompressStream(r)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressed.Close()
+
+	entries := make(map[string]diffEntry)
+	tr := tar.NewReader(decompressed)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "." {
+			continue
+		}
+		entry := diffEntry{hdr: hdr}
+		if hdr.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, err
+			}
+			copy(entry.hash[:], h.Sum(nil))
+		}
+		entries[name] = entry
+	}
+}
+
+// diffHeadersDiffer reports whether the entries described by the headers
+// differ, not considering their content.
+func diffHeadersDiffer(older, newer *tar.Header) bool {
+	if older.Typeflag != newer.Typeflag ||
+		older.Mode != newer.Mode ||
+		older.Uid != newer.Uid ||
+		older.Gid != newer.Gid ||
+		older.Devmajor != newer.Devmajor ||
+		older.Devminor != newer.Devminor ||
+		older.Linkname != newer.Linkname {
+		return true
+	}
+	// Don't look at size or modification time for dirs, as for ChangesDirs.
+	if newer.Typeflag != tar.TypeDir &&
+		(older.Size != newer.Size || !sameFsTime(older.ModTime, newer.ModTime)) {
+		return true
+	}
+	return !maps.Equal(diffXattrs(older), diffXattrs(newer))
+}
+
+// diffXattrs returns the extended attribute records of hdr.
+func diffXattrs(hdr *tar.Header) map[string]string {
+	xattrs := make(map[string]string)
+	for key, value := range hdr.PAXRecords {
+		if strings.HasPrefix(key, paxSchilyXattr) {
+			xattrs[key] = value
+		}
+	}
+	return xattrs
+}
@@ -0,0 +1,156 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestDiffArchives(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require elevated privileges on Windows")
+	}
+	modTime := time.Unix(1700000000, 0)
+	uid, gid := os.Getuid(), os.Getgid()
+	entry := func(name string, typeflag byte, mode int64, linkname string) *tar.Header {
+		return &tar.Header{
+			Name:     name,
+			Typeflag: typeflag,
+			Mode:     mode,
+			Linkname: linkname,
+			Uid:      uid,
+			Gid:      gid,
+			ModTime:  modTime,
+			Format:   tar.FormatPAX,
+		}
+	}
+	older := func() []*tar.Header {
+		return []*tar.Header{
+			entry("dir/", tar.TypeDir, 0o755, ""),
+			entry("dir/same", tar.TypeReg, 0o644, ""),
+			entry("dir/samesize", tar.TypeReg, 0o644, ""),
+			entry("dir/grow", tar.TypeReg, 0o644, ""),
+			entry("removed/", tar.TypeDir, 0o755, ""),
+			entry("removed/file", tar.TypeReg, 0o644, ""),
+			entry("gone", tar.TypeReg, 0o644, ""),
+			entry("link", tar.TypeSymlink, 0o777, "dir/same"),
+			entry("hard", tar.TypeLink, 0o644, "dir/samesize"),
+			entry("mode", tar.TypeReg, 0o644, ""),
+			entry("replaced/", tar.TypeDir, 0o755, ""),
+			entry("replaced/file", tar.TypeReg, 0o644, ""),
+		}
+	}
+	olderContents := map[string]string{
+		"dir/same":      "same",
+		"dir/samesize":  "aaaa",
+		"dir/grow":      "a",
+		"removed/file":  "removed",
+		"gone":          "gone",
+		"mode":          "mode",
+		"replaced/file": "file",
+	}
+	newer := func() []*tar.Header {
+		return []*tar.Header{
+			entry("dir/", tar.TypeDir, 0o755, ""),
+			entry("dir/same", tar.TypeReg, 0o644, ""),
+			entry("dir/samesize", tar.TypeReg, 0o644, ""),
+			entry("dir/grow", tar.TypeReg, 0o644, ""),
+			entry("link", tar.TypeSymlink, 0o777, "dir/grow"),
+			entry("hard", tar.TypeLink, 0o644, "dir/samesize"),
+			entry("mode", tar.TypeReg, 0o600, ""),
+			entry("added/", tar.TypeDir, 0o755, ""),
+			entry("added/file", tar.TypeReg, 0o644, ""),
+			entry("replaced", tar.TypeReg, 0o644, ""),
+		}
+	}
+	newerContents := map[string]string{
+		"dir/same":     "same",
+		"dir/samesize": "bbbb",
+		"dir/grow":     "aaaa",
+		"mode":         "mode",
+		"added/file":   "added",
+		"replaced":     "no longer a directory",
+	}
+
+	diff, err := DiffArchives(buildTestArchive(t, older(), olderContents), buildTestArchive(t, newer(), newerContents))
+	assert.NilError(t, err)
+	defer diff.Close()
+	layer, err := io.ReadAll(diff)
+	assert.NilError(t, err)
+
+	var names []string
+	err = Walk(bytes.NewReader(layer), func(hdr *tar.Header, _ io.Reader) error {
+		names = append(names, hdr.Name)
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(names, []string{
+		"dir/samesize",
+		"dir/grow",
+		"link",
+		"hard",
+		"mode",
+		"added/",
+		"added/file",
+		"replaced",
+		".wh.gone",
+		".wh.removed",
+	}))
+
+	olderDir := t.TempDir()
+	assert.NilError(t, Untar(buildTestArchive(t, older(), olderContents), olderDir, nil))
+	_, err = ApplyLayer(olderDir, bytes.NewReader(layer))
+	assert.NilError(t, err)
+
+	newerDir := t.TempDir()
+	assert.NilError(t, Untar(buildTestArchive(t, newer(), newerContents), newerDir, nil))
+
+	changes, err := ChangesDirs(olderDir, newerDir)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(changes, 0), "changes: %v", changes)
+}
+
+func TestDiffArchivesIdentical(t *testing.T) {
+	headers := func() []*tar.Header {
+		return []*tar.Header{
+			{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		}
+	}
+	contents := map[string]string{"dir/file": "hello"}
+
+	diff, err := DiffArchives(buildTestArchive(t, headers(), contents), buildTestArchive(t, headers(), contents))
+	assert.NilError(t, err)
+	defer diff.Close()
+
+	empty, err := IsEmpty(diff)
+	assert.NilError(t, err)
+	assert.Check(t, empty)
+}
+
+func TestDiffArchivesGlobalHeaders(t *testing.T) {
+	older := buildTestArchive(t, []*tar.Header{
+		{Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "older"}},
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"file": "hello"})
+	newer := buildTestArchive(t, []*tar.Header{
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "newer"}},
+	}, map[string]string{"file": "hello"})
+
+	diff, err := DiffArchives(older, newer)
+	assert.NilError(t, err)
+	defer diff.Close()
+
+	// The layer has no entries, not even global headers or whiteouts for
+	// them.
+	_, err = tar.NewReader(diff).Next()
+	assert.Check(t, is.ErrorIs(err, io.EOF))
+}
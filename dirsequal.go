@@ -0,0 +1,138 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// EqualOptions configures the differences that [DirsEqual] ignores.
+type EqualOptions struct {
+	// IgnoreModTime ignores the modification times of files. As files can
+	// then no longer be assumed unmodified if their size and modification
+	// time are the same, the content of regular files is compared instead.
+	IgnoreModTime bool
+	// IgnoreOwnership ignores the owner and group of files.
+	IgnoreOwnership bool
+}
+
+// DirsEqual reports whether the directories a and b have the same content,
+// names, and metadata, such that archiving them produces equivalent archives.
+// If they are not equal, it also returns the changes from a to b, as
+// returned by [ChangesDirs], without the modifications that opts ignores.
+//
+// Files are compared as by [ChangesDirs]: their type, mode, ownership,
+// device numbers, "security.capability" extended attribute, and, for files
+// other than directories, their size and modification time. As with
+// [ChangesDirs], the content of files with the same size and modification
+// time is not compared, unless opts.IgnoreModTime is set. Directories that
+// are only reported because their content changed are not included in the
+// changes, as their own metadata did not change.
+func DirsEqual(a, b string, opts EqualOptions) (bool, []Change, error) {
+	changes, err := ChangesDirs(b, a)
+	if err != nil {
+		return false, nil, err
+	}
+
+	var diff []Change
+	for _, c := range changes {
+		if c.Kind == ChangeModify {
+			equal, err := opts.filesEqual(filepath.Join(a, c.Path), filepath.Join(b, c.Path))
+			if err != nil {
+				return false, nil, err
+			}
+			if equal {
+				continue
+			}
+		}
+		diff = append(diff, c)
+	}
+	return len(diff) == 0, diff, nil
+}
+
+// filesEqual reports whether the files at paths a and b are equal, ignoring
+// the differences that opts ignores.
+func (opts EqualOptions) filesEqual(a, b string) (bool, error) {
+	fiA, err := os.Lstat(a)
+	if err != nil {
+		return false, err
+	}
+	fiB, err := os.Lstat(b)
+	if err != nil {
+		return false, err
+	}
+
+	if fiA.Mode() != fiB.Mode() {
+		return false, nil
+	}
+	uidA, gidA, rdevA := statIDs(fiA)
+	uidB, gidB, rdevB := statIDs(fiB)
+	if rdevA != rdevB || !opts.IgnoreOwnership && (uidA != uidB || gidA != gidB) {
+		return false, nil
+	}
+	capA, _ := lgetxattr(a, "security.capability")
+	capB, _ := lgetxattr(b, "security.capability")
+	if !bytes.Equal(capA, capB) {
+		return false, nil
+	}
+	if fiA.IsDir() {
+		return true, nil
+	}
+	if fiA.Size() != fiB.Size() {
+		return false, nil
+	}
+	if !opts.IgnoreModTime {
+		return sameFsTime(fiA.ModTime(), fiB.ModTime()), nil
+	}
+
+	switch {
+	case fiA.Mode().IsRegular():
+		return sameContent(a, b)
+	case fiA.Mode()&os.ModeSymlink != 0:
+		targetA, err := os.Readlink(a)
+		if err != nil {
+			return false, err
+		}
+		targetB, err := os.Readlink(b)
+		if err != nil {
+			return false, err
+		}
+		return targetA == targetB, nil
+	default:
+		return true, nil
+	}
+}
+
+// sameContent reports whether the regular files at paths a and b, which are
+// of the same size, have the same content.
+func sameContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA, bufB := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		n, errA := io.ReadFull(fa, bufA)
+		if _, err := io.ReadFull(fb, bufB[:n]); err != nil {
+			return false, err
+		}
+		if !bytes.Equal(bufA[:n], bufB[:n]) {
+			return false, nil
+		}
+		if errors.Is(errA, io.EOF) || errors.Is(errA, io.ErrUnexpectedEOF) {
+			return true, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+	}
+}
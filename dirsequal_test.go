@@ -0,0 +1,88 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+	"gotest.tools/v3/skip"
+)
+
+// makeEqualTestDirs returns two directories with the same content, and the
+// same modification times.
+func makeEqualTestDirs(t *testing.T) (string, string) {
+	t.Helper()
+	mtime := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	var dirs []string
+	for range 2 {
+		dir := t.TempDir()
+		assert.NilError(t, os.Mkdir(filepath.Join(dir, "sub"), 0o755))
+		assert.NilError(t, os.WriteFile(filepath.Join(dir, "sub", "file"), []byte("hello"), 0o644))
+		assert.NilError(t, os.Chtimes(filepath.Join(dir, "sub", "file"), mtime, mtime))
+		dirs = append(dirs, dir)
+	}
+	return dirs[0], dirs[1]
+}
+
+func TestDirsEqualModTime(t *testing.T) {
+	a, b := makeEqualTestDirs(t)
+
+	equal, changes, err := DirsEqual(a, b, EqualOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, equal)
+	assert.Check(t, is.Len(changes, 0))
+
+	mtime := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+	file := filepath.Join(b, "sub", "file")
+	assert.NilError(t, os.Chtimes(file, mtime, mtime))
+
+	equal, changes, err = DirsEqual(a, b, EqualOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, !equal)
+	assert.Check(t, is.DeepEqual(changes, []Change{{Path: filepath.FromSlash("/sub/file"), Kind: ChangeModify}}))
+
+	equal, changes, err = DirsEqual(a, b, EqualOptions{IgnoreModTime: true})
+	assert.NilError(t, err)
+	assert.Check(t, equal)
+	assert.Check(t, is.Len(changes, 0))
+
+	// Content of the same size is compared if modification times are
+	// ignored.
+	assert.NilError(t, os.WriteFile(file, []byte("world"), 0o644))
+	assert.NilError(t, os.Chtimes(file, mtime, mtime))
+	equal, changes, err = DirsEqual(a, b, EqualOptions{IgnoreModTime: true})
+	assert.NilError(t, err)
+	assert.Check(t, !equal)
+	assert.Check(t, is.DeepEqual(changes, []Change{{Path: filepath.FromSlash("/sub/file"), Kind: ChangeModify}}))
+}
+
+func TestDirsEqualOwnership(t *testing.T) {
+	skip.If(t, runtime.GOOS == "windows", "ownership is not compared on Windows")
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	a, b := makeEqualTestDirs(t)
+	assert.NilError(t, os.Lchown(filepath.Join(b, "sub", "file"), 1000, 1000))
+
+	equal, changes, err := DirsEqual(a, b, EqualOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, !equal)
+	assert.Check(t, is.DeepEqual(changes, []Change{{Path: "/sub/file", Kind: ChangeModify}}))
+
+	equal, changes, err = DirsEqual(a, b, EqualOptions{IgnoreOwnership: true})
+	assert.NilError(t, err)
+	assert.Check(t, equal)
+	assert.Check(t, is.Len(changes, 0))
+}
+
+func TestDirsEqualAdded(t *testing.T) {
+	a, b := makeEqualTestDirs(t)
+	assert.NilError(t, os.WriteFile(filepath.Join(b, "sub", "new"), nil, 0o644))
+
+	equal, changes, err := DirsEqual(a, b, EqualOptions{IgnoreModTime: true, IgnoreOwnership: true})
+	assert.NilError(t, err)
+	assert.Check(t, !equal)
+	assert.Check(t, is.DeepEqual(changes, []Change{{Path: filepath.FromSlash("/sub/new"), Kind: ChangeAdd}}))
+}
@@ -0,0 +1,125 @@
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+// File flags from linux/fs.h, as used by chattr(1) and FS_IOC_GETFLAGS.
+const (
+	fsSyncFl      = 0x00000008
+	fsImmutableFl = 0x00000010
+	fsAppendFl    = 0x00000020
+	fsNodumpFl    = 0x00000040
+	fsNoatimeFl   = 0x00000080
+	fsDirsyncFl   = 0x00010000
+	fsNocowFl     = 0x00800000
+)
+
+// fileFlagNames maps the file flags that are archived to the names used for
+// them by libarchive on Linux. Other flags, such as those managed by the
+// filesystem, are not archived.
+var fileFlagNames = []struct {
+	name string
+	flag uint32
+}{
+	{name: "sappnd", flag: fsAppendFl},
+	{name: "schg", flag: fsImmutableFl},
+	{name: "nodump", flag: fsNodumpFl},
+	{name: "noatime", flag: fsNoatimeFl},
+	{name: "sync", flag: fsSyncFl},
+	{name: "dirsync", flag: fsDirsyncFl},
+	{name: "nocow", flag: fsNocowFl},
+}
+
+// isFileFlagsUnsupported reports whether err indicates that the filesystem
+// does not support file flags.
+func isFileFlagsUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EINVAL)
+}
+
+// readFileFlagsToTarHeader reads the file flags of the regular file or
+// directory at filePath, and stores them in hdr. Filesystems that do not
+// support file flags are ignored.
+func readFileFlagsToTarHeader(filePath string, hdr *tar.Header) error {
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+		return nil
+	}
+	fd, err := unix.Open(filePath, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: filePath, Err: err}
+	}
+	defer func() { _ = unix.Close(fd) }()
+
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		if isFileFlagsUnsupported(err) {
+			return nil
+		}
+		return &os.PathError{Op: "ioctl FS_IOC_GETFLAGS", Path: filePath, Err: err}
+	}
+	var names []string
+	for _, f := range fileFlagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = make(map[string]string)
+	}
+	hdr.PAXRecords[paxFileFlags] = strings.Join(names, ",")
+	return nil
+}
+
+// setFileFlags sets the file flags in the comma-separated list of names on
+// the regular file or directory at name within root. Flags that are not
+// archived are left unchanged, and unknown names are ignored.
+func setFileFlags(root *os.Root, name string, value string) error {
+	var flags uint32
+	for n := range strings.SplitSeq(value, ",") {
+		for _, f := range fileFlagNames {
+			if f.name == n {
+				flags |= f.flag
+			}
+		}
+	}
+
+	file, err := root.OpenFile(name, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+
+	fd := int(file.Fd())
+	current, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err == nil {
+		var mask uint32
+		for _, f := range fileFlagNames {
+			mask |= f.flag
+		}
+		if current&mask == flags {
+			return nil
+		}
+		err = unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(current&^mask|flags))
+	}
+	if err != nil {
+		if isFileFlagsUnsupported(err) || errors.Is(err, unix.EPERM) {
+			// EPERM occurs if setting the immutable or append-only flags
+			// is not permitted (without CAP_LINUX_IMMUTABLE).
+			log.G(context.TODO()).WithFields(log.Fields{"error": err, "path": name, "flags": value}).Warn("ignored file flags in archive")
+			return nil
+		}
+		return &os.PathError{Op: "ioctl FS_IOC_SETFLAGS", Path: name, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package archive
+
+import (
+	"archive/tar"
+	"os"
+)
+
+// readFileFlagsToTarHeader is a no-op; file flags are only archived on Linux.
+func readFileFlagsToTarHeader(string, *tar.Header) error {
+	return nil
+}
+
+// setFileFlags is a no-op; file flags are only restored on Linux.
+func setFileFlags(*os.Root, string, string) error {
+	return nil
+}
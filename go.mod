@@ -5,6 +5,7 @@ go 1.25
 require (
 	github.com/AdaLogics/go-fuzz-headers v0.0.0-20240806141605-e8a1dd7889d6
 	github.com/containerd/log v0.1.0
+	github.com/dsnet/compress v0.0.1
 	github.com/klauspost/compress v1.18.7
 	github.com/moby/patternmatcher v0.6.1
 	github.com/moby/sys/mount v0.3.5
@@ -13,6 +14,7 @@ require (
 	github.com/moby/sys/sequential v0.7.0
 	github.com/moby/sys/user v0.4.1
 	github.com/moby/sys/userns v0.1.0
+	github.com/pierrec/lz4/v4 v4.1.22
 	golang.org/x/sys v0.37.0
 	gotest.tools/v3 v3.5.2
 )
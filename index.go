@@ -0,0 +1,106 @@
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/moby/go-archive/compression"
+)
+
+// Index records the headers of the entries in an uncompressed tar archive,
+// and the offsets of their content, to read entries without reading the
+// archive sequentially. Use [IndexArchive] to create an Index.
+type Index struct {
+	r       io.ReaderAt
+	entries map[string]indexEntry
+	headers []*tar.Header
+}
+
+// indexEntry is an entry of an Index.
+type indexEntry struct {
+	hdr    *tar.Header
+	offset int64
+}
+
+// IndexArchive reads the headers of the entries in the uncompressed tar
+// archive of the given size in r, and returns an Index to open them. The
+// content of the entries is skipped, and only read when opened. Compressed
+// archives cannot be indexed, as they cannot be read at an offset, and
+// produce an error.
+//
+// The Index keeps using r to read entries, so r must not change while the
+// Index is in use.
+func IndexArchive(r io.ReaderAt, size int64) (*Index, error) {
+	magic := make([]byte, 10)
+	n, err := r.ReadAt(magic, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if c := compression.Detect(magic[:n]); c != compression.None {
+		return nil, fmt.Errorf("cannot index archive compressed as %s: only uncompressed archives are supported", c.Extension())
+	}
+
+	idx := &Index{r: r, entries: make(map[string]indexEntry)}
+	sr := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(sr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return idx, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The tar reader reads headers without reading ahead, so the
+		// content of the entry starts at the current offset.
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		name, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		// Later entries replace earlier ones with the same name, as when
+		// extracting the archive.
+		idx.entries[name] = indexEntry{hdr: hdr, offset: offset}
+		idx.headers = append(idx.headers, hdr)
+	}
+}
+
+// Headers returns the headers of the entries in the archive, in the order
+// they appear in the archive.
+func (idx *Index) Headers() []*tar.Header {
+	return idx.headers
+}
+
+// Open returns the content and header of the entry with the given name,
+// reading it directly from its offset in the archive. Names are compared
+// after cleaning them, as for [ExtractFile]; if the archive contains several
+// entries with the same name, the last one is returned. Open returns an error
+// matching [fs.ErrNotExist] if the archive has no entry with the name.
+//
+// Entries other than regular files have no content. Sparse files are not
+// supported, as their content is not stored contiguously.
+func (idx *Index) Open(name string) (io.ReadCloser, *tar.Header, error) {
+	cleaned, err := cleanEntryName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry, ok := idx.entries[cleaned]
+	if !ok {
+		return nil, nil, fmt.Errorf("%q not found in archive: %w", name, fs.ErrNotExist)
+	}
+	hdr := entry.hdr
+	if hdr.Typeflag == tar.TypeGNUSparse || isSparseHeader(hdr) {
+		return nil, nil, fmt.Errorf("cannot open %q: sparse entries are not supported", name)
+	}
+	var size int64
+	if hdr.Typeflag == tar.TypeReg {
+		size = hdr.Size
+	}
+	return io.NopCloser(io.NewSectionReader(idx.r, entry.offset, size)), hdr, nil
+}
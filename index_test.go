@@ -0,0 +1,101 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+// countingReaderAt counts the bytes read from an io.ReaderAt.
+type countingReaderAt struct {
+	r io.ReaderAt
+	n atomic.Int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func TestIndexArchive(t *testing.T) {
+	longName := strings.Repeat("d", 120) + "/file"
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "large", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644, PAXRecords: map[string]string{"SCHILY.xattr.user.foo": "bar"}},
+		{Name: longName, Typeflag: tar.TypeReg, Mode: 0o644, Format: tar.FormatGNU},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file"},
+		{Name: "./dup", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "dup", Typeflag: tar.TypeReg, Mode: 0o600},
+		{Name: "empty", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{
+		"large":    strings.Repeat("a", 1<<20),
+		"dir/file": "hello world",
+		longName:   "long",
+		"./dup":    "first",
+		"dup":      "second",
+	}).Bytes()
+
+	r := &countingReaderAt{r: bytes.NewReader(archive)}
+	idx, err := IndexArchive(r, int64(len(archive)))
+	assert.NilError(t, err)
+	assert.Check(t, r.n.Load() < int64(len(archive))/2, "content was read while indexing: %d of %d bytes", r.n.Load(), len(archive))
+	assert.Check(t, is.Len(idx.Headers(), 8))
+
+	for _, tc := range []struct {
+		name     string
+		expected string
+		hdrName  string
+	}{
+		{name: "dir/file", expected: "hello world", hdrName: "dir/file"},
+		{name: "/dir/../dir/file", expected: "hello world", hdrName: "dir/file"},
+		{name: longName, expected: "long", hdrName: longName},
+		{name: "large", expected: strings.Repeat("a", 1<<20), hdrName: "large"},
+		{name: "dup", expected: "second", hdrName: "dup"},
+		{name: "empty", expected: "", hdrName: "empty"},
+		{name: "dir/link", expected: "", hdrName: "dir/link"},
+		{name: "dir", expected: "", hdrName: "dir/"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rc, hdr, err := idx.Open(tc.name)
+			assert.NilError(t, err)
+			defer rc.Close()
+			content, err := io.ReadAll(rc)
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(string(content), tc.expected))
+			assert.Check(t, is.Equal(hdr.Name, tc.hdrName))
+		})
+	}
+
+	_, hdr, err := idx.Open("dir/file")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(hdr.PAXRecords["SCHILY.xattr.user.foo"], "bar"))
+
+	_, _, err = idx.Open("missing")
+	assert.Check(t, errors.Is(err, fs.ErrNotExist), "unexpected error: %v", err)
+}
+
+func TestIndexArchiveCompressed(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"file": "hello"}).Bytes()
+
+	compressed := &bytes.Buffer{}
+	gw := gzip.NewWriter(compressed)
+	_, err := gw.Write(archive)
+	assert.NilError(t, err)
+	assert.NilError(t, gw.Close())
+
+	_, err = IndexArchive(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+	assert.Check(t, is.ErrorContains(err, "only uncompressed archives are supported"))
+}
@@ -0,0 +1,101 @@
+package archive
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// layerChanges records the changes made to the destination while applying a
+// layer, for ApplyLayerWithChanges. A nil *layerChanges records nothing.
+//
+// Changes are kept in a tree of path components, so that deleting a
+// directory drops the changes below it without scanning all changes.
+type layerChanges struct {
+	root changeNode
+}
+
+// changeNode is a path in layerChanges, and the change recorded to it, if
+// any.
+type changeNode struct {
+	kind     ChangeType
+	recorded bool
+	children map[string]*changeNode
+}
+
+// record records a change of the given kind to the root-relative path p,
+// merging it with earlier changes to p as [MergeChanges] does.
+func (c *layerChanges) record(p string, kind ChangeType) {
+	if c == nil {
+		return
+	}
+	// As for ChangesDirs, paths are OS specific.
+	n := &c.root
+	for _, name := range strings.Split(filepath.Join(string(os.PathSeparator), p)[1:], string(os.PathSeparator)) {
+		if name == "" {
+			continue
+		}
+		child, ok := n.children[name]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*changeNode)
+			}
+			child = &changeNode{}
+			n.children[name] = child
+		}
+		n = child
+	}
+	if kind == ChangeDelete {
+		n.children = nil
+	}
+	if !n.recorded {
+		n.kind, n.recorded = kind, true
+		return
+	}
+	if merged, ok := mergeChangeKind(n.kind, kind); ok {
+		n.kind = merged
+	} else {
+		n.recorded = false
+	}
+}
+
+// recordParents records the parent directories of the root-relative path p
+// as added if they do not exist in root yet, as they are created before the
+// entry is applied, or as modified otherwise, as ChangesDirs reports the
+// directories containing changes.
+func (c *layerChanges) recordParents(root *os.Root, p string) error {
+	if c == nil {
+		return nil
+	}
+	for dir := filepath.Dir(p); dir != "."; dir = filepath.Dir(dir) {
+		kind := ChangeType(ChangeModify)
+		if _, err := root.Lstat(dir); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			kind = ChangeAdd
+		}
+		c.record(dir, kind)
+	}
+	return nil
+}
+
+// list returns the changes recorded, sorted by path.
+func (c *layerChanges) list() []Change {
+	var changes []Change
+	var walk func(p string, n *changeNode)
+	walk = func(p string, n *changeNode) {
+		if n.recorded {
+			changes = append(changes, Change{Path: p, Kind: n.kind})
+		}
+		for name, child := range n.children {
+			walk(filepath.Join(p, name), child)
+		}
+	}
+	walk(string(os.PathSeparator), &c.root)
+	sort.Sort(changesByPath(changes))
+	return changes
+}
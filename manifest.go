@@ -0,0 +1,129 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+
+	"github.com/containerd/log"
+)
+
+// ManifestEntry maps a file or directory to its name in an archive created
+// by [TarFromManifest].
+type ManifestEntry struct {
+	// Source is the path of the file or directory to archive. Directories
+	// are archived with their content.
+	Source string
+	// Name is the slash-separated name of the entry in the archive. The
+	// content of directories is archived below Name. If Name is "." or
+	// empty, only the content of the directory is archived.
+	Name string
+}
+
+// TarFromManifest creates an archive from the files and directories in
+// entries, which can be in different source directories, and returns it as a
+// stream of bytes. Entries are archived in order; if several entries have
+// the same name, the first one is archived. Parent directories of entries
+// that were not archived before the entry are written with
+// [ImpliedDirectoryMode], as for RebaseNames with ParentsFirst, and files
+// that are hard linked are archived as hard links, including across entries.
+//
+// Options are applied as for [TarWithOptions], except for IncludeFiles,
+// ExcludePatterns, RebaseNames, IncludeSourceDir, ParentsFirst, and
+// FollowSymlinks, which are ignored. An error is returned if the name of an
+// entry is invalid; errors reading the sources are logged, and the files
+// that cannot be read are skipped, as for TarWithOptions.
+func TarFromManifest(entries []ManifestEntry, options *TarOptions) (io.ReadCloser, error) {
+	if options == nil {
+		options = &TarOptions{}
+	}
+	manifest := make([]ManifestEntry, 0, len(entries))
+	for _, entry := range entries {
+		name, err := cleanEntryName(entry.Name)
+		if err != nil {
+			return nil, err
+		}
+		manifest = append(manifest, ManifestEntry{Source: addLongPathPrefix(entry.Source), Name: name})
+	}
+
+	tb, err := NewTarballer("", options)
+	if err != nil {
+		return nil, err
+	}
+	tb.manifest = manifest
+	go tb.Do()
+	return tb.Reader(), nil
+}
+
+// addManifest writes the entries of t.manifest with ta.
+func (t *Tarballer) addManifest(ta *tarAppender) {
+	ta.FollowSymlinks = false
+
+	seen := make(map[string]bool)
+
+	// dirs holds the names of the directories written, to write the
+	// parent directories that are not in the manifest.
+	dirs := make(map[string]bool)
+
+	for _, entry := range t.manifest {
+		err := filepath.WalkDir(entry.Source, func(filePath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				log.G(context.TODO()).Errorf("Tar: Can't stat file %s to tar: %s", filePath, err)
+				return nil
+			}
+			rel, err := filepath.Rel(entry.Source, filePath)
+			if err != nil {
+				return nil
+			}
+			name := path.Join(entry.Name, filepath.ToSlash(rel))
+			if name == "." || seen[name] {
+				return nil
+			}
+			seen[name] = true
+
+			if err := addManifestParentDirs(ta, name, dirs); err != nil {
+				log.G(context.TODO()).Errorf("Can't add parent directories of %s to tar: %s", filePath, err)
+				// if pipe is broken, stop writing tar stream to it
+				if errors.Is(err, io.ErrClosedPipe) {
+					return err
+				}
+			}
+			if d.IsDir() {
+				dirs[name] = true
+			}
+
+			if err := ta.addTarFile(filePath, name); err != nil {
+				log.G(context.TODO()).Errorf("Can't add file %s to tar: %s", filePath, err)
+				// if pipe is broken, stop writing tar stream to it
+				if errors.Is(err, io.ErrClosedPipe) {
+					return err
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, io.ErrClosedPipe) {
+			return
+		}
+	}
+}
+
+// addManifestParentDirs writes the parent directories of the entry with the
+// given name that were not written yet as implied directories.
+func addManifestParentDirs(ta *tarAppender, name string, dirs map[string]bool) error {
+	var parents []string
+	for dir := path.Dir(name); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+		parents = append(parents, dir)
+	}
+	for _, dir := range slices.Backward(parents) {
+		dirs[dir] = true
+		if err := ta.addImpliedDir(dir); err != nil {
+			return fmt.Errorf("failed to add implied directory %s: %w", dir, err)
+		}
+	}
+	return nil
+}
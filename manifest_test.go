@@ -0,0 +1,84 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestTarFromManifest(t *testing.T) {
+	srcA := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(srcA, "file"), []byte("hello"), 0o755))
+	srcB := t.TempDir()
+	assert.NilError(t, os.MkdirAll(filepath.Join(srcB, "dir", "sub"), 0o700))
+	assert.NilError(t, os.WriteFile(filepath.Join(srcB, "dir", "sub", "data"), []byte("data"), 0o644))
+	assert.NilError(t, os.Link(filepath.Join(srcA, "file"), filepath.Join(srcB, "dir", "hardlink")))
+
+	rdr, err := TarFromManifest([]ManifestEntry{
+		{Source: filepath.Join(srcA, "file"), Name: "/usr/local/bin/tool"},
+		{Source: filepath.Join(srcB, "dir"), Name: "usr/share/tool"},
+		{Source: filepath.Join(srcB, "dir", "sub", "data"), Name: "usr/share/tool/sub/data"},
+	}, nil)
+	assert.NilError(t, err)
+	defer rdr.Close()
+
+	type entry struct {
+		Typeflag byte
+		Mode     int64
+		Linkname string
+		Content  string
+	}
+	entries := make(map[string]entry)
+	var names []string
+	err = Walk(rdr, func(hdr *tar.Header, content io.Reader) error {
+		b, err := io.ReadAll(content)
+		if err != nil {
+			return err
+		}
+		names = append(names, hdr.Name)
+		entries[hdr.Name] = entry{Typeflag: hdr.Typeflag, Mode: hdr.Mode, Linkname: hdr.Linkname, Content: string(b)}
+		return nil
+	})
+	assert.NilError(t, err)
+
+	// Duplicate names are only archived once.
+	assert.Check(t, is.DeepEqual(names, []string{
+		"usr/",
+		"usr/local/",
+		"usr/local/bin/",
+		"usr/local/bin/tool",
+		"usr/share/",
+		"usr/share/tool/",
+		"usr/share/tool/hardlink",
+		"usr/share/tool/sub/",
+		"usr/share/tool/sub/data",
+	}))
+
+	implied := entry{Typeflag: tar.TypeDir, Mode: chmodTarEntry(ImpliedDirectoryMode)}
+	assert.Check(t, is.DeepEqual(entries["usr/"], implied))
+	assert.Check(t, is.DeepEqual(entries["usr/local/bin/"], implied))
+	assert.Check(t, is.DeepEqual(entries["usr/local/bin/tool"], entry{Typeflag: tar.TypeReg, Mode: chmodTarEntry(0o755), Content: "hello"}))
+	assert.Check(t, is.Equal(entries["usr/share/tool/sub/data"].Content, "data"))
+
+	hardlink := entries["usr/share/tool/hardlink"]
+	if runtime.GOOS == "windows" {
+		// Hard links are not detected on Windows.
+		assert.Check(t, is.Equal(hardlink.Content, "hello"))
+	} else {
+		assert.Check(t, is.Equal(hardlink.Typeflag, byte(tar.TypeLink)))
+		assert.Check(t, is.Equal(hardlink.Linkname, "usr/local/bin/tool"))
+	}
+}
+
+func TestTarFromManifestInvalidName(t *testing.T) {
+	_, err := TarFromManifest([]ManifestEntry{
+		{Source: t.TempDir(), Name: "../escape"},
+	}, nil)
+	assert.Check(t, is.ErrorContains(err, "invalid entry name"))
+}
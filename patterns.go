@@ -0,0 +1,158 @@
+package archive
+
+import (
+	"context"
+	"io/fs"
+	"strings"
+
+	"github.com/containerd/log"
+	"github.com/moby/patternmatcher"
+)
+
+// PatternSyntax is the syntax used to interpret [TarOptions.ExcludePatterns].
+type PatternSyntax int
+
+const (
+	// PatternDefault interprets ExcludePatterns using patternmatcher semantics
+	// when creating an archive, and as path prefixes when extracting one.
+	PatternDefault PatternSyntax = iota
+
+	// PatternGitignore interprets ExcludePatterns using .gitignore semantics,
+	// both when creating and extracting an archive:
+	//
+	//   - a pattern without a "/" (other than a trailing one) matches at
+	//     any depth, so "foo" is equivalent to "**/foo".
+	//   - a pattern with a leading or middle "/" is anchored to the root of
+	//     the archive.
+	//   - a pattern starting with "!" re-includes paths excluded by an earlier
+	//     pattern.
+	//   - blank patterns and patterns starting with "#" are ignored; use "\#"
+	//     and "\!" for patterns starting with a literal "#" or "!".
+	//
+	// A trailing "/" is accepted, but does not restrict the pattern to match
+	// only directories.
+	PatternGitignore
+)
+
+// newExcludeMatcher returns a pattern matcher for the ExcludePatterns in
+// options, interpreted according to options.ExcludePatternSyntax.
+func newExcludeMatcher(options *TarOptions) (*patternmatcher.PatternMatcher, error) {
+	if options.ExcludePatternSyntax != PatternGitignore {
+		return patternmatcher.New(options.ExcludePatterns)
+	}
+	patterns := make([]string, 0, len(options.ExcludePatterns))
+	for _, p := range options.ExcludePatterns {
+		if p = fromGitignorePattern(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patternmatcher.New(patterns)
+}
+
+// fromGitignorePattern converts a .gitignore pattern to the equivalent
+// patternmatcher pattern. It returns an empty string for blank patterns
+// and comments.
+func fromGitignorePattern(pattern string) string {
+	pattern = strings.TrimRight(pattern, " ")
+	if pattern == "" || pattern[0] == '#' {
+		return ""
+	}
+
+	var exclusion string
+	switch {
+	case pattern[0] == '!':
+		exclusion, pattern = "!", pattern[1:]
+	case strings.HasPrefix(pattern, `\!`), strings.HasPrefix(pattern, `\#`):
+		pattern = pattern[1:]
+	}
+
+	pattern = strings.TrimSuffix(pattern, "/")
+	if pattern == "" {
+		return ""
+	}
+	if anchored := strings.TrimPrefix(pattern, "/"); anchored != pattern {
+		pattern = anchored
+	} else if !strings.Contains(pattern, "/") && !strings.HasPrefix(pattern, "**") {
+		pattern = "**/" + pattern
+	}
+	return exclusion + pattern
+}
+
+// excludeWalker applies exclude patterns to the entries found by a walk of
+// an include path, in lexical order, reusing the match results of their
+// parent directories.
+type excludeWalker struct {
+	pm      *patternmatcher.PatternMatcher
+	include string
+	sep     string // path separator of the names walked
+
+	parentMatchInfo []patternmatcher.MatchInfo
+	parentDirs      []string
+}
+
+// excluded reports whether the entry name, relative to the source, is
+// excluded. For an excluded directory, it returns fs.SkipDir if no exclusion
+// (!...) pattern may match an entry inside it.
+func (w *excludeWalker) excluded(name string, isDir bool) (bool, error) {
+	// If "include" is an exact match for the current file
+	// then even if there's an "excludePatterns" pattern that
+	// matches it, don't skip it. IOW, assume an explicit 'include'
+	// is asking for that file no matter what - which is true
+	// for some files, like .dockerignore and Dockerfile (sometimes)
+	if name == w.include {
+		return false, nil
+	}
+
+	for len(w.parentDirs) != 0 {
+		if strings.HasPrefix(name, w.parentDirs[len(w.parentDirs)-1]+w.sep) {
+			break
+		}
+		w.parentDirs = w.parentDirs[:len(w.parentDirs)-1]
+		w.parentMatchInfo = w.parentMatchInfo[:len(w.parentMatchInfo)-1]
+	}
+
+	var parentInfo patternmatcher.MatchInfo
+	if len(w.parentMatchInfo) != 0 {
+		parentInfo = w.parentMatchInfo[len(w.parentMatchInfo)-1]
+	}
+	skip, matchInfo, err := w.pm.MatchesUsingParentResults(name, parentInfo)
+	if err != nil {
+		log.G(context.TODO()).Errorf("Error matching %s: %v", name, err)
+		return false, err
+	}
+	if isDir {
+		w.parentDirs = append(w.parentDirs, name)
+		w.parentMatchInfo = append(w.parentMatchInfo, matchInfo)
+	}
+	if !skip || !isDir {
+		return skip, nil
+	}
+
+	// Don't skip the contents of the directory if an exclusion pattern
+	// (e.g. !dir/file) may match an entry inside it.
+	if w.pm.Exclusions() {
+		dirSlash := name + w.sep
+		for _, pat := range w.pm.Patterns() {
+			if pat.Exclusion() && strings.HasPrefix(pat.String()+w.sep, dirSlash) {
+				return true, nil
+			}
+		}
+	}
+	return true, fs.SkipDir
+}
+
+// rebaseEntryName replaces include in name, an entry found under include,
+// with rebase, as set in RebaseNames. name is returned as is if rebase is
+// empty.
+func rebaseEntryName(name, include, rebase, sep string) string {
+	if rebase == "" {
+		return name
+	}
+	// Special case the root directory to replace with an empty string
+	// instead so that we don't end up with double slashes in the paths.
+	var replacement string
+	if rebase != sep {
+		replacement = rebase
+	}
+	return strings.Replace(name, include, replacement, 1)
+}
@@ -0,0 +1,115 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestFromGitignorePattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		expected string
+	}{
+		{pattern: "", expected: ""},
+		{pattern: "# comment", expected: ""},
+		{pattern: "foo", expected: "**/foo"},
+		{pattern: "foo/", expected: "**/foo"},
+		{pattern: "*.log", expected: "**/*.log"},
+		{pattern: "/foo", expected: "foo"},
+		{pattern: "foo/bar", expected: "foo/bar"},
+		{pattern: "**/foo", expected: "**/foo"},
+		{pattern: "!keep.txt", expected: "!**/keep.txt"},
+		{pattern: "!/build/keep.txt", expected: "!build/keep.txt"},
+		{pattern: `\!important`, expected: "**/!important"},
+		{pattern: `\#hash`, expected: "**/#hash"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.pattern, func(t *testing.T) {
+			assert.Check(t, is.Equal(fromGitignorePattern(tc.pattern), tc.expected))
+		})
+	}
+}
+
+func TestTarUntarGitignorePatterns(t *testing.T) {
+	origin := t.TempDir()
+	for _, p := range []string{
+		"top",
+		"app.log",
+		"keep.log",
+		"sub/top",
+		"sub/debug.log",
+		"sub/keep.log",
+		"build/out",
+		"build/keep.txt",
+	} {
+		assert.NilError(t, os.MkdirAll(filepath.Join(origin, filepath.Dir(p)), 0o755))
+		assert.NilError(t, os.WriteFile(filepath.Join(origin, p), []byte(p), 0o644))
+	}
+
+	excludes := []string{"/top", "*.log", "!keep.log", "/build", "!/build/keep.txt"}
+	expected := []string{
+		"build/",
+		"build/keep.txt",
+		"keep.log",
+		"sub/",
+		"sub/keep.log",
+		"sub/top",
+	}
+
+	t.Run("tar", func(t *testing.T) {
+		rdr, err := TarWithOptions(origin, &TarOptions{
+			ExcludePatterns:      excludes,
+			ExcludePatternSyntax: PatternGitignore,
+		})
+		assert.NilError(t, err)
+		defer rdr.Close()
+
+		var names []string
+		err = Walk(rdr, func(hdr *tar.Header, _ io.Reader) error {
+			names = append(names, hdr.Name)
+			return nil
+		})
+		assert.NilError(t, err)
+		slices.Sort(names)
+		// The excluded "build" directory is traversed for re-included files,
+		// but is not added to the archive itself.
+		assert.Check(t, is.DeepEqual(names, expected[1:]))
+	})
+
+	t.Run("untar", func(t *testing.T) {
+		rdr, err := TarWithOptions(origin, &TarOptions{})
+		assert.NilError(t, err)
+		defer rdr.Close()
+
+		dest := t.TempDir()
+		err = Untar(rdr, dest, &TarOptions{
+			ExcludePatterns:      excludes,
+			ExcludePatternSyntax: PatternGitignore,
+		})
+		assert.NilError(t, err)
+
+		var names []string
+		err = filepath.WalkDir(dest, func(p string, d os.DirEntry, err error) error {
+			if err != nil || p == dest {
+				return err
+			}
+			name, _ := filepath.Rel(dest, p)
+			name = filepath.ToSlash(name)
+			if d.IsDir() {
+				name += "/"
+			}
+			names = append(names, name)
+			return nil
+		})
+		assert.NilError(t, err)
+		slices.Sort(names)
+		assert.Check(t, is.DeepEqual(names, expected))
+	})
+}
@@ -0,0 +1,37 @@
+package archive
+
+import (
+	"io"
+
+	"github.com/moby/go-archive/compression"
+)
+
+// Recompress reads the (possibly compressed) archive from in, and writes it
+// to out compressed with the compression algorithm "to", without otherwise
+// modifying it: the uncompressed content written is identical to the
+// uncompressed content read, byte for byte. If level is non-nil, it is the
+// compression level to use, which is validated as by
+// [compression.CompressStreamLevel].
+func Recompress(in io.Reader, out io.Writer, to compression.Compression, level *int) error {
+	decompressed, err := compression.DecompressStream(in)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = decompressed.Close() }()
+
+	var w io.WriteCloser
+	if level != nil {
+		w, err = compression.CompressStreamLevel(out, to, *level)
+	} else {
+		w, err = compression.CompressStream(out, to)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := copyWithBuffer(w, decompressed); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
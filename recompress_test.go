@@ -0,0 +1,66 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+
+	"github.com/moby/go-archive/compression"
+)
+
+func TestRecompress(t *testing.T) {
+	origin := t.TempDir()
+	assert.NilError(t, os.MkdirAll(filepath.Join(origin, "dir"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "file"), bytes.Repeat([]byte("hello"), 1000), 0o644))
+	assert.NilError(t, os.Symlink("file", filepath.Join(origin, "dir", "link")))
+
+	rdr, err := Tar(origin, compression.Gzip)
+	assert.NilError(t, err)
+	gzipped, err := io.ReadAll(rdr)
+	assert.NilError(t, err)
+	assert.NilError(t, rdr.Close())
+
+	decompressed, err := compression.DecompressStream(bytes.NewReader(gzipped))
+	assert.NilError(t, err)
+	uncompressed, err := io.ReadAll(decompressed)
+	assert.NilError(t, err)
+	assert.NilError(t, decompressed.Close())
+
+	var plain bytes.Buffer
+	assert.NilError(t, Recompress(bytes.NewReader(gzipped), &plain, compression.None, nil))
+	assert.Check(t, bytes.Equal(plain.Bytes(), uncompressed), "expected the tar content to be preserved")
+
+	level := 9
+	var regzipped bytes.Buffer
+	assert.NilError(t, Recompress(bytes.NewReader(plain.Bytes()), &regzipped, compression.Gzip, &level))
+	assert.Check(t, is.Equal(compression.Detect(regzipped.Bytes()), compression.Gzip))
+
+	expected := t.TempDir()
+	assert.NilError(t, Untar(bytes.NewReader(gzipped), expected, nil))
+	for _, archive := range [][]byte{plain.Bytes(), regzipped.Bytes()} {
+		dest := t.TempDir()
+		assert.NilError(t, Untar(bytes.NewReader(archive), dest, nil))
+		changes, err := ChangesDirs(dest, expected)
+		assert.NilError(t, err)
+		assert.Check(t, is.Len(changes, 0))
+	}
+}
+
+func TestRecompressInvalidLevel(t *testing.T) {
+	level := 100
+	err := Recompress(bytes.NewReader(nil), io.Discard, compression.Gzip, &level)
+	assert.Check(t, is.ErrorContains(err, "invalid compression level"))
+}
+
+func TestRecompressInvalidInput(t *testing.T) {
+	// A truncated gzip header fails to decompress, and nothing is written.
+	var out bytes.Buffer
+	err := Recompress(bytes.NewReader([]byte{0x1f, 0x8b, 0x08}), &out, compression.Gzip, nil)
+	assert.Check(t, err != nil, "expected error for invalid input")
+	assert.Check(t, is.Equal(out.Len(), 0))
+}
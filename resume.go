@@ -0,0 +1,58 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+)
+
+// Checkpoint records the progress of Untar, to resume an interrupted
+// extraction with [TarOptions.ResumeFrom].
+type Checkpoint struct {
+	// Offset is the offset in the uncompressed archive of the header
+	// following the last entry extracted.
+	Offset int64
+	// Name is the name of the last entry extracted, as stored in the
+	// archive.
+	Name string
+	// HeaderOffset is the offset in the uncompressed archive of the first
+	// header of the last entry extracted, including its PAX or GNU extension
+	// headers. An extraction is resumed by reading the archive from it.
+	HeaderOffset int64
+}
+
+// entryCheckpoint returns the checkpoint after the entry with the given name,
+// whose headers start at offset headerStart of src, and whose content starts
+// at offset dataStart. It reads the content of the entry that was not read
+// yet, so that src is at the end of its content.
+func entryCheckpoint(tr *tar.Reader, src *countingReader, headerStart, dataStart int64, name string) (Checkpoint, error) {
+	if _, err := io.Copy(io.Discard, tr); err != nil {
+		return Checkpoint{}, err
+	}
+	// The content read from src may differ from the size of the entry for
+	// sparse files, so use the number of bytes read to find the padding.
+	size := src.n - dataStart
+	return Checkpoint{Offset: dataStart + size + (-size & (blockSize - 1)), Name: name, HeaderOffset: headerStart}, nil
+}
+
+// resume reads the last entry extracted before cp from the archive, which
+// must be read from cp.HeaderOffset, and checks that it matches cp, so that
+// extraction continues with the entry following it.
+func (xr *extractReader) resume(cp Checkpoint) error {
+	xr.src.n = cp.HeaderOffset
+	hdr, err := xr.tr.Next()
+	if err != nil {
+		return fmt.Errorf("cannot resume after %q at offset %d: %w", cp.Name, cp.HeaderOffset, err)
+	}
+	if hdr.Name != cp.Name {
+		return fmt.Errorf("cannot resume after %q at offset %d: archive has %q instead", cp.Name, cp.HeaderOffset, hdr.Name)
+	}
+	next, err := entryCheckpoint(xr.tr, xr.src, cp.HeaderOffset, xr.src.n, hdr.Name)
+	if err != nil {
+		return fmt.Errorf("cannot resume after %q at offset %d: %w", cp.Name, cp.HeaderOffset, err)
+	}
+	if next.Offset != cp.Offset {
+		return fmt.Errorf("cannot resume after %q at offset %d: entry ends at offset %d instead of %d", cp.Name, cp.HeaderOffset, next.Offset, cp.Offset)
+	}
+	return nil
+}
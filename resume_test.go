@@ -0,0 +1,155 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+
+	"github.com/moby/go-archive/compression"
+)
+
+func TestUntarResumeFrom(t *testing.T) {
+	origin := t.TempDir()
+	assert.NilError(t, os.MkdirAll(filepath.Join(origin, "dir", strings.Repeat("d", 120)), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "a"), []byte("a"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "b"), bytes.Repeat([]byte("b"), 1000), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", strings.Repeat("d", 120), "c"), []byte("c"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "e"), nil, 0o644))
+	assert.NilError(t, os.Link(filepath.Join(origin, "dir", "a"), filepath.Join(origin, "f")))
+
+	rdr, err := Tar(origin, compression.None)
+	assert.NilError(t, err)
+	data, err := io.ReadAll(rdr)
+	assert.NilError(t, err)
+	assert.NilError(t, rdr.Close())
+
+	full := t.TempDir()
+	var entries int
+	assert.NilError(t, Untar(bytes.NewReader(data), full, &TarOptions{
+		OnCheckpoint: func(Checkpoint) error {
+			entries++
+			return nil
+		},
+	}))
+
+	for stop := 1; stop < entries; stop++ {
+		dest := t.TempDir()
+		checkpoint := stopAfter(t, data, dest, stop)
+
+		n := stop
+		var last Checkpoint
+		err := Untar(bytes.NewReader(data[checkpoint.HeaderOffset:]), dest, &TarOptions{
+			ResumeFrom: &checkpoint,
+			OnCheckpoint: func(cp Checkpoint) error {
+				last = cp
+				n++
+				return nil
+			},
+		})
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(n, entries))
+		assert.Check(t, last.Offset <= int64(len(data)))
+
+		changes, err := ChangesDirs(dest, full)
+		assert.NilError(t, err)
+		for _, c := range changes {
+			// The modification times of directories extracted before the
+			// checkpoint are not restored.
+			fi, err := os.Lstat(filepath.Join(dest, c.Path))
+			if c.Kind == ChangeModify && err == nil && fi.IsDir() {
+				continue
+			}
+			t.Errorf("stop after %d entries: unexpected change %s", stop, c)
+		}
+	}
+}
+
+// stopAfter extracts data to dest, stopping after n entries, and returns the
+// checkpoint after the last entry extracted.
+func stopAfter(t *testing.T, data []byte, dest string, n int) Checkpoint {
+	t.Helper()
+	var checkpoint Checkpoint
+	errStop := errors.New("stop")
+	err := Untar(bytes.NewReader(data), dest, &TarOptions{
+		OnCheckpoint: func(cp Checkpoint) error {
+			checkpoint = cp
+			if n--; n == 0 {
+				return errStop
+			}
+			return nil
+		},
+	})
+	assert.Assert(t, is.ErrorIs(err, errStop))
+	return checkpoint
+}
+
+func TestUntarResumeFromWithoutOnCheckpoint(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "a", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "b", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "c", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"a": "a", "b": strings.Repeat("b", 1000), "c": "c"})
+	data := archive.Bytes()
+
+	dest := t.TempDir()
+	checkpoint := stopAfter(t, data, dest, 2)
+	assert.Check(t, is.Equal(checkpoint.Name, "b"))
+
+	assert.NilError(t, UntarUncompressed(bytes.NewReader(data[checkpoint.HeaderOffset:]), dest, &TarOptions{ResumeFrom: &checkpoint}))
+	content, err := os.ReadFile(filepath.Join(dest, "c"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(content), "c"))
+}
+
+func TestUntarResumeFromMismatch(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "a", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "b", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "c", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"a": "a", "b": "b", "c": "c"})
+	data := archive.Bytes()
+	checkpoint := stopAfter(t, data, t.TempDir(), 2)
+
+	tests := []struct {
+		doc         string
+		checkpoint  Checkpoint
+		expectedErr string
+	}{
+		{
+			doc:         "name",
+			checkpoint:  Checkpoint{Offset: checkpoint.Offset, Name: "other", HeaderOffset: checkpoint.HeaderOffset},
+			expectedErr: `cannot resume after "other" at offset 1024: archive has "b" instead`,
+		},
+		{
+			doc:         "offset",
+			checkpoint:  Checkpoint{Offset: checkpoint.Offset + 512, Name: "b", HeaderOffset: checkpoint.HeaderOffset},
+			expectedErr: `cannot resume after "b" at offset 1024: entry ends at offset 2048 instead of 2560`,
+		},
+		{
+			doc:         "header offset",
+			checkpoint:  Checkpoint{Offset: checkpoint.Offset, Name: "b", HeaderOffset: checkpoint.HeaderOffset + 512},
+			expectedErr: `cannot resume after "b" at offset 1536: archive/tar: invalid tar header`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.doc, func(t *testing.T) {
+			dest := t.TempDir()
+			err := Untar(bytes.NewReader(data[tc.checkpoint.HeaderOffset:]), dest, &TarOptions{ResumeFrom: &tc.checkpoint})
+			assert.Check(t, is.Error(err, tc.expectedErr))
+			_, err = os.Lstat(filepath.Join(dest, "c"))
+			assert.Check(t, os.IsNotExist(err))
+		})
+	}
+
+	// Compressed archives cannot be resumed.
+	err := UntarWithCompression(bytes.NewReader(data), t.TempDir(), compression.Gzip, &TarOptions{ResumeFrom: &checkpoint})
+	assert.Check(t, is.Error(err, "cannot resume extracting a tar.gz archive"))
+}
@@ -0,0 +1,36 @@
+package archive
+
+import "time"
+
+// RetryPolicy configures Untar to retry filesystem operations that fail with
+// a transient error, such as EINTR or ESTALE on network filesystems. Other
+// errors are returned immediately.
+type RetryPolicy struct {
+	// MaxRetries is the maximum number of times an operation is retried.
+	// Zero disables retries.
+	MaxRetries int
+	// Backoff is the delay before the first retry, which is doubled for
+	// every subsequent retry.
+	Backoff time.Duration
+	// MaxBackoff, if set, is the maximum delay between retries.
+	MaxBackoff time.Duration
+}
+
+// do calls fn, and calls it again if it fails with a transient error, until
+// it succeeds or the retries are exhausted. It calls fn once if p is nil.
+func (p *RetryPolicy) do(fn func() error) error {
+	err := fn()
+	if p == nil {
+		return err
+	}
+	delay := p.Backoff
+	for i := 0; i < p.MaxRetries && err != nil && isTransientError(err); i++ {
+		time.Sleep(delay)
+		delay *= 2
+		if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+			delay = p.MaxBackoff
+		}
+		err = fn()
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package archive
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// isTransientError reports whether err is an error for which a filesystem
+// operation may succeed when retried.
+func isTransientError(err error) bool {
+	return errors.Is(err, unix.EINTR) || errors.Is(err, unix.ESTALE) || errors.Is(err, unix.EAGAIN)
+}
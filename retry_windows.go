@@ -0,0 +1,7 @@
+package archive
+
+// isTransientError reports whether err is an error for which a filesystem
+// operation may succeed when retried. No errors are retried on Windows.
+func isTransientError(error) bool {
+	return false
+}
@@ -22,6 +22,10 @@
 	"path/filepath"
 )
 
+// maxLinksWalked is the maximum number of symlinks followed when resolving a
+// path within a root.
+const maxLinksWalked = 255
+
 var errTooManyLinks = errors.New("too many links")
 
 // fsRootPath joins a path with a root, evaluating and bounding any
@@ -49,7 +53,7 @@ func fsRootPath(root, path string) (string, error) {
 }
 
 func walkLink(root, path string, linksWalked *int) (newpath string, islink bool, err error) {
-	if *linksWalked > 255 {
+	if *linksWalked > maxLinksWalked {
 		return "", false, errTooManyLinks
 	}
 
@@ -0,0 +1,99 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SecureJoin joins the name of a tar entry to dest, and returns the path the
+// entry is extracted to by [Untar]. The name is cleaned as a slash-separated
+// path, with leading slashes removed, and names that escape dest or that are
+// Windows absolute paths are rejected.
+//
+// Symlinks in the parent directories of the entry that exist in dest are
+// resolved the way the extractor resolves them: relative symlinks are
+// followed as long as they stay within dest, and absolute symlinks, or
+// symlinks pointing outside dest, produce an error. The last element of the
+// name is not resolved, as extracting the entry replaces it.
+//
+// The result is only valid as long as the symlinks in dest do not change.
+func SecureJoin(dest, name string) (string, error) {
+	cleaned, err := cleanEntryName(name)
+	if err != nil {
+		return "", err
+	}
+	if cleaned == "." {
+		return filepath.Clean(dest), nil
+	}
+	dir, file := path.Split(cleaned)
+	resolved, err := resolveInRoot(dest, dir)
+	if err != nil {
+		return "", fmt.Errorf("invalid entry name %q: %w", name, err)
+	}
+	return filepath.Join(dest, filepath.FromSlash(resolved), file), nil
+}
+
+// resolveInRoot resolves the symlinks in the slash-separated path p, relative
+// to root, and returns the resolved path relative to root. Symlinks that are
+// absolute, or that point outside root, are rejected. Resolution stops at the
+// first element that does not exist.
+func resolveInRoot(root, p string) (string, error) {
+	var (
+		resolved    string
+		linksWalked int // to protect against cycles
+	)
+	remaining := strings.Split(p, "/")
+	for len(remaining) > 0 {
+		elem := remaining[0]
+		remaining = remaining[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == "" {
+				return "", breakoutError(errors.New("path escapes from parent"))
+			}
+			if resolved = path.Dir(resolved); resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := path.Join(resolved, elem)
+		fullPath := filepath.Join(root, filepath.FromSlash(next))
+		fi, err := os.Lstat(fullPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			resolved = path.Join(append([]string{next}, remaining...)...)
+			if !filepath.IsLocal(resolved) {
+				return "", breakoutError(errors.New("path escapes from parent"))
+			}
+			return resolved, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		linksWalked++
+		if linksWalked > maxLinksWalked {
+			return "", errTooManyLinks
+		}
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) || filepath.VolumeName(target) != "" || strings.HasPrefix(target, "/") || isWindowsAbs(target) {
+			return "", breakoutError(fmt.Errorf("symlink %q points to absolute path %q", next, target))
+		}
+		remaining = append(strings.Split(filepath.ToSlash(target), "/"), remaining...)
+	}
+	return resolved, nil
+}
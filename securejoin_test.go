@@ -0,0 +1,102 @@
+package archive
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestSecureJoin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require elevated privileges on Windows")
+	}
+	dest := t.TempDir()
+	assert.NilError(t, os.MkdirAll(filepath.Join(dest, "dir", "sub"), 0o755))
+	assert.NilError(t, os.Symlink("dir/sub", filepath.Join(dest, "link")))
+	assert.NilError(t, os.Symlink("..", filepath.Join(dest, "dir", "sub", "up")))
+	assert.NilError(t, os.Symlink("../..", filepath.Join(dest, "dir", "escape")))
+	assert.NilError(t, os.Symlink("/etc", filepath.Join(dest, "abs")))
+	assert.NilError(t, os.Symlink("loop", filepath.Join(dest, "loop")))
+
+	for _, tc := range []struct {
+		name     string
+		expected string
+		err      bool
+	}{
+		{name: "", expected: "."},
+		{name: "/", expected: "."},
+		{name: "file", expected: "file"},
+		{name: "/dir/file", expected: "dir/file"},
+		{name: "dir/../file", expected: "file"},
+		{name: "missing/file", expected: "missing/file"},
+		{name: "link/file", expected: "dir/sub/file"},
+		{name: "link/up/file", expected: "dir/file"},
+		{name: "link", expected: "link"},
+		{name: "abs", expected: "abs"},
+		{name: "../file", err: true},
+		{name: "dir/../../file", err: true},
+		{name: `C:\file`, err: true},
+		{name: "dir/escape/file", err: true},
+		{name: "abs/passwd", err: true},
+		{name: "loop/file", err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := SecureJoin(dest, tc.name)
+			if tc.err {
+				assert.Check(t, err != nil, "expected an error, got %q", p)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(p, filepath.Join(dest, filepath.FromSlash(tc.expected))))
+		})
+	}
+}
+
+// TestSecureJoinMatchesUntar verifies that entries are extracted to the path
+// returned by SecureJoin, and that names rejected by SecureJoin are rejected
+// by Untar.
+func TestSecureJoinMatchesUntar(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require elevated privileges on Windows")
+	}
+	for _, tc := range []struct {
+		name string
+		err  bool
+	}{
+		{name: "link/file"},
+		{name: "link/up/file"},
+		{name: "escape/file", err: true},
+		{name: "abs/file", err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dest := t.TempDir()
+			assert.NilError(t, os.MkdirAll(filepath.Join(dest, "dir", "sub"), 0o755))
+			assert.NilError(t, os.Symlink("dir/sub", filepath.Join(dest, "link")))
+			assert.NilError(t, os.Symlink("..", filepath.Join(dest, "dir", "sub", "up")))
+			assert.NilError(t, os.Symlink("..", filepath.Join(dest, "escape")))
+			assert.NilError(t, os.Symlink(t.TempDir(), filepath.Join(dest, "abs")))
+
+			p, joinErr := SecureJoin(dest, tc.name)
+
+			archive := buildTestArchive(t, []*tar.Header{
+				{Name: tc.name, Typeflag: tar.TypeReg, Mode: 0o644},
+			}, map[string]string{tc.name: "hello"})
+			untarErr := Untar(archive, dest, &TarOptions{NoLchown: true})
+			if tc.err {
+				assert.Check(t, joinErr != nil)
+				assert.Check(t, untarErr != nil)
+				return
+			}
+			assert.NilError(t, joinErr)
+			assert.NilError(t, untarErr)
+			content, err := os.ReadFile(p)
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(string(content), "hello"))
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/moby/sys/user"
+)
+
+// ShiftIDs reads the tar stream from in, and writes it to out with the owner
+// of every entry mapped from the container to the host ids with uidMap and
+// gidMap, as Untar does with the IDMap in [TarOptions]. The user and group
+// names of entries are cleared, as they refer to the original ids. The
+// content and all other header fields of entries are copied unmodified. PAX
+// Global Extended Headers are copied unmodified.
+//
+// An error is returned if the owner of an entry is not covered by the
+// mappings. Empty mappings leave the ids unmodified.
+func ShiftIDs(in io.Reader, out io.Writer, uidMap, gidMap []user.IDMap) error {
+	idMapping := user.IdentityMapping{UIDMaps: uidMap, GIDMaps: gidMap}
+
+	tr := tar.NewReader(in)
+	tw := tar.NewWriter(out)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// PAX Global Extended Headers have no owner, and are written
+		// unmodified.
+		if hdr.Typeflag != tar.TypeXGlobalHeader {
+			if err := remapIDs(idMapping, hdr); err != nil {
+				return fmt.Errorf("cannot shift owner of %q: %w", hdr.Name, err)
+			}
+			hdr.Uname, hdr.Gname = "", ""
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err := copyWithBuffer(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
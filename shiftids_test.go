@@ -0,0 +1,64 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/moby/sys/user"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestShiftIDs(t *testing.T) {
+	in := buildTestArchive(t, []*tar.Header{
+		{Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "abc"}},
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755, Uname: "root", Gname: "root"},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 1000, Gid: 1001, Uname: "user", Gname: "group"},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file", Uid: 1000},
+	}, map[string]string{"dir/file": "hello"})
+
+	idMaps := []user.IDMap{{ID: 0, ParentID: 100000, Count: 65536}}
+	var out bytes.Buffer
+	assert.NilError(t, ShiftIDs(in, &out, idMaps, idMaps))
+
+	// The global header is written unmodified.
+	hdr, err := tar.NewReader(bytes.NewReader(out.Bytes())).Next()
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(hdr.Typeflag, byte(tar.TypeXGlobalHeader)))
+	assert.Check(t, is.DeepEqual(hdr.PAXRecords, map[string]string{"comment": "abc"}))
+
+	type entry struct {
+		Name     string
+		UID, GID int
+		Uname    string
+		Content  string
+	}
+	var entries []entry
+	err = Walk(&out, func(hdr *tar.Header, content io.Reader) error {
+		b, err := io.ReadAll(content)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{Name: hdr.Name, UID: hdr.Uid, GID: hdr.Gid, Uname: hdr.Uname, Content: string(b)})
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(entries, []entry{
+		{Name: "dir/", UID: 100000, GID: 100000},
+		{Name: "dir/file", UID: 101000, GID: 101001, Content: "hello"},
+		{Name: "dir/link", UID: 101000, GID: 100000},
+	}))
+}
+
+func TestShiftIDsUnmapped(t *testing.T) {
+	in := buildTestArchive(t, []*tar.Header{
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 70000},
+	}, nil)
+
+	idMaps := []user.IDMap{{ID: 0, ParentID: 100000, Count: 65536}}
+	err := ShiftIDs(in, io.Discard, idMaps, idMaps)
+	assert.Check(t, is.ErrorContains(err, `cannot shift owner of "file"`))
+}
@@ -0,0 +1,230 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	blockSize = 512
+
+	paxGNUSparse          = "GNU.sparse."
+	paxGNUSparseMajor     = paxGNUSparse + "major"
+	paxGNUSparseMinor     = paxGNUSparse + "minor"
+	paxGNUSparseName      = paxGNUSparse + "name"
+	paxGNUSparseRealSize  = paxGNUSparse + "realsize"
+	paxGNUSparseMap       = paxGNUSparse + "map"
+	paxGNUSparseNumBlocks = paxGNUSparse + "numblocks"
+
+	// sparsePlaceholder replaces paxGNUSparse in the keys of PAX records
+	// passed to tar.Writer, which drops GNU sparse records. It has the same
+	// length, so the records can be renamed in the encoded header.
+	sparsePlaceholder = "XNU.sparse."
+)
+
+var errSparseEncoding = errors.New("unexpected encoding of sparse file header")
+
+// sparseEntry is a region of data in a sparse file.
+type sparseEntry struct {
+	Offset, Length int64
+}
+
+// addSparseFile adds the regular file at srcPath with header hdr to the
+// archive as a sparse file in the PAX 1.0 format used by GNU tar, if the
+// file has holes. It reports whether the file was added.
+//
+// The archive/tar package can read sparse files, but not write them, so the
+// entry is encoded separately and written to the underlying writer.
+func (ta *tarAppender) addSparseFile(srcPath string, hdr *tar.Header) (bool, error) {
+	if ta.Format != tar.FormatUnknown && ta.Format != tar.FormatPAX {
+		return false, nil
+	}
+	file, err := ta.openSource(srcPath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	regions, err := dataRegions(file, hdr.Size)
+	if err != nil || regions == nil {
+		return false, err
+	}
+	var dataSize int64
+	for _, r := range regions {
+		dataSize += r.Length
+	}
+	if dataSize == hdr.Size {
+		return false, nil
+	}
+
+	// GNU tar marks a trailing hole with an empty region at the end.
+	if len(regions) == 0 || regions[len(regions)-1].Offset+regions[len(regions)-1].Length < hdr.Size {
+		regions = append(regions, sparseEntry{Offset: hdr.Size})
+	}
+	sparseMap := encodeSparseMap(regions)
+
+	sparseHdr := *hdr
+	sparseHdr.Name = path.Join(path.Dir(hdr.Name), "GNUSparseFile.0", path.Base(hdr.Name))
+	sparseHdr.Size = int64(len(sparseMap)) + dataSize
+	sparseHdr.Format = tar.FormatPAX
+	sparseHdr.PAXRecords = maps.Clone(hdr.PAXRecords)
+	if sparseHdr.PAXRecords == nil {
+		sparseHdr.PAXRecords = make(map[string]string)
+	}
+	for key, value := range map[string]string{
+		paxGNUSparseMajor:    "1",
+		paxGNUSparseMinor:    "0",
+		paxGNUSparseName:     hdr.Name,
+		paxGNUSparseRealSize: strconv.FormatInt(hdr.Size, 10),
+	} {
+		sparseHdr.PAXRecords[sparsePlaceholder+strings.TrimPrefix(key, paxGNUSparse)] = value
+	}
+
+	var encoded bytes.Buffer
+	if err := tar.NewWriter(&encoded).WriteHeader(&sparseHdr); err != nil {
+		return false, err
+	}
+	if err := renameSparseRecords(encoded.Bytes()); err != nil {
+		return false, err
+	}
+
+	// Complete the padding of the previous entry before writing to the
+	// underlying writer.
+	if err := ta.TarWriter.Flush(); err != nil {
+		return false, err
+	}
+	if _, err := ta.writer.Write(encoded.Bytes()); err != nil {
+		return false, err
+	}
+	if _, err := ta.writer.Write(sparseMap); err != nil {
+		return false, err
+	}
+	for _, r := range regions {
+		// Pad with zeros if the file was truncated since its regions were
+		// detected, as the sizes are already written.
+		data := io.MultiReader(io.NewSectionReader(file, r.Offset, r.Length), zeroReader{})
+		if _, err := io.CopyN(ta.writer, data, r.Length); err != nil {
+			return false, err
+		}
+	}
+	if pad := -sparseHdr.Size & (blockSize - 1); pad > 0 {
+		if _, err := ta.writer.Write(make([]byte, pad)); err != nil {
+			return false, err
+		}
+	}
+	ta.updateStats(hdr, int64(encoded.Len()+len(sparseMap))+(-sparseHdr.Size&(blockSize-1)))
+	return true, nil
+}
+
+// encodeSparseMap returns the sparse map of the PAX 1.0 sparse format, which
+// precedes the data of the file, padded to a multiple of the block size.
+func encodeSparseMap(regions []sparseEntry) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d\n", len(regions))
+	for _, r := range regions {
+		fmt.Fprintf(&b, "%d\n%d\n", r.Offset, r.Length)
+	}
+	if pad := -b.Len() & (blockSize - 1); pad > 0 {
+		b.Write(make([]byte, pad))
+	}
+	return b.Bytes()
+}
+
+// renameSparseRecords renames the PAX records with sparsePlaceholder keys in
+// the encoded header to GNU sparse records. The encoded header must start
+// with a PAX extended header.
+func renameSparseRecords(encoded []byte) error {
+	if len(encoded) < blockSize || encoded[156] != tar.TypeXHeader {
+		return errSparseEncoding
+	}
+	size, err := strconv.ParseInt(strings.Trim(string(encoded[124:136]), " \x00"), 8, 64)
+	if err != nil || blockSize+size > int64(len(encoded)) {
+		return errSparseEncoding
+	}
+	records := encoded[blockSize : blockSize+size]
+	for len(records) > 0 {
+		// Each record is encoded as "<length> <key>=<value>\n".
+		sp := bytes.IndexByte(records, ' ')
+		if sp < 0 {
+			return errSparseEncoding
+		}
+		n, err := strconv.Atoi(string(records[:sp]))
+		if err != nil || n <= sp || n > len(records) {
+			return errSparseEncoding
+		}
+		if key := records[sp+1 : n]; bytes.HasPrefix(key, []byte(sparsePlaceholder)) {
+			copy(key, paxGNUSparse)
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+// isSparseHeader reports whether hdr is a regular file that was stored as a
+// sparse file in a GNU PAX sparse format.
+func isSparseHeader(hdr *tar.Header) bool {
+	if hdr.Typeflag != tar.TypeReg {
+		return false
+	}
+	for _, key := range []string{paxGNUSparseMajor, paxGNUSparseMap, paxGNUSparseNumBlocks} {
+		if _, ok := hdr.PAXRecords[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// copySparse copies size bytes from src to file, seeking over blocks of zeros
+// instead of writing them, so that they become holes on filesystems that
+// support sparse files.
+func copySparse(file *os.File, src io.Reader, size int64) error {
+	b := copyPool.Get().(*copyBuffer)
+	defer copyPool.Put(b)
+	buf := b.buf
+
+	var written int64
+	for written < size {
+		n, err := io.ReadFull(src, buf[:min(int64(len(buf)), size-written)])
+		if err != nil {
+			return err
+		}
+		for chunk := range slices.Chunk(buf[:n], 4096) {
+			if isZero(chunk) {
+				if _, err := file.Seek(int64(len(chunk)), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := file.Write(chunk); err != nil {
+				return err
+			}
+		}
+		written += int64(n)
+	}
+	// Extend the file if it ends with a hole.
+	return file.Truncate(size)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// zeroReader is an io.Reader that returns an infinite stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,40 @@
+package archive
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataRegions returns the regions of file, which is size bytes long, that
+// contain data, using SEEK_DATA and SEEK_HOLE. It returns nil if the
+// filesystem does not support them.
+func dataRegions(file *os.File, size int64) ([]sparseEntry, error) {
+	fd := int(file.Fd())
+	regions := []sparseEntry{}
+	for offset := int64(0); offset < size; {
+		data, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// No data after offset.
+			break
+		}
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if data >= size {
+			break
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		hole = min(hole, size)
+		regions = append(regions, sparseEntry{Offset: data, Length: hole - data})
+		offset = hole
+	}
+	return regions, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package archive
+
+import "os"
+
+// dataRegions returns nil, as detecting holes in files is only supported on
+// Linux.
+func dataRegions(*os.File, int64) ([]sparseEntry, error) {
+	return nil, nil
+}
@@ -0,0 +1,135 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+)
+
+var (
+	errSymlinkLoop        = errors.New("symlink loop")
+	errSymlinkOutsideRoot = errors.New("symlink points outside of the source directory")
+)
+
+// walkFollowSymlinks walks the file tree rooted at root, calling fn for each
+// file or directory in the tree, including root, in the same order as
+// [filepath.WalkDir]. Unlike filepath.WalkDir, symlinks are followed: fn is
+// called with the path of the symlink, but with a [fs.DirEntry] describing
+// its target, and symlinks to directories are descended into.
+//
+// The walk is aborted with an error if a symlink loop is found, or, unless
+// allowOutside is set, if a symlink points outside of boundary.
+func walkFollowSymlinks(root, boundary string, allowOutside bool, fn fs.WalkDirFunc) error {
+	realBoundary, err := filepath.EvalSymlinks(boundary)
+	if err != nil {
+		return err
+	}
+	w := &symlinkWalker{
+		boundary:     realBoundary,
+		allowOutside: allowOutside,
+		fn:           fn,
+	}
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = w.walk(root, fs.FileInfoToDirEntry(fi))
+	}
+	if errors.Is(err, filepath.SkipDir) || errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+type symlinkWalker struct {
+	boundary     string
+	allowOutside bool
+	fn           fs.WalkDirFunc
+
+	// ancestors holds the resolved paths of the directories being walked,
+	// to detect symlinks pointing to one of their parent directories.
+	ancestors []string
+}
+
+func (w *symlinkWalker) walk(p string, d fs.DirEntry) error {
+	if !d.IsDir() {
+		return w.fn(p, d, nil)
+	}
+
+	realPath, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return w.fn(p, d, err)
+	}
+	if slices.Contains(w.ancestors, realPath) {
+		return fmt.Errorf("%s refers to its parent directory %s: %w", p, realPath, errSymlinkLoop)
+	}
+
+	if err := w.fn(p, d, nil); err != nil {
+		if errors.Is(err, filepath.SkipDir) {
+			return nil
+		}
+		return err
+	}
+
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		if err := w.fn(p, d, err); err != nil && !errors.Is(err, filepath.SkipDir) {
+			return err
+		}
+		return nil
+	}
+
+	w.ancestors = append(w.ancestors, realPath)
+	defer func() { w.ancestors = w.ancestors[:len(w.ancestors)-1] }()
+
+	for _, entry := range entries {
+		childPath := filepath.Join(p, entry.Name())
+		if entry.Type()&fs.ModeSymlink != 0 {
+			target, err := w.resolve(childPath)
+			if err != nil {
+				if errors.Is(err, errSymlinkLoop) || errors.Is(err, errSymlinkOutsideRoot) {
+					return err
+				}
+				if err := w.fn(childPath, entry, err); err != nil && !errors.Is(err, filepath.SkipDir) {
+					return err
+				}
+				continue
+			}
+			entry = target
+		}
+		if err := w.walk(childPath, entry); err != nil {
+			if errors.Is(err, filepath.SkipDir) {
+				// Returned for a file; skip the remaining files in p.
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve returns a [fs.DirEntry] describing the target of the symlink at p.
+func (w *symlinkWalker) resolve(p string) (fs.DirEntry, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, syscall.ELOOP) {
+			return nil, fmt.Errorf("%s: %w", p, errSymlinkLoop)
+		}
+		return nil, err
+	}
+	if !w.allowOutside {
+		target, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return nil, err
+		}
+		if rel, err := filepath.Rel(w.boundary, target); err != nil || !filepath.IsLocal(rel) && rel != "." {
+			return nil, fmt.Errorf("%s: %w", p, errSymlinkOutsideRoot)
+		}
+	}
+	return fs.FileInfoToDirEntry(fi), nil
+}
@@ -0,0 +1,80 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestTarWithOptionsFollowSymlinks(t *testing.T) {
+	tmp := t.TempDir()
+	origin := filepath.Join(tmp, "origin")
+	outside := filepath.Join(tmp, "outside")
+	assert.NilError(t, os.MkdirAll(filepath.Join(origin, "dir"), 0o755))
+	assert.NilError(t, os.MkdirAll(outside, 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "file"), []byte("inside"), 0o644))
+	assert.NilError(t, os.WriteFile(filepath.Join(outside, "file"), []byte("outside"), 0o644))
+	assert.NilError(t, os.Symlink(filepath.Join("dir", "file"), filepath.Join(origin, "link-file")))
+	assert.NilError(t, os.Symlink("dir", filepath.Join(origin, "link-dir")))
+
+	list := func(t *testing.T, opts *TarOptions) (map[string]byte, error) {
+		t.Helper()
+		rdr, err := TarWithOptions(origin, opts)
+		assert.NilError(t, err)
+		defer rdr.Close()
+
+		entries := map[string]byte{}
+		err = Walk(rdr, func(hdr *tar.Header, _ io.Reader) error {
+			entries[hdr.Name] = hdr.Typeflag
+			return nil
+		})
+		return entries, err
+	}
+
+	t.Run("default", func(t *testing.T) {
+		entries, err := list(t, &TarOptions{})
+		assert.NilError(t, err)
+		assert.Check(t, is.DeepEqual(entries, map[string]byte{
+			"dir/":      tar.TypeDir,
+			"dir/file":  tar.TypeReg,
+			"link-dir":  tar.TypeSymlink,
+			"link-file": tar.TypeSymlink,
+		}))
+	})
+
+	t.Run("follow", func(t *testing.T) {
+		entries, err := list(t, &TarOptions{FollowSymlinks: true})
+		assert.NilError(t, err)
+		assert.Check(t, is.DeepEqual(entries, map[string]byte{
+			"dir/":          tar.TypeDir,
+			"dir/file":      tar.TypeReg,
+			"link-dir/":     tar.TypeDir,
+			"link-dir/file": tar.TypeReg,
+			"link-file":     tar.TypeReg,
+		}))
+	})
+
+	assert.NilError(t, os.Symlink(outside, filepath.Join(origin, "link-outside")))
+
+	t.Run("outside source", func(t *testing.T) {
+		_, err := list(t, &TarOptions{FollowSymlinks: true})
+		assert.Check(t, is.ErrorIs(err, errSymlinkOutsideRoot))
+
+		entries, err := list(t, &TarOptions{FollowSymlinks: true, FollowSymlinksOutsideSource: true})
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(entries["link-outside/"], byte(tar.TypeDir)))
+		assert.Check(t, is.Equal(entries["link-outside/file"], byte(tar.TypeReg)))
+	})
+
+	assert.NilError(t, os.Symlink("..", filepath.Join(origin, "dir", "loop")))
+
+	t.Run("loop", func(t *testing.T) {
+		_, err := list(t, &TarOptions{FollowSymlinks: true, FollowSymlinksOutsideSource: true})
+		assert.Check(t, is.ErrorIs(err, errSymlinkLoop))
+	})
+}
@@ -0,0 +1,153 @@
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/containerd/log"
+	"github.com/moby/patternmatcher"
+)
+
+// TarFS creates an archive from the file system fsys, and returns it as a
+// stream of bytes. It is the [fs.FS] equivalent of [TarWithOptions], and uses
+// the IncludeFiles, ExcludePatterns, ExcludePatternSyntax, RebaseNames,
+// Compression, CompressionLevel, and ChownOpts options in the same way; other
+// options are ignored.
+//
+// As [fs.FS] has no notion of hardlinks, ownership, or devices, hardlinks are
+// archived as regular files, entries are owned by 0:0 unless ChownOpts is set,
+// and device nodes, fifos, and sockets are omitted. Symlinks are archived if
+// fsys implements [fs.ReadLinkFS], and omitted otherwise.
+func TarFS(fsys fs.FS, options *TarOptions) (io.ReadCloser, error) {
+	if options == nil {
+		options = &TarOptions{}
+	}
+	pm, err := newExcludeMatcher(options)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	compressWriter, err := compressStream(pipeWriter, options)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		tw := tar.NewWriter(compressWriter)
+		defer func() {
+			if err := tw.Close(); err != nil {
+				log.G(context.TODO()).Errorf("Can't close tar writer: %s", err)
+			}
+			if err := compressWriter.Close(); err != nil {
+				log.G(context.TODO()).Errorf("Can't close compress writer: %s", err)
+			}
+			if err := pipeWriter.Close(); err != nil {
+				log.G(context.TODO()).Errorf("Can't close pipe writer: %s", err)
+			}
+		}()
+
+		includes := options.IncludeFiles
+		if len(includes) == 0 {
+			includes = []string{"."}
+		}
+
+		seen := make(map[string]bool)
+		for _, include := range includes {
+			if err := tarFSInclude(fsys, tw, pm, options, include, seen); err != nil {
+				// if pipe is broken, stop writing tar stream to it
+				return
+			}
+		}
+	}()
+
+	return pipeReader, nil
+}
+
+// tarFSInclude walks the include path in fsys and writes all entries that
+// are not excluded to tw. Errors for individual entries are logged and
+// ignored, except for a broken pipe, which is returned.
+func tarFSInclude(fsys fs.FS, tw *tar.Writer, pm *patternmatcher.PatternMatcher, options *TarOptions, include string, seen map[string]bool) error {
+	rebaseName := options.RebaseNames[include]
+
+	ew := &excludeWalker{pm: pm, include: include, sep: "/"}
+
+	return fs.WalkDir(fsys, include, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.G(context.TODO()).Errorf("TarFS: Can't stat file %s to tar: %s", filePath, err)
+			return nil
+		}
+		if filePath == "." {
+			return nil
+		}
+
+		if skip, err := ew.excluded(filePath, d.IsDir()); err != nil || skip {
+			return err
+		}
+
+		if seen[filePath] {
+			return nil
+		}
+		seen[filePath] = true
+
+		archivePath := rebaseEntryName(filePath, include, rebaseName, "/")
+
+		if err := addFSTarFile(fsys, tw, filePath, archivePath, d, options.ChownOpts); err != nil {
+			log.G(context.TODO()).Errorf("Can't add file %s to tar: %s", filePath, err)
+			if errors.Is(err, io.ErrClosedPipe) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// addFSTarFile adds the file at filePath in fsys to the archive as archivePath.
+func addFSTarFile(fsys fs.FS, tw *tar.Writer, filePath, archivePath string, d fs.DirEntry, chownOpts *ChownOpts) error {
+	fi, err := d.Info()
+	if err != nil {
+		return err
+	}
+
+	var link string
+	switch mode := fi.Mode(); {
+	case mode&fs.ModeSymlink != 0:
+		link, err = fs.ReadLink(fsys, filePath)
+		if err != nil {
+			log.G(context.TODO()).WithError(err).Debugf("TarFS: skipping symlink %s", filePath)
+			return nil
+		}
+	case mode&(fs.ModeDevice|fs.ModeCharDevice|fs.ModeNamedPipe|fs.ModeSocket) != 0:
+		log.G(context.TODO()).Debugf("TarFS: skipping special file %s", filePath)
+		return nil
+	}
+
+	hdr, err := FileInfoHeader(path.Clean(archivePath), fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Uid, hdr.Gid = 0, 0
+	hdr.Uname, hdr.Gname = "", ""
+	if chownOpts != nil {
+		hdr.Uid = chownOpts.UID
+		hdr.Gid = chownOpts.GID
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+		return nil
+	}
+
+	f, err := fsys.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	return copyWithBuffer(tw, f)
+}
@@ -0,0 +1,100 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+
+	"github.com/moby/go-archive/compression"
+)
+
+func TestTarFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir/file":          {Data: []byte("hello world"), Mode: 0o644},
+		"dir/link":          {Data: []byte("file"), Mode: fs.ModeSymlink | 0o777},
+		"dir/fifo":          {Mode: fs.ModeNamedPipe | 0o644},
+		"excluded/file":     {Data: []byte("excluded"), Mode: 0o644},
+		"excluded/keep.txt": {Data: []byte("kept"), Mode: 0o644},
+	}
+
+	tests := []struct {
+		doc      string
+		opts     *TarOptions
+		expected map[string]string
+	}{
+		{
+			doc: "default",
+			opts: &TarOptions{
+				Compression: compression.Gzip,
+			},
+			expected: map[string]string{
+				"dir/":              "",
+				"dir/file":          "hello world",
+				"dir/link":          "-> file",
+				"excluded/":         "",
+				"excluded/file":     "excluded",
+				"excluded/keep.txt": "kept",
+			},
+		},
+		{
+			doc: "exclude patterns",
+			opts: &TarOptions{
+				ExcludePatterns: []string{"excluded", "!excluded/keep.txt"},
+			},
+			expected: map[string]string{
+				"dir/":              "",
+				"dir/file":          "hello world",
+				"dir/link":          "-> file",
+				"excluded/keep.txt": "kept",
+			},
+		},
+		{
+			doc: "include files and rebase",
+			opts: &TarOptions{
+				IncludeFiles: []string{"dir/file"},
+				RebaseNames:  map[string]string{"dir/file": "renamed"},
+				ChownOpts:    &ChownOpts{UID: 1000, GID: 1000},
+			},
+			expected: map[string]string{
+				"renamed": "hello world",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.doc, func(t *testing.T) {
+			rdr, err := TarFS(fsys, tc.opts)
+			assert.NilError(t, err)
+			defer rdr.Close()
+
+			expectedUID := 0
+			if tc.opts.ChownOpts != nil {
+				expectedUID = tc.opts.ChownOpts.UID
+			}
+
+			actual := map[string]string{}
+			err = Walk(rdr, func(hdr *tar.Header, content io.Reader) error {
+				assert.Check(t, is.Equal(hdr.Uid, expectedUID))
+				assert.Check(t, is.Equal(hdr.Gid, expectedUID))
+				switch hdr.Typeflag {
+				case tar.TypeSymlink:
+					actual[hdr.Name] = "-> " + hdr.Linkname
+				default:
+					b, err := io.ReadAll(content)
+					if err != nil {
+						return err
+					}
+					actual[hdr.Name] = string(b)
+				}
+				return nil
+			})
+			assert.NilError(t, err)
+			assert.Check(t, is.DeepEqual(actual, tc.expected))
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/moby/go-archive/compression"
+)
+
+// Target is a destination that archives can be extracted to with [UntarTo].
+//
+// Names passed to its methods are slash-separated paths relative to the root
+// of the target. UntarTo rejects entry names and hardlink targets that
+// escape the root before calling the Target, but symlinks created earlier
+// may still point outside of it; implementations must not follow those.
+//
+// UntarTo removes existing entries with RemoveAll before replacing them, so
+// Mkdir, WriteFile, Symlink, and Link are only called for names that do not
+// exist.
+type Target interface {
+	// Stat returns the file info of name, following symlinks. The error
+	// matches [fs.ErrNotExist] if name does not exist.
+	Stat(name string) (fs.FileInfo, error)
+	// Lstat returns the file info of name, without following symlinks.
+	// The error matches [fs.ErrNotExist] if name does not exist.
+	Lstat(name string) (fs.FileInfo, error)
+	// RemoveAll removes name, and its contents if it is a directory.
+	RemoveAll(name string) error
+	// Mkdir creates a directory.
+	Mkdir(name string, perm fs.FileMode) error
+	// WriteFile creates a regular file with the content read from r.
+	WriteFile(name string, r io.Reader, perm fs.FileMode) error
+	// Symlink creates newname as a symbolic link to oldname. The target is
+	// stored verbatim.
+	Symlink(oldname, newname string) error
+	// Link creates newname as a hard link to oldname.
+	Link(oldname, newname string) error
+	// Chmod changes the mode of name, without following symlinks. It is
+	// not called for symlinks.
+	Chmod(name string, mode fs.FileMode) error
+	// Chtimes changes the access and modification times of name.
+	Chtimes(name string, atime, mtime time.Time) error
+	// Lchtimes changes the access and modification times of the symlink
+	// name, without following it.
+	Lchtimes(name string, atime, mtime time.Time) error
+	// Lchown changes the numeric uid and gid of name, without following
+	// symlinks.
+	Lchown(name string, uid, gid int) error
+	// Setxattr sets the extended attribute attr of name, without following
+	// symlinks.
+	Setxattr(name, attr string, value []byte) error
+}
+
+// diskTarget is implemented by [OSTarget], for the options and entry types
+// that only apply when extracting to a directory on disk.
+type diskTarget interface {
+	// osRoot returns the root of the target, for WhiteoutFormat.
+	osRoot() *os.Root
+	// writeFile creates a regular file with the size bytes of content
+	// read from r, seeking over blocks of zeros if sparse is set.
+	writeFile(name string, r io.Reader, perm fs.FileMode, size int64, sparse bool, options *TarOptions) error
+	// mknod creates the device node or fifo described by hdr.
+	mknod(name string, hdr *tar.Header) error
+	// setBirthTime sets the creation time of name, for PreserveBirthTime.
+	setBirthTime(name string, btime time.Time) error
+	// setFileFlags sets the file flags of name, for PreserveFileFlags.
+	setFileFlags(name, flags string) error
+}
+
+// OSTarget is a [Target] that extracts to a directory on disk. All
+// operations are performed through an [os.Root], so that they cannot
+// escape the directory, including through symlinks. It is the target used
+// by [Untar].
+type OSTarget struct {
+	root *os.Root
+}
+
+var (
+	_ Target     = (*OSTarget)(nil)
+	_ diskTarget = (*OSTarget)(nil)
+)
+
+// NewOSTarget returns an OSTarget for the existing directory dir. The
+// OSTarget must be closed when it is no longer used.
+func NewOSTarget(dir string) (*OSTarget, error) {
+	root, err := openDestRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &OSTarget{root: root}, nil
+}
+
+// Close closes the OSTarget.
+func (t *OSTarget) Close() error {
+	return t.root.Close()
+}
+
+// Stat implements [Target.Stat].
+func (t *OSTarget) Stat(name string) (fs.FileInfo, error) {
+	return t.root.Stat(filepath.FromSlash(name))
+}
+
+// Lstat implements [Target.Lstat].
+func (t *OSTarget) Lstat(name string) (fs.FileInfo, error) {
+	return t.root.Lstat(filepath.FromSlash(name))
+}
+
+// RemoveAll implements [Target.RemoveAll].
+func (t *OSTarget) RemoveAll(name string) error {
+	return t.root.RemoveAll(filepath.FromSlash(name))
+}
+
+// Mkdir implements [Target.Mkdir].
+func (t *OSTarget) Mkdir(name string, perm fs.FileMode) error {
+	// os.Root.Mkdir only accepts the permission bits; special bits are
+	// applied by Chmod.
+	return t.root.Mkdir(filepath.FromSlash(name), perm.Perm())
+}
+
+// WriteFile implements [Target.WriteFile].
+func (t *OSTarget) WriteFile(name string, r io.Reader, perm fs.FileMode) error {
+	return t.writeFile(name, r, perm, 0, false, &TarOptions{})
+}
+
+func (t *OSTarget) writeFile(name string, r io.Reader, perm fs.FileMode, size int64, sparse bool, options *TarOptions) error {
+	// os.Root.OpenFile only accepts the nine least-significant permission
+	// bits; special bits are applied afterward by Chmod.
+	// We use sequential file access to avoid depleting the standby list
+	// on Windows (go1.26). On Linux, this equates to a regular os.OpenFile.
+	var file *os.File
+	err := options.Retry.do(func() (err error) {
+		file, err = t.root.OpenFile(filepath.FromSlash(name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC|windows_O_FILE_FLAG_SEQUENTIAL_SCAN, perm.Perm())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if sparse {
+		err = copySparse(file, r, size)
+	} else {
+		err = copyWithBufferSize(file, r, options.CopyBufferSize)
+	}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Symlink implements [Target.Symlink].
+func (t *OSTarget) Symlink(oldname, newname string) error {
+	// os.Root.Symlink contains the symlink's location (newname) within
+	// root but stores the target (oldname) verbatim, so absolute targets
+	// such as /usr/lib -- common and legitimate in container images -- are
+	// preserved rather than rejected. The symlink node is therefore always
+	// created within root via openat(2) semantics, without resolving to an
+	// absolute path; containment applies when the symlink is followed, not
+	// at creation.
+	return t.root.Symlink(oldname, filepath.FromSlash(newname))
+}
+
+// Link implements [Target.Link].
+func (t *OSTarget) Link(oldname, newname string) error {
+	return t.root.Link(filepath.FromSlash(oldname), filepath.FromSlash(newname))
+}
+
+// Chmod implements [Target.Chmod]. It is a no-op on Windows.
+func (t *OSTarget) Chmod(name string, mode fs.FileMode) error {
+	return chmodNoSymlink(t.root, filepath.FromSlash(name), mode)
+}
+
+// Chtimes implements [Target.Chtimes].
+func (t *OSTarget) Chtimes(name string, atime, mtime time.Time) error {
+	return t.root.Chtimes(filepath.FromSlash(name), atime, mtime)
+}
+
+// Lchtimes implements [Target.Lchtimes]. It is a no-op on Windows.
+func (t *OSTarget) Lchtimes(name string, atime, mtime time.Time) error {
+	return lchtimes(t.root, filepath.FromSlash(name), atime, mtime)
+}
+
+// Lchown implements [Target.Lchown]. It is a no-op on Windows.
+func (t *OSTarget) Lchown(name string, uid, gid int) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	return t.root.Lchown(filepath.FromSlash(name), uid, gid)
+}
+
+// Setxattr implements [Target.Setxattr].
+func (t *OSTarget) Setxattr(name, attr string, value []byte) error {
+	return setxattrInRoot(t.root, filepath.FromSlash(name), attr, value)
+}
+
+func (t *OSTarget) osRoot() *os.Root {
+	return t.root
+}
+
+func (t *OSTarget) mknod(name string, hdr *tar.Header) error {
+	return handleTarTypeBlockCharFifo(t.root, hdr, filepath.FromSlash(name))
+}
+
+func (t *OSTarget) setBirthTime(name string, btime time.Time) error {
+	return setBirthTime(t.root, filepath.FromSlash(name), btime)
+}
+
+func (t *OSTarget) setFileFlags(name, flags string) error {
+	return setFileFlags(t.root, filepath.FromSlash(name), flags)
+}
+
+// UntarTo reads the (possibly compressed) archive from r, and extracts it
+// to target. [Untar] extracts to an [OSTarget] in the same way, and UntarTo
+// supports the same options, except that MaxPathLength is checked against
+// the length of the entry name, as there is no destination directory.
+//
+// For targets other than OSTarget, WhiteoutFormat is not supported, device
+// nodes and fifos cannot be extracted, and options that control how files
+// are written to disk (Sparsify, CopyBufferSize, PreserveBirthTime, and
+// PreserveFileFlags) are ignored.
+//
+// Parent directories that are not in the archive are created with
+// options.ImpliedDirMode, or [ImpliedDirectoryMode] if not set, with
+// options.ExtractUmask applied, and owned by the root of options.IDMap.
+func UntarTo(r io.Reader, target Target, options *TarOptions) error {
+	if options == nil {
+		options = &TarOptions{}
+	}
+	if options.ResumeFrom == nil {
+		decompressed, err := compression.DecompressStreamWithDicts(r, compressionDicts(options)...)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = decompressed.Close() }()
+		r = decompressed
+	}
+
+	xr, err := newExtractReader(r, "", options)
+	if err != nil {
+		return err
+	}
+	return extractEntries(xr, target, options)
+}
@@ -0,0 +1,319 @@
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+
+	"github.com/moby/go-archive/compression"
+)
+
+// memEntry is a file, directory, or link in a memTarget.
+type memEntry struct {
+	Mode     fs.FileMode
+	Content  string
+	Linkname string
+	UID, GID int
+	ModTime  time.Time
+	Xattrs   map[string]string
+}
+
+// memTarget is an in-memory [Target] for testing.
+type memTarget map[string]*memEntry
+
+func (m memTarget) get(name string) (*memEntry, error) {
+	e, ok := m[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "get", Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (m memTarget) checkParent(name string) error {
+	if dir := path.Dir(name); dir != "." {
+		e, err := m.get(dir)
+		if err != nil {
+			return err
+		}
+		if !e.Mode.IsDir() {
+			return &fs.PathError{Op: "create", Path: name, Err: errors.New("not a directory")}
+		}
+	}
+	return nil
+}
+
+func (m memTarget) create(name string, e *memEntry) error {
+	if err := m.checkParent(name); err != nil {
+		return err
+	}
+	m[name] = e
+	return nil
+}
+
+// memFileInfo is the [fs.FileInfo] of a memEntry.
+type memFileInfo struct {
+	name string
+	*memEntry
+}
+
+func (fi memFileInfo) Name() string       { return path.Base(fi.name) }
+func (fi memFileInfo) Size() int64        { return int64(len(fi.Content)) }
+func (fi memFileInfo) Mode() fs.FileMode  { return fi.memEntry.Mode }
+func (fi memFileInfo) ModTime() time.Time { return fi.memEntry.ModTime }
+func (fi memFileInfo) IsDir() bool        { return fi.memEntry.Mode.IsDir() }
+func (fi memFileInfo) Sys() any           { return nil }
+
+// Stat follows symlinks in the last element of name only, which is enough
+// for the tests.
+func (m memTarget) Stat(name string) (fs.FileInfo, error) {
+	for range 255 {
+		e, err := m.get(name)
+		if err != nil {
+			return nil, err
+		}
+		if e.Mode&fs.ModeSymlink == 0 {
+			return memFileInfo{name: name, memEntry: e}, nil
+		}
+		if path.IsAbs(e.Linkname) {
+			name = path.Clean(e.Linkname)[1:]
+		} else {
+			name = path.Join(path.Dir(name), e.Linkname)
+		}
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: errors.New("too many levels of symbolic links")}
+}
+
+func (m memTarget) Lstat(name string) (fs.FileInfo, error) {
+	e, err := m.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return memFileInfo{name: name, memEntry: e}, nil
+}
+
+func (m memTarget) RemoveAll(name string) error {
+	for n := range m {
+		if n == name || strings.HasPrefix(n, name+"/") {
+			delete(m, n)
+		}
+	}
+	return nil
+}
+
+func (m memTarget) Mkdir(name string, perm fs.FileMode) error {
+	return m.create(name, &memEntry{Mode: fs.ModeDir | perm})
+}
+
+func (m memTarget) WriteFile(name string, r io.Reader, perm fs.FileMode) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return m.create(name, &memEntry{Mode: perm, Content: string(b)})
+}
+
+func (m memTarget) Symlink(oldname, newname string) error {
+	return m.create(newname, &memEntry{Mode: fs.ModeSymlink | 0o777, Linkname: oldname})
+}
+
+func (m memTarget) Link(oldname, newname string) error {
+	e, err := m.get(oldname)
+	if err != nil {
+		return err
+	}
+	return m.create(newname, e)
+}
+
+func (m memTarget) Chmod(name string, mode fs.FileMode) error {
+	e, err := m.get(name)
+	if err != nil {
+		return err
+	}
+	e.Mode = e.Mode.Type() | mode.Perm()
+	return nil
+}
+
+func (m memTarget) Chtimes(name string, _, mtime time.Time) error {
+	fi, err := m.Stat(name)
+	if err != nil {
+		return err
+	}
+	fi.(memFileInfo).memEntry.ModTime = mtime
+	return nil
+}
+
+func (m memTarget) Lchtimes(name string, _, mtime time.Time) error {
+	e, err := m.get(name)
+	if err != nil {
+		return err
+	}
+	e.ModTime = mtime
+	return nil
+}
+
+func (m memTarget) Lchown(name string, uid, gid int) error {
+	e, err := m.get(name)
+	if err != nil {
+		return err
+	}
+	e.UID, e.GID = uid, gid
+	return nil
+}
+
+func (m memTarget) Setxattr(name, attr string, value []byte) error {
+	e, err := m.get(name)
+	if err != nil {
+		return err
+	}
+	if e.Xattrs == nil {
+		e.Xattrs = map[string]string{}
+	}
+	e.Xattrs[attr] = string(value)
+	return nil
+}
+
+func TestUntarTo(t *testing.T) {
+	mtime := time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC)
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o750, Uid: 1, Gid: 2, ModTime: mtime},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o640, Uid: 3, Gid: 4, ModTime: mtime, PAXRecords: map[string]string{
+			paxSchilyXattr + "user.test": "value",
+		}},
+		{Name: "dir/symlink", Typeflag: tar.TypeSymlink, Linkname: "../outside", ModTime: mtime},
+		{Name: "dir/hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file", Mode: 0o640, Uid: 3, Gid: 4, ModTime: mtime},
+		{Name: "implied/file", Typeflag: tar.TypeReg, Mode: 0o600, ModTime: mtime},
+	}, map[string]string{
+		"dir/file":     "hello",
+		"implied/file": "world",
+	})
+
+	target := memTarget{}
+	assert.NilError(t, UntarTo(archive, target, nil))
+
+	file := &memEntry{Mode: 0o640, Content: "hello", UID: 3, GID: 4, ModTime: mtime, Xattrs: map[string]string{"user.test": "value"}}
+	assert.Check(t, is.DeepEqual(target, memTarget{
+		"dir":          {Mode: fs.ModeDir | 0o750, UID: 1, GID: 2, ModTime: mtime},
+		"dir/file":     file,
+		"dir/symlink":  {Mode: fs.ModeSymlink | 0o777, Linkname: "../outside", ModTime: mtime},
+		"dir/hardlink": file,
+		"implied":      {Mode: fs.ModeDir | ImpliedDirectoryMode},
+		"implied/file": {Mode: 0o600, Content: "world", ModTime: mtime},
+	}))
+}
+
+func TestUntarToInvalidNames(t *testing.T) {
+	for _, hdr := range []*tar.Header{
+		{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "link", Typeflag: tar.TypeLink, Linkname: "../escape"},
+	} {
+		t.Run(hdr.Name, func(t *testing.T) {
+			target := memTarget{}
+			err := UntarTo(buildTestArchive(t, []*tar.Header{hdr}, nil), target, nil)
+			var boErr *breakoutErr
+			assert.Check(t, errors.As(err, &boErr), "expected a breakout error, got %v", err)
+			assert.Check(t, is.Len(target, 0))
+		})
+	}
+}
+
+func TestUntarToOSTarget(t *testing.T) {
+	origin := t.TempDir()
+	assert.NilError(t, os.MkdirAll(filepath.Join(origin, "dir", "sub"), 0o750))
+	assert.NilError(t, os.WriteFile(filepath.Join(origin, "dir", "file"), []byte("hello"), 0o640))
+	assert.NilError(t, os.Symlink("file", filepath.Join(origin, "dir", "symlink")))
+	assert.NilError(t, os.Link(filepath.Join(origin, "dir", "file"), filepath.Join(origin, "dir", "hardlink")))
+
+	rdr, err := Tar(origin, compression.None)
+	assert.NilError(t, err)
+	defer rdr.Close()
+
+	dest := t.TempDir()
+	target, err := NewOSTarget(dest)
+	assert.NilError(t, err)
+	defer target.Close()
+	assert.NilError(t, UntarTo(rdr, target, &TarOptions{NoLchown: true}))
+
+	changes, err := ChangesDirs(dest, origin)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(changes, 0), "unexpected changes: %v", changes)
+}
+
+func TestUntarToReplacedDirectory(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "a/x", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "a", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "a/b", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "c/d/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "c", Typeflag: tar.TypeSymlink, Linkname: "a"},
+		{Name: "c/d/e", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"a/x": "x", "a": "a", "a/b": "b", "c/d/e": "e"})
+
+	dest := t.TempDir()
+	target, err := NewOSTarget(dest)
+	assert.NilError(t, err)
+	defer target.Close()
+
+	var checkpoints int
+	assert.NilError(t, UntarTo(archive, target, &TarOptions{
+		NoLchown: true,
+		OnCheckpoint: func(Checkpoint) error {
+			checkpoints++
+			return nil
+		},
+	}))
+	assert.Check(t, is.Equal(checkpoints, 6))
+
+	// As for Untar, the parent directories of c/d/e are resolved through
+	// the symlink that replaced c.
+	for name, expected := range map[string]string{"a/b": "b", "a/d/e": "e"} {
+		content, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(string(content), expected))
+	}
+	_, err = os.Lstat(filepath.Join(dest, "a", "x"))
+	assert.Check(t, is.ErrorIs(err, fs.ErrNotExist))
+	fi, err := os.Lstat(filepath.Join(dest, "c"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(fi.Mode().Type(), fs.ModeSymlink))
+}
+
+func TestUntarToExisting(t *testing.T) {
+	archive := func() io.Reader {
+		return buildTestArchive(t, []*tar.Header{
+			{Name: "dir", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+		}, map[string]string{"dir": "new", "file": "new"})
+	}
+	existing := func() memTarget {
+		return memTarget{
+			"dir":       {Mode: fs.ModeDir | 0o755},
+			"dir/child": {Mode: 0o644, Content: "old"},
+			"file":      {Mode: 0o644, Content: "old"},
+		}
+	}
+
+	target := existing()
+	assert.NilError(t, UntarTo(archive(), target, &TarOptions{NoLchown: true}))
+	assert.Check(t, is.Len(target, 2))
+	assert.Check(t, is.Equal(target["dir"].Content, "new"))
+	assert.Check(t, is.Equal(target["file"].Content, "new"))
+
+	target = existing()
+	err := UntarTo(archive(), target, &TarOptions{NoLchown: true, NoOverwriteDirNonDir: true})
+	assert.Check(t, is.ErrorContains(err, "cannot overwrite directory"))
+
+	target = existing()
+	assert.NilError(t, UntarTo(archive(), target, &TarOptions{NoLchown: true, SkipExisting: true}))
+	assert.Check(t, is.Equal(target["dir"].Content, "new"))
+	assert.Check(t, is.Equal(target["file"].Content, "old"))
+}
@@ -0,0 +1,183 @@
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"strings"
+
+	"github.com/moby/patternmatcher"
+)
+
+// TransformOptions are the options for [TransformArchive].
+type TransformOptions struct {
+	// ExcludePatterns are matched against the names of the entries in the
+	// input archive, with leading slashes and trailing slashes removed.
+	// Matching entries, and the contents of matching directories, are
+	// removed from the output.
+	ExcludePatterns []string
+	// ExcludePatternSyntax is the syntax of ExcludePatterns. It defaults
+	// to [PatternDefault], which uses patternmatcher semantics.
+	ExcludePatternSyntax PatternSyntax
+	// OldBase and NewBase rebase the entries that remain after applying
+	// ExcludePatterns, as done by [RebaseArchiveEntries]. Entries are not
+	// rebased if OldBase is empty.
+	OldBase, NewBase string
+	// Modifiers are applied after rebasing, as done by
+	// [ReplaceFileTarWrapper]. The keys are matched against the rebased
+	// entry names.
+	Modifiers map[string]TarModifierFunc
+}
+
+// TransformArchive reads the uncompressed tar stream from in, and writes it
+// to out after removing the entries excluded by opts, rebasing the remaining
+// entries, and applying the modifiers in opts, in that order. The archive is
+// transformed in a single streaming pass, without extracting it. The headers
+// and content of entries that are not modified, including their xattrs and
+// hardlink targets, are copied as-is, except for the rebased names.
+func TransformArchive(in io.Reader, out io.Writer, opts TransformOptions) error {
+	var pm *patternmatcher.PatternMatcher
+	if len(opts.ExcludePatterns) > 0 {
+		var err error
+		pm, err = newExcludeMatcher(&TarOptions{
+			ExcludePatterns:      opts.ExcludePatterns,
+			ExcludePatternSyntax: opts.ExcludePatternSyntax,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	rdr := io.NopCloser(in)
+	if pm != nil {
+		pr, pw := io.Pipe()
+		// Unblock excludeTarEntries if a later stage stops reading.
+		defer pr.Close()
+		go func(in io.Reader) {
+			_ = pw.CloseWithError(excludeTarEntries(in, pw, pm))
+		}(rdr)
+		rdr = pr
+	}
+	if opts.OldBase != "" {
+		rebased := RebaseArchiveEntries(rdr, opts.OldBase, opts.NewBase)
+		defer rebased.Close()
+		rdr = rebased
+	}
+	if len(opts.Modifiers) > 0 {
+		// ReplaceFileTarWrapper consumes the modifiers it applied.
+		rdr = ReplaceFileTarWrapper(rdr, maps.Clone(opts.Modifiers))
+		defer rdr.Close()
+	}
+
+	return copyWithBuffer(out, rdr)
+}
+
+// excludeTarEntries copies the tar stream from in to out, without the entries
+// matched by pm.
+func excludeTarEntries(in io.Reader, out io.Writer, pm *patternmatcher.PatternMatcher) error {
+	tr := tar.NewReader(in)
+	tw := tar.NewWriter(out)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(strings.TrimLeft(hdr.Name, "/"))
+		if name != "." {
+			skip, err := pm.MatchesOrParentMatches(name)
+			if err != nil {
+				return err
+			}
+			if skip {
+				continue
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err := copyWithBuffer(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// HardlinkResolver returns the content of the file at target, for a hardlink
+// pointing to target that is not earlier in the archive. It is used by
+// [ResolveHardlinks].
+type HardlinkResolver func(target string) ([]byte, error)
+
+// ResolveHardlinks reads the uncompressed tar stream from in, and writes it to
+// out after checking that the target of every hardlink is an earlier entry in
+// the stream, for example after concatenating archives, or after rewriting an
+// archive with [ReplaceFileTarWrapper]. Names are compared with leading
+// slashes removed.
+//
+// If resolve is nil, ResolveHardlinks fails on the first hardlink whose
+// target is not an earlier entry. Otherwise, the first such hardlink to a
+// target is converted to a regular file, with the metadata of the hardlink
+// and the content returned by resolve, and later hardlinks to the same target
+// are repointed to that file.
+func ResolveHardlinks(in io.Reader, out io.Writer, resolve HardlinkResolver) error {
+	tr := tar.NewReader(in)
+	tw := tar.NewWriter(out)
+
+	// seen holds the names of the entries written that can be the target
+	// of a hardlink.
+	seen := make(map[string]struct{})
+	// converted maps the targets of converted hardlinks to the regular file
+	// they were converted to.
+	converted := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+
+		var data []byte
+		if hdr.Typeflag == tar.TypeLink {
+			target := path.Clean(strings.TrimLeft(hdr.Linkname, "/"))
+			if _, ok := seen[target]; !ok {
+				if name, ok := converted[target]; ok {
+					hdr.Linkname = name
+				} else {
+					if resolve == nil {
+						return fmt.Errorf("hardlink %q points to %q, which is not an earlier entry in the archive", hdr.Name, hdr.Linkname)
+					}
+					data, err = resolve(target)
+					if err != nil {
+						return fmt.Errorf("failed to resolve hardlink %q to %q: %w", hdr.Name, hdr.Linkname, err)
+					}
+					hdr.Typeflag = tar.TypeReg
+					hdr.Linkname = ""
+					hdr.Size = int64(len(data))
+					converted[target] = hdr.Name
+				}
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if data != nil {
+			if _, err := tw.Write(data); err != nil {
+				return err
+			}
+		} else if err := copyWithBuffer(tw, tr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			seen[path.Clean(strings.TrimLeft(hdr.Name, "/"))] = struct{}{}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestTransformArchive(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "src/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "src/file", Typeflag: tar.TypeReg, Mode: 0o644, PAXRecords: map[string]string{
+			paxSchilyXattr + "user.test": "value",
+		}},
+		{Name: "src/hardlink", Typeflag: tar.TypeLink, Linkname: "src/file"},
+		{Name: "src/symlink", Typeflag: tar.TypeSymlink, Linkname: "file"},
+		{Name: "src/replaced", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "src/skip/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "src/skip/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "src/file.log", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{
+		"src/file":      "hello",
+		"src/replaced":  "old",
+		"src/skip/file": "skipped",
+		"src/file.log":  "log",
+	})
+
+	mods := map[string]TarModifierFunc{
+		"dst/replaced": func(_ string, hdr *tar.Header, _ io.Reader) (*tar.Header, []byte, error) {
+			return hdr, []byte("new"), nil
+		},
+		"dst/added": func(string, *tar.Header, io.Reader) (*tar.Header, []byte, error) {
+			return &tar.Header{Typeflag: tar.TypeReg, Mode: 0o600}, []byte("added"), nil
+		},
+	}
+
+	var out bytes.Buffer
+	err := TransformArchive(archive, &out, TransformOptions{
+		ExcludePatterns: []string{"src/skip", "**/*.log"},
+		OldBase:         "src",
+		NewBase:         "dst",
+		Modifiers:       mods,
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(mods, 2), "modifiers must not be consumed")
+
+	type entry struct {
+		Name, Linkname, Content string
+		Xattrs                  map[string]string
+	}
+	var got []entry
+	tr := tar.NewReader(&out)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		assert.NilError(t, err)
+		content, err := io.ReadAll(tr)
+		assert.NilError(t, err)
+		var xattrs map[string]string
+		for k, v := range hdr.PAXRecords {
+			if xattr, ok := strings.CutPrefix(k, paxSchilyXattr); ok {
+				if xattrs == nil {
+					xattrs = map[string]string{}
+				}
+				xattrs[xattr] = v
+			}
+		}
+		got = append(got, entry{Name: hdr.Name, Linkname: hdr.Linkname, Content: string(content), Xattrs: xattrs})
+	}
+
+	assert.Check(t, is.DeepEqual(got, []entry{
+		{Name: "dst/"},
+		{Name: "dst/file", Content: "hello", Xattrs: map[string]string{"user.test": "value"}},
+		{Name: "dst/hardlink", Linkname: "dst/file"},
+		{Name: "dst/symlink", Linkname: "file"},
+		{Name: "dst/replaced", Content: "new"},
+		{Name: "dst/added", Content: "added"},
+	}))
+}
+
+func TestTransformArchiveInvalid(t *testing.T) {
+	var out bytes.Buffer
+	err := TransformArchive(bytes.NewReader(bytes.Repeat([]byte("x"), 1024)), &out, TransformOptions{
+		ExcludePatterns: []string{"skip"},
+		OldBase:         "src",
+		NewBase:         "dst",
+	})
+	assert.Check(t, err != nil)
+}
+
+func TestResolveHardlinks(t *testing.T) {
+	newArchive := func() io.ReadCloser {
+		return io.NopCloser(buildTestArchive(t, []*tar.Header{
+			{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "link1", Typeflag: tar.TypeLink, Linkname: "file", Mode: 0o644},
+			{Name: "link2", Typeflag: tar.TypeLink, Linkname: "file", Mode: 0o644},
+		}, map[string]string{"file": "hello"}))
+	}
+
+	type entry struct {
+		Name     string
+		Typeflag byte
+		Linkname string
+		Content  string
+	}
+	readEntries := func(t *testing.T, r io.Reader) []entry {
+		t.Helper()
+		var entries []entry
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				return entries
+			}
+			assert.NilError(t, err)
+			content, err := io.ReadAll(tr)
+			assert.NilError(t, err)
+			entries = append(entries, entry{Name: hdr.Name, Typeflag: hdr.Typeflag, Linkname: hdr.Linkname, Content: string(content)})
+		}
+	}
+
+	t.Run("replaced target", func(t *testing.T) {
+		rdr := ReplaceFileTarWrapper(newArchive(), map[string]TarModifierFunc{
+			"file": func(_ string, hdr *tar.Header, _ io.Reader) (*tar.Header, []byte, error) {
+				return hdr, []byte("replaced"), nil
+			},
+		})
+		defer rdr.Close()
+
+		var out bytes.Buffer
+		assert.NilError(t, ResolveHardlinks(rdr, &out, nil))
+		assert.Check(t, is.DeepEqual(readEntries(t, &out), []entry{
+			{Name: "file", Typeflag: tar.TypeReg, Content: "replaced"},
+			{Name: "link1", Typeflag: tar.TypeLink, Linkname: "file"},
+			{Name: "link2", Typeflag: tar.TypeLink, Linkname: "file"},
+		}))
+	})
+
+	// ReplaceFileTarWrapper consumes the modifiers it applied.
+	removeFile := func() map[string]TarModifierFunc {
+		return map[string]TarModifierFunc{
+			"file": func(string, *tar.Header, io.Reader) (*tar.Header, []byte, error) {
+				return nil, nil, nil
+			},
+		}
+	}
+
+	t.Run("removed target", func(t *testing.T) {
+		rdr := ReplaceFileTarWrapper(newArchive(), removeFile())
+		defer rdr.Close()
+
+		var resolved []string
+		var out bytes.Buffer
+		err := ResolveHardlinks(rdr, &out, func(target string) ([]byte, error) {
+			resolved = append(resolved, target)
+			return []byte("resolved"), nil
+		})
+		assert.NilError(t, err)
+		assert.Check(t, is.DeepEqual(resolved, []string{"file"}))
+		assert.Check(t, is.DeepEqual(readEntries(t, &out), []entry{
+			{Name: "link1", Typeflag: tar.TypeReg, Content: "resolved"},
+			{Name: "link2", Typeflag: tar.TypeLink, Linkname: "link1"},
+		}))
+	})
+
+	t.Run("removed target without resolver", func(t *testing.T) {
+		rdr := ReplaceFileTarWrapper(newArchive(), removeFile())
+		defer rdr.Close()
+
+		err := ResolveHardlinks(rdr, io.Discard, nil)
+		assert.Check(t, is.ErrorContains(err, `hardlink "link1" points to "file"`))
+	})
+
+	t.Run("resolver error", func(t *testing.T) {
+		rdr := ReplaceFileTarWrapper(newArchive(), removeFile())
+		defer rdr.Close()
+
+		errNotFound := errors.New("not found")
+		err := ResolveHardlinks(rdr, io.Discard, func(string) ([]byte, error) {
+			return nil, errNotFound
+		})
+		assert.Check(t, is.ErrorIs(err, errNotFound))
+	})
+}
@@ -0,0 +1,292 @@
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/go-archive/compression"
+)
+
+// ValidateArchive reads the (possibly compressed) archive from r, and checks
+// whether it can be extracted safely by [Untar] with the given options,
+// without writing to the filesystem. It returns an error describing the first
+// entry that would be rejected, or nil if there is none.
+//
+// The entries are checked for names and hardlink targets that escape the
+// destination, including through symlinks created by earlier entries, for
+// unsupported entry types, and against the extraction limits set in options.
+// Entries are excluded, stripped, and checked for case collisions as set in
+// options, as by Untar.
+// MaxPathLength is checked against the length of the entry name, as there is
+// no destination directory. Files that already exist in the destination are
+// not taken into account, so extracting an archive that passes validation can
+// still fail, for example because of NoOverwriteDirNonDir.
+func ValidateArchive(r io.Reader, options *TarOptions) error {
+	if options == nil {
+		options = &TarOptions{}
+	}
+	decompressed, err := compression.DecompressStreamWithDicts(r, compressionDicts(options)...)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = decompressed.Close() }()
+
+	xr, err := newExtractReader(decompressed, "", options)
+	if err != nil {
+		return err
+	}
+	// Validating does not report the global headers.
+	xr.onGlobalHeader = nil
+
+	tree := &archiveTree{}
+	for {
+		hdr, err := xr.next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			xr.written += hdr.Size
+		}
+		if err := tree.add(hdr); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveTree tracks the symlinks created by the entries of an archive, to
+// resolve paths within the archive as [os.Root] does when extracting it.
+//
+// The symlinks are kept in a tree of path components, so that an entry
+// replacing a directory drops the symlinks below it without scanning all
+// symlinks.
+type archiveTree struct {
+	root archiveNode
+}
+
+// archiveNode is a path in an archiveTree: a symlink, or a directory that
+// contains symlinks.
+type archiveNode struct {
+	symlink  bool
+	target   string
+	children map[string]*archiveNode
+}
+
+// child returns the node of the entry name in n, or nil if there is none.
+func (n *archiveNode) child(name string) *archiveNode {
+	if n == nil {
+		return nil
+	}
+	return n.children[name]
+}
+
+// add checks whether hdr, which must have a cleaned name, can be extracted
+// within the root, and records it.
+func (t *archiveTree) add(hdr *tar.Header) error {
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeDir, tar.TypeBlock, tar.TypeChar, tar.TypeFifo, tar.TypeSymlink:
+	case tar.TypeLink:
+		linkname := path.Clean(hdr.Linkname)
+		if linkname == "." || !filepath.IsLocal(linkname) || isWindowsAbs(linkname) {
+			return breakoutError(fmt.Errorf("invalid hardlink target %q", hdr.Linkname))
+		}
+		if _, err := t.resolve(linkname); err != nil {
+			return breakoutError(fmt.Errorf("invalid hardlink target %q of %q: %w", hdr.Linkname, hdr.Name, err))
+		}
+	default:
+		return unsupportedTypeflagError(hdr)
+	}
+
+	p, err := t.resolve(hdr.Name)
+	if err != nil {
+		return breakoutError(fmt.Errorf("invalid entry %q: %w", hdr.Name, err))
+	}
+
+	dir, name := &t.root, p[len(p)-1]
+	for _, part := range p[:len(p)-1] {
+		child := dir.child(part)
+		if child == nil {
+			if hdr.Typeflag != tar.TypeSymlink {
+				// There are no symlinks to replace.
+				return nil
+			}
+			if dir.children == nil {
+				dir.children = make(map[string]*archiveNode)
+			}
+			child = &archiveNode{}
+			dir.children[part] = child
+		}
+		dir = child
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		// A directory is merged with an existing directory, but replaces
+		// anything else.
+		if child := dir.child(name); child != nil && child.symlink {
+			delete(dir.children, name)
+		}
+	case tar.TypeSymlink:
+		if dir.children == nil {
+			dir.children = make(map[string]*archiveNode)
+		}
+		dir.children[name] = &archiveNode{symlink: true, target: hdr.Linkname}
+	default:
+		// Anything other than a directory replaces the existing path,
+		// including its contents if it is a directory.
+		delete(dir.children, name)
+	}
+	return nil
+}
+
+// resolve returns the components of the path that the cleaned, root-relative
+// path p refers to after following the symlinks in all but its last
+// component, or an error if it escapes the root.
+func (t *archiveTree) resolve(p string) ([]string, error) {
+	var (
+		resolved []string
+		// nodes holds the node of the root and of each resolved component,
+		// which is nil if it contains no symlinks.
+		nodes    = []*archiveNode{&t.root}
+		pending  = strings.Split(p, "/")
+		followed int
+	)
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return nil, errors.New("path escapes from parent")
+			}
+			resolved = resolved[:len(resolved)-1]
+			nodes = nodes[:len(nodes)-1]
+			continue
+		}
+		node := nodes[len(nodes)-1].child(part)
+		if len(pending) == 0 || node == nil || !node.symlink {
+			// The last component is not followed.
+			resolved = append(resolved, part)
+			nodes = append(nodes, node)
+			continue
+		}
+
+		if followed++; followed > maxLinksWalked {
+			return nil, errTooManyLinks
+		}
+		if path.IsAbs(node.target) {
+			return nil, fmt.Errorf("symlink %q to absolute path %q escapes from parent", strings.Join(append(resolved, part), "/"), node.target)
+		}
+		pending = append(strings.Split(node.target, "/"), pending...)
+	}
+	return resolved, nil
+}
+
+// ValidateLayer reads the (possibly compressed) layer from r, and checks that
+// it is consistent, as a layer produced by [ExportChanges] is. It returns an
+// error describing the first inconsistency found, or nil if there is none.
+//
+// A layer is inconsistent if it contains several entries with the same name,
+// if a hardlink does not point to a file added by an earlier entry, or if a
+// whiteout removes a path that is added by the layer, or that contains a path
+// added by the layer, as the result of applying the layer then depends on the
+// order of its entries. Opaque directory markers do not conflict with the
+// entries added to the directory. The layer is checked as it is read, and
+// only the names of its entries are kept in memory.
+//
+// ValidateLayer does not check whether the layer can be extracted safely;
+// use [ValidateArchive] for that.
+func ValidateLayer(r io.Reader) error {
+	decompressed, err := compression.DecompressStream(r)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = decompressed.Close() }()
+
+	var (
+		tr = tar.NewReader(decompressed)
+		// names holds the names of all entries, to find duplicates.
+		names = make(map[string]struct{})
+		// added maps the names of the entries that are not whiteouts to
+		// their type, and addedParents holds their parent directories.
+		added        = make(map[string]byte)
+		addedParents = make(map[string]struct{})
+		// removed holds the paths removed by whiteouts.
+		removed = make(map[string]string)
+	)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			continue
+		}
+		if _, ok := names[name]; ok {
+			return fmt.Errorf("duplicate entry %q in layer", hdr.Name)
+		}
+		names[name] = struct{}{}
+
+		if base, opaque, ok := IsWhiteout(name); ok {
+			if opaque {
+				continue
+			}
+			p := path.Join(path.Dir(name), base)
+			if _, ok := added[p]; ok {
+				return fmt.Errorf("whiteout %q removes %q, which is added by the same layer", hdr.Name, p)
+			}
+			if _, ok := addedParents[p]; ok {
+				return fmt.Errorf("whiteout %q removes %q, which contains entries added by the same layer", hdr.Name, p)
+			}
+			removed[p] = hdr.Name
+			continue
+		}
+
+		for p := name; p != "."; p = path.Dir(p) {
+			whiteout, ok := removed[p]
+			if !ok {
+				continue
+			}
+			if p == name {
+				return fmt.Errorf("entry %q is removed by whiteout %q in the same layer", hdr.Name, whiteout)
+			}
+			return fmt.Errorf("entry %q is added to %q, which is removed by whiteout %q in the same layer", hdr.Name, p, whiteout)
+		}
+
+		if hdr.Typeflag == tar.TypeLink {
+			target, err := cleanEntryName(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			switch typeflag, ok := added[target]; {
+			case !ok:
+				return fmt.Errorf("hardlink %q points to %q, which is not an earlier entry of the layer", hdr.Name, hdr.Linkname)
+			case typeflag == tar.TypeDir:
+				return fmt.Errorf("hardlink %q points to directory %q", hdr.Name, hdr.Linkname)
+			}
+		}
+
+		added[name] = hdr.Typeflag
+		for p := path.Dir(name); p != "."; p = path.Dir(p) {
+			addedParents[p] = struct{}{}
+		}
+	}
+}
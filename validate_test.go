@@ -0,0 +1,330 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+
+	"github.com/moby/go-archive/compression"
+)
+
+func TestValidateArchive(t *testing.T) {
+	tests := []struct {
+		doc         string
+		headers     []*tar.Header
+		options     *TarOptions
+		expectedErr string
+		breakout    bool
+	}{
+		{
+			doc: "valid",
+			headers: []*tar.Header{
+				{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+				{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644},
+				{Name: "dir/hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file"},
+				{Name: "dir/symlink", Typeflag: tar.TypeSymlink, Linkname: "../etc/passwd"},
+				{Name: "abs-symlink", Typeflag: tar.TypeSymlink, Linkname: "/usr/lib"},
+				{Name: "link-to-dir", Typeflag: tar.TypeSymlink, Linkname: "dir"},
+				{Name: "link-to-dir/file2", Typeflag: tar.TypeReg, Mode: 0o644},
+				{Name: "/abs/file", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+		},
+		{
+			doc:         "dotdot name",
+			headers:     []*tar.Header{{Name: "../victim/dotdot", Typeflag: tar.TypeReg, Mode: 0o644}},
+			expectedErr: `invalid entry name "../victim/dotdot"`,
+			breakout:    true,
+		},
+		{
+			doc:         "slash dotdot name",
+			headers:     []*tar.Header{{Name: "/../victim/slash-dotdot", Typeflag: tar.TypeReg, Mode: 0o644}},
+			expectedErr: `invalid entry name "/../victim/slash-dotdot"`,
+			breakout:    true,
+		},
+		{
+			doc:         "dotdot hardlink",
+			headers:     []*tar.Header{{Name: "dotdot", Typeflag: tar.TypeLink, Linkname: "../victim/hello"}},
+			expectedErr: `invalid hardlink target "../victim/hello"`,
+			breakout:    true,
+		},
+		{
+			doc: "write through symlink",
+			headers: []*tar.Header{
+				{Name: "loophole-victim", Typeflag: tar.TypeSymlink, Linkname: "../victim"},
+				{Name: "loophole-victim/file", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+			expectedErr: `invalid entry "loophole-victim/file": path escapes from parent`,
+			breakout:    true,
+		},
+		{
+			doc: "write through nested symlink",
+			headers: []*tar.Header{
+				{Name: "dir/loophole", Typeflag: tar.TypeSymlink, Linkname: "../../victim"},
+				{Name: "dir/loophole/newdir/newfile", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+			expectedErr: `invalid entry "dir/loophole/newdir/newfile": path escapes from parent`,
+			breakout:    true,
+		},
+		{
+			doc: "write through absolute symlink",
+			headers: []*tar.Header{
+				{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+				{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+			expectedErr: `invalid entry "etc/passwd": symlink "etc" to absolute path "/etc" escapes from parent`,
+			breakout:    true,
+		},
+		{
+			doc: "hardlink through symlink",
+			headers: []*tar.Header{
+				{Name: "loophole-victim", Typeflag: tar.TypeSymlink, Linkname: "../victim"},
+				{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "loophole-victim/hello"},
+			},
+			expectedErr: `invalid hardlink target "loophole-victim/hello" of "hardlink": path escapes from parent`,
+			breakout:    true,
+		},
+		{
+			doc: "replaced symlinks",
+			headers: []*tar.Header{
+				{Name: "loophole", Typeflag: tar.TypeSymlink, Linkname: "../victim"},
+				{Name: "loophole", Typeflag: tar.TypeReg, Mode: 0o644},
+				{Name: "other", Typeflag: tar.TypeSymlink, Linkname: "/"},
+				{Name: "other", Typeflag: tar.TypeSymlink, Linkname: "dir"},
+				{Name: "other/file", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+		},
+		{
+			doc: "symlink loop",
+			headers: []*tar.Header{
+				{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "b"},
+				{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a"},
+				{Name: "a/file", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+			expectedErr: `invalid entry "a/file": too many links`,
+			breakout:    true,
+		},
+		{
+			doc:         "unsupported type",
+			headers:     []*tar.Header{{Name: "contiguous", Typeflag: tar.TypeCont, Mode: 0o644}},
+			expectedErr: `unsupported tar header type 55 for "contiguous"`,
+		},
+		{
+			doc: "max entries",
+			headers: []*tar.Header{
+				{Name: "a", Typeflag: tar.TypeReg, Mode: 0o644},
+				{Name: "b", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+			options:     &TarOptions{MaxEntries: 1},
+			expectedErr: "archive contains more than 1 entries: extraction limit exceeded",
+		},
+		{
+			doc:     "excluded",
+			headers: []*tar.Header{{Name: "contiguous", Typeflag: tar.TypeCont, Mode: 0o644}},
+			options: &TarOptions{ExcludePatterns: []string{"contiguous"}},
+		},
+		{
+			doc: "replaced directory with symlinks",
+			headers: []*tar.Header{
+				{Name: "dir/sub/loophole", Typeflag: tar.TypeSymlink, Linkname: "../../../victim"},
+				{Name: "dir", Typeflag: tar.TypeReg, Mode: 0o644},
+				{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+				{Name: "dir/sub/loophole/file", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+		},
+		{
+			doc: "symlink replaced by directory",
+			headers: []*tar.Header{
+				{Name: "loophole", Typeflag: tar.TypeSymlink, Linkname: "../victim"},
+				{Name: "loophole/", Typeflag: tar.TypeDir, Mode: 0o755},
+				{Name: "loophole/file", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+		},
+		{
+			doc: "stripped components",
+			headers: []*tar.Header{
+				{Name: "top/loophole", Typeflag: tar.TypeSymlink, Linkname: "../../victim"},
+				{Name: "top/loophole/file", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+			options:     &TarOptions{StripComponents: 1},
+			expectedErr: `invalid entry "loophole/file": path escapes from parent`,
+			breakout:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.doc, func(t *testing.T) {
+			archive := buildTestArchive(t, tc.headers, nil)
+			err := ValidateArchive(archive, tc.options)
+			if tc.expectedErr == "" {
+				assert.NilError(t, err)
+				return
+			}
+			assert.Check(t, is.Error(err, tc.expectedErr))
+			var boErr *breakoutErr
+			assert.Check(t, is.Equal(errors.As(err, &boErr), tc.breakout))
+		})
+	}
+}
+
+func TestValidateArchiveScales(t *testing.T) {
+	// An archive with n symlinks followed by n files replacing them.
+	validate := func(n int) time.Duration {
+		var headers []*tar.Header
+		for i := range n {
+			headers = append(headers, &tar.Header{Name: fmt.Sprintf("link%d", i), Typeflag: tar.TypeSymlink, Linkname: "target"})
+		}
+		for i := range n {
+			headers = append(headers, &tar.Header{Name: fmt.Sprintf("link%d", i), Typeflag: tar.TypeReg, Mode: 0o644})
+		}
+		archive := buildTestArchive(t, headers, nil).Bytes()
+
+		// Use the fastest of a few runs to reduce noise.
+		var fastest time.Duration
+		for range 3 {
+			start := time.Now()
+			assert.NilError(t, ValidateArchive(bytes.NewReader(archive), nil))
+			if d := time.Since(start); fastest == 0 || d < fastest {
+				fastest = d
+			}
+		}
+		return fastest
+	}
+
+	// Validation takes linear time, so it takes about 8 times longer for
+	// 8 times as many entries. A quadratic validation would take 64 times
+	// longer.
+	small, large := validate(2_000), validate(16_000)
+	assert.Check(t, large < 32*small, "validating 8 times as many entries took %s instead of %s", large, small)
+}
+
+func TestValidateArchiveCompressed(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, nil)
+
+	var buf bytes.Buffer
+	w, err := compression.CompressStream(&buf, compression.Gzip)
+	assert.NilError(t, err)
+	_, err = w.Write(archive.Bytes())
+	assert.NilError(t, err)
+	assert.NilError(t, w.Close())
+
+	err = ValidateArchive(&buf, nil)
+	assert.Check(t, is.Error(err, `invalid entry name "../escape"`))
+}
+
+func TestValidateLayer(t *testing.T) {
+	tests := []struct {
+		doc         string
+		headers     []*tar.Header
+		expectedErr string
+	}{
+		{
+			doc: "valid",
+			headers: []*tar.Header{
+				{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+				{Name: "dir/" + WhiteoutOpaqueDir, Typeflag: tar.TypeReg, Mode: 0o600},
+				{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644},
+				{Name: "dir/hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file"},
+				{Name: "dir/" + WhiteoutPrefix + "removed", Typeflag: tar.TypeReg, Mode: 0o600},
+				{Name: WhiteoutPrefix + "other", Typeflag: tar.TypeReg, Mode: 0o600},
+			},
+		},
+		{
+			doc: "duplicate entry",
+			headers: []*tar.Header{
+				{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+				{Name: "./file", Typeflag: tar.TypeReg, Mode: 0o600},
+			},
+			expectedErr: `duplicate entry "./file" in layer`,
+		},
+		{
+			doc: "duplicate whiteout",
+			headers: []*tar.Header{
+				{Name: WhiteoutPrefix + "file", Typeflag: tar.TypeReg, Mode: 0o600},
+				{Name: WhiteoutPrefix + "file", Typeflag: tar.TypeReg, Mode: 0o600},
+			},
+			expectedErr: `duplicate entry ".wh.file" in layer`,
+		},
+		{
+			doc: "hardlink before target",
+			headers: []*tar.Header{
+				{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "file"},
+				{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+			expectedErr: `hardlink "hardlink" points to "file", which is not an earlier entry of the layer`,
+		},
+		{
+			doc: "hardlink to missing target",
+			headers: []*tar.Header{
+				{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "missing"},
+			},
+			expectedErr: `hardlink "hardlink" points to "missing", which is not an earlier entry of the layer`,
+		},
+		{
+			doc: "hardlink to whiteout",
+			headers: []*tar.Header{
+				{Name: WhiteoutPrefix + "file", Typeflag: tar.TypeReg, Mode: 0o600},
+				{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: WhiteoutPrefix + "file"},
+			},
+			expectedErr: `hardlink "hardlink" points to ".wh.file", which is not an earlier entry of the layer`,
+		},
+		{
+			doc: "hardlink to directory",
+			headers: []*tar.Header{
+				{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+				{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "dir/"},
+			},
+			expectedErr: `hardlink "hardlink" points to directory "dir/"`,
+		},
+		{
+			doc: "whiteout of added file",
+			headers: []*tar.Header{
+				{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644},
+				{Name: "dir/" + WhiteoutPrefix + "file", Typeflag: tar.TypeReg, Mode: 0o600},
+			},
+			expectedErr: `whiteout "dir/.wh.file" removes "dir/file", which is added by the same layer`,
+		},
+		{
+			doc: "whiteout of directory with added file",
+			headers: []*tar.Header{
+				{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644},
+				{Name: WhiteoutPrefix + "dir", Typeflag: tar.TypeReg, Mode: 0o600},
+			},
+			expectedErr: `whiteout ".wh.dir" removes "dir", which contains entries added by the same layer`,
+		},
+		{
+			doc: "file added after whiteout",
+			headers: []*tar.Header{
+				{Name: WhiteoutPrefix + "file", Typeflag: tar.TypeReg, Mode: 0o600},
+				{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+			expectedErr: `entry "file" is removed by whiteout ".wh.file" in the same layer`,
+		},
+		{
+			doc: "file added to removed directory",
+			headers: []*tar.Header{
+				{Name: WhiteoutPrefix + "dir", Typeflag: tar.TypeReg, Mode: 0o600},
+				{Name: "dir/sub/file", Typeflag: tar.TypeReg, Mode: 0o644},
+			},
+			expectedErr: `entry "dir/sub/file" is added to "dir", which is removed by whiteout ".wh.dir" in the same layer`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.doc, func(t *testing.T) {
+			err := ValidateLayer(buildTestArchive(t, tc.headers, nil))
+			if tc.expectedErr == "" {
+				assert.NilError(t, err)
+				return
+			}
+			assert.Check(t, is.Error(err, tc.expectedErr))
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/containerd/log"
+
+	"github.com/moby/go-archive/compression"
+)
+
+// WalkFunc is the type of the function called by [Walk] for each entry in the
+// archive. The content reader returns the content of the entry, and is only
+// valid until WalkFunc returns; any unread content is discarded before moving
+// to the next entry.
+//
+// If the function returns [fs.SkipAll], Walk stops reading the archive and
+// returns nil. Any other error aborts the walk and is returned by Walk.
+type WalkFunc func(hdr *tar.Header, content io.Reader) error
+
+// errEntryClosed is returned when reading the content of an entry after
+// the WalkFunc it was passed to returned.
+var errEntryClosed = errors.New("read of archive entry after WalkFunc returned")
+
+// entryReader wraps the content of a single archive entry, and is invalidated
+// once the WalkFunc it was passed to returns.
+type entryReader struct {
+	r io.Reader
+}
+
+func (e *entryReader) Read(p []byte) (int, error) {
+	if e.r == nil {
+		return 0, errEntryClosed
+	}
+	return e.r.Read(p)
+}
+
+// Walk reads the (possibly compressed) archive from r, and calls fn for each
+// entry in the archive, in the order in which they appear. Compression is
+// detected automatically. PAX Global Extended Headers are skipped, the same
+// as [Untar] does.
+//
+// Walk does not write to the filesystem, and can be used to inspect the
+// contents of an archive without extracting it.
+func Walk(r io.Reader, fn WalkFunc) error {
+	decompressed, err := compression.DecompressStream(r)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = decompressed.Close() }()
+
+	return walkUncompressed(decompressed, fn)
+}
+
+func walkUncompressed(r io.Reader, fn WalkFunc) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			log.G(context.TODO()).Debugf("PAX Global Extended Headers found for %s and ignored", hdr.Name)
+			continue
+		}
+
+		content := &entryReader{r: tr}
+		err = fn(hdr, content)
+		content.r = nil
+		if err != nil {
+			if errors.Is(err, fs.SkipAll) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// ListArchive reads the (possibly compressed) archive from r, and returns the
+// headers of all entries in the archive without extracting them. Entry names
+// are normalized the same way as [Untar] does, so they match the paths
+// produced by extraction. Entries referring to the root of the archive are
+// omitted, and, as for Untar, an error is returned if an entry name escapes
+// the root, such as "../file" or `C:\file`.
+//
+// Content of entries is skipped, and not kept in memory.
+func ListArchive(r io.Reader) ([]tar.Header, error) {
+	var headers []tar.Header
+	err := Walk(r, func(hdr *tar.Header, _ io.Reader) error {
+		name, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		hdr.Name = name
+		headers = append(headers, *hdr)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// UncompressedSize reads the (possibly compressed) archive from r, and returns
+// the total size of the content of the regular files in the archive, as
+// reported by their headers. Hardlinks, and other entries without content, are
+// not counted. The archive is streamed, and not written to disk.
+func UncompressedSize(r io.Reader) (int64, error) {
+	var size int64
+	err := Walk(r, func(hdr *tar.Header, _ io.Reader) error {
+		if hdr.Typeflag == tar.TypeReg {
+			size += hdr.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// UncompressedArchiveSize is like [UncompressedSize], but returns the size of
+// the uncompressed tar stream: the content of every entry rounded up to the
+// tar block size of 512 bytes, and the header blocks of every entry,
+// including PAX and GNU extension headers and PAX Global Extended Headers,
+// and the end-of-archive marker. Padding after the end-of-archive marker is
+// not counted.
+func UncompressedArchiveSize(r io.Reader) (int64, error) {
+	decompressed, err := compression.DecompressStream(r)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = decompressed.Close() }()
+
+	// The tar reader reads the headers, the content and its padding, and the
+	// end-of-archive marker from cr, and nothing beyond.
+	cr := &countingReader{Reader: decompressed}
+	tr := tar.NewReader(cr)
+	for {
+		_, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return cr.n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// ExtractFile reads the (possibly compressed) archive from r, and returns the
+// content and header of the entry with the given name, without extracting the
+// archive. Names are compared after normalizing them the same way as [Untar]
+// does, so "/dir/file", "./dir/file", and "dir/file" all match the same entry.
+// Reading stops at the first matching entry; if the archive contains multiple
+// entries with the name, Untar extracts the last one instead.
+//
+// The content is read into memory. Entries other than regular files have no
+// content. If the archive has no entry with the name, an error matching
+// [fs.ErrNotExist] is returned. As for Untar, an error is returned if name,
+// or the name of an entry before the matching one, escapes the root.
+func ExtractFile(r io.Reader, name string) ([]byte, *tar.Header, error) {
+	name, err := cleanEntryName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		content []byte
+		found   *tar.Header
+	)
+	err = Walk(r, func(hdr *tar.Header, entry io.Reader) error {
+		entryName, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if entryName != name {
+			return nil
+		}
+		content, err = io.ReadAll(entry)
+		if err != nil {
+			return err
+		}
+		found = hdr
+		return fs.SkipAll
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if found == nil {
+		return nil, nil, fmt.Errorf("%q not found in archive: %w", name, fs.ErrNotExist)
+	}
+	return content, found, nil
+}
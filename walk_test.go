@@ -0,0 +1,280 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestWalk(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "hello"}},
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file"},
+		{Name: "other", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{
+		"dir/file": "hello world",
+		"other":    "unread",
+	})
+
+	// Compress the archive to verify compression is detected.
+	compressed := &bytes.Buffer{}
+	gw := gzip.NewWriter(compressed)
+	_, err := io.Copy(gw, archive)
+	assert.NilError(t, err)
+	assert.NilError(t, gw.Close())
+
+	var names []string
+	contents := map[string]string{}
+	err = Walk(compressed, func(hdr *tar.Header, content io.Reader) error {
+		names = append(names, hdr.Name)
+		if hdr.Name == "dir/file" {
+			b, err := io.ReadAll(content)
+			if err != nil {
+				return err
+			}
+			contents[hdr.Name] = string(b)
+		}
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(names, []string{"dir/", "dir/file", "dir/link", "other"}))
+	assert.Check(t, is.DeepEqual(contents, map[string]string{"dir/file": "hello world"}))
+}
+
+func TestWalkStop(t *testing.T) {
+	newArchive := func() io.Reader {
+		return buildTestArchive(t, []*tar.Header{
+			{Name: "a", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "b", Typeflag: tar.TypeReg, Mode: 0o644},
+		}, map[string]string{"a": "a", "b": "b"})
+	}
+
+	var calls int
+	err := Walk(newArchive(), func(*tar.Header, io.Reader) error {
+		calls++
+		return fs.SkipAll
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(calls, 1))
+
+	errStop := errors.New("stop")
+	err = Walk(newArchive(), func(*tar.Header, io.Reader) error {
+		return errStop
+	})
+	assert.Check(t, is.ErrorIs(err, errStop))
+}
+
+func TestWalkContentInvalidAfterReturn(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "a", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"a": "hello"})
+
+	var saved io.Reader
+	err := Walk(archive, func(_ *tar.Header, content io.Reader) error {
+		saved = content
+		return nil
+	})
+	assert.NilError(t, err)
+	_, err = saved.Read(make([]byte, 1))
+	assert.Check(t, is.ErrorIs(err, errEntryClosed))
+}
+
+func TestListArchive(t *testing.T) {
+	longName := strings.Repeat("a", 150) + "/file"
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "hello"}},
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "/dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file"},
+		{Name: longName, Typeflag: tar.TypeReg, Mode: 0o600, Format: tar.FormatGNU},
+	}, map[string]string{
+		"dir/file": "hello world",
+		longName:   "long",
+	})
+
+	headers, err := ListArchive(archive)
+	assert.NilError(t, err)
+
+	type entry struct {
+		Name     string
+		Size     int64
+		Mode     int64
+		Linkname string
+	}
+	var actual []entry
+	for _, hdr := range headers {
+		actual = append(actual, entry{Name: hdr.Name, Size: hdr.Size, Mode: hdr.Mode, Linkname: hdr.Linkname})
+	}
+	assert.Check(t, is.DeepEqual(actual, []entry{
+		{Name: "dir", Mode: 0o755},
+		{Name: "dir/file", Size: 11, Mode: 0o644},
+		{Name: "dir/link", Linkname: "file"},
+		{Name: longName, Size: 4, Mode: 0o600},
+	}))
+}
+
+func TestListArchiveInvalidNames(t *testing.T) {
+	for _, name := range []string{"../escape", "dir/../../escape", `C:\escape`, `\\host\share\escape`} {
+		t.Run(name, func(t *testing.T) {
+			archive := buildTestArchive(t, []*tar.Header{
+				{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+				{Name: name, Typeflag: tar.TypeReg, Mode: 0o644},
+			}, nil)
+			_, err := ListArchive(archive)
+			var boErr *breakoutErr
+			assert.Check(t, errors.As(err, &boErr), "expected a breakout error, got %v", err)
+		})
+	}
+}
+
+func TestUncompressedSize(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "dir/hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file"},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file"},
+		{Name: "other", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{
+		"dir/file": "hello world",
+		"other":    "more",
+	})
+
+	compressed := &bytes.Buffer{}
+	gw := gzip.NewWriter(compressed)
+	_, err := io.Copy(gw, archive)
+	assert.NilError(t, err)
+	assert.NilError(t, gw.Close())
+
+	size, err := UncompressedSize(compressed)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(size, int64(15)))
+}
+
+func TestUncompressedSizeLarge(t *testing.T) {
+	// Sizes over 8GiB do not fit the ustar header, and are stored in a PAX
+	// record. Generate the content instead of buffering it.
+	const fileSize = 8<<30 + 1
+	var hdr bytes.Buffer
+	tw := tar.NewWriter(&hdr)
+	assert.NilError(t, tw.WriteHeader(&tar.Header{Name: "large", Typeflag: tar.TypeReg, Mode: 0o644, Size: fileSize}))
+	archive := io.MultiReader(
+		&hdr,
+		io.LimitReader(zeroReader{}, fileSize+(-fileSize&(blockSize-1))),
+		bytes.NewReader(make([]byte, 2*blockSize)),
+	)
+
+	size, err := UncompressedSize(archive)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(size, int64(fileSize)))
+}
+
+func TestUncompressedArchiveSize(t *testing.T) {
+	archive := buildTestArchive(t, []*tar.Header{
+		{Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "hello"}},
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: strings.Repeat("d", 120) + "/file", Typeflag: tar.TypeReg, Mode: 0o644, Format: tar.FormatGNU},
+		{Name: "dir/hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file"},
+		{Name: "other", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{
+		"dir/file": "hello world",
+		"other":    strings.Repeat("a", 1000),
+	})
+	expected := int64(archive.Len())
+
+	compressed := &bytes.Buffer{}
+	gw := gzip.NewWriter(compressed)
+	_, err := io.Copy(gw, archive)
+	assert.NilError(t, err)
+	assert.NilError(t, gw.Close())
+
+	size, err := UncompressedArchiveSize(compressed)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(size, expected))
+}
+
+func TestUncompressedSizeInvalid(t *testing.T) {
+	_, err := UncompressedSize(strings.NewReader(strings.Repeat("x", 1024)))
+	assert.Check(t, err != nil)
+}
+
+func TestExtractFile(t *testing.T) {
+	longName := strings.Repeat("d", 120) + "/file"
+	archive := buildTestArchive(t, []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "./dir/target", Typeflag: tar.TypeReg, Mode: 0o600, Uname: "someone"},
+		{Name: longName, Typeflag: tar.TypeReg, Mode: 0o644, Format: tar.FormatGNU},
+		{Name: "large", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{
+		"dir/file":     "other",
+		"./dir/target": "hello world",
+		longName:       "long",
+		"large":        strings.Repeat("a", 1<<20),
+	}).Bytes()
+
+	t.Run("found", func(t *testing.T) {
+		r := &countingReader{Reader: bytes.NewReader(archive)}
+		content, hdr, err := ExtractFile(r, "/dir/target")
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(string(content), "hello world"))
+		assert.Check(t, is.Equal(hdr.Name, "./dir/target"))
+		assert.Check(t, is.Equal(hdr.Uname, "someone"))
+		assert.Check(t, r.n < int64(len(archive))/2, "archive was read past the entry: %d of %d bytes", r.n, len(archive))
+	})
+
+	t.Run("long name compressed", func(t *testing.T) {
+		compressed := &bytes.Buffer{}
+		gw := gzip.NewWriter(compressed)
+		_, err := gw.Write(archive)
+		assert.NilError(t, err)
+		assert.NilError(t, gw.Close())
+
+		content, hdr, err := ExtractFile(compressed, longName)
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(string(content), "long"))
+		assert.Check(t, is.Equal(hdr.Name, longName))
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		content, hdr, err := ExtractFile(bytes.NewReader(archive), "dir")
+		assert.NilError(t, err)
+		assert.Check(t, is.Len(content, 0))
+		assert.Check(t, is.Equal(hdr.Typeflag, byte(tar.TypeDir)))
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, _, err := ExtractFile(bytes.NewReader(archive), "dir/missing")
+		assert.Check(t, is.ErrorIs(err, fs.ErrNotExist))
+		assert.Check(t, is.Error(err, `"dir/missing" not found in archive: file does not exist`))
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		for _, name := range []string{"../dir/file", `C:\dir\file`} {
+			_, _, err := ExtractFile(bytes.NewReader(archive), name)
+			var boErr *breakoutErr
+			assert.Check(t, errors.As(err, &boErr), "expected a breakout error for %q, got %v", name, err)
+		}
+	})
+
+	t.Run("invalid entry name", func(t *testing.T) {
+		invalid := buildTestArchive(t, []*tar.Header{
+			{Name: "../file", Typeflag: tar.TypeReg, Mode: 0o644},
+			{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644},
+		}, map[string]string{"../file": "outside", "file": "inside"})
+		_, _, err := ExtractFile(invalid, "file")
+		var boErr *breakoutErr
+		assert.Check(t, errors.As(err, &boErr), "expected a breakout error, got %v", err)
+	})
+}
@@ -1,5 +1,10 @@
 package archive
 
+import (
+	"path"
+	"strings"
+)
+
 // Whiteouts are files with a special meaning for the layered filesystem.
 // Docker uses AUFS whiteout files inside exported archives. In other
 // filesystems these files are generated/handled on tar creation/extraction.
@@ -21,3 +26,26 @@
 // WhiteoutOpaqueDir file means directory has been made opaque - meaning
 // readdir calls to this directory do not follow to lower layers.
 const WhiteoutOpaqueDir = WhiteoutMetaPrefix + ".opq"
+
+// IsWhiteout reports whether the archive entry name is a whiteout, as
+// interpreted by [UnpackLayer]. If name is a whiteout for a file that was
+// removed, base is the name of that file, which is in the same directory as
+// the whiteout. If name is the [WhiteoutOpaqueDir] file of a directory that
+// was made opaque, base is empty and opaque is true.
+//
+// Entries in the root directory starting with [WhiteoutMetaPrefix], other
+// than [WhiteoutOpaqueDir], are AUFS metadata, and not whiteouts.
+func IsWhiteout(name string) (base string, opaque bool, ok bool) {
+	name = path.Clean(strings.TrimLeft(name, "/"))
+	if strings.HasPrefix(name, WhiteoutMetaPrefix) && name != WhiteoutOpaqueDir {
+		return "", false, false
+	}
+	b := path.Base(name)
+	if b == WhiteoutOpaqueDir {
+		return "", true, true
+	}
+	if base, ok := strings.CutPrefix(b, WhiteoutPrefix); ok {
+		return base, false, true
+	}
+	return "", false, false
+}
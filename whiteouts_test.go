@@ -0,0 +1,39 @@
+package archive
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestIsWhiteout(t *testing.T) {
+	tests := []struct {
+		name   string
+		base   string
+		opaque bool
+		ok     bool
+	}{
+		{name: "file"},
+		{name: "dir/file"},
+		{name: "dir/file.wh.foo"},
+		{name: ".wh.foo", base: "foo", ok: true},
+		{name: "/.wh.foo", base: "foo", ok: true},
+		{name: "dir/.wh.foo", base: "foo", ok: true},
+		{name: "dir/sub/.wh.foo.txt", base: "foo.txt", ok: true},
+		{name: ".wh..wh..opq", opaque: true, ok: true},
+		{name: "dir/.wh..wh..opq", opaque: true, ok: true},
+		{name: ".wh..wh.plnk"},
+		{name: ".wh..wh.plnk/123.456"},
+		{name: ".wh..wh.aufs"},
+		{name: "dir/.wh..wh.aufs", base: ".wh.aufs", ok: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			base, opaque, ok := IsWhiteout(tc.name)
+			assert.Check(t, is.Equal(base, tc.base))
+			assert.Check(t, is.Equal(opaque, tc.opaque))
+			assert.Check(t, is.Equal(ok, tc.ok))
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Writer writes a tar archive from entries added programmatically, applying
+// the same conventions as [TarWithOptions]: entry names are made canonical,
+// modes are adjusted for the platform, and headers are written in the PAX
+// format. Parent directories of an entry that were not added before it are
+// written with [ImpliedDirectoryMode], owned by 0:0, matching how Untar
+// creates directories that are missing from an archive.
+//
+// The archive is not complete until [Writer.Close] is called.
+type Writer struct {
+	tw *tar.Writer
+
+	// dirs holds the names of the directories written, without trailing
+	// slash.
+	dirs map[string]struct{}
+}
+
+// NewWriter returns a [Writer] that writes an uncompressed tar archive to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		tw:   tar.NewWriter(w),
+		dirs: make(map[string]struct{}),
+	}
+}
+
+// AddFile adds a regular file with the given name, and the content read from
+// r. If hdr is set, it provides the metadata of the file, such as its mode,
+// ownership, and modification time, and its Name and Typeflag are ignored.
+// If hdr is nil, the file has mode 0o644, is owned by 0:0, and its
+// modification time is the Unix epoch.
+//
+// If hdr is nil, or its Size is zero, r is read into memory to determine the
+// size of the file. Otherwise, r must provide exactly hdr.Size bytes. r may be
+// nil for an empty file.
+func (w *Writer) AddFile(name string, r io.Reader, hdr *tar.Header) error {
+	hdr = newWriterHeader(hdr, tar.TypeReg, 0o644)
+	if r == nil {
+		r = bytes.NewReader(nil)
+	}
+	if hdr.Size == 0 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, r); err != nil {
+			return err
+		}
+		hdr.Size = int64(buf.Len())
+		r = &buf
+	}
+	if err := w.writeHeader(name, hdr); err != nil {
+		return err
+	}
+	return copyWithBuffer(w.tw, r)
+}
+
+// AddDir adds a directory with the given name. If hdr is set, it provides the
+// metadata of the directory, and its Name and Typeflag are ignored. If hdr is
+// nil, the directory has mode 0o755, is owned by 0:0, and its modification
+// time is the Unix epoch.
+func (w *Writer) AddDir(name string, hdr *tar.Header) error {
+	return w.writeHeader(name, newWriterHeader(hdr, tar.TypeDir, 0o755))
+}
+
+// AddSymlink adds a symbolic link with the given name, pointing to target,
+// which is stored as-is. If hdr is set, it provides the metadata of the link,
+// and its Name, Typeflag, and Linkname are ignored. If hdr is nil, the link
+// has mode 0o777, is owned by 0:0, and its modification time is the Unix
+// epoch.
+func (w *Writer) AddSymlink(name, target string, hdr *tar.Header) error {
+	hdr = newWriterHeader(hdr, tar.TypeSymlink, 0o777)
+	hdr.Linkname = target
+	return w.writeHeader(name, hdr)
+}
+
+// Close writes the end of the archive. It does not close the underlying
+// writer.
+func (w *Writer) Close() error {
+	return w.tw.Close()
+}
+
+// newWriterHeader returns a copy of hdr with the given type, or a header
+// with the given type and mode if hdr is nil.
+func newWriterHeader(hdr *tar.Header, typeflag byte, mode int64) *tar.Header {
+	if hdr == nil {
+		return &tar.Header{
+			Typeflag: typeflag,
+			Mode:     mode,
+			ModTime:  time.Unix(0, 0),
+		}
+	}
+	h := *hdr
+	h.Typeflag = typeflag
+	h.Linkname = ""
+	if typeflag != tar.TypeReg {
+		h.Size = 0
+	}
+	return &h
+}
+
+// writeHeader writes hdr for the entry with the given name, preceded by the
+// parent directories of the entry that were not written yet.
+func (w *Writer) writeHeader(name string, hdr *tar.Header) error {
+	cleaned, err := cleanEntryName(name)
+	if err != nil {
+		return err
+	}
+	if cleaned == "." {
+		return fmt.Errorf("invalid entry name %q", name)
+	}
+	name = cleaned
+
+	var parent string
+	for dir := range strings.SplitSeq(path.Dir(name), "/") {
+		if dir == "." {
+			break
+		}
+		parent = path.Join(parent, dir)
+		if _, ok := w.dirs[parent]; ok {
+			continue
+		}
+		if err := w.tw.WriteHeader(&tar.Header{
+			Name:     canonicalTarName(parent, true),
+			Typeflag: tar.TypeDir,
+			Mode:     chmodTarEntry(ImpliedDirectoryMode),
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatPAX,
+		}); err != nil {
+			return err
+		}
+		w.dirs[parent] = struct{}{}
+	}
+
+	isDir := hdr.Typeflag == tar.TypeDir
+	hdr.Name = canonicalTarName(name, isDir)
+	hdr.Mode = chmodTarEntry(hdr.Mode)
+	if hdr.Format == tar.FormatUnknown {
+		hdr.Format = tar.FormatPAX
+	}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if isDir {
+		w.dirs[name] = struct{}{}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	assert.NilError(t, w.AddDir("dir", &tar.Header{Mode: 0o700, Uid: 1000, Gid: 1000}))
+	assert.NilError(t, w.AddFile("dir/sub/file", strings.NewReader("hello"), nil))
+	assert.NilError(t, w.AddFile("./other/file", strings.NewReader("world"), &tar.Header{Mode: 0o600, Size: 5, ModTime: time.Unix(1700000000, 0)}))
+	assert.NilError(t, w.AddFile("empty", nil, nil))
+	assert.NilError(t, w.AddSymlink("dir/link", "sub/file", nil))
+	assert.Check(t, is.ErrorContains(w.AddFile("../escape", nil, nil), "invalid entry name"))
+	assert.Check(t, is.ErrorContains(w.AddDir(".", nil), "invalid entry name"))
+	assert.NilError(t, w.Close())
+
+	headers, err := ListArchive(bytes.NewReader(buf.Bytes()))
+	assert.NilError(t, err)
+
+	type entry struct {
+		Name     string
+		Typeflag byte
+		Mode     int64
+		Size     int64
+		Linkname string
+	}
+	var actual []entry
+	for _, hdr := range headers {
+		actual = append(actual, entry{Name: hdr.Name, Typeflag: hdr.Typeflag, Mode: hdr.Mode, Size: hdr.Size, Linkname: hdr.Linkname})
+	}
+	expected := []entry{
+		{Name: "dir", Typeflag: tar.TypeDir, Mode: chmodTarEntry(0o700)},
+		{Name: "dir/sub", Typeflag: tar.TypeDir, Mode: chmodTarEntry(ImpliedDirectoryMode)},
+		{Name: "dir/sub/file", Typeflag: tar.TypeReg, Mode: chmodTarEntry(0o644), Size: 5},
+		{Name: "other", Typeflag: tar.TypeDir, Mode: chmodTarEntry(ImpliedDirectoryMode)},
+		{Name: "other/file", Typeflag: tar.TypeReg, Mode: chmodTarEntry(0o600), Size: 5},
+		{Name: "empty", Typeflag: tar.TypeReg, Mode: chmodTarEntry(0o644)},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Mode: chmodTarEntry(0o777), Linkname: "sub/file"},
+	}
+	assert.Check(t, is.DeepEqual(actual, expected))
+	assert.Check(t, is.Equal(headers[0].Uid, 1000))
+	assert.Check(t, headers[4].ModTime.Equal(time.Unix(1700000000, 0)))
+
+	dest := t.TempDir()
+	assert.NilError(t, Untar(bytes.NewReader(buf.Bytes()), dest, &TarOptions{NoLchown: true}))
+	content, err := os.ReadFile(filepath.Join(dest, "dir", "sub", "file"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(content), "hello"))
+	content, err = os.ReadFile(filepath.Join(dest, "other", "file"))
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(content), "world"))
+}
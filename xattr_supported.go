@@ -6,6 +6,7 @@
 	"errors"
 	"fmt"
 	"io/fs"
+	"strings"
 
 	"golang.org/x/sys/unix"
 )
@@ -44,6 +45,37 @@ func lsetxattr(filePath string, attr string, data []byte, flags int) error {
 	return wrapPathError("lsetxattr", filePath, attr, unix.Lsetxattr(filePath, attr, data, flags))
 }
 
+// llistxattr returns the names of the extended attributes associated with
+// the given path in the file system.
+func llistxattr(filePath string) ([]string, error) {
+	for {
+		sz, err := unix.Llistxattr(filePath, nil)
+		if err != nil {
+			return nil, &fs.PathError{Op: "llistxattr", Path: filePath, Err: err}
+		}
+		if sz == 0 {
+			return nil, nil
+		}
+		dest := make([]byte, sz)
+		sz, err = unix.Llistxattr(filePath, dest)
+		if errors.Is(err, unix.ERANGE) {
+			// Attributes were added since the size was retrieved.
+			continue
+		}
+		if err != nil {
+			return nil, &fs.PathError{Op: "llistxattr", Path: filePath, Err: err}
+		}
+
+		var names []string
+		for name := range strings.SplitSeq(string(dest[:sz]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+}
+
 func wrapPathError(op, filePath, attr string, err error) error {
 	if err == nil {
 		return nil